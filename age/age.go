@@ -0,0 +1,53 @@
+// Package age provides script filters that encrypt and decrypt data in the
+// age format (https://age-encryption.org).
+package age
+
+import (
+	"strings"
+
+	agelib "filippo.io/age"
+	"github.com/bitfield/script"
+)
+
+// Decrypt decrypts the contents of the pipe, which should be in the age
+// format, using the given identities. Each identity is an age secret key
+// ("AGE-SECRET-KEY-1..."), or the contents of an identity file containing one
+// key per line. If none of the identities can decrypt the data, the pipe's
+// error status will be set. Decryption is streaming, so any corruption of the
+// data will be reported as an error when the pipe is read.
+func Decrypt(p *script.Pipe, identities ...string) *script.Pipe {
+	if p == nil || p.Error() != nil {
+		return p
+	}
+	ids, err := agelib.ParseIdentities(strings.NewReader(strings.Join(identities, "\n")))
+	if err != nil {
+		return p.WithError(err)
+	}
+	r, err := agelib.Decrypt(p.Reader, ids...)
+	if err != nil {
+		return p.WithError(err)
+	}
+	return p.WithReader(r)
+}
+
+// Encrypt encrypts the contents of the pipe in the age format, so that it can
+// be decrypted by any of the given recipients, and returns a pipe containing
+// the encrypted data. Each recipient is an age public key ("age1..."). If any
+// recipient is invalid, the pipe's error status will be set. Encryption is
+// streaming, so large inputs need not fit in memory:
+//
+//	age.Encrypt(script.File("backup.tar"), key).WriteFile("backup.tar.age")
+func Encrypt(p *script.Pipe, recipients ...string) *script.Pipe {
+	if p == nil || p.Error() != nil {
+		return p
+	}
+	rs, err := agelib.ParseRecipients(strings.NewReader(strings.Join(recipients, "\n")))
+	if err != nil {
+		return p.WithError(err)
+	}
+	r, err := agelib.EncryptReader(p.Reader, rs...)
+	if err != nil {
+		return p.WithError(err)
+	}
+	return p.WithReader(r)
+}
@@ -0,0 +1,63 @@
+package age_test
+
+import (
+	"bytes"
+	"testing"
+
+	agelib "filippo.io/age"
+	"github.com/bitfield/script"
+	"github.com/bitfield/script/age"
+)
+
+func TestEncryptDecrypt(t *testing.T) {
+	t.Parallel()
+	id, err := agelib.GenerateX25519Identity()
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := "hello world\n"
+	encrypted, err := age.Encrypt(script.Echo(want), id.Recipient().String()).Bytes()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Contains(encrypted, []byte(want)) {
+		t.Fatalf("want encrypted data not to contain plaintext, got %q", encrypted)
+	}
+	got, err := age.Decrypt(script.Echo(string(encrypted)), id.String()).String()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got != want {
+		t.Errorf("want %q, got %q", want, got)
+	}
+	other, err := agelib.GenerateX25519Identity()
+	if err != nil {
+		t.Fatal(err)
+	}
+	p := age.Decrypt(script.Echo(string(encrypted)), other.String())
+	if p.Error() == nil {
+		t.Error("want error decrypting with wrong identity, got nil")
+	}
+}
+
+func TestEncryptInvalidRecipient(t *testing.T) {
+	t.Parallel()
+	p := age.Encrypt(script.Echo("hello"), "bogus")
+	if p.Error() == nil {
+		t.Error("want error for invalid recipient, got nil")
+	}
+	p = age.Decrypt(script.Echo("hello"), "bogus")
+	if p.Error() == nil {
+		t.Error("want error for invalid identity, got nil")
+	}
+}
+
+func TestFiltersReturnNilForNilPipe(t *testing.T) {
+	t.Parallel()
+	if age.Decrypt(nil) != nil {
+		t.Error("Decrypt: want nil for nil pipe")
+	}
+	if age.Encrypt(nil) != nil {
+		t.Error("Encrypt: want nil for nil pipe")
+	}
+}
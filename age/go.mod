@@ -0,0 +1,17 @@
+module github.com/bitfield/script/age
+
+go 1.26.0
+
+require (
+	filippo.io/age v1.3.2
+	github.com/bitfield/script v0.25.1
+)
+
+require (
+	filippo.io/hpke v0.4.0 // indirect
+	github.com/itchyny/gojq v0.12.13 // indirect
+	github.com/itchyny/timefmt-go v0.1.5 // indirect
+	golang.org/x/crypto v0.55.0 // indirect
+	golang.org/x/sys v0.47.0 // indirect
+	mvdan.cc/sh/v3 v3.7.0 // indirect
+)
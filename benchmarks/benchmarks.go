@@ -0,0 +1,50 @@
+// Package benchmarks measures the performance of common script pipelines, so
+// that regressions in the filter core are caught, and so that users can
+// compare ways of building the same pipeline, such as streaming and
+// synchronous Exec chains. Run the benchmarks with:
+//
+//	go test -bench . ./benchmarks
+//
+// By default they work on 100 MiB of input; use the -size flag to change
+// this:
+//
+//	go test -bench Match ./benchmarks -args -size 10000000
+//
+// The tests in this package, which run with the rest of the test suite,
+// check that the memory allocated by key pipelines doesn't grow with the size
+// of their input.
+package benchmarks
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+)
+
+// Needle is the string contained in roughly one line in a thousand of the
+// input written by WriteLog.
+const Needle = "NEEDLE"
+
+// WriteLog writes at least size bytes of log-like text to w, one entry per
+// line, in which roughly one line in a thousand contains Needle. The output
+// is the same every time for a given size.
+func WriteLog(w io.Writer, size int64) error {
+	bw := bufio.NewWriter(w)
+	var written int64
+	for i := 0; written < size; i++ {
+		n, err := fmt.Fprintf(bw, "2024-03-01T10:%02d:%02d INFO request %d from 10.0.%d.%d served in %dms\n",
+			i/60%60, i%60, i, i/256%256, i%256, i%1000)
+		if err != nil {
+			return err
+		}
+		written += int64(n)
+		if i%1000 == 0 {
+			n, err := fmt.Fprintf(bw, "2024-03-01T10:%02d:%02d ERROR %s in request %d\n", i/60%60, i%60, Needle, i)
+			if err != nil {
+				return err
+			}
+			written += int64(n)
+		}
+	}
+	return bw.Flush()
+}
@@ -0,0 +1,265 @@
+package benchmarks_test
+
+import (
+	"bytes"
+	"flag"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/bitfield/script"
+	"github.com/bitfield/script/benchmarks"
+)
+
+var size = flag.Int64("size", 100<<20, "size in bytes of the input for benchmarks")
+
+var (
+	inputOnce sync.Once
+	inputPath string
+	inputErr  error
+	tempDir   string
+)
+
+func TestMain(m *testing.M) {
+	flag.Parse()
+	var err error
+	tempDir, err = os.MkdirTemp("", "script-benchmarks")
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	code := m.Run()
+	os.RemoveAll(tempDir)
+	os.Exit(code)
+}
+
+// writeInput writes a log of the given size to a new file in the temporary
+// directory, and returns its path.
+func writeInput(tb testing.TB, size int64) string {
+	tb.Helper()
+	f, err := os.Create(filepath.Join(tempDir, "log-"+strconv.FormatInt(size, 10)))
+	if err != nil {
+		tb.Fatal(err)
+	}
+	defer f.Close()
+	if err := benchmarks.WriteLog(f, size); err != nil {
+		tb.Fatal(err)
+	}
+	return f.Name()
+}
+
+// input returns the path of the file used by the benchmarks, writing it the
+// first time it's needed, and sets the number of bytes processed per
+// iteration.
+func input(b *testing.B) string {
+	b.Helper()
+	inputOnce.Do(func() {
+		f, err := os.Create(filepath.Join(tempDir, "input.log"))
+		if err != nil {
+			inputErr = err
+			return
+		}
+		defer f.Close()
+		inputPath, inputErr = f.Name(), benchmarks.WriteLog(f, *size)
+	})
+	if inputErr != nil {
+		b.Fatal(inputErr)
+	}
+	info, err := os.Stat(inputPath)
+	if err != nil {
+		b.Fatal(err)
+	}
+	b.SetBytes(info.Size())
+	return inputPath
+}
+
+// needCommands skips the benchmark unless all the named commands are
+// available.
+func needCommands(b *testing.B, names ...string) {
+	b.Helper()
+	for _, name := range names {
+		if _, err := exec.LookPath(name); err != nil {
+			b.Skipf("%s not found", name)
+		}
+	}
+}
+
+func TestWriteLogWritesRequestedSizeDeterministically(t *testing.T) {
+	t.Parallel()
+	var first, second bytes.Buffer
+	if err := benchmarks.WriteLog(&first, 100000); err != nil {
+		t.Fatal(err)
+	}
+	if err := benchmarks.WriteLog(&second, 100000); err != nil {
+		t.Fatal(err)
+	}
+	if first.Len() < 100000 || first.Len() > 100200 {
+		t.Errorf("want about 100000 bytes, got %d", first.Len())
+	}
+	if !bytes.Equal(first.Bytes(), second.Bytes()) {
+		t.Error("want same output each time")
+	}
+	if n := bytes.Count(first.Bytes(), []byte(benchmarks.Needle)); n == 0 {
+		t.Error("want some lines containing the needle, got none")
+	}
+}
+
+// allocsPerLine reports the difference in allocations made by pipeline on
+// inputs of two sizes, per extra line of input.
+func allocsPerLine(t *testing.T, pipeline func(path string)) float64 {
+	t.Helper()
+	small, large := writeInput(t, 1<<20), writeInput(t, 8<<20)
+	lines := func(path string) float64 {
+		n, err := script.File(path).CountLines()
+		if err != nil {
+			t.Fatal(err)
+		}
+		return float64(n)
+	}
+	smallAllocs := testing.AllocsPerRun(3, func() { pipeline(small) })
+	largeAllocs := testing.AllocsPerRun(3, func() { pipeline(large) })
+	return (largeAllocs - smallAllocs) / (lines(large) - lines(small))
+}
+
+// Allocation tests don't call t.Parallel, since allocations made by other
+// tests running at the same time would be counted too.
+func TestMatchAllocationsDontGrowWithLines(t *testing.T) {
+	perLine := allocsPerLine(t, func(path string) {
+		script.File(path).Match(benchmarks.Needle).String()
+	})
+	if perLine > 0.01 {
+		t.Errorf("want Match allocations independent of the number of lines, got %.3f per line", perLine)
+	}
+}
+
+func TestCountLinesAllocationsDontGrowWithLines(t *testing.T) {
+	perLine := allocsPerLine(t, func(path string) {
+		script.File(path).CountLines()
+	})
+	if perLine > 0.001 {
+		t.Errorf("want CountLines allocations independent of the number of lines, got %.4f per line", perLine)
+	}
+}
+
+func TestEachLineBytesAllocationsDontGrowWithLines(t *testing.T) {
+	needle := []byte(benchmarks.Needle)
+	perLine := allocsPerLine(t, func(path string) {
+		script.File(path).EachLineBytes(func(line, out []byte) []byte {
+			if bytes.Contains(line, needle) {
+				out = append(out, line...)
+				out = append(out, '\n')
+			}
+			return out
+		}).String()
+	})
+	if perLine > 0.01 {
+		t.Errorf("want EachLineBytes allocations independent of the number of lines, got %.3f per line", perLine)
+	}
+}
+
+func BenchmarkFileMatchCountLines(b *testing.B) {
+	path := input(b)
+	for b.Loop() {
+		if _, err := script.File(path).Match(benchmarks.Needle).CountLines(); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkFileCountLines(b *testing.B) {
+	path := input(b)
+	for b.Loop() {
+		if _, err := script.File(path).CountLines(); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkEachLine(b *testing.B) {
+	path := input(b)
+	for b.Loop() {
+		_, err := script.File(path).EachLine(func(line string, out *strings.Builder) {
+			if strings.Contains(line, benchmarks.Needle) {
+				out.WriteString(line)
+				out.WriteByte('\n')
+			}
+		}).String()
+		if err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkEachLineBytes(b *testing.B) {
+	path := input(b)
+	needle := []byte(benchmarks.Needle)
+	for b.Loop() {
+		_, err := script.File(path).EachLineBytes(func(line, out []byte) []byte {
+			if bytes.Contains(line, needle) {
+				out = append(out, line...)
+				out = append(out, '\n')
+			}
+			return out
+		}).String()
+		if err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkMatchRegexp(b *testing.B) {
+	path := input(b)
+	re := regexp.MustCompile(`ERROR \w+ in request \d+`)
+	for b.Loop() {
+		if _, err := script.File(path).MatchRegexp(re).CountLines(); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkReplaceRegexp(b *testing.B) {
+	path := input(b)
+	re := regexp.MustCompile(`10\.0\.(\d+)\.(\d+)`)
+	for b.Loop() {
+		if _, err := script.File(path).ReplaceRegexp(re, "10.0.x.x").CountLines(); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkExecChain(b *testing.B) {
+	needCommands(b, "grep", "wc")
+	for _, mode := range []struct {
+		name string
+		run  func(path string) *script.Pipe
+	}{
+		{"Sync", func(path string) *script.Pipe {
+			return script.File(path).Exec("grep " + benchmarks.Needle).Exec("wc -l")
+		}},
+		{"Stream", func(path string) *script.Pipe {
+			return script.File(path).Stream().Exec("grep " + benchmarks.Needle).Exec("wc -l")
+		}},
+		{"Pipeline", func(path string) *script.Pipe {
+			return script.File(path).ExecPipeline("grep " + benchmarks.Needle + " | wc -l")
+		}},
+	} {
+		b.Run(mode.name, func(b *testing.B) {
+			path := input(b)
+			for b.Loop() {
+				out, err := mode.run(path).String()
+				if err != nil {
+					b.Fatal(err)
+				}
+				if strings.TrimSpace(out) == "0" {
+					b.Fatal("want some matching lines, got none")
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,122 @@
+package script
+
+import (
+	"cmp"
+	"runtime"
+	"slices"
+	"sync"
+)
+
+// cleanups records the cleanup functions that haven't been called yet, so
+// that CloseAll can call them.
+var cleanups = struct {
+	sync.Mutex
+	pending map[*cleanup]uint64
+	next    uint64
+}{pending: map[*cleanup]uint64{}}
+
+// CloseAll calls every function registered with [Pipe.Defer] that hasn't been
+// called yet, most recently registered first, and stops any streaming
+// commands that are still running, as if their pipes had been closed. Call it
+// before the program exits, so that nothing is left behind by pipes that were
+// never fully read, such as when a script is interrupted:
+//
+//	defer script.CloseAll()
+//
+// Pipes can still be used after CloseAll, and it can be called more than once.
+func CloseAll() {
+	cleanups.Lock()
+	pending := make([]*cleanup, 0, len(cleanups.pending))
+	for c := range cleanups.pending {
+		pending = append(pending, c)
+	}
+	order := cleanups.pending
+	slices.SortFunc(pending, func(a, b *cleanup) int {
+		return cmp.Compare(order[b], order[a])
+	})
+	cleanups.Unlock()
+	for _, c := range pending {
+		c.run()
+	}
+}
+
+// cleanup is a function to be called once, when the resources it releases
+// are no longer needed, or by CloseAll.
+type cleanup struct {
+	mu   sync.Mutex
+	done bool
+	f    func()
+}
+
+// registerCleanup returns a cleanup that calls f, recording it for CloseAll.
+func registerCleanup(f func()) *cleanup {
+	c := &cleanup{f: f}
+	cleanups.Lock()
+	defer cleanups.Unlock()
+	cleanups.next++
+	cleanups.pending[c] = cleanups.next
+	return c
+}
+
+// run calls the cleanup function, unless it has already been called or
+// cancelled.
+func (c *cleanup) run() {
+	if c.finish() {
+		c.f()
+	}
+}
+
+// cancel stops the cleanup function from being called, because the resources
+// have been released some other way.
+func (c *cleanup) cancel() {
+	c.finish()
+}
+
+// finish marks the cleanup as done, and removes it from the pending cleanups.
+// It reports whether the cleanup was still to be done.
+func (c *cleanup) finish() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.done {
+		return false
+	}
+	c.done = true
+	cleanups.Lock()
+	delete(cleanups.pending, c)
+	cleanups.Unlock()
+	return true
+}
+
+// deferReader reads from a pipe's reader, and runs a cleanup when the reader
+// is finished with: when reading it returns io.EOF or an error, or it's
+// closed, or, if it's abandoned, when it's garbage collected.
+type deferReader struct {
+	r       ReadAutoCloser
+	cleanup *cleanup
+}
+
+// newDeferReader returns a deferReader that reads from r, and calls f when
+// it's finished with.
+func newDeferReader(r ReadAutoCloser, f func()) *deferReader {
+	d := &deferReader{r: r, cleanup: registerCleanup(f)}
+	runtime.AddCleanup(d, (*cleanup).run, d.cleanup)
+	return d
+}
+
+// Read reads from the underlying reader, running the cleanup once it returns
+// an error, including io.EOF.
+func (d *deferReader) Read(buf []byte) (int, error) {
+	n, err := d.r.Read(buf)
+	if err != nil {
+		d.r.Close()
+		d.cleanup.run()
+	}
+	return n, err
+}
+
+// Close closes the underlying reader, and runs the cleanup.
+func (d *deferReader) Close() error {
+	err := d.r.Close()
+	d.cleanup.run()
+	return err
+}
@@ -0,0 +1,110 @@
+package script_test
+
+import (
+	"errors"
+	"runtime"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/bitfield/script"
+)
+
+func TestDeferRunsWhenPipeIsReadToTheEnd(t *testing.T) {
+	t.Parallel()
+	var calls atomic.Int32
+	p := script.Echo("hello\n").Defer(func() { calls.Add(1) })
+	if calls.Load() != 0 {
+		t.Fatal("deferred function called before pipe was read")
+	}
+	got, err := p.String()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got != "hello\n" {
+		t.Errorf("want %q, got %q", "hello\n", got)
+	}
+	p.Close()
+	if calls.Load() != 1 {
+		t.Errorf("want deferred function called once, got %d calls", calls.Load())
+	}
+}
+
+func TestDeferRunsWhenFilterConsumesPipe(t *testing.T) {
+	t.Parallel()
+	var called atomic.Bool
+	got, err := script.Echo("a\nb\n").Defer(func() { called.Store(true) }).Match("b").String()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got != "b\n" {
+		t.Errorf("want %q, got %q", "b\n", got)
+	}
+	if !called.Load() {
+		t.Error("want deferred function called, but it wasn't")
+	}
+}
+
+func TestDeferRunsWhenPipeIsClosedOrErrors(t *testing.T) {
+	t.Parallel()
+	var closed, errored atomic.Bool
+	script.Echo("unread").Defer(func() { closed.Store(true) }).Close()
+	if !closed.Load() {
+		t.Error("want deferred function called on Close, but it wasn't")
+	}
+	script.Echo("unread").Defer(func() { errored.Store(true) }).SetError(errors.New("oh no"))
+	if !errored.Load() {
+		t.Error("want deferred function called on error, but it wasn't")
+	}
+	var already atomic.Bool
+	script.NewPipe().WithError(errors.New("oh no")).Defer(func() { already.Store(true) })
+	if !already.Load() {
+		t.Error("want deferred function called straight away on pipe with error, but it wasn't")
+	}
+}
+
+func TestDeferRunsWhenPipeIsGarbageCollected(t *testing.T) {
+	t.Parallel()
+	called := make(chan struct{})
+	func() {
+		script.Echo("abandoned").Defer(func() { close(called) })
+	}()
+	for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); {
+		runtime.GC()
+		select {
+		case <-called:
+			return
+		case <-time.After(10 * time.Millisecond):
+		}
+	}
+	t.Error("want deferred function called when pipe was garbage collected, but it wasn't")
+}
+
+func TestCloseAllRunsPendingDeferredFunctionsInReverseOrder(t *testing.T) {
+	// Not parallel, since CloseAll affects every pipe.
+	var order []int
+	p1 := script.Echo("one").Defer(func() { order = append(order, 1) })
+	p2 := script.Echo("two").Defer(func() { order = append(order, 2) })
+	script.CloseAll()
+	if len(order) != 2 || order[0] != 2 || order[1] != 1 {
+		t.Errorf("want deferred functions called in order [2 1], got %v", order)
+	}
+	p1.Close()
+	p2.Close()
+	script.CloseAll()
+	if len(order) != 2 {
+		t.Errorf("want each deferred function called only once, got calls %v", order)
+	}
+}
+
+func TestCloseAllStopsStreamingCommands(t *testing.T) {
+	// Not parallel, since CloseAll affects every pipe.
+	before := script.ActivePipelines()
+	p := script.NewPipe().Stream().Exec("sleep 10")
+	if script.ActivePipelines() == before {
+		t.Fatal("want streaming command running, but it isn't")
+	}
+	script.CloseAll()
+	waitForActivePipelines(t, before)
+	p.Close()
+}
@@ -0,0 +1,79 @@
+// Package compress provides script filters for the Zstandard and xz
+// compression formats.
+package compress
+
+import (
+	"io"
+
+	"github.com/bitfield/script"
+	"github.com/klauspost/compress/zstd"
+	"github.com/ulikunitz/xz"
+)
+
+// Unxz decompresses the contents of the pipe, which should be in xz format,
+// and returns a pipe containing the decompressed data. If the stream header is
+// invalid, the pipe's error status will be set; any later corruption will be
+// reported as an error when the pipe is read.
+func Unxz(p *script.Pipe) *script.Pipe {
+	if p == nil || p.Error() != nil {
+		return p
+	}
+	r, err := xz.NewReader(p.Reader)
+	if err != nil {
+		return p.WithError(err)
+	}
+	return p.WithReader(r)
+}
+
+// Unzstd decompresses the contents of the pipe, which should be in Zstandard
+// format, and returns a pipe containing the decompressed data. Any corrupt
+// input will be reported as an error when the pipe is read.
+func Unzstd(p *script.Pipe) *script.Pipe {
+	if p == nil || p.Error() != nil {
+		return p
+	}
+	d, err := zstd.NewReader(p.Reader, zstd.WithDecoderConcurrency(1))
+	if err != nil {
+		return p.WithError(err)
+	}
+	return p.WithReader(d.IOReadCloser())
+}
+
+// Zstd compresses the contents of the pipe in Zstandard format, and returns a
+// pipe containing the compressed data. Compression is streaming, so large
+// inputs need not fit in memory.
+func Zstd(p *script.Pipe) *script.Pipe {
+	if p == nil || p.Error() != nil {
+		return p
+	}
+	input := p.Reader
+	pr, pw := io.Pipe()
+	go func() {
+		zw, err := zstd.NewWriter(pw)
+		if err != nil {
+			pw.CloseWithError(err)
+			return
+		}
+		_, err = io.Copy(zw, input)
+		if cerr := zw.Close(); err == nil {
+			err = cerr
+		}
+		pw.CloseWithError(err)
+	}()
+	return p.WithReader(compressor{pr, input})
+}
+
+// compressor reads the output of Zstd, which compresses its input in a
+// separate goroutine. Closing it closes the input as well as the output, so
+// that the goroutine stops as soon as the pipe does, even if it's waiting for
+// input.
+type compressor struct {
+	*io.PipeReader
+	input io.Closer
+}
+
+// Close closes both the compressed output and the input.
+func (c compressor) Close() error {
+	c.input.Close()
+	return c.PipeReader.Close()
+}
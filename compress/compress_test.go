@@ -0,0 +1,61 @@
+package compress_test
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/bitfield/script"
+	"github.com/bitfield/script/compress"
+)
+
+func TestUnxz(t *testing.T) {
+	t.Parallel()
+	want := "hello world"
+	got, err := compress.Unxz(script.File("testdata/hello.txt.xz")).String()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got != want {
+		t.Errorf("want %q, got %q", want, got)
+	}
+	p := compress.Unxz(script.Echo("not xz"))
+	if p.Error() == nil {
+		t.Error("want error decompressing invalid data, got nil")
+	}
+}
+
+func TestZstdRoundTrip(t *testing.T) {
+	t.Parallel()
+	want := strings.Repeat("hello world\n", 1000)
+	compressed, err := compress.Zstd(script.Echo(want)).Bytes()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(compressed) >= len(want) {
+		t.Errorf("want compressed data smaller than %d bytes, got %d", len(want), len(compressed))
+	}
+	got, err := compress.Unzstd(script.Echo(string(compressed))).String()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got != want {
+		t.Errorf("want %q, got %q", want, got)
+	}
+	_, err = compress.Unzstd(script.Echo("not zstd")).String()
+	if err == nil {
+		t.Error("want error decompressing invalid data, got nil")
+	}
+}
+
+func TestFiltersReturnNilForNilPipe(t *testing.T) {
+	t.Parallel()
+	for name, filter := range map[string]func(*script.Pipe) *script.Pipe{
+		"Unxz":   compress.Unxz,
+		"Unzstd": compress.Unzstd,
+		"Zstd":   compress.Zstd,
+	} {
+		if filter(nil) != nil {
+			t.Errorf("%s: want nil for nil pipe", name)
+		}
+	}
+}
@@ -0,0 +1,19 @@
+module github.com/bitfield/script/compress
+
+go 1.26.0
+
+require (
+	github.com/bitfield/script v0.25.1
+	github.com/klauspost/compress v1.20.1
+	github.com/ulikunitz/xz v0.5.17
+)
+
+require (
+	github.com/google/go-cmp v0.6.0 // indirect
+	github.com/itchyny/gojq v0.12.13 // indirect
+	github.com/itchyny/timefmt-go v0.1.5 // indirect
+	github.com/rogpeppe/go-internal v1.16.0 // indirect
+	golang.org/x/sys v0.47.0 // indirect
+	golang.org/x/tools v0.49.0 // indirect
+	mvdan.cc/sh/v3 v3.7.0 // indirect
+)
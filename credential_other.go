@@ -0,0 +1,15 @@
+//go:build !unix
+
+package script
+
+import (
+	"fmt"
+	"os/exec"
+	"runtime"
+)
+
+// setCredential returns an error, because running commands as another user
+// isn't supported on this platform.
+func setCredential(cmd *exec.Cmd, username string) error {
+	return fmt.Errorf("can't run commands as user %q: not supported on %s", username, runtime.GOOS)
+}
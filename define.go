@@ -0,0 +1,34 @@
+package script
+
+// Definition is a pipeline defined once, with Define, that can be run any
+// number of times, on different sources.
+type Definition struct {
+	build func(p *Pipe) *Pipe
+}
+
+// Define returns a [Definition] of the pipeline that build constructs from a
+// source pipe, without running it. Since a pipe can only be read once, this
+// lets scheduled jobs, servers, and tests reuse a single pipeline, instead of
+// building the chain of filters again every time:
+//
+//	errors := script.Define(func(p *script.Pipe) *script.Pipe {
+//		return p.Match("ERROR").Column(3).Freq()
+//	})
+//	errors.Run(script.File("today.log")).Stdout()
+//	errors.Run(script.File("yesterday.log")).Stdout()
+//
+// Build should only construct the pipeline from the pipe it's given, not read
+// it or keep it, since it's called afresh for each run.
+func Define(build func(p *Pipe) *Pipe) *Definition {
+	return &Definition{build: build}
+}
+
+// Run runs the pipeline on src, and returns the resulting pipe. If src is nil,
+// the pipeline runs on an empty pipe. Run can be called as many times as
+// required, including concurrently.
+func (d *Definition) Run(src *Pipe) *Pipe {
+	if src == nil {
+		src = NewPipe()
+	}
+	return d.build(src)
+}
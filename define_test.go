@@ -0,0 +1,66 @@
+package script_test
+
+import (
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/bitfield/script"
+)
+
+func TestDefinitionRunsOnEachSource(t *testing.T) {
+	t.Parallel()
+	d := script.Define(func(p *script.Pipe) *script.Pipe {
+		return p.Match("a").Freq()
+	})
+	for input, want := range map[string]string{
+		"a\nb\na\n": "2 a\n",
+		"b\n":       "",
+		"abc\n":     "1 abc\n",
+	} {
+		got, err := d.Run(script.Echo(input)).String()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if want != got {
+			t.Errorf("%q: want %q, got %q", input, want, got)
+		}
+	}
+}
+
+func TestDefinitionRunsOnEmptyPipeGivenNil(t *testing.T) {
+	t.Parallel()
+	d := script.Define(func(p *script.Pipe) *script.Pipe {
+		return p.Append("done")
+	})
+	got, err := d.Run(nil).String()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got != "done\n" {
+		t.Errorf("want %q, got %q", "done\n", got)
+	}
+}
+
+func TestDefinitionRunsConcurrently(t *testing.T) {
+	t.Parallel()
+	d := script.Define(func(p *script.Pipe) *script.Pipe {
+		return p.Exec("tr a-z A-Z")
+	})
+	var wg sync.WaitGroup
+	for _, word := range []string{"one", "two", "three", "four"} {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			got, err := d.Run(script.Echo(word)).String()
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			if want := strings.ToUpper(word); want != got {
+				t.Errorf("want %q, got %q", want, got)
+			}
+		}()
+	}
+	wg.Wait()
+}
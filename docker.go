@@ -0,0 +1,243 @@
+package script
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+
+	"bitbucket.org/creachadair/shell"
+)
+
+// DockerExec runs a command in the specified running container, using the
+// Docker Engine API, like `docker exec`, and returns a pipe containing its
+// output, which is streamed as the command runs. The command line is split
+// into arguments as for Exec, but isn't run by a shell. Standard output and
+// standard error are combined, as for Exec. Once the output has been read, if
+// the command had a non-zero exit status, the pipe's error status will be set
+// to "exit status X", where X is the integer exit status, so that ExitStatus
+// works as usual:
+//
+//	_, err := script.DockerExec("db", "pg_isready -q").String()
+//	if err != nil {
+//		log.Fatalf("database not ready: %v", err)
+//	}
+//
+// The Docker daemon is found from the DOCKER_HOST environment variable, if
+// set, as for the docker command, and otherwise at its usual Unix socket,
+// /var/run/docker.sock. If the daemon can't be reached, or the container isn't
+// running, the pipe's error status will be set.
+func DockerExec(container, cmdLine string) *Pipe {
+	args, ok := shell.Split(cmdLine)
+	if !ok || len(args) == 0 {
+		return newSource("DockerExec").WithError(fmt.Errorf("unbalanced quotes or backslashes in [%s]", cmdLine))
+	}
+	d, err := newDockerClient()
+	if err != nil {
+		return newSource("DockerExec").WithError(err)
+	}
+	var created struct{ Id string }
+	err = d.call(http.MethodPost, "/containers/"+url.PathEscape(container)+"/exec", map[string]any{
+		"AttachStdout": true,
+		"AttachStderr": true,
+		"Cmd":          args,
+	}, &created)
+	if err != nil {
+		return newSource("DockerExec").WithError(err)
+	}
+	exec := "/exec/" + url.PathEscape(created.Id)
+	resp, err := d.request(http.MethodPost, exec+"/start", map[string]any{"Detach": false, "Tty": false})
+	if err != nil {
+		return newSource("DockerExec").WithError(err)
+	}
+	return dockerPipe("DockerExec", resp.Body, false, func() error {
+		var inspect struct{ ExitCode int }
+		if err := d.call(http.MethodGet, exec+"/json", nil, &inspect); err != nil {
+			return err
+		}
+		if inspect.ExitCode != 0 {
+			return fmt.Errorf("exit status %d", inspect.ExitCode)
+		}
+		return nil
+	})
+}
+
+// DockerLogs returns a pipe containing the logs of the specified container,
+// using the Docker Engine API, like `docker logs`, with the container's
+// standard output and standard error combined. If follow is true, the pipe
+// keeps streaming new log output, like `docker logs -f`, until the container
+// stops, or the pipe is closed:
+//
+//	script.DockerLogs("web", true).Match("ERROR").Stdout()
+//
+// The Docker daemon is found as for DockerExec. If the daemon can't be
+// reached, or the container doesn't exist, the pipe's error status will be
+// set.
+func DockerLogs(container string, follow bool) *Pipe {
+	d, err := newDockerClient()
+	if err != nil {
+		return newSource("DockerLogs").WithError(err)
+	}
+	path := "/containers/" + url.PathEscape(container)
+	var inspect struct{ Config struct{ Tty bool } }
+	if err := d.call(http.MethodGet, path+"/json", nil, &inspect); err != nil {
+		return newSource("DockerLogs").WithError(err)
+	}
+	query := url.Values{"stdout": {"1"}, "stderr": {"1"}}
+	if follow {
+		query.Set("follow", "1")
+	}
+	resp, err := d.request(http.MethodGet, path+"/logs?"+query.Encode(), nil)
+	if err != nil {
+		return newSource("DockerLogs").WithError(err)
+	}
+	return dockerPipe("DockerLogs", resp.Body, inspect.Config.Tty, nil)
+}
+
+// copyDockerStream copies the output from r, which is a stream multiplexed by
+// the Docker Engine API, to w, combining standard output and standard error.
+// Each frame of the stream has an eight-byte header, giving the stream it
+// belongs to in the first byte, and its length in the last four.
+func copyDockerStream(w io.Writer, r io.Reader) error {
+	var header [8]byte
+	for {
+		_, err := io.ReadFull(r, header[:])
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		size := binary.BigEndian.Uint32(header[4:])
+		if _, err := io.CopyN(w, r, int64(size)); err != nil {
+			return err
+		}
+	}
+}
+
+// dockerClient makes requests to the Docker Engine API.
+type dockerClient struct {
+	client *http.Client
+	base   string
+}
+
+// newDockerClient returns a client for the Docker daemon given by the
+// DOCKER_HOST environment variable, or at the default Unix socket.
+func newDockerClient() (*dockerClient, error) {
+	host := os.Getenv("DOCKER_HOST")
+	if host == "" {
+		host = "unix:///var/run/docker.sock"
+	}
+	scheme, addr, ok := strings.Cut(host, "://")
+	if !ok {
+		return nil, fmt.Errorf("DOCKER_HOST %q: missing scheme", host)
+	}
+	switch scheme {
+	case "unix":
+		transport := &http.Transport{
+			DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+				var dialer net.Dialer
+				return dialer.DialContext(ctx, "unix", addr)
+			},
+		}
+		return &dockerClient{client: &http.Client{Transport: transport}, base: "http://docker"}, nil
+	case "tcp", "http":
+		if os.Getenv("DOCKER_TLS_VERIFY") != "" {
+			return nil, errors.New("DOCKER_HOST: TLS connections to the Docker daemon aren't supported")
+		}
+		return &dockerClient{client: &http.Client{}, base: "http://" + addr}, nil
+	}
+	return nil, fmt.Errorf("DOCKER_HOST %q: unsupported scheme %q", host, scheme)
+}
+
+// request sends a request to the API, with body, if not nil, encoded as
+// JSON, and returns the response. If the response status isn't a success, it
+// returns the error message from the response instead.
+func (d *dockerClient) request(method, path string, body any) (*http.Response, error) {
+	var reqBody io.Reader
+	if body != nil {
+		data, err := json.Marshal(body)
+		if err != nil {
+			return nil, err
+		}
+		reqBody = bytes.NewReader(data)
+	}
+	req, err := http.NewRequest(method, d.base+path, reqBody)
+	if err != nil {
+		return nil, err
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	resp, err := d.client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("docker: %w", err)
+	}
+	if resp.StatusCode/100 != 2 {
+		defer resp.Body.Close()
+		var apiErr struct{ Message string }
+		data, _ := io.ReadAll(io.LimitReader(resp.Body, 64*1024))
+		if json.Unmarshal(data, &apiErr) != nil || apiErr.Message == "" {
+			apiErr.Message = strings.TrimSpace(string(data))
+		}
+		return nil, fmt.Errorf("docker: %s (%s)", apiErr.Message, resp.Status)
+	}
+	return resp, nil
+}
+
+// call sends a request to the API, as for request, and decodes the JSON
+// response into result, if not nil.
+func (d *dockerClient) call(method, path string, body, result any) error {
+	resp, err := d.request(method, path, body)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if result == nil {
+		return nil
+	}
+	return json.NewDecoder(resp.Body).Decode(result)
+}
+
+// dockerPipe returns a pipe for the source op that reads the output from body,
+// which is a raw stream if tty is true, and otherwise a multiplexed stream
+// (see copyDockerStream). Once the output has been read, done, if not nil, is
+// called, and any error it returns is the error from reading the pipe.
+func dockerPipe(op string, body io.ReadCloser, tty bool, done func() error) *Pipe {
+	pr, pw := io.Pipe()
+	goStage(func() {
+		defer body.Close()
+		var err error
+		if tty {
+			_, err = io.Copy(pw, body)
+		} else {
+			err = copyDockerStream(pw, body)
+		}
+		if err == nil && done != nil {
+			err = done()
+		}
+		pw.CloseWithError(err)
+	})
+	return newSource(op).withReader(dockerReader{pr, body})
+}
+
+// dockerReader reads the output streamed from the Docker Engine API, and
+// closes the connection when it is closed, so that following logs stops.
+type dockerReader struct {
+	*io.PipeReader
+	body io.Closer
+}
+
+// Close closes both the pipe reader and the underlying connection.
+func (r dockerReader) Close() error {
+	r.PipeReader.Close()
+	return r.body.Close()
+}
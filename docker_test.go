@@ -0,0 +1,194 @@
+package script_test
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/bitfield/script"
+)
+
+// dockerFrame returns data as a frame of a multiplexed Docker stream, for the
+// specified stream (1 for standard output, 2 for standard error).
+func dockerFrame(stream byte, data string) []byte {
+	frame := make([]byte, 8, 8+len(data))
+	frame[0] = stream
+	binary.BigEndian.PutUint32(frame[4:], uint32(len(data)))
+	return append(frame, data...)
+}
+
+// fakeDocker starts a fake Docker daemon, listening on a Unix socket and
+// serving the API with handler, and points DOCKER_HOST at it. Tests using it
+// can't be parallel, since DOCKER_HOST affects every test.
+func fakeDocker(t *testing.T, handler http.Handler) {
+	t.Helper()
+	socket := filepath.Join(t.TempDir(), "docker.sock")
+	l, err := net.Listen("unix", socket)
+	if err != nil {
+		t.Skip(err)
+	}
+	srv := httptest.NewUnstartedServer(handler)
+	srv.Listener = l
+	srv.Start()
+	t.Cleanup(srv.Close)
+	t.Setenv("DOCKER_HOST", "unix://"+socket)
+}
+
+func TestDockerExecStreamsCombinedOutput(t *testing.T) {
+	// Not parallel, since it sets DOCKER_HOST.
+	var cmd []string
+	mux := http.NewServeMux()
+	mux.HandleFunc("POST /containers/web/exec", func(w http.ResponseWriter, r *http.Request) {
+		var req struct{ Cmd []string }
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			t.Error(err)
+		}
+		cmd = req.Cmd
+		w.Write([]byte(`{"Id":"exec1"}`))
+	})
+	mux.HandleFunc("POST /exec/exec1/start", func(w http.ResponseWriter, r *http.Request) {
+		w.Write(dockerFrame(1, "hello\n"))
+		w.Write(dockerFrame(2, "warning\n"))
+		w.Write(dockerFrame(1, "world\n"))
+	})
+	mux.HandleFunc("GET /exec/exec1/json", func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"ExitCode":0}`))
+	})
+	fakeDocker(t, mux)
+	got, err := script.DockerExec("web", `sh -c "echo hello; echo world"`).String()
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := "hello\nwarning\nworld\n"
+	if got != want {
+		t.Errorf("want combined output %q, got %q", want, got)
+	}
+	if strings.Join(cmd, "|") != "sh|-c|echo hello; echo world" {
+		t.Errorf("want command split into arguments, got %q", cmd)
+	}
+}
+
+func TestDockerExecWithFailingCommandSetsExitStatus(t *testing.T) {
+	// Not parallel, since it sets DOCKER_HOST.
+	mux := http.NewServeMux()
+	mux.HandleFunc("POST /containers/web/exec", func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"Id":"exec1"}`))
+	})
+	mux.HandleFunc("POST /exec/exec1/start", func(w http.ResponseWriter, r *http.Request) {
+		w.Write(dockerFrame(2, "oops\n"))
+	})
+	mux.HandleFunc("GET /exec/exec1/json", func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"ExitCode":3}`))
+	})
+	fakeDocker(t, mux)
+	p := script.DockerExec("web", "sh -c 'exit 3'")
+	_, err := p.String()
+	if err == nil || err.Error() != "exit status 3" {
+		t.Errorf("want error %q, got %v", "exit status 3", err)
+	}
+	if p.ExitStatus() != 3 {
+		t.Errorf("want exit status 3, got %d", p.ExitStatus())
+	}
+}
+
+func TestDockerExecWithUnknownContainerIsError(t *testing.T) {
+	// Not parallel, since it sets DOCKER_HOST.
+	mux := http.NewServeMux()
+	mux.HandleFunc("POST /containers/missing/exec", func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNotFound)
+		w.Write([]byte(`{"message":"No such container: missing"}`))
+	})
+	fakeDocker(t, mux)
+	p := script.DockerExec("missing", "true")
+	if p.Error() == nil || !strings.Contains(p.Error().Error(), "No such container: missing") {
+		t.Errorf("want error from daemon, got %v", p.Error())
+	}
+	p = script.DockerExec("web", `echo "unbalanced`)
+	if p.Error() == nil {
+		t.Error("want error for unbalanced quotes, got nil")
+	}
+}
+
+func TestDockerLogsDemultiplexesOutput(t *testing.T) {
+	// Not parallel, since it sets DOCKER_HOST.
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /containers/web/json", func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"Config":{"Tty":false}}`))
+	})
+	mux.HandleFunc("GET /containers/tty/json", func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"Config":{"Tty":true}}`))
+	})
+	mux.HandleFunc("GET /containers/web/logs", func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Query().Get("follow") != "" {
+			t.Errorf("want no follow, got %q", r.URL.RawQuery)
+		}
+		w.Write(dockerFrame(1, "started\n"))
+		w.Write(dockerFrame(2, "ERROR oh no\n"))
+	})
+	mux.HandleFunc("GET /containers/tty/logs", func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("raw output\n"))
+	})
+	fakeDocker(t, mux)
+	got, err := script.DockerLogs("web", false).String()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got != "started\nERROR oh no\n" {
+		t.Errorf("want %q, got %q", "started\nERROR oh no\n", got)
+	}
+	got, err = script.DockerLogs("tty", false).String()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got != "raw output\n" {
+		t.Errorf("want raw output from TTY container, got %q", got)
+	}
+	p := script.DockerLogs("missing", false)
+	if p.Error() == nil {
+		t.Error("want error for missing container, got nil")
+	}
+}
+
+func TestDockerLogsFollowStreamsUntilClosed(t *testing.T) {
+	// Not parallel, since it sets DOCKER_HOST.
+	disconnected := make(chan struct{})
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /containers/web/json", func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"Config":{"Tty":false}}`))
+	})
+	mux.HandleFunc("GET /containers/web/logs", func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Query().Get("follow") != "1" {
+			t.Errorf("want follow, got %q", r.URL.RawQuery)
+		}
+		w.Write(dockerFrame(1, "first\n"))
+		w.(http.Flusher).Flush()
+		<-r.Context().Done()
+		close(disconnected)
+	})
+	fakeDocker(t, mux)
+	p := script.DockerLogs("web", true)
+	line, err := p.FirstMatch("first")
+	if err != nil || line != "first" {
+		t.Fatalf("want first line streamed, got %q, %v", line, err)
+	}
+	p.Close()
+	select {
+	case <-disconnected:
+	case <-time.After(5 * time.Second):
+		t.Error("want connection closed when pipe closed, but it wasn't")
+	}
+}
+
+func TestDockerWithUnsupportedHostIsError(t *testing.T) {
+	// Not parallel, since it sets DOCKER_HOST.
+	t.Setenv("DOCKER_HOST", "ssh://example.com")
+	if p := script.DockerLogs("web", false); p.Error() == nil {
+		t.Error("want error for unsupported DOCKER_HOST, got nil")
+	}
+}
@@ -0,0 +1,14 @@
+package main
+
+import (
+	"time"
+
+	"github.com/bitfield/script"
+)
+
+// This program reads a list of hosts from its standard input, one per line,
+// pings each of them, and prints the ones that are up.
+
+func main() {
+	script.Stdin().PingEach(time.Second).Match(" up ").Column(1).Stdout()
+}
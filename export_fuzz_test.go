@@ -0,0 +1,5 @@
+package script
+
+// SplitPipeline exposes the command-line splitter used by ExecPipeline, so
+// that it can be fuzzed without running any commands.
+var SplitPipeline = splitPipeline
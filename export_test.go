@@ -0,0 +1,16 @@
+//go:build !windows && !plan9
+// +build !windows,!plan9
+
+package script
+
+// SetSyslogServer directs Syslog to the specified server, instead of the local
+// system logger, so that tests can intercept messages.
+func SetSyslogServer(network, addr string) {
+	syslogNetwork, syslogAddr = network, addr
+}
+
+// SetJournalSocket directs Journal to the specified socket, so that tests can
+// intercept log entries.
+func SetJournalSocket(path string) {
+	journalSocket = path
+}
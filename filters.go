@@ -3,12 +3,21 @@ package script
 import (
 	"bufio"
 	"bytes"
+	"compress/bzip2"
 	"container/ring"
+	"context"
 	"crypto/sha256"
 	"encoding/hex"
+	"encoding/json"
 	"errors"
 	"fmt"
+	"hash/fnv"
 	"io"
+	"io/ioutil"
+	"math"
+	"net"
+	"net/netip"
+	"net/url"
 	"os"
 	"os/exec"
 	"path/filepath"
@@ -16,31 +25,218 @@ import (
 	"sort"
 	"strconv"
 	"strings"
+	"sync"
+	"syscall"
 	"text/template"
+	"time"
+	"unicode/utf8"
 
 	"bitbucket.org/creachadair/shell"
+	"gopkg.in/yaml.v3"
 )
 
+// Append returns a pipe containing the contents of the pipe, followed by s,
+// such as a footer. If s doesn't end with a newline, one is added, and if the
+// contents don't end with a newline, one is added before s, so that s always
+// starts and ends a line. The contents are streamed, not read into memory.
+func (p *Pipe) Append(s string) *Pipe {
+	if p == nil || p.Error() != nil {
+		return p
+	}
+	p.addStage("Append")
+	return p.withReader(&appendReader{input: p.Reader, tail: asLines(s), last: '\n'})
+}
+
+// AppendPipe returns a pipe containing the contents of the pipe, followed by
+// the contents of q. Neither is read until the returned pipe is read, so this
+// is a cheap way to assemble a document from several sources:
+//
+//	script.File("header.txt").AppendPipe(script.Exec("generate")).AppendPipe(script.File("footer.txt"))
+//
+// Closing the returned pipe closes both inputs. If q has error status, the
+// returned pipe's error status is set to the same error.
+func (p *Pipe) AppendPipe(q *Pipe) *Pipe {
+	if p == nil || p.Error() != nil || q == nil {
+		return p
+	}
+	p.addStage("AppendPipe")
+	if q.Error() != nil {
+		return p.WithError(q.Error())
+	}
+	return p.withReader(multiReader{io.MultiReader(p.Reader, q.Reader), []io.Closer{p.Reader, q.Reader}}).withStageInputs(q)
+}
+
+// AsTempFile writes the contents of the pipe to a new temporary file, and
+// returns a pipe containing the path of that file. This is useful for
+// commands that insist on reading from a named file, rather than standard
+// input, like the shell's `<(...)`:
+//
+//	script.Echo(data).AsTempFile().ExecForEach("unzip -l {{.}}")
+//
+// The file is removed once the next Exec, ExecForEach, or ExecPipeline on the
+// returned pipe has run. If the path isn't passed to one of these methods,
+// it's up to you to remove the file. If there is an error reading the pipe or
+// writing the file, the pipe's error status is also set.
+func (p *Pipe) AsTempFile() *Pipe {
+	if p == nil || p.Error() != nil {
+		return p
+	}
+	p.addStage("AsTempFile")
+	path, err := p.WriteTempFile("script-")
+	if err != nil {
+		return p
+	}
+	q := p.derive(Echo(path + "\n"))
+	q.tempFiles = []string{path}
+	return q
+}
+
 // Basename reads a list of filepaths from the pipe, one per line, and removes
 // any leading directory components from each line. If a line is empty, Basename
-// will produce '.'. Trailing slashes are removed.
+// will produce '.'. Trailing slashes are removed. On Windows, both forward
+// slashes and backslashes separate path components.
 func (p *Pipe) Basename() *Pipe {
 	if p == nil || p.Error() != nil {
 		return p
 	}
-	return p.EachLine(func(line string, out *strings.Builder) {
-		out.WriteString(filepath.Base(line))
+	return p.addStage("Basename").eachLine(func(line string, out *strings.Builder) {
+		base := filepath.Base(line)
+		// Keep forward slashes, which filepath.Base() converts to backslashes
+		// on Windows
+		if !strings.ContainsRune(line, '\\') {
+			base = filepath.ToSlash(base)
+		}
+		out.WriteString(base)
 		out.WriteRune('\n')
 	})
 }
 
+// Between reads from the pipe, and returns a new pipe containing only the
+// blocks of lines that start with a line matching startRe and end with a line
+// matching endRe, including those lines, like the awk range pattern
+// `/start/,/end/`. The end pattern is checked starting with the start line
+// itself, so a line matching both is a block on its own. There can be any
+// number of blocks, and if the last block has no end line, it runs to the end
+// of the input. If there is an error reading the pipe, the pipe's error
+// status is also set.
+func (p *Pipe) Between(startRe, endRe *regexp.Regexp) *Pipe {
+	return p.addStage("Between").between(startRe, endRe, true)
+}
+
+// BetweenExclusive is like Between, but leaves out the lines matching startRe
+// and endRe, so that only the lines inside each block are included.
+func (p *Pipe) BetweenExclusive(startRe, endRe *regexp.Regexp) *Pipe {
+	return p.addStage("BetweenExclusive").between(startRe, endRe, false)
+}
+
+// Bunzip2 decompresses the contents of the pipe, which should be in bzip2
+// format, and returns a pipe containing the decompressed data. Decompression
+// is streaming, so a corrupt input will be reported as an error when the pipe
+// is read.
+func (p *Pipe) Bunzip2() *Pipe {
+	if p == nil || p.Error() != nil {
+		return p
+	}
+	p.addStage("Bunzip2")
+	return p.withReader(bzip2.NewReader(p.Reader))
+}
+
+// CheckPortEach reads a list of hostnames or IP addresses from the pipe, one
+// per line, and tries to make a TCP connection to the specified port on each
+// of them, waiting at most `timeout` for each attempt. The checks run
+// concurrently. It returns a pipe containing one line per input line, in the
+// same order, consisting of the address (`host:port`) followed by either
+// `open` or `closed`, like this:
+//
+//	example.com:443 open
+//	10.0.0.1:22 closed
+//
+// If there is an error reading the pipe, the pipe's error status is also set.
+func (p *Pipe) CheckPortEach(port int, timeout time.Duration) *Pipe {
+	return p.addStage("CheckPortEach").eachLineConcurrently(func(host string) (string, error) {
+		addr := net.JoinHostPort(host, strconv.Itoa(port))
+		conn, err := net.DialTimeout("tcp", addr, timeout)
+		if err != nil {
+			return addr + " closed", nil
+		}
+		conn.Close()
+		return addr + " open", nil
+	})
+}
+
+// ChmodEach reads a list of file paths from the pipe, one per line, and sets
+// the permissions of each file to `mode` (for example, 0644), like Unix
+// `chmod`. It returns a pipe containing the path of each file changed, one per
+// line. If the pipe is in dry-run mode (see DryRun), it lists the files that
+// would be changed, without changing them. If any file can't be changed, the
+// remaining files are still processed, and then the pipe's error status is
+// set to an error listing every failure.
+func (p *Pipe) ChmodEach(mode os.FileMode) *Pipe {
+	return p.addStage("ChmodEach").eachFile(func(path string) (string, error) {
+		if p.dryRun {
+			_, err := os.Stat(path)
+			return path, err
+		}
+		return path, os.Chmod(path, mode)
+	})
+}
+
+// Clone reads the contents of the pipe into memory, and returns n new pipes,
+// each containing a complete copy of the data. Since a pipe can only be read
+// once, this is useful for sending the same data to more than one sink:
+//
+//	pipes := script.File("release.tar.gz").Clone(2)
+//	pipes[0].WriteFile("/backup/release.tar.gz")
+//	sum, err := pipes[1].SHA256Sum()
+//
+// The clones have the same settings (such as DryRun or Binary mode) and error
+// status as the original pipe. If a reader was set with WithStdin, it's also
+// read into memory, and each clone gets its own copy. If there is an error
+// reading the pipe, its error status is also set, and so is that of each
+// clone.
+func (p *Pipe) Clone(n int) []*Pipe {
+	clones := make([]*Pipe, max(n, 0))
+	if p == nil {
+		return clones
+	}
+	var data, stdin []byte
+	if p.Error() == nil {
+		var err error
+		data, err = ioutil.ReadAll(p.Reader)
+		if err == nil && p.stdin != nil {
+			stdin, err = ioutil.ReadAll(p.stdin)
+		}
+		if err != nil {
+			p.SetError(err)
+		}
+	}
+	stage := newStage("Clone")
+	for i := range clones {
+		q := *p
+		q.Reader = NewReadAutoCloser(bytes.NewReader(data))
+		if p.stdin != nil {
+			q.stdin = bytes.NewReader(stdin)
+		}
+		if p.cache != nil {
+			entry := *p.cache
+			q.cache = &entry
+		}
+		q.sources = p.sources[:len(p.sources):len(p.sources)]
+		q.changes = p.changes[:len(p.changes):len(p.changes)]
+		q.tempFiles = nil
+		q.stages = append(p.stages[:len(p.stages):len(p.stages)], stage)
+		clones[i] = &q
+	}
+	return clones
+}
+
 // Column reads from the pipe, and returns a new pipe containing only the Nth
 // column of each line in the input, where '1' means the first column, and
 // columns are delimited by whitespace. Specifically, whatever Unicode defines
 // as whitespace ('WSpace=yes'). If there is an error reading the pipe, the
 // pipe's error status is also set.
 func (p *Pipe) Column(col int) *Pipe {
-	return p.EachLine(func(line string, out *strings.Builder) {
+	return p.addStage("Column").eachLine(func(line string, out *strings.Builder) {
 		columns := strings.Fields(line)
 		if col > 0 && col <= len(columns) {
 			out.WriteString(columns[col-1])
@@ -49,47 +245,275 @@ func (p *Pipe) Column(col int) *Pipe {
 	})
 }
 
+// CombinedLog reads lines in the Apache/NGINX combined log format (or the
+// common log format, which lacks the last two fields), and returns a pipe
+// containing the same entries in logfmt format, with the keys remote_addr,
+// ident, user, time, request, method, path, protocol, status, bytes, referer,
+// and user_agent. Use Field to extract a particular field:
+//
+//	script.File("access.log").CombinedLog().Field("status").Freq()
+//
+// Lines that aren't in combined or common log format are dropped.
+func (p *Pipe) CombinedLog() *Pipe {
+	return p.addStage("CombinedLog").eachLine(func(line string, out *strings.Builder) {
+		m := combinedLogPattern.FindStringSubmatch(line)
+		if m == nil {
+			return
+		}
+		pairs := []logfmtPair{
+			{"remote_addr", m[1]},
+			{"ident", m[2]},
+			{"user", m[3]},
+			{"time", m[4]},
+			{"request", m[5]},
+		}
+		if req := strings.Fields(m[5]); len(req) == 3 {
+			pairs = append(pairs,
+				logfmtPair{"method", req[0]},
+				logfmtPair{"path", req[1]},
+				logfmtPair{"protocol", req[2]},
+			)
+		}
+		pairs = append(pairs, logfmtPair{"status", m[6]}, logfmtPair{"bytes", m[7]})
+		if m[8] != "" || m[9] != "" {
+			pairs = append(pairs, logfmtPair{"referer", m[8]}, logfmtPair{"user_agent", m[9]})
+		}
+		out.WriteString(formatLogfmt(pairs))
+		out.WriteRune('\n')
+	})
+}
+
 // Concat reads a list of filenames from the pipe, one per line, and returns a
 // pipe that reads all those files in sequence. If there are any errors (for
 // example, non-existent files), these will be ignored, execution will continue,
 // and the pipe's error status will not be set.
 func (p *Pipe) Concat() *Pipe {
-	if p == nil || p.Error() != nil {
+	if p == nil || p.Error() != nil || p.rejectBinary() {
 		return p
 	}
+	p.addStage("Concat")
 	var readers []io.Reader
 	scanner := bufio.NewScanner(p.Reader)
 	for scanner.Scan() {
-		input, err := os.Open(scanner.Text())
+		input, err := openSource(scanner.Text())
 		if err != nil {
 			continue // Concat() ignores errors
 		}
+		p.sources = append(p.sources, input)
 		readers = append(readers, NewReadAutoCloser(input))
 	}
 	err := scanner.Err()
 	if err != nil {
 		p.SetError(err)
 	}
-	return p.WithReader(io.MultiReader(readers...))
+	return p.withReader(io.MultiReader(readers...))
+}
+
+// ConcatWithNames is like Concat, but prefixes each line of each file with the
+// file's name and a colon, like `grep -H`, so that it's clear which file each
+// line came from, even after further filtering:
+//
+//	script.ListFiles("*.go").ConcatWithNames().Match("TODO").Stdout()
+//
+// As with Concat, files that can't be opened, and directories, are skipped,
+// and the pipe's error status is not set. But if there's an error part way
+// through reading a file, or a line is too long, the pipe's error status is
+// set, since some of the file's lines would be missing. StripNames removes the
+// prefixes again.
+func (p *Pipe) ConcatWithNames() *Pipe {
+	return p.addStage("ConcatWithNames").eachLine(func(name string, out *strings.Builder) {
+		f, err := os.Open(name)
+		if err != nil {
+			return // like Concat, ConcatWithNames ignores errors
+		}
+		defer f.Close()
+		if info, err := f.Stat(); err != nil || info.IsDir() {
+			return
+		}
+		scanner := bufio.NewScanner(f)
+		for scanner.Scan() {
+			out.WriteString(name)
+			out.WriteByte(':')
+			out.WriteString(scanner.Text())
+			out.WriteByte('\n')
+		}
+		if err := scanner.Err(); err != nil {
+			p.SetError(fmt.Errorf("%s: %w", name, err))
+		}
+	})
+}
+
+// ErrNotConfirmed is the error status set by Confirm and ConfirmPreview when
+// the user doesn't answer yes.
+var ErrNotConfirmed = errors.New("not confirmed")
+
+// Confirm reads the whole contents of the pipe, then writes the specified
+// prompt to the pipe's standard error (followed by " [y/N] "), and reads a
+// line from the program's standard input (or the reader set by WithStdin). If
+// the answer is "y" or "yes" (in any case), it returns a pipe containing the
+// original contents, so that the pipeline can continue. Otherwise, the pipe's
+// error status is set to ErrNotConfirmed, so that later stages (such as a
+// destructive ExecForEach) do nothing.
+func (p *Pipe) Confirm(prompt string) *Pipe {
+	p.addStage("Confirm")
+	return p.confirmPreview(prompt, 0)
+}
+
+// ConfirmPreview is like Confirm, but before the prompt, it shows the first N
+// lines of the pipe's contents, followed by a count of any remaining lines, so
+// that the user can see what they're agreeing to. Like the prompt, the
+// preview is written to the pipe's standard error, so that it's seen even when
+// standard output is redirected.
+func (p *Pipe) ConfirmPreview(prompt string, lines int) *Pipe {
+	p.addStage("ConfirmPreview")
+	return p.confirmPreview(prompt, lines)
+}
+
+// CopyFilesTo reads a list of file paths from the pipe, one per line, and
+// copies each file into the directory `dir`, keeping its name and permissions,
+// like Unix `cp`. It returns a pipe containing the path of each new copy, one
+// per line. If the pipe is in dry-run mode (see DryRun), it lists the copies
+// that would be made, without making them. If any file can't be copied, the
+// remaining files are still processed, and then the pipe's error status is
+// set to an error listing every failure.
+func (p *Pipe) CopyFilesTo(dir string) *Pipe {
+	return p.addStage("CopyFilesTo").eachFile(func(path string) (string, error) {
+		dst := filepath.Join(dir, filepath.Base(path))
+		if p.dryRun {
+			_, err := os.Lstat(path)
+			return dst, err
+		}
+		return dst, copyFile(path, dst)
+	})
+}
+
+// CountBy reads lines from the pipe, calls keyFn to get the key for each
+// line, and returns a pipe containing one line for each distinct key, of the
+// form "key<TAB>count", where count is the number of lines with that key. Keys
+// appear in the order they were first seen, so the input needn't be sorted,
+// unlike with Unix `sort | uniq -c`:
+//
+//	script.File("app.log").CountBy(func(line string) string {
+//		level, _, _ := strings.Cut(line, " ")
+//		return level
+//	})
+func (p *Pipe) CountBy(keyFn func(string) string) *Pipe {
+	if p == nil || p.Error() != nil {
+		return p
+	}
+	p.addStage("CountBy")
+	var keys []string
+	counts := map[string]int{}
+	p.eachLine(func(line string, out *strings.Builder) {
+		key := keyFn(line)
+		if counts[key] == 0 {
+			keys = append(keys, key)
+		}
+		counts[key]++
+	})
+	var output strings.Builder
+	for _, key := range keys {
+		fmt.Fprintf(&output, "%s\t%d\n", key, counts[key])
+	}
+	return p.derive(Echo(output.String()).WithError(p.Error()))
+}
+
+// Dedupe returns a pipe containing the lines from the input with any
+// duplicates removed, keeping the first occurrence of each line. Unlike Unix
+// `uniq`, the duplicates needn't be adjacent, so the input doesn't need
+// sorting, and the lines stay in their original order. Lines are passed on as
+// they're read, but Dedupe must remember every distinct line; for huge inputs,
+// DedupeApprox uses bounded memory.
+func (p *Pipe) Dedupe() *Pipe {
+	p.addStage("Dedupe")
+	seen := map[string]bool{}
+	return p.streamLines(func(line string) (string, bool) {
+		if seen[line] {
+			return "", false
+		}
+		seen[line] = true
+		return line, true
+	})
+}
+
+// DedupeApprox is like Dedupe, but uses a Bloom filter sized for the expected
+// number of distinct lines, so that its memory use is fixed no matter how much
+// input there is. The price is that a small proportion of distinct lines
+// (roughly fpRate, such as 0.001, once the expected number of distinct lines
+// have been seen) will wrongly be treated as duplicates and dropped. Duplicate
+// lines are always removed.
+func (p *Pipe) DedupeApprox(expected int, fpRate float64) *Pipe {
+	if p == nil || p.Error() != nil {
+		return p
+	}
+	p.addStage("DedupeApprox")
+	if expected < 1 || fpRate <= 0 || fpRate >= 1 {
+		return p.WithError(fmt.Errorf("invalid Bloom filter parameters: expected %d, false positive rate %g", expected, fpRate))
+	}
+	seen := newBloomFilter(expected, fpRate)
+	return p.streamLines(func(line string) (string, bool) {
+		return line, seen.add(line)
+	})
+}
+
+// DialUnix connects to the Unix domain socket at the specified path, writes
+// the contents of the pipe to it, and returns a pipe containing the response,
+// until the server closes the connection. This is useful for querying local
+// daemons that listen on a socket, such as Docker:
+//
+//	script.Echo("GET /containers/json HTTP/1.0\r\n\r\n").DialUnix("/var/run/docker.sock")
+//
+// Once the contents of the pipe have been written, the writing half of the
+// connection is shut down, so the server sees the end of the request. The
+// connection is closed once the returned pipe has been fully read. If the
+// connection fails, the pipe's error status will be set. If writing to the
+// socket fails, the connection is closed, and reading the pipe returns an
+// error.
+func (p *Pipe) DialUnix(path string) *Pipe {
+	if p == nil || p.Error() != nil {
+		return p
+	}
+	p.addStage("DialUnix")
+	conn, err := net.DialUnix("unix", nil, &net.UnixAddr{Name: path, Net: "unix"})
+	if err != nil {
+		return p.WithError(err)
+	}
+	input := p.Reader
+	goStage(func() {
+		if _, err := io.Copy(conn, input); err != nil {
+			conn.Close()
+			return
+		}
+		conn.CloseWrite()
+	})
+	// Closing the input too stops the copy if it's waiting for more.
+	return p.withReader(multiReader{conn, []io.Closer{conn, input}})
 }
 
 // Dirname reads a list of pathnames from the pipe, one per line, and returns a
 // pipe that contains only the parent directories of each pathname. If a line
 // is empty, Dirname will produce a '.'. Trailing slashes are removed, unless
-// Dirname returns the root folder.
+// Dirname returns the root folder. On Windows, both forward slashes and
+// backslashes separate path components, and a pathname that uses only forward
+// slashes produces a directory that does too.
 func (p *Pipe) Dirname() *Pipe {
 	if p == nil || p.Error() != nil {
 		return p
 	}
-	return p.EachLine(func(line string, out *strings.Builder) {
+	return p.addStage("Dirname").eachLine(func(line string, out *strings.Builder) {
 		// filepath.Dir() does not handle trailing slashes correctly
-		if len(line) > 1 && strings.HasSuffix(line, "/") {
+		if len(line) > 1 && os.IsPathSeparator(line[len(line)-1]) {
 			line = line[0 : len(line)-1]
 		}
 		dirname := filepath.Dir(line)
-		// filepath.Dir() does not preserve a leading './'
-		if len(dirname) > 1 && strings.HasPrefix(line, "./") {
-			dirname = "./" + dirname
+		// filepath.Dir() does not preserve a leading './' (or '.\' on Windows)
+		if len(dirname) > 1 && len(line) > 2 && line[0] == '.' && os.IsPathSeparator(line[1]) {
+			dirname = line[:2] + dirname
+		}
+		// Keep forward slashes, which filepath.Dir() converts to backslashes
+		// on Windows
+		if !strings.ContainsRune(line, '\\') {
+			dirname = filepath.ToSlash(dirname)
 		}
 		out.WriteString(dirname)
 		out.WriteRune('\n')
@@ -100,13 +524,35 @@ func (p *Pipe) Dirname() *Pipe {
 // line as a string, and a *strings.Builder to write its output to. The return
 // value from EachLine is a pipe containing the contents of the strings.Builder.
 func (p *Pipe) EachLine(process func(string, *strings.Builder)) *Pipe {
-	if p == nil || p.Error() != nil {
+	return p.addStage("EachLine").eachLine(process)
+}
+
+// EachLineBytes is a faster version of EachLine for high-throughput
+// pipelines. It calls the specified function for each line of input, passing
+// it the line, and the output so far, to which it should append any output of
+// its own, returning the result, as with the append function. For example:
+//
+//	p.EachLineBytes(func(line, out []byte) []byte {
+//		if bytes.HasPrefix(line, []byte("ERROR")) {
+//			out = append(out, line...)
+//			out = append(out, '\n')
+//		}
+//		return out
+//	})
+//
+// Unlike EachLine, it doesn't copy each line into a new string: the line is
+// only valid until the function returns, so it mustn't be retained. The
+// return value from EachLineBytes is a pipe containing the final output.
+func (p *Pipe) EachLineBytes(process func(line, out []byte) []byte) *Pipe {
+	if p == nil || p.Error() != nil || p.rejectBinary() {
 		return p
 	}
-	scanner := bufio.NewScanner(p.Reader)
-	output := strings.Builder{}
+	p.addStage("EachLineBytes")
+	scanner, release := newLineScanner(p.Reader)
+	defer release()
+	var output []byte
 	for scanner.Scan() {
-		process(scanner.Text(), &output)
+		output = process(scanner.Bytes(), output)
 		if p.Error() != nil {
 			return p
 		}
@@ -115,282 +561,3406 @@ func (p *Pipe) EachLine(process func(string, *strings.Builder)) *Pipe {
 	if err != nil {
 		p.SetError(err)
 	}
-	return Echo(output.String())
+	return p.derive(NewPipe().withReader(bytes.NewReader(output)).WithError(p.Error()))
 }
 
-// Exec runs an external command and returns a pipe containing the output. If
-// the command had a non-zero exit status, the pipe's error status will also be
-// set to the string "exit status X", where X is the integer exit status.
+// Exec runs an external command and returns a pipe containing the output. The
+// command's standard input is the contents of the pipe, unless a different
+// reader was set using WithStdin. If the command had a non-zero exit status,
+// the pipe's error status will also be set to the string "exit status X",
+// where X is the integer exit status. If the command can't be found, the
+// pipe's error status is set to ErrCommandNotFound.
 func (p *Pipe) Exec(cmdLine string) *Pipe {
+	defer p.removeTempFiles()
 	if p == nil || p.Error() != nil {
 		return p
 	}
-	q := NewPipe()
-	args, ok := shell.Split(cmdLine) // strings.Fields doesn't handle quotes
-	if !ok {
-		return p.WithError(fmt.Errorf("unbalanced quotes or backslashes in [%s]", cmdLine))
-	}
-	cmd := exec.Command(args[0], args[1:]...)
-	cmd.Stdin = p.Reader
-	output, err := cmd.CombinedOutput()
-	if err != nil {
-		q.SetError(err)
-	}
-	return q.WithReader(bytes.NewReader(output))
+	p.addStage("Exec")
+	return p.exec(cmdLine, p.stdinReader())
 }
 
 // ExecForEach runs the supplied command once for each line of input, and
 // returns a pipe containing the output. The command string is interpreted as a
 // Go template, so `{{.}}` will be replaced with the input value, for example.
-// If any command resulted in a non-zero exit status, the pipe's error status
-// will also be set to the string "exit status X", where X is the integer exit
-// status.
+// For commands that insist on reading from a file, `{{.File}}` will be
+// replaced with the path of a temporary file containing the input value (plus
+// a newline), which is removed once the command has finished, like the
+// shell's `<(...)`. `{{.Index}}` is replaced with the number of the input
+// line, counting from 1, and `{{.Total}}` with the total number of lines,
+// which is useful for numbering output files or showing progress:
+//
+//	script.ListFiles("*.jpg").ExecForEach("convert {{.}} out_{{.Index}}.png")
+//
+// To find the total, ExecForEach must read all its input before running the
+// first command, so `{{.Total}}` shouldn't be used with input that never
+// ends. If the command can't be found, ExecForEach sets the pipe's error status
+// to ErrCommandNotFound without running anything. If any command resulted in a
+// non-zero exit status, the pipe's error status will also be set to the string
+// "exit status X", where X is the integer exit status.
 func (p *Pipe) ExecForEach(cmdTpl string) *Pipe {
+	defer p.removeTempFiles()
 	if p == nil || p.Error() != nil {
 		return p
 	}
+	p.addStage("ExecForEach")
 	tpl, err := template.New("").Parse(cmdTpl)
 	if err != nil {
 		return p.WithError(err)
 	}
-	return p.EachLine(func(line string, out *strings.Builder) {
+	if err := p.checkTemplateCommand(cmdTpl); err != nil {
+		return p.WithError(err)
+	}
+	total := -1
+	if strings.Contains(cmdTpl, ".Total") {
+		if total, err = p.bufferLines(); err != nil {
+			return p
+		}
+	}
+	cp, err := p.openCheckpoint()
+	if err != nil {
+		return p.WithError(err)
+	}
+	var truncated bool
+	var process *ProcessInfo
+	index := 0
+	q := p.eachLine(func(line string, out *strings.Builder) {
+		index++
+		if cp.processed(index, line) {
+			return
+		}
 		cmdLine := strings.Builder{}
-		err := tpl.Execute(&cmdLine, line)
+		files, err := executeLineTemplate(tpl, &cmdLine, line, index, total)
+		defer removeFiles(files)
 		if err != nil {
 			p.SetError(err)
 			return
 		}
-		cmdOutput, err := Exec(cmdLine.String()).String()
+		result := p.execPipe().exec(cmdLine.String(), nil)
+		truncated = truncated || result.truncated
+		cmdOutput, err := result.String()
+		process = result.process
 		if err != nil {
 			p.SetError(err)
 			return
 		}
 		out.WriteString(cmdOutput)
+		if err := cp.record(index, line); err != nil {
+			p.SetError(err)
+		}
 	})
+	cp.finish(q.Error() == nil)
+	q.truncated = q.truncated || truncated
+	q.process = process
+	return q
 }
 
-// First reads from the pipe, and returns a new pipe containing only the first N
-// lines. If there is an error reading the pipe, the pipe's error status is also
-// set.
-func (p *Pipe) First(lines int) *Pipe {
-	if p == nil || p.Error() != nil {
+// ExecForEachParallel is like ExecForEach, but runs up to the specified
+// number of commands at once. It returns straight away, and the returned pipe
+// contains each command's output as soon as it can be produced: by default,
+// in the same order as the input lines, but, if the pipe was set to Unordered
+// with WithOrdering, in the order the commands finish, which gives the lowest
+// latency:
+//
+//	script.File("hosts.txt").WithOrdering(script.Unordered).ExecForEachParallel("ssh {{.}} uptime", 8)
+//
+// If a command fails, no more are started, no more input is read, and reading
+// the end of the output returns the error; in ordered mode, the output stops
+// just before the input line whose command failed. In ordered mode, a slow
+// command holds up the output of later lines, so no more than twice the number
+// of workers lines are run or held at once.
+func (p *Pipe) ExecForEachParallel(cmdTpl string, workers int) *Pipe {
+	if p == nil || p.Error() != nil || p.rejectBinary() {
 		return p
 	}
-	defer p.Close()
-	if lines <= 0 {
-		return NewPipe()
+	p.addStage("ExecForEachParallel")
+	tpl, err := template.New("").Parse(cmdTpl)
+	if err != nil {
+		return p.WithError(err)
 	}
-	scanner := bufio.NewScanner(p.Reader)
-	output := strings.Builder{}
-	for i := 0; i < lines; i++ {
-		if !scanner.Scan() {
-			break
+	if err := p.checkTemplateCommand(cmdTpl); err != nil {
+		return p.WithError(err)
+	}
+	total := -1
+	if strings.Contains(cmdTpl, ".Total") {
+		if total, err = p.bufferLines(); err != nil {
+			return p
 		}
-		output.WriteString(scanner.Text())
-		output.WriteRune('\n')
 	}
-	err := scanner.Err()
+	if workers < 1 {
+		workers = 1
+	}
+	cp, err := p.openCheckpoint()
 	if err != nil {
-		p.SetError(err)
+		return p.WithError(err)
 	}
-	return Echo(output.String())
+	input := p.Reader
+	tempFiles := p.tempFiles
+	p.tempFiles = nil
+	pr, pw := io.Pipe()
+	goStage(func() {
+		defer removeFiles(tempFiles)
+		err := p.execParallel(tpl, total, workers, input, pw, cp)
+		cp.finish(err == nil)
+		pw.CloseWithError(err)
+	})
+	return p.execPipe().withReader(stageReader{pr, input})
 }
 
-// Freq reads from the pipe, and returns a new pipe containing only unique lines
-// from the input, prefixed with a frequency count, in descending numerical
-// order (most frequent lines first). Lines with equal frequency will be sorted
-// alphabetically. If there is an error reading the pipe, the pipe's error
-// status is also set.
-func (p *Pipe) Freq() *Pipe {
+// ExecResult describes the result of running one command with
+// ExecForEachResult.
+type ExecResult struct {
+	// Input is the line of input the command was run for.
+	Input string `json:"input"`
+	// ExitStatus is the command's exit status, or -1 if it couldn't be run.
+	ExitStatus int `json:"exit_status"`
+	// Duration is how long the command took to run, in seconds.
+	Duration float64 `json:"duration"`
+	// Output is the command's combined output, with leading and trailing
+	// whitespace removed.
+	Output string `json:"output"`
+	// Error describes why the command couldn't be run, if it couldn't.
+	Error string `json:"error,omitempty"`
+}
+
+// ExecForEachResult is like ExecForEach, but instead of the commands' output,
+// returns a pipe containing one line for each command, describing its result
+// as an ExecResult in JSON format:
+//
+//	{"input":"example.com","exit_status":0,"duration":0.51,"output":"..."}
+//
+// A command that fails doesn't stop later commands from running, or set the
+// pipe's error status, so downstream filters can separate successes from
+// failures by their exit status, and the results can be decoded with Lines:
+//
+//	results, err := script.Lines(script.File("hosts.txt").ExecForEachResult("ssh {{.}} uptime"),
+//		func(line string) (r script.ExecResult, err error) {
+//			return r, json.Unmarshal([]byte(line), &r)
+//		})
+//
+// If the command template is invalid, the pipe's error status is set.
+func (p *Pipe) ExecForEachResult(cmdTpl string) *Pipe {
+	defer p.removeTempFiles()
 	if p == nil || p.Error() != nil {
 		return p
 	}
-	freq := map[string]int{}
-	p.EachLine(func(line string, out *strings.Builder) {
-		freq[line]++
-	})
-	type frequency struct {
-		line  string
-		count int
+	p.addStage("ExecForEachResult")
+	tpl, err := template.New("").Parse(cmdTpl)
+	if err != nil {
+		return p.WithError(err)
 	}
-	freqs := make([]frequency, 0, len(freq))
-	var maxCount int
-	for line, count := range freq {
-		freqs = append(freqs, frequency{line, count})
-		if count > maxCount {
-			maxCount = count
+	total := -1
+	if strings.Contains(cmdTpl, ".Total") {
+		if total, err = p.bufferLines(); err != nil {
+			return p
 		}
 	}
-	sort.Slice(freqs, func(i, j int) bool {
-		if freqs[i].count == freqs[j].count {
-			return freqs[i].line < freqs[j].line
+	index := 0
+	return p.eachLine(func(line string, out *strings.Builder) {
+		index++
+		cmdLine := strings.Builder{}
+		files, err := executeLineTemplate(tpl, &cmdLine, line, index, total)
+		defer removeFiles(files)
+		if err != nil {
+			p.SetError(err)
+			return
 		}
-		return freqs[i].count > freqs[j].count
+		q := p.execPipe()
+		q.stream = false
+		start := time.Now()
+		result := q.exec(cmdLine.String(), nil)
+		r := ExecResult{
+			Input:      line,
+			ExitStatus: result.ExitStatus(),
+			Duration:   time.Since(start).Seconds(),
+		}
+		output, _ := ioutil.ReadAll(result.Reader)
+		r.Output = strings.TrimSpace(string(output))
+		if err := result.Error(); err != nil && r.ExitStatus == 0 {
+			r.ExitStatus = -1
+			r.Error = err.Error()
+		}
+		data, err := json.Marshal(r)
+		if err != nil {
+			p.SetError(err)
+			return
+		}
+		out.Write(data)
+		out.WriteRune('\n')
 	})
-	fieldWidth := len(strconv.Itoa(maxCount))
-	var output strings.Builder
-	for _, item := range freqs {
-		output.WriteString(fmt.Sprintf("%*d %s", fieldWidth, item.count, item.line))
-		output.WriteRune('\n')
-	}
-	return Echo(output.String())
 }
 
-// Join reads the contents of the pipe, line by line, and joins them into a
-// single space-separated string. It returns a pipe containing this string. Any
-// terminating newline is preserved.
-func (p *Pipe) Join() *Pipe {
+// ExecNoStdin is like Exec, but the command's standard input is empty (the null
+// device), instead of the contents of the pipe. This is useful for running
+// commands in the middle of a pipeline that might otherwise wait indefinitely
+// for input, such as interactive programs. The contents of the pipe are
+// ignored.
+func (p *Pipe) ExecNoStdin(cmdLine string) *Pipe {
+	defer p.removeTempFiles()
 	if p == nil || p.Error() != nil {
 		return p
 	}
-	result, err := p.String()
-	if err != nil {
+	p.addStage("ExecNoStdin")
+	return p.exec(cmdLine, nil)
+}
+
+// ExecPipeline runs a pipeline of external commands, separated by `|`
+// characters, as in the shell: for example, "sort | uniq -c | sort -rn". The
+// commands run concurrently, with the standard output of each connected
+// directly to the standard input of the next, and the contents of the pipe are
+// the standard input of the first command. It returns a pipe containing the
+// output of the last command, together with the standard error of every
+// command. Like the shell's `pipefail` option, if any command had a non-zero
+// exit status, the pipe's error status will be set to the string "exit status
+// X", where X is the exit status of the last (rightmost) command that failed.
+// If any command can't be found, none of them are run, and the pipe's error
+// status is set to ErrCommandNotFound, with a message saying which stage of
+// the pipeline it's in: for example, "command not found: uniq at stage 2".
+func (p *Pipe) ExecPipeline(cmdLine string) *Pipe {
+	defer p.removeTempFiles()
+	if p == nil || p.Error() != nil {
 		return p
 	}
-	var terminator string
-	if strings.HasSuffix(result, "\n") {
-		terminator = "\n"
-		result = result[:len(result)-1]
-	}
-	output := strings.ReplaceAll(result, "\n", " ")
-	return Echo(output + terminator)
+	p.addStage("ExecPipeline")
+	return p.execPipeline(cmdLine)
 }
 
-// Last reads from the pipe, and returns a new pipe containing only the last N
-// lines. If there is an error reading the pipe, the pipe's error status is also
-// set.
-func (p *Pipe) Last(lines int) *Pipe {
+// ExecPowerShell is like ExecShell, but runs the command line with
+// PowerShell (`powershell` on Windows, or `pwsh` on other platforms, where it
+// must be installed separately).
+func (p *Pipe) ExecPowerShell(cmdLine string) *Pipe {
+	defer p.removeTempFiles()
 	if p == nil || p.Error() != nil {
 		return p
 	}
-	defer p.Close()
-	if lines <= 0 {
-		return NewPipe()
+	p.addStage("ExecPowerShell")
+	return p.execCommand(powerShellCommand(cmdLine), cmdLine, p.stdinReader())
+}
+
+// ExecShell is like Exec, but runs the command line with the platform's
+// command interpreter: `sh -c` on Unix-like systems, or `cmd /C` on Windows.
+// This means that the command line can use shell features such as variables,
+// wildcards, redirection, and built-in commands (such as Windows `dir`),
+// but also that the same command line might not work on every platform.
+func (p *Pipe) ExecShell(cmdLine string) *Pipe {
+	defer p.removeTempFiles()
+	if p == nil || p.Error() != nil {
+		return p
 	}
-	scanner := bufio.NewScanner(p.Reader)
-	input := ring.New(lines)
-	for scanner.Scan() {
-		input.Value = scanner.Text()
-		input = input.Next()
+	p.addStage("ExecShell")
+	return p.execCommand(shellCommand(cmdLine), cmdLine, p.stdinReader())
+}
+
+// ExpandCIDR reads CIDR prefixes from the pipe, one per line (such as
+// `192.168.1.0/30`), and returns a pipe containing every address in each
+// prefix, one per line, in order. Output is produced as it's read, so large
+// prefixes don't need to fit in memory; use First to take only some addresses
+// from a very large prefix. If a line isn't a valid prefix, reading the pipe
+// returns an error.
+func (p *Pipe) ExpandCIDR() *Pipe {
+	if p == nil || p.Error() != nil || p.rejectBinary() {
+		return p
 	}
-	output := strings.Builder{}
-	input.Do(func(p interface{}) {
-		value, ok := p.(string)
-		if ok {
-			output.WriteString(value)
-			output.WriteRune('\n')
+	p.addStage("ExpandCIDR")
+	input := p.Reader
+	pr, pw := io.Pipe()
+	goStage(func() {
+		w := bufio.NewWriter(pw)
+		scanner := bufio.NewScanner(input)
+		var err error
+		for err == nil && scanner.Scan() {
+			var prefix netip.Prefix
+			prefix, err = netip.ParsePrefix(strings.TrimSpace(scanner.Text()))
+			if err != nil {
+				break
+			}
+			prefix = prefix.Masked()
+			for addr := prefix.Addr(); prefix.Contains(addr); addr = addr.Next() {
+				if _, err := fmt.Fprintln(w, addr); err != nil {
+					return // reader has gone away
+				}
+			}
+		}
+		if err == nil {
+			err = scanner.Err()
 		}
+		// Pass on the addresses expanded so far, even if there's an error.
+		if flushErr := w.Flush(); err == nil {
+			err = flushErr
+		}
+		pw.CloseWithError(err)
 	})
-	err := scanner.Err()
-	if err != nil {
-		p.SetError(err)
-	}
-	return Echo(output.String())
+	return p.withReader(stageReader{pr, input})
 }
 
-// Match reads from the pipe, and returns a new pipe containing only lines that
-// contain the specified string. If there is an error reading the pipe, the
-// pipe's error status is also set.
-func (p *Pipe) Match(s string) *Pipe {
-	return p.EachLine(func(line string, out *strings.Builder) {
-		if strings.Contains(line, s) {
-			out.WriteString(line)
-			out.WriteRune('\n')
+// ExtractBlocks reads from the pipe, and returns a new pipe containing each
+// block of lines that starts with a line matching startRe, followed by any
+// continuation lines, as a single line, with the original lines joined by the
+// two characters `\n`. A line is a continuation line if contFn returns true
+// for it, or, if contFn is nil, if it starts with a space or tab. Lines that
+// aren't part of a block are left out. This turns multiline records such as
+// stack traces into single lines, ready for filters such as Freq or Match:
+//
+//	script.File("app.log").ExtractBlocks(regexp.MustCompile(`^panic:`), nil).Freq().First(10).Stdout()
+//
+// A line matching startRe always starts a new block, even if it would also be
+// a continuation line. If there is an error reading the pipe, the pipe's error
+// status is also set.
+func (p *Pipe) ExtractBlocks(startRe *regexp.Regexp, contFn func(string) bool) *Pipe {
+	if p == nil || p.Error() != nil || p.rejectBinary() {
+		return p
+	}
+	p.addStage("ExtractBlocks")
+	if contFn == nil {
+		contFn = func(line string) bool {
+			return strings.HasPrefix(line, " ") || strings.HasPrefix(line, "\t")
 		}
-	})
+	}
+	scanner := bufio.NewScanner(p.Reader)
+	output := strings.Builder{}
+	var block []string
+	flush := func() {
+		if block != nil {
+			output.WriteString(strings.Join(block, `\n`))
+			output.WriteRune('\n')
+			block = nil
+		}
+	}
+	for scanner.Scan() {
+		line := scanner.Text()
+		switch {
+		case startRe.MatchString(line):
+			flush()
+			block = []string{line}
+		case block != nil && contFn(line):
+			block = append(block, line)
+		default:
+			flush()
+		}
+	}
+	flush()
+	err := scanner.Err()
+	if err != nil {
+		p.SetError(err)
+	}
+	return p.derive(Echo(output.String()).WithError(p.Error()))
 }
 
-// MatchRegexp reads from the pipe, and returns a new pipe containing only lines
-// that match the specified compiled regular expression. If there is an error
-// reading the pipe, the pipe's error status is also set.
-func (p *Pipe) MatchRegexp(re *regexp.Regexp) *Pipe {
-	if re == nil { // to prevent SIGSEGV
-		return p.WithError(errors.New("nil regular expression"))
-	}
-	return p.EachLine(func(line string, out *strings.Builder) {
-		if re.MatchString(line) {
-			out.WriteString(line)
-			out.WriteRune('\n')
+// Field reads lines in logfmt format (`key=value key2="quoted value"`), such
+// as those produced by Logfmt or CombinedLog, and returns a pipe containing
+// the value of the named field in each line, unquoted. Lines that don't have
+// the field are dropped.
+func (p *Pipe) Field(name string) *Pipe {
+	return p.addStage("Field").eachLine(func(line string, out *strings.Builder) {
+		for _, pair := range parseLogfmt(line) {
+			if pair.key == name {
+				out.WriteString(pair.value)
+				out.WriteRune('\n')
+				return
+			}
 		}
 	})
 }
 
-// Reject reads from the pipe, and returns a new pipe containing only lines
-// that do not contain the specified string. If there is an error reading the
-// pipe, the pipe's error status is also set.
-func (p *Pipe) Reject(s string) *Pipe {
-	return p.EachLine(func(line string, out *strings.Builder) {
-		if !strings.Contains(line, s) {
-			out.WriteString(line)
-			out.WriteRune('\n')
-		}
+// FilterByMTime reads a list of file paths from the pipe, one per line, and
+// returns a pipe containing only those files last modified within the
+// specified time range, inclusive, like Unix `find -newer`. A zero `after` or
+// `before` time means there is no limit in that direction. If a file can't be
+// examined (for example, because it doesn't exist), the pipe's error status is
+// set.
+func (p *Pipe) FilterByMTime(after, before time.Time) *Pipe {
+	return p.addStage("FilterByMTime").filterByStat(func(info os.FileInfo) bool {
+		mtime := info.ModTime()
+		return (after.IsZero() || !mtime.Before(after)) && (before.IsZero() || !mtime.After(before))
 	})
 }
 
-// RejectRegexp reads from the pipe, and returns a new pipe containing only
-// lines that don't match the specified compiled regular expression. If there
-// is an error reading the pipe, the pipe's error status is also set.
-func (p *Pipe) RejectRegexp(re *regexp.Regexp) *Pipe {
-	if re == nil { // to prevent SIGSEGV
-		return p.WithError(errors.New("nil regular expression"))
+// FilterBySize reads a list of file paths from the pipe, one per line, and
+// returns a pipe containing only those files whose size in bytes is between
+// `min` and `max`, inclusive, like Unix `find -size`. A negative `max` means
+// there is no upper limit. If a file can't be examined (for example, because
+// it doesn't exist), the pipe's error status is set.
+func (p *Pipe) FilterBySize(min, max int64) *Pipe {
+	return p.addStage("FilterBySize").filterByStat(func(info os.FileInfo) bool {
+		return info.Size() >= min && (max < 0 || info.Size() <= max)
+	})
+}
+
+// FilterCIDR reads IP addresses from the pipe, one per line, and returns a
+// pipe containing only those addresses within the given CIDR prefix (such as
+// `10.0.0.0/8` or `2001:db8::/32`). Lines that aren't IP addresses are
+// dropped. If the prefix is invalid, the pipe's error status will be set.
+func (p *Pipe) FilterCIDR(cidr string) *Pipe {
+	if p == nil || p.Error() != nil {
+		return p
 	}
-	return p.EachLine(func(line string, out *strings.Builder) {
-		if !re.MatchString(line) {
-			out.WriteString(line)
-			out.WriteRune('\n')
+	p.addStage("FilterCIDR")
+	prefix, err := netip.ParsePrefix(cidr)
+	if err != nil {
+		return p.WithError(err)
+	}
+	return p.eachLine(func(line string, out *strings.Builder) {
+		addr, err := netip.ParseAddr(strings.TrimSpace(line))
+		if err != nil || !prefix.Contains(addr.Unmap()) {
+			return
 		}
+		out.WriteString(line)
+		out.WriteRune('\n')
 	})
 }
 
-// Replace filters its input by replacing all occurrences of the string `search`
-// with the string `replace`. If there is an error reading the pipe, the pipe's
-// error status is also set.
-func (p *Pipe) Replace(search, replace string) *Pipe {
-	return p.EachLine(func(line string, out *strings.Builder) {
-		out.WriteString(strings.ReplaceAll(line, search, replace))
+// FilterSince reads lines from the pipe that contain a timestamp in the given
+// column, in the format specified by layout (as for time.Parse), and returns a
+// pipe containing only the lines whose timestamp is not before since. Columns
+// are numbered and delimited as for Column; if the layout contains spaces,
+// the timestamp spans the corresponding number of columns. Timestamps without
+// a time zone are taken to be in local time. Lines without a valid timestamp
+// are dropped.
+//
+//	script.File("app.log").FilterSince(time.Now().Add(-time.Hour), time.RFC3339, 1)
+func (p *Pipe) FilterSince(since time.Time, layout string, column int) *Pipe {
+	return p.addStage("FilterSince").eachLine(func(line string, out *strings.Builder) {
+		t, _, _, ok := timeColumn(line, layout, column)
+		if !ok || t.Before(since) {
+			return
+		}
+		out.WriteString(line)
 		out.WriteRune('\n')
 	})
 }
 
-// ReplaceRegexp filters its input by replacing all matches of the compiled
-// regular expression `re` with the replacement string `replace`. Inside
-// `replace`, $ signs are interpreted as in regexp.Expand, so for instance "$1"
-// represents the text of the first submatch. If there is an error reading the
-// pipe, the pipe's error status is also set.
-func (p *Pipe) ReplaceRegexp(re *regexp.Regexp, replace string) *Pipe {
-	if re == nil { // to prevent SIGSEGV
-		return p.WithError(errors.New("nil regular expression"))
+// First reads from the pipe, and returns a new pipe containing only the first N
+// lines. If there is an error reading the pipe, the pipe's error status is also
+// set.
+func (p *Pipe) First(lines int) *Pipe {
+	if p == nil || p.Error() != nil || p.rejectBinary() {
+		return p
 	}
-	return p.EachLine(func(line string, out *strings.Builder) {
-		out.WriteString(re.ReplaceAllString(line, replace))
-		out.WriteRune('\n')
-	})
+	p.addStage("First")
+	defer p.Close()
+	if lines <= 0 {
+		return p.derive(Echo(""))
+	}
+	scanner := bufio.NewScanner(p.Reader)
+	output := strings.Builder{}
+	for i := 0; i < lines; i++ {
+		if !scanner.Scan() {
+			break
+		}
+		output.WriteString(scanner.Text())
+		output.WriteRune('\n')
+	}
+	err := scanner.Err()
+	if err != nil {
+		p.SetError(err)
+	}
+	return p.derive(Echo(output.String()).WithError(p.Error()))
 }
 
-// SHA256Sums reads a list of file paths from the pipe, one per line, and
-// returns a pipe that contains the SHA-256 checksum of each pathname. If there
-// are any errors (for example, non-existent files), the pipe's error status
-// will be set to the first error encountered, but execution will continue.
-func (p *Pipe) SHA256Sums() *Pipe {
+// FirstSuccess runs the supplied command once for each line of input, in
+// turn, until one succeeds (that is, has a zero exit status), and returns a
+// pipe containing just the line for which it succeeded. The command string is
+// a template, exactly as for ExecForEach. For example, to find the first host
+// that responds to ping:
+//
+//	script.File("mirrors.txt").FirstSuccess("ping -c 1 -W 1 {{.}}")
+//
+// The commands' output is discarded, and no further commands are run once one
+// has succeeded. If no command succeeds, the returned pipe is empty, and its
+// error status is set to the error from the last command. If there is no
+// input, so that no command is run, the error status is also set.
+func (p *Pipe) FirstSuccess(cmdTpl string) *Pipe {
+	if p == nil || p.Error() != nil || p.rejectBinary() {
+		return p
+	}
+	p.addStage("FirstSuccess")
+	tpl, err := template.New("").Parse(cmdTpl)
+	if err != nil {
+		return p.WithError(err)
+	}
+	if err := p.checkTemplateCommand(cmdTpl); err != nil {
+		return p.WithError(err)
+	}
+	total := -1
+	if strings.Contains(cmdTpl, ".Total") {
+		if total, err = p.bufferLines(); err != nil {
+			return p
+		}
+	}
+	defer p.Close()
+	scanner := bufio.NewScanner(p.Reader)
+	var cmdErr error
+	for index := 1; scanner.Scan(); index++ {
+		line := scanner.Text()
+		cmdLine := strings.Builder{}
+		files, err := executeLineTemplate(tpl, &cmdLine, line, index, total)
+		if err != nil {
+			removeFiles(files)
+			return p.WithError(err)
+		}
+		p.echoCommand(cmdLine.String())
+		cmdErr = p.runQuietly(context.Background(), cmdLine.String())
+		removeFiles(files)
+		if cmdErr == nil {
+			return p.derive(Echo(line + "\n"))
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return p.WithError(err)
+	}
+	if cmdErr == nil {
+		cmdErr = errors.New("no input lines")
+	}
+	return p.derive(Echo("").WithError(cmdErr))
+}
+
+// FirstSuccessParallel is like FirstSuccess, but runs up to the specified
+// number of commands at once. As soon as one succeeds, the others are killed,
+// and no more are started. The returned pipe contains the line for the first
+// command to succeed, which isn't necessarily the earliest line in the input.
+// FirstSuccessParallel reads all its input before running the first command.
+func (p *Pipe) FirstSuccessParallel(cmdTpl string, workers int) *Pipe {
+	if p == nil || p.Error() != nil || p.rejectBinary() {
+		return p
+	}
+	p.addStage("FirstSuccessParallel")
+	tpl, err := template.New("").Parse(cmdTpl)
+	if err != nil {
+		return p.WithError(err)
+	}
+	if err := p.checkTemplateCommand(cmdTpl); err != nil {
+		return p.WithError(err)
+	}
+	lines, err := p.Slice()
+	if err != nil {
+		return p
+	}
+	if workers < 1 {
+		workers = 1
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	var (
+		mu     sync.Mutex
+		winner *string
+		cmdErr error
+		wg     sync.WaitGroup
+		sem    = make(chan struct{}, p.limiter().workers(workers))
+		group  = &procGroup{}
+	)
+	for i, line := range lines {
+		sem <- struct{}{}
+		if ctx.Err() != nil {
+			break
+		}
+		cmdLine := strings.Builder{}
+		files, err := executeLineTemplate(tpl, &cmdLine, line, i+1, len(lines))
+		if err != nil {
+			removeFiles(files)
+			cancel()
+			wg.Wait()
+			return p.WithError(err)
+		}
+		p.echoCommand(cmdLine.String())
+		wg.Add(1)
+		go func(line, cmdLine string, files []string) {
+			defer func() {
+				removeFiles(files)
+				<-sem
+				wg.Done()
+			}()
+			release := p.limiter().acquire(group)
+			err := p.runQuietly(ctx, cmdLine)
+			release()
+			mu.Lock()
+			defer mu.Unlock()
+			switch {
+			case winner != nil:
+			case err == nil:
+				winner = &line
+				cancel()
+			default:
+				cmdErr = err
+			}
+		}(line, cmdLine.String(), files)
+	}
+	wg.Wait()
+	if winner != nil {
+		return p.derive(Echo(*winner + "\n"))
+	}
+	if len(lines) == 0 {
+		cmdErr = errors.New("no input lines")
+	}
+	return p.derive(Echo("").WithError(cmdErr))
+}
+
+// Freq reads from the pipe, and returns a new pipe containing only unique lines
+// from the input, prefixed with a frequency count, in descending numerical
+// order (most frequent lines first). Lines with equal frequency will be sorted
+// alphabetically. If there is an error reading the pipe, the pipe's error
+// status is also set.
+func (p *Pipe) Freq() *Pipe {
 	if p == nil || p.Error() != nil {
 		return p
 	}
+	p.addStage("Freq")
+	freq := map[string]int{}
+	p.eachLine(func(line string, out *strings.Builder) {
+		freq[line]++
+	})
+	type frequency struct {
+		line  string
+		count int
+	}
+	freqs := make([]frequency, 0, len(freq))
+	var maxCount int
+	for line, count := range freq {
+		freqs = append(freqs, frequency{line, count})
+		if count > maxCount {
+			maxCount = count
+		}
+	}
+	sort.Slice(freqs, func(i, j int) bool {
+		if freqs[i].count == freqs[j].count {
+			return freqs[i].line < freqs[j].line
+		}
+		return freqs[i].count > freqs[j].count
+	})
+	fieldWidth := len(strconv.Itoa(maxCount))
+	var output strings.Builder
+	for _, item := range freqs {
+		output.WriteString(fmt.Sprintf("%*d %s", fieldWidth, item.count, item.line))
+		output.WriteRune('\n')
+	}
+	return p.derive(Echo(output.String()).WithError(p.Error()))
+}
 
-	return p.EachLine(func(line string, out *strings.Builder) {
-		f, err := os.Open(line)
+// Glob reads a list of glob patterns from the pipe, one per line, conforming to
+// filepath.Match syntax (for example, `/var/log/*.log`), and returns a pipe
+// containing the paths matching each pattern, one per line. Patterns that
+// match nothing produce no output, like the shell's `nullglob` option. If a
+// pattern is malformed, the pipe's error status is set.
+func (p *Pipe) Glob() *Pipe {
+	return p.addStage("Glob").eachLine(func(line string, out *strings.Builder) {
+		matches, err := filepath.Glob(line)
 		if err != nil {
-			p.SetError(err)
+			p.SetError(fmt.Errorf("%q: %w", line, err))
 			return
 		}
-		defer f.Close()
+		for _, m := range matches {
+			out.WriteString(m)
+			out.WriteRune('\n')
+		}
+	})
+}
 
-		h := sha256.New()
-		if _, err := io.Copy(h, f); err != nil {
-			p.SetError(err)
-			return
+// GroupLines reads lines from the pipe, calls keyFn to get the key for each
+// line, and returns a pipe containing the same lines, rearranged so that all
+// lines with the same key are together. Groups appear in the order their keys
+// were first seen, and lines within each group keep their original order.
+func (p *Pipe) GroupLines(keyFn func(string) string) *Pipe {
+	if p == nil || p.Error() != nil {
+		return p
+	}
+	p.addStage("GroupLines")
+	var keys []string
+	groups := map[string][]string{}
+	p.eachLine(func(line string, out *strings.Builder) {
+		key := keyFn(line)
+		if _, ok := groups[key]; !ok {
+			keys = append(keys, key)
 		}
+		groups[key] = append(groups[key], line)
+	})
+	var output strings.Builder
+	for _, key := range keys {
+		for _, line := range groups[key] {
+			output.WriteString(line)
+			output.WriteRune('\n')
+		}
+	}
+	return p.derive(Echo(output.String()).WithError(p.Error()))
+}
 
-		out.WriteString(hex.EncodeToString(h.Sum(nil)[:]))
+// Hexdump reads binary data from the pipe, and returns a pipe containing a
+// hex dump of it in the style of Unix `xxd`: each line shows the offset of
+// up to 16 bytes, their values in hex, and the same bytes as ASCII, with
+// non-printable characters shown as dots. This is useful for inspecting
+// binary data from sources such as Dial or Exec. Output is produced as the
+// input is read, so large inputs need not fit in memory.
+func (p *Pipe) Hexdump() *Pipe {
+	if p == nil || p.Error() != nil {
+		return p
+	}
+	p.addStage("Hexdump")
+	input := p.Reader
+	pr, pw := io.Pipe()
+	goStage(func() {
+		w := bufio.NewWriter(pw)
+		chunk := make([]byte, 16)
+		offset := 0
+		for {
+			n, err := io.ReadFull(input, chunk)
+			if n > 0 {
+				writeHexdumpLine(w, offset, chunk[:n])
+				offset += n
+			}
+			if err == io.EOF || err == io.ErrUnexpectedEOF {
+				break
+			}
+			if err != nil {
+				pw.CloseWithError(err)
+				return
+			}
+		}
+		pw.CloseWithError(w.Flush())
+	})
+	return p.withReader(stageReader{pr, input})
+}
+
+// HistogramChart counts numbers from the pipe into buckets, exactly as for
+// Histogram, and returns a pipe containing a text bar chart of the counts,
+// with bars at most width characters long:
+//
+//	script.File("latency.txt").HistogramChart([]float64{10, 100, 1000}, 40).Stdout()
+//	// Output:
+//	//   <= 10 ████████████████████████████████████████ 402
+//	//  <= 100 ████████████ 118
+//	// <= 1000 █ 9
+//	//  > 1000 0
+func (p *Pipe) HistogramChart(buckets []float64, width int) *Pipe {
+	if p == nil || p.Error() != nil {
+		return p
+	}
+	p.addStage("HistogramChart")
+	counts, err := p.Histogram(buckets)
+	if err != nil {
+		return p
+	}
+	labels := make([]string, len(counts))
+	for i, b := range buckets {
+		labels[i] = "<= " + strconv.FormatFloat(b, 'g', -1, 64)
+	}
+	labels[len(buckets)] = "all"
+	if len(buckets) > 0 {
+		labels[len(buckets)] = "> " + strconv.FormatFloat(buckets[len(buckets)-1], 'g', -1, 64)
+	}
+	labelWidth, maxCount := 0, 0
+	for i, count := range counts {
+		labelWidth = max(labelWidth, len(labels[i]))
+		maxCount = max(maxCount, count)
+	}
+	var output strings.Builder
+	for i, count := range counts {
+		bar := ""
+		if count > 0 {
+			bar = strings.Repeat("█", max(1, count*width/maxCount)) + " "
+		}
+		fmt.Fprintf(&output, "%*s %s%d\n", labelWidth, labels[i], bar, count)
+	}
+	return p.derive(Echo(output.String()))
+}
+
+// ErrUnchanged is the error status set by IfChanged when the contents of the
+// pipe haven't changed since the last run.
+var ErrUnchanged = errors.New("unchanged")
+
+// IfChanged reads the whole contents of the pipe, and compares their SHA-256
+// hash with the one saved in the file statePath by an earlier run. If they're
+// the same, the pipe's error status is set to ErrUnchanged, so that later
+// stages, such as a slow Exec or a WriteFile, do nothing, just as make skips
+// targets that are up to date. Otherwise, it returns a pipe containing the
+// same contents. The new hash isn't saved until MarkDone is called, once the
+// rest of the pipeline has succeeded, so that a run that fails or is
+// interrupted doesn't count, and the next run tries again:
+//
+//	p := script.File("schema.sql").IfChanged(".schema.sha256").Exec("generate-models")
+//	_, err := p.WriteFile("models.go")
+//	switch {
+//	case errors.Is(err, script.ErrUnchanged):
+//		fmt.Println("models.go is up to date")
+//	case err == nil:
+//		err = p.MarkDone()
+//	}
+//
+// If statePath can't be read, the pipe's error status is set.
+func (p *Pipe) IfChanged(statePath string) *Pipe {
+	if p == nil || p.Error() != nil {
+		return p
+	}
+	p.addStage("IfChanged")
+	data, err := io.ReadAll(p.Reader)
+	if err != nil {
+		return p.WithError(err)
+	}
+	sum := sha256.Sum256(data)
+	hash := hex.EncodeToString(sum[:])
+	saved, err := os.ReadFile(statePath)
+	if err != nil && !os.IsNotExist(err) {
+		return p.WithError(err)
+	}
+	if strings.TrimSpace(string(saved)) == hash {
+		return p.WithError(ErrUnchanged)
+	}
+	p.changes = append(p.changes[:len(p.changes):len(p.changes)], change{statePath, hash})
+	return p.withReader(bytes.NewReader(data))
+}
+
+// InsertAfter reads from the pipe, and returns a new pipe containing the same
+// lines, plus s after each line that matches re, like `sed '/re/a text'`. If s
+// doesn't end with a newline, one is added. If there is an error reading the
+// pipe, the pipe's error status is also set.
+func (p *Pipe) InsertAfter(re *regexp.Regexp, s string) *Pipe {
+	p.addStage("InsertAfter")
+	s = asLines(s)
+	return p.eachLine(func(line string, out *strings.Builder) {
+		out.WriteString(line)
 		out.WriteRune('\n')
+		if re.MatchString(line) {
+			out.WriteString(s)
+		}
 	})
 }
+
+// Join reads the contents of the pipe, line by line, and joins them into a
+// single space-separated string. It returns a pipe containing this string. Any
+// terminating newline is preserved.
+func (p *Pipe) Join() *Pipe {
+	if p == nil || p.Error() != nil {
+		return p
+	}
+	p.addStage("Join")
+	result, err := p.String()
+	if err != nil {
+		return p
+	}
+	var terminator string
+	if strings.HasSuffix(result, "\n") {
+		terminator = "\n"
+		result = result[:len(result)-1]
+	}
+	output := strings.ReplaceAll(result, "\n", " ")
+	return p.derive(Echo(output + terminator))
+}
+
+// JSONCompact reads JSON from the pipe, and returns a pipe containing the same
+// JSON with all insignificant whitespace removed. The input can be a single
+// JSON document, or a sequence of documents such as newline-delimited JSON
+// (NDJSON), in which case each is written on its own line. If the input is
+// not valid JSON, the pipe's error status will be set.
+func (p *Pipe) JSONCompact() *Pipe {
+	return p.addStage("JSONCompact").eachJSONValue(json.Compact)
+}
+
+// JSONIndent reads JSON from the pipe, and returns a pipe containing the same
+// JSON reformatted with each element on its own line, beginning with prefix
+// and indented by one or more copies of indent, like `jq .`. The input can be
+// a single JSON document, or a sequence of documents such as
+// newline-delimited JSON (NDJSON), each of which is reformatted separately. If
+// the input is not valid JSON, the pipe's error status will be set.
+func (p *Pipe) JSONIndent(prefix, indent string) *Pipe {
+	return p.addStage("JSONIndent").eachJSONValue(func(dst *bytes.Buffer, src []byte) error {
+		return json.Indent(dst, src, prefix, indent)
+	})
+}
+
+// Last reads from the pipe, and returns a new pipe containing only the last N
+// lines. If there is an error reading the pipe, the pipe's error status is also
+// set.
+func (p *Pipe) Last(lines int) *Pipe {
+	if p == nil || p.Error() != nil || p.rejectBinary() {
+		return p
+	}
+	p.addStage("Last")
+	defer p.Close()
+	if lines <= 0 {
+		return p.derive(Echo(""))
+	}
+	scanner := bufio.NewScanner(p.Reader)
+	input := ring.New(lines)
+	for scanner.Scan() {
+		input.Value = scanner.Text()
+		input = input.Next()
+	}
+	output := strings.Builder{}
+	input.Do(func(p interface{}) {
+		value, ok := p.(string)
+		if ok {
+			output.WriteString(value)
+			output.WriteRune('\n')
+		}
+	})
+	err := scanner.Err()
+	if err != nil {
+		p.SetError(err)
+	}
+	return p.derive(Echo(output.String()).WithError(p.Error()))
+}
+
+// Logfmt reads lines in logfmt format (`key=value key2="quoted value"`), and
+// returns a pipe containing the same lines in a normalised form, with single
+// spaces between fields, and values quoted only where necessary. Lines that
+// don't contain any key=value pairs, such as stray plain-text messages, are
+// dropped. Use Field to extract a particular field:
+//
+//	script.File("app.log").Logfmt().Field("level").Freq()
+func (p *Pipe) Logfmt() *Pipe {
+	return p.addStage("Logfmt").eachLine(func(line string, out *strings.Builder) {
+		pairs := parseLogfmt(line)
+		if !strings.Contains(line, "=") || len(pairs) == 0 {
+			return
+		}
+		out.WriteString(formatLogfmt(pairs))
+		out.WriteRune('\n')
+	})
+}
+
+// Match reads from the pipe, and returns a new pipe containing only lines that
+// contain the specified string. Rather than examining every line, Match
+// searches large blocks of input for the string, so it's fast even on huge
+// inputs where few lines match. If there is an error reading the pipe, the
+// pipe's error status is also set.
+func (p *Pipe) Match(s string) *Pipe {
+	p.addStage("Match")
+	if s == "" || strings.ContainsAny(s, "\r\n") {
+		return p.eachLine(func(line string, out *strings.Builder) {
+			if strings.Contains(line, s) {
+				out.WriteString(line)
+				out.WriteRune('\n')
+			}
+		})
+	}
+	return p.matchBlocks([]byte(s), false)
+}
+
+// MatchAll reads from the pipe, and returns a new pipe containing only lines
+// that contain every one of the specified strings, in a single pass over the
+// input. If there is an error reading the pipe, the pipe's error status is
+// also set.
+func (p *Pipe) MatchAll(patterns ...string) *Pipe {
+	return p.addStage("MatchAll").eachLine(func(line string, out *strings.Builder) {
+		for _, s := range patterns {
+			if !strings.Contains(line, s) {
+				return
+			}
+		}
+		out.WriteString(line)
+		out.WriteRune('\n')
+	})
+}
+
+// MatchAllRegexp reads from the pipe, and returns a new pipe containing only
+// lines that match every one of the specified compiled regular expressions.
+// If there is an error reading the pipe, the pipe's error status is also set.
+func (p *Pipe) MatchAllRegexp(res ...*regexp.Regexp) *Pipe {
+	p.addStage("MatchAllRegexp")
+	for _, re := range res {
+		if re == nil { // to prevent SIGSEGV
+			return p.WithError(errors.New("nil regular expression"))
+		}
+	}
+	return p.eachLine(func(line string, out *strings.Builder) {
+		for _, re := range res {
+			if !re.MatchString(line) {
+				return
+			}
+		}
+		out.WriteString(line)
+		out.WriteRune('\n')
+	})
+}
+
+// MatchAny reads from the pipe, and returns a new pipe containing only lines
+// that contain at least one of the specified strings, in a single pass over
+// the input. If there is an error reading the pipe, the pipe's error status is
+// also set.
+func (p *Pipe) MatchAny(patterns ...string) *Pipe {
+	return p.addStage("MatchAny").eachLine(func(line string, out *strings.Builder) {
+		for _, s := range patterns {
+			if strings.Contains(line, s) {
+				out.WriteString(line)
+				out.WriteRune('\n')
+				return
+			}
+		}
+	})
+}
+
+// MatchAnyRegexp reads from the pipe, and returns a new pipe containing only
+// lines that match at least one of the specified compiled regular
+// expressions. If there is an error reading the pipe, the pipe's error status
+// is also set.
+func (p *Pipe) MatchAnyRegexp(res ...*regexp.Regexp) *Pipe {
+	p.addStage("MatchAnyRegexp")
+	for _, re := range res {
+		if re == nil { // to prevent SIGSEGV
+			return p.WithError(errors.New("nil regular expression"))
+		}
+	}
+	return p.eachLine(func(line string, out *strings.Builder) {
+		for _, re := range res {
+			if re.MatchString(line) {
+				out.WriteString(line)
+				out.WriteRune('\n')
+				return
+			}
+		}
+	})
+}
+
+// MatchFold is like Match, but ignores case, so that, for example,
+// MatchFold("error") matches lines containing "ERROR" or "Error". If s
+// contains only ASCII characters, only ASCII letters are folded, which is much
+// faster; otherwise, Unicode simple case folding is used, as for the (?i) flag
+// in regular expressions, so that each character matches only characters
+// that fold to it one for one ("ß" doesn't match "SS", for example).
+func (p *Pipe) MatchFold(s string) *Pipe {
+	p.addStage("MatchFold")
+	if s == "" || strings.ContainsAny(s, "\r\n") || !isASCII(s) {
+		return p.matchRegexp(regexp.MustCompile("(?i)" + regexp.QuoteMeta(s)))
+	}
+	return p.matchBlocks(asciiLower(nil, []byte(s)), true)
+}
+
+// MatchRegexp reads from the pipe, and returns a new pipe containing only lines
+// that match the specified compiled regular expression. If there is an error
+// reading the pipe, the pipe's error status is also set.
+func (p *Pipe) MatchRegexp(re *regexp.Regexp) *Pipe {
+	p.addStage("MatchRegexp")
+	if re == nil { // to prevent SIGSEGV
+		return p.WithError(errors.New("nil regular expression"))
+	}
+	return p.matchRegexp(re)
+}
+
+// MkdirAllEach reads a list of directory paths from the pipe, one per line, and
+// creates each directory, along with any missing parents, with permissions
+// `mode` (before umask), like Unix `mkdir -p`. Directories that already exist
+// are left alone. It returns a pipe containing the path of each directory, one
+// per line. If the pipe is in dry-run mode (see DryRun), it lists the
+// directories without creating them. If any directory can't be created, the
+// remaining directories are still processed, and then the pipe's error status
+// is set to an error listing every failure.
+func (p *Pipe) MkdirAllEach(mode os.FileMode) *Pipe {
+	return p.addStage("MkdirAllEach").eachFile(func(path string) (string, error) {
+		if p.dryRun {
+			return path, nil
+		}
+		return path, os.MkdirAll(path, mode)
+	})
+}
+
+// MoveFilesTo reads a list of file paths from the pipe, one per line, and moves
+// each file into the directory `dir`, keeping its name, like Unix `mv`. Files
+// can be moved between filesystems, in which case they're copied and then
+// removed. It returns a pipe containing the new path of each file, one per
+// line. If the pipe is in dry-run mode (see DryRun), it lists the new paths
+// that the files would have, without moving them. If any file can't be moved,
+// the remaining files are still processed, and then the pipe's error status
+// is set to an error listing every failure.
+func (p *Pipe) MoveFilesTo(dir string) *Pipe {
+	return p.addStage("MoveFilesTo").eachFile(func(path string) (string, error) {
+		dst := filepath.Join(dir, filepath.Base(path))
+		if p.dryRun {
+			_, err := os.Lstat(path)
+			return dst, err
+		}
+		err := os.Rename(path, dst)
+		if !errors.Is(err, syscall.EXDEV) {
+			return dst, err
+		}
+		// Rename can't move files between filesystems, so copy instead.
+		if err := copyFile(path, dst); err != nil {
+			return "", err
+		}
+		return dst, os.Remove(path)
+	})
+}
+
+// PingEach reads a list of hostnames or IP addresses from the pipe, one per
+// line, and sends an ICMP echo request ('ping') to each of them, waiting at
+// most `timeout` for a reply. The pings run concurrently. It returns a pipe
+// containing one line per input line, in the same order, consisting of the
+// host followed by `up` and the round-trip time, or by `down`, like this:
+//
+//	example.com up 11.503ms
+//	10.0.0.1 down
+//
+// PingEach doesn't need the external `ping` command, but it does need
+// permission to send ICMP packets. On Linux, this means either running as root
+// or being in a group listed in `net.ipv4.ping_group_range`. If ICMP isn't
+// available, or there is an error reading the pipe, the pipe's error status is
+// set.
+func (p *Pipe) PingEach(timeout time.Duration) *Pipe {
+	return p.addStage("PingEach").eachLineConcurrently(func(host string) (string, error) {
+		rtt, err := ping(host, timeout)
+		if err == errICMPUnavailable {
+			return "", err
+		}
+		if err != nil {
+			return host + " down", nil
+		}
+		return fmt.Sprintf("%s up %s", host, rtt), nil
+	})
+}
+
+// Prepend returns a pipe containing s, such as a header, followed by the
+// contents of the pipe. If s doesn't end with a newline, one is added. The
+// contents are streamed, not read into memory.
+func (p *Pipe) Prepend(s string) *Pipe {
+	if p == nil || p.Error() != nil {
+		return p
+	}
+	p.addStage("Prepend")
+	return p.withReader(multiReader{io.MultiReader(strings.NewReader(asLines(s)), p.Reader), []io.Closer{p.Reader}})
+}
+
+// PrependPipe is like AppendPipe, but returns a pipe containing the contents of
+// q, followed by the contents of the pipe.
+func (p *Pipe) PrependPipe(q *Pipe) *Pipe {
+	if p == nil || p.Error() != nil || q == nil {
+		return p
+	}
+	p.addStage("PrependPipe")
+	if q.Error() != nil {
+		return p.WithError(q.Error())
+	}
+	return p.withReader(multiReader{io.MultiReader(q.Reader, p.Reader), []io.Closer{q.Reader, p.Reader}}).withStageInputs(q)
+}
+
+// Range reads from the pipe, and returns a new pipe containing only lines
+// fromLine to toLine inclusive, numbering lines from 1, like Unix
+// `sed -n 'from,to p'`. If toLine is zero or negative, the range runs to the
+// end of the input. Range stops reading and closes the pipe after toLine. If
+// there is an error reading the pipe, the pipe's error status is also set.
+func (p *Pipe) Range(fromLine, toLine int) *Pipe {
+	if p == nil || p.Error() != nil || p.rejectBinary() {
+		return p
+	}
+	p.addStage("Range")
+	defer p.Close()
+	scanner := bufio.NewScanner(p.Reader)
+	output := strings.Builder{}
+	for n := 1; toLine <= 0 || n <= toLine; n++ {
+		if !scanner.Scan() {
+			break
+		}
+		if n >= fromLine {
+			output.WriteString(scanner.Text())
+			output.WriteRune('\n')
+		}
+	}
+	err := scanner.Err()
+	if err != nil {
+		p.SetError(err)
+	}
+	return p.derive(Echo(output.String()).WithError(p.Error()))
+}
+
+// ReformatTime reads lines from the pipe that contain a timestamp in the
+// given column, in the format specified by inLayout (as for time.Parse), and
+// returns a pipe containing the same lines with the timestamp rewritten in
+// the format specified by outLayout. Columns are numbered and delimited as for
+// Column; if inLayout contains spaces, the timestamp spans the corresponding
+// number of columns. The rest of each line is left unchanged, as are any
+// lines without a valid timestamp.
+//
+//	script.File("access.log").ReformatTime("[02/Jan/2006:15:04:05 -0700]", time.RFC3339, 4)
+func (p *Pipe) ReformatTime(inLayout, outLayout string, column int) *Pipe {
+	return p.addStage("ReformatTime").eachLine(func(line string, out *strings.Builder) {
+		t, start, end, ok := timeColumn(line, inLayout, column)
+		if ok {
+			line = line[:start] + t.Format(outLayout) + line[end:]
+		}
+		out.WriteString(line)
+		out.WriteRune('\n')
+	})
+}
+
+// Reject reads from the pipe, and returns a new pipe containing only lines
+// that do not contain the specified string. If there is an error reading the
+// pipe, the pipe's error status is also set.
+func (p *Pipe) Reject(s string) *Pipe {
+	return p.addStage("Reject").eachLine(func(line string, out *strings.Builder) {
+		if !strings.Contains(line, s) {
+			out.WriteString(line)
+			out.WriteRune('\n')
+		}
+	})
+}
+
+// RejectRegexp reads from the pipe, and returns a new pipe containing only
+// lines that don't match the specified compiled regular expression. If there
+// is an error reading the pipe, the pipe's error status is also set.
+func (p *Pipe) RejectRegexp(re *regexp.Regexp) *Pipe {
+	p.addStage("RejectRegexp")
+	if re == nil { // to prevent SIGSEGV
+		return p.WithError(errors.New("nil regular expression"))
+	}
+	return p.eachLine(func(line string, out *strings.Builder) {
+		if !re.MatchString(line) {
+			out.WriteString(line)
+			out.WriteRune('\n')
+		}
+	})
+}
+
+// RemoveFiles reads a list of file paths from the pipe, one per line, and
+// removes each file, like Unix `rm`. Directories are only removed if they're
+// empty. It returns a pipe containing the path of each removed file, one per
+// line. If the pipe is in dry-run mode (see DryRun), it lists the files that
+// would be removed, without removing them. If any file can't be removed, the
+// remaining files are still processed, and then the pipe's error status is
+// set to an error listing every failure.
+func (p *Pipe) RemoveFiles() *Pipe {
+	return p.addStage("RemoveFiles").eachFile(func(path string) (string, error) {
+		if p.dryRun {
+			_, err := os.Lstat(path)
+			return path, err
+		}
+		return path, os.Remove(path)
+	})
+}
+
+// Replace filters its input by replacing all occurrences of the string `search`
+// with the string `replace`. If there is an error reading the pipe, the pipe's
+// error status is also set.
+func (p *Pipe) Replace(search, replace string) *Pipe {
+	return p.addStage("Replace").eachLine(func(line string, out *strings.Builder) {
+		out.WriteString(strings.ReplaceAll(line, search, replace))
+		out.WriteRune('\n')
+	})
+}
+
+// ReplaceRegexp filters its input by replacing all matches of the compiled
+// regular expression `re` with the replacement string `replace`. Inside
+// `replace`, $ signs are interpreted as in regexp.Expand, so for instance "$1"
+// represents the text of the first submatch. If there is an error reading the
+// pipe, the pipe's error status is also set.
+func (p *Pipe) ReplaceRegexp(re *regexp.Regexp, replace string) *Pipe {
+	p.addStage("ReplaceRegexp")
+	if re == nil { // to prevent SIGSEGV
+		return p.WithError(errors.New("nil regular expression"))
+	}
+	return p.eachLine(func(line string, out *strings.Builder) {
+		out.WriteString(re.ReplaceAllString(line, replace))
+		out.WriteRune('\n')
+	})
+}
+
+// ReverseHexdump reads a hex dump in the format produced by Hexdump (or Unix
+// `xxd`) from the pipe, and returns a pipe containing the original binary
+// data, like `xxd -r`. Any gaps between the offsets of successive lines are
+// filled with zero bytes. If a line isn't in hex dump format, or its offset
+// is lower than that of the data already produced, the pipe's error status
+// will be set.
+func (p *Pipe) ReverseHexdump() *Pipe {
+	if p == nil || p.Error() != nil {
+		return p
+	}
+	p.addStage("ReverseHexdump")
+	offset := int64(0)
+	return p.eachLine(func(line string, out *strings.Builder) {
+		if p.Error() != nil || strings.TrimSpace(line) == "" {
+			return
+		}
+		data, lineOffset, err := parseHexdumpLine(line)
+		if err != nil {
+			p.SetError(err)
+			return
+		}
+		if lineOffset < offset {
+			p.SetError(fmt.Errorf("hex dump offset %08x out of sequence in %q", lineOffset, line))
+			return
+		}
+		for ; offset < lineOffset; offset++ {
+			out.WriteByte(0)
+		}
+		out.Write(data)
+		offset += int64(len(data))
+	})
+}
+
+// SHA256Sums reads a list of file paths from the pipe, one per line, and
+// returns a pipe that contains the SHA-256 checksum of each pathname. If there
+// are any errors (for example, non-existent files), the pipe's error status
+// will be set to the first error encountered, but execution will continue.
+func (p *Pipe) SHA256Sums() *Pipe {
+	if p == nil || p.Error() != nil {
+		return p
+	}
+	p.addStage("SHA256Sums")
+
+	return p.eachLine(func(line string, out *strings.Builder) {
+		f, err := os.Open(line)
+		if err != nil {
+			p.SetError(err)
+			return
+		}
+		defer f.Close()
+
+		h := sha256.New()
+		if _, err := io.Copy(h, f); err != nil {
+			p.SetError(err)
+			return
+		}
+
+		out.WriteString(hex.EncodeToString(h.Sum(nil)[:]))
+		out.WriteRune('\n')
+	})
+}
+
+// SortIP reads IP addresses from the pipe, one per line, and returns a pipe
+// containing them sorted in numerical order, with IPv4 addresses before IPv6.
+// Lines that aren't IP addresses are placed after all the addresses, in their
+// original order.
+func (p *Pipe) SortIP() *Pipe {
+	if p == nil || p.Error() != nil {
+		return p
+	}
+	p.addStage("SortIP")
+	type ipLine struct {
+		line string
+		addr netip.Addr
+	}
+	var lines []ipLine
+	p.eachLine(func(line string, out *strings.Builder) {
+		addr, _ := netip.ParseAddr(strings.TrimSpace(line))
+		lines = append(lines, ipLine{line, addr})
+	})
+	sort.SliceStable(lines, func(i, j int) bool {
+		a, b := lines[i].addr, lines[j].addr
+		if !a.IsValid() || !b.IsValid() {
+			return a.IsValid() && !b.IsValid()
+		}
+		return a.Less(b)
+	})
+	var output strings.Builder
+	for _, l := range lines {
+		output.WriteString(l.line)
+		output.WriteRune('\n')
+	}
+	return p.derive(Echo(output.String()).WithError(p.Error()))
+}
+
+// DefaultStatFormat is the format Stat uses when none is specified, similar to
+// the output of `ls -l`.
+const DefaultStatFormat = `{{.Mode}} {{.Owner}} {{.Group}} {{.Size}} {{.ModTime.Format "2006-01-02T15:04:05Z07:00"}} {{.Path}}`
+
+// FileStat describes a file, for use in Stat templates.
+type FileStat struct {
+	// Path is the path of the file, as read from the pipe.
+	Path string
+	// Name is the base name of the file.
+	Name string
+	// Size is the size of the file in bytes.
+	Size int64
+	// Mode is the file's mode and permission bits.
+	Mode os.FileMode
+	// ModTime is the time the file was last modified.
+	ModTime time.Time
+	// Owner and Group are the names of the user and group that own the file,
+	// or their numeric IDs if the names can't be found. They're empty on
+	// platforms that don't support file ownership, such as Windows.
+	Owner, Group string
+	// IsDir is true if the file is a directory.
+	IsDir bool
+}
+
+// Stat reads a list of file paths from the pipe, one per line, and returns a
+// pipe containing information about each file, one per line. The format
+// string is interpreted as a Go template, executed with a FileStat for each
+// file, so `{{.Size}} {{.Path}}` will produce the size and path of each file,
+// for example. If the format is empty, DefaultStatFormat is used. If a file
+// can't be examined (for example, because it doesn't exist), or the format is
+// invalid, the pipe's error status is set.
+func (p *Pipe) Stat(format string) *Pipe {
+	if p == nil || p.Error() != nil {
+		return p
+	}
+	p.addStage("Stat")
+	if format == "" {
+		format = DefaultStatFormat
+	}
+	tpl, err := template.New("").Parse(format)
+	if err != nil {
+		return p.WithError(err)
+	}
+	return p.eachLine(func(line string, out *strings.Builder) {
+		info, err := os.Stat(line)
+		if err != nil {
+			p.SetError(err)
+			return
+		}
+		owner, group := fileOwner(info)
+		err = tpl.Execute(out, FileStat{
+			Path:    line,
+			Name:    info.Name(),
+			Size:    info.Size(),
+			Mode:    info.Mode(),
+			ModTime: info.ModTime(),
+			Owner:   owner,
+			Group:   group,
+			IsDir:   info.IsDir(),
+		})
+		if err != nil {
+			p.SetError(err)
+			return
+		}
+		out.WriteRune('\n')
+	})
+}
+
+// StreamExec is like Exec, but always runs the command in streaming mode (see
+// Stream), whether or not the pipe is in streaming mode itself. Neither the
+// command's input nor its output is ever buffered in full: the contents of the
+// pipe are fed to the command as they're read, and the command's output can be
+// read as soon as it's written. This means StreamExec works live, even on
+// input that never ends:
+//
+//	script.Stdin().StreamExec("grep --line-buffered ERROR").Stdout()
+//
+// Only this command is streamed: the returned pipe has the same mode as p.
+func (p *Pipe) StreamExec(cmdLine string) *Pipe {
+	defer p.removeTempFiles()
+	if p == nil || p.Error() != nil {
+		return p
+	}
+	p.addStage("StreamExec")
+	stream := p.stream
+	p.stream = true
+	q := p.exec(cmdLine, p.stdinReader())
+	p.stream = stream
+	q.stream = stream
+	return q
+}
+
+// Strings reads arbitrary binary data from the pipe, and returns a pipe
+// containing each run of at least minLen printable ASCII characters, one per
+// line, like Unix `strings`. This is useful for finding text such as messages
+// or paths inside binaries and core files. If minLen is zero or negative, the
+// `strings` default of 4 is used. Output is produced as the input is read, so
+// large inputs need not fit in memory.
+func (p *Pipe) Strings(minLen int) *Pipe {
+	if p == nil || p.Error() != nil {
+		return p
+	}
+	p.addStage("Strings")
+	if minLen <= 0 {
+		minLen = 4
+	}
+	input := p.Reader
+	pr, pw := io.Pipe()
+	goStage(func() {
+		r := bufio.NewReader(input)
+		w := bufio.NewWriter(pw)
+		var run []byte
+		flush := func() {
+			if len(run) >= minLen {
+				w.Write(run)
+				w.WriteByte('\n')
+			}
+			run = run[:0]
+		}
+		for {
+			c, err := r.ReadByte()
+			if err != nil {
+				flush()
+				if err == io.EOF {
+					err = w.Flush()
+				}
+				pw.CloseWithError(err)
+				return
+			}
+			if c == '\t' || (' ' <= c && c <= '~') {
+				run = append(run, c)
+				continue
+			}
+			flush()
+		}
+	})
+	return p.withReader(stageReader{pr, input})
+}
+
+// StripNames removes the file name prefixes added by ConcatWithNames (or by
+// `grep -H`) from each line of input: that is, everything up to and including
+// the first colon. Lines without a colon are unchanged. Because only the first
+// colon is significant, this doesn't work for file names that contain colons.
+func (p *Pipe) StripNames() *Pipe {
+	return p.addStage("StripNames").eachLine(func(line string, out *strings.Builder) {
+		_, rest, found := strings.Cut(line, ":")
+		if !found {
+			rest = line
+		}
+		out.WriteString(rest)
+		out.WriteByte('\n')
+	})
+}
+
+// Timestamp returns a pipe containing each line of input prefixed with the
+// time it passed through the filter, formatted according to layout, and a
+// space, like `ts` from moreutils. If layout is empty, the `ts` default format
+// "Jan 02 15:04:05" is used. Lines are passed on as they're read, so in
+// Stream mode the timestamps show when each line was actually produced, which
+// is useful for measuring the latency of long-running pipelines.
+func (p *Pipe) Timestamp(layout string) *Pipe {
+	p.addStage("Timestamp")
+	if layout == "" {
+		layout = "Jan 02 15:04:05"
+	}
+	return p.streamLines(func(line string) (string, bool) {
+		return time.Now().Format(layout) + " " + line, true
+	})
+}
+
+// ToPrometheus reads lines of the form "label value" (or just "value"), and
+// returns a pipe containing the equivalent samples of a gauge named
+// metricName, in the Prometheus text exposition format. Every sample has the
+// given labels. The first column of each line, if there are two, is used as
+// the value of any label whose value in labels is empty, or else of a label
+// named "label". For example:
+//
+//	script.Exec("df --output=target,pcent").ToPrometheus("disk_used_percent", map[string]string{"mount": ""})
+//
+// The result can be written to a file for the node exporter's textfile
+// collector, or sent with Pushgateway. If the metric name or any label name is
+// invalid, or any value is not a number, the pipe's error status will be set.
+func (p *Pipe) ToPrometheus(metricName string, labels map[string]string) *Pipe {
+	if p == nil || p.Error() != nil {
+		return p
+	}
+	p.addStage("ToPrometheus")
+	if !metricNamePattern.MatchString(metricName) {
+		return p.WithError(fmt.Errorf("invalid metric name %q", metricName))
+	}
+	names := make([]string, 0, len(labels))
+	var slots []string
+	for name, value := range labels {
+		names = append(names, name)
+		if value == "" {
+			slots = append(slots, name)
+		}
+	}
+	if len(slots) == 0 {
+		slots = []string{"label"}
+		names = append(names, "label")
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		if !labelNamePattern.MatchString(name) {
+			return p.WithError(fmt.Errorf("invalid label name %q", name))
+		}
+	}
+	q := p.eachLine(func(line string, out *strings.Builder) {
+		fields := strings.Fields(line)
+		if len(fields) == 0 {
+			return
+		}
+		value := fields[len(fields)-1]
+		if _, err := strconv.ParseFloat(value, 64); err != nil {
+			p.SetError(fmt.Errorf("invalid metric value %q", value))
+			return
+		}
+		sample := map[string]string{}
+		for name, v := range labels {
+			sample[name] = v
+		}
+		if len(fields) > 1 {
+			for _, name := range slots {
+				sample[name] = strings.Join(fields[:len(fields)-1], " ")
+			}
+		}
+		var pairs []string
+		for _, name := range names {
+			if sample[name] != "" {
+				pairs = append(pairs, fmt.Sprintf(`%s="%s"`, name, labelValueEscaper.Replace(sample[name])))
+			}
+		}
+		out.WriteString(metricName)
+		if len(pairs) > 0 {
+			fmt.Fprintf(out, "{%s}", strings.Join(pairs, ","))
+		}
+		fmt.Fprintf(out, " %s\n", value)
+	})
+	if q.Error() != nil {
+		return q
+	}
+	samples, _ := q.String()
+	return p.derive(Echo(fmt.Sprintf("# TYPE %s gauge\n%s", metricName, samples)))
+}
+
+// TouchEach reads a list of file paths from the pipe, one per line, and sets
+// the access and modification times of each file to the current time,
+// creating it (empty) if it doesn't exist, like Unix `touch`. It returns a
+// pipe containing the path of each file, one per line. If the pipe is in
+// dry-run mode (see DryRun), it lists the files without touching them. If any
+// file can't be touched, the remaining files are still processed, and then the
+// pipe's error status is set to an error listing every failure.
+func (p *Pipe) TouchEach() *Pipe {
+	return p.addStage("TouchEach").eachFile(func(path string) (string, error) {
+		if p.dryRun {
+			return path, nil
+		}
+		now := time.Now()
+		err := os.Chtimes(path, now, now)
+		if !os.IsNotExist(err) {
+			return path, err
+		}
+		f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE, 0666)
+		if err != nil {
+			return path, err
+		}
+		return path, f.Close()
+	})
+}
+
+// URLDecode decodes each line of input that was encoded by URLEncode (or as a
+// URL query component, with `%XX` escapes and `+` for spaces), and returns a
+// pipe containing the decoded lines. If any line is not validly encoded, the
+// pipe's error status will be set.
+func (p *Pipe) URLDecode() *Pipe {
+	if p == nil || p.Error() != nil {
+		return p
+	}
+	return p.addStage("URLDecode").eachLine(func(line string, out *strings.Builder) {
+		decoded, err := url.QueryUnescape(line)
+		if err != nil {
+			p.SetError(err)
+			return
+		}
+		out.WriteString(decoded)
+		out.WriteRune('\n')
+	})
+}
+
+// URLEncode encodes each line of input so that it can safely be used as a URL
+// query component, and returns a pipe containing the encoded lines.
+func (p *Pipe) URLEncode() *Pipe {
+	return p.addStage("URLEncode").eachLine(func(line string, out *strings.Builder) {
+		out.WriteString(url.QueryEscape(line))
+		out.WriteRune('\n')
+	})
+}
+
+// URLParts parses each line of input as a URL, and returns a pipe containing
+// the specified part of each one. The part can be "scheme", "user", "host"
+// (including any port), "hostname", "port", "path", "query", or "fragment".
+// To get the value of a particular query parameter, use "query." followed by
+// its name, as in "query.id". Parts missing from the URL produce empty lines.
+// If the part name is not recognised, or any line can't be parsed, the pipe's
+// error status will be set.
+func (p *Pipe) URLParts(part string) *Pipe {
+	if p == nil || p.Error() != nil {
+		return p
+	}
+	p.addStage("URLParts")
+	get, ok := urlParts[part]
+	if param, isParam := strings.CutPrefix(part, "query."); isParam {
+		get, ok = func(u *url.URL) string { return u.Query().Get(param) }, true
+	}
+	if !ok {
+		return p.WithError(fmt.Errorf("unknown URL part %q", part))
+	}
+	return p.eachLine(func(line string, out *strings.Builder) {
+		u, err := url.Parse(line)
+		if err != nil {
+			p.SetError(err)
+			return
+		}
+		out.WriteString(get(u))
+		out.WriteRune('\n')
+	})
+}
+
+// YQ reads the whole contents of the pipe as YAML, and returns a pipe
+// containing the value at the given path in each document, like the `yq`
+// tool. A path is a series of map keys, each preceded by a dot, and array
+// indexes in brackets; `[]` selects every element of an array. For example:
+//
+//	script.File("deployment.yaml").YQ(".spec.template.spec.containers[].image")
+//
+// The path `.` selects the whole document. Scalar values are written as plain
+// text, one per line, and maps and arrays are re-encoded as YAML. A path that
+// doesn't exist in the document produces `null`. If the input can't be
+// parsed, or the path is invalid, the pipe's error status will be set.
+func (p *Pipe) YQ(path string) *Pipe {
+	if p == nil || p.Error() != nil {
+		return p
+	}
+	p.addStage("YQ")
+	steps, err := parsePath(path)
+	if err != nil {
+		return p.WithError(err)
+	}
+	buf := &bytes.Buffer{}
+	dec := yaml.NewDecoder(p.Reader)
+	for {
+		var doc any
+		err := dec.Decode(&doc)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return p.WithError(err)
+		}
+		values, err := queryPath(doc, steps)
+		if err != nil {
+			return p.WithError(err)
+		}
+		for _, v := range values {
+			if err := writeQueryValue(buf, v, yaml.Marshal); err != nil {
+				return p.WithError(err)
+			}
+		}
+	}
+	return p.withReader(buf)
+}
+
+// appendReader reads from its input, followed by tail, adding a newline
+// before tail if the input doesn't end with one. Closing it closes the input.
+type appendReader struct {
+	input io.ReadCloser
+	tail  string
+	last  byte
+	rest  io.Reader
+}
+
+// Close closes the input.
+func (r *appendReader) Close() error {
+	return r.input.Close()
+}
+
+// Read reads the input, and then the tail.
+func (r *appendReader) Read(buf []byte) (int, error) {
+	if r.rest != nil {
+		return r.rest.Read(buf)
+	}
+	n, err := r.input.Read(buf)
+	if n > 0 {
+		r.last = buf[n-1]
+	}
+	if err != io.EOF {
+		return n, err
+	}
+	if r.last != '\n' {
+		r.tail = "\n" + r.tail
+	}
+	r.rest = strings.NewReader(r.tail)
+	if n > 0 {
+		return n, nil
+	}
+	return r.rest.Read(buf)
+}
+
+// asLines returns s with a terminating newline added, unless it's empty or
+// already has one.
+func asLines(s string) string {
+	if s == "" || strings.HasSuffix(s, "\n") {
+		return s
+	}
+	return s + "\n"
+}
+
+// asciiLower appends a copy of src to dst, with ASCII letters converted to
+// lower case, and returns the result. Unlike bytes.ToLower, it never changes
+// the length of the data.
+func asciiLower(dst, src []byte) []byte {
+	for _, c := range src {
+		if 'A' <= c && c <= 'Z' {
+			c += 'a' - 'A'
+		}
+		dst = append(dst, c)
+	}
+	return dst
+}
+
+// between returns the blocks of lines from startRe to endRe, as for Between,
+// with or without the lines matching the patterns, depending on inclusive.
+func (p *Pipe) between(startRe, endRe *regexp.Regexp, inclusive bool) *Pipe {
+	inBlock := false
+	return p.eachLine(func(line string, out *strings.Builder) {
+		edge := false
+		if !inBlock && startRe.MatchString(line) {
+			inBlock, edge = true, true
+		}
+		if !inBlock {
+			return
+		}
+		if endRe.MatchString(line) {
+			inBlock, edge = false, true
+		}
+		if inclusive || !edge {
+			out.WriteString(line)
+			out.WriteRune('\n')
+		}
+	})
+}
+
+// bloomFilter is a fixed-size probabilistic set of strings.
+type bloomFilter struct {
+	bits   []uint64
+	hashes uint64
+}
+
+// add adds s to the filter, and reports whether it was (probably) absent
+// before.
+func (b *bloomFilter) add(s string) bool {
+	h := fnv.New64a()
+	h.Write([]byte(s))
+	h1 := h.Sum64()
+	h2 := h1>>33 | h1<<31 | 1
+	size := uint64(len(b.bits)) * 64
+	added := false
+	for i := uint64(0); i < b.hashes; i++ {
+		bit := (h1 + i*h2) % size
+		word, mask := bit/64, uint64(1)<<(bit%64)
+		if b.bits[word]&mask == 0 {
+			b.bits[word] |= mask
+			added = true
+		}
+	}
+	return added
+}
+
+// bufferLines reads all the lines of input, replaces the pipe's reader with
+// one that reads the same lines again, and returns the number of lines.
+func (p *Pipe) bufferLines() (int, error) {
+	lines, err := p.Slice()
+	if err != nil {
+		return 0, err
+	}
+	input := strings.Builder{}
+	for _, line := range lines {
+		input.WriteString(line)
+		input.WriteRune('\n')
+	}
+	p.Reader = NewReadAutoCloser(strings.NewReader(input.String()))
+	return len(lines), nil
+}
+
+// cappedBuffer collects the output of a command, keeping at most max bytes of
+// it, if max is positive. Once the limit is exceeded, further output is
+// discarded, or, if fail is true, Write returns ErrOutputTooLarge.
+type cappedBuffer struct {
+	buf       bytes.Buffer
+	max       int64
+	fail      bool
+	truncated bool
+}
+
+// Write appends as much of data to the buffer as the limit allows.
+func (b *cappedBuffer) Write(data []byte) (int, error) {
+	room := b.max - int64(b.buf.Len())
+	if b.max <= 0 || int64(len(data)) <= room {
+		return b.buf.Write(data)
+	}
+	b.truncated = true
+	b.buf.Write(data[:room])
+	if b.fail {
+		return int(room), ErrOutputTooLarge
+	}
+	return len(data), nil
+}
+
+// checkpoint records, in a file, which input lines a batch stage such as
+// ExecForEach has processed, so that an interrupted run can resume where it
+// left off (see [Pipe.WithCheckpoint]). Each line of the file contains the
+// number of an input line, and the SHA-256 hash of its contents, so that a
+// line is only skipped if it's unchanged.
+type checkpoint struct {
+	mu   sync.Mutex
+	path string
+	file *os.File
+	done map[int]string
+}
+
+// openCheckpoint reads the lines already processed from the checkpoint file at
+// path, if it exists, and opens it to record more.
+func openCheckpoint(path string) (*checkpoint, error) {
+	c := &checkpoint{path: path, done: map[int]string{}}
+	data, err := os.ReadFile(path)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	for _, line := range strings.Split(string(data), "\n") {
+		index, hash, ok := strings.Cut(line, " ")
+		n, err := strconv.Atoi(index)
+		// A line cut short by a crash is ignored.
+		if !ok || err != nil || len(hash) != sha256.Size*2 {
+			continue
+		}
+		c.done[n] = hash
+	}
+	c.file, err = os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0o644)
+	if err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+func checkpointHash(line string) string {
+	sum := sha256.Sum256([]byte(line))
+	return hex.EncodeToString(sum[:])
+}
+
+// processed reports whether input line number index, containing line, was
+// processed by an earlier run.
+func (c *checkpoint) processed(index int, line string) bool {
+	if c == nil {
+		return false
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.done[index] == checkpointHash(line)
+}
+
+// record records that input line number index, containing line, has been
+// processed.
+func (c *checkpoint) record(index int, line string) error {
+	if c == nil {
+		return nil
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	_, err := fmt.Fprintf(c.file, "%d %s\n", index, checkpointHash(line))
+	return err
+}
+
+// finish closes the checkpoint file, and, if the run is complete, removes it,
+// so that the next run starts afresh.
+func (c *checkpoint) finish(complete bool) {
+	if c == nil {
+		return
+	}
+	c.file.Close()
+	if complete {
+		os.Remove(c.path)
+	}
+}
+
+// maxConcurrentChecks is the maximum number of network checks that
+// eachLineConcurrently will run at once.
+const maxConcurrentChecks = 64
+
+// closeAll closes each of the supplied files, ignoring any errors.
+func closeAll(files []*os.File) {
+	for _, f := range files {
+		f.Close()
+	}
+}
+
+// confirmPreview is ConfirmPreview, or Confirm, once its stage is recorded.
+func (p *Pipe) confirmPreview(prompt string, lines int) *Pipe {
+	if p == nil || p.Error() != nil {
+		return p
+	}
+	contents, err := p.Slice()
+	if err != nil {
+		return p
+	}
+	out := p.stderr
+	if out == nil {
+		out = ioutil.Discard
+	}
+	for i := 0; i < lines && i < len(contents); i++ {
+		fmt.Fprintln(out, contents[i])
+	}
+	if lines > 0 && len(contents) > lines {
+		fmt.Fprintf(out, "... (%d more lines)\n", len(contents)-lines)
+	}
+	fmt.Fprintf(out, "%s [y/N] ", prompt)
+	in := p.stdin
+	if in == nil {
+		in = os.Stdin
+	}
+	answer, err := bufio.NewReader(in).ReadString('\n')
+	if err != nil && err != io.EOF {
+		return p.WithError(err)
+	}
+	switch strings.ToLower(strings.TrimSpace(answer)) {
+	case "y", "yes":
+		if len(contents) == 0 {
+			return p.derive(Echo(""))
+		}
+		return p.derive(Slice(contents))
+	}
+	return p.WithError(ErrNotConfirmed)
+}
+
+// connectPipeline connects the standard output of each command in cmds to the
+// standard input of the next, the standard output of the last command to out,
+// and the standard error of all of them to stderr. It returns the parent's
+// copies of the connecting pipes, which the caller must close once the
+// commands have started.
+func connectPipeline(cmds []*exec.Cmd, out *os.File, stderr io.Writer) ([]*os.File, error) {
+	if _, ok := stderr.(*os.File); !ok && stderr != nil && len(cmds) > 1 {
+		// Each command copies its standard error to a writer that isn't a
+		// file in its own goroutine, so they mustn't write at once.
+		stderr = &lockedWriter{w: stderr}
+	}
+	var files []*os.File
+	for i, cmd := range cmds {
+		cmd.Stderr = stderr
+		if i == len(cmds)-1 {
+			cmd.Stdout = out
+			break
+		}
+		r, w, err := os.Pipe()
+		if err != nil {
+			return files, err
+		}
+		cmd.Stdout = w
+		cmds[i+1].Stdin = r
+		files = append(files, r, w)
+	}
+	return files, nil
+}
+
+// copyFile copies the regular file src to dst, with the same permissions. It
+// refuses to copy a file onto itself, which would truncate it, and if the copy
+// fails part way through, it removes the incomplete dst.
+func copyFile(src, dst string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	info, err := in.Stat()
+	if err != nil {
+		return err
+	}
+	if !info.Mode().IsRegular() {
+		return fmt.Errorf("%s: not a regular file", src)
+	}
+	if dstInfo, err := os.Stat(dst); err == nil && os.SameFile(info, dstInfo) {
+		return fmt.Errorf("%s: can't copy a file onto itself (%s)", src, dst)
+	}
+	out, err := os.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, info.Mode().Perm())
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(out, in)
+	if closeErr := out.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(dst)
+		return err
+	}
+	return nil
+}
+
+// eachFile calls apply for each path read from the pipe, and returns a pipe
+// containing the results, one per line. Failures don't stop processing:
+// instead, the pipe's error status is set afterwards to an error listing each
+// failed path.
+func (p *Pipe) eachFile(apply func(path string) (string, error)) *Pipe {
+	if p == nil || p.Error() != nil {
+		return p
+	}
+	var errs []error
+	q := p.eachLine(func(line string, out *strings.Builder) {
+		result, err := apply(line)
+		if err != nil {
+			errs = append(errs, err)
+			return
+		}
+		out.WriteString(result)
+		out.WriteRune('\n')
+	})
+	if len(errs) > 0 {
+		q.SetError(errors.Join(errs...))
+	}
+	return q
+}
+
+// eachLine is EachLine for other filters, once they've recorded their own
+// stages, and for sinks, which aren't stages.
+func (p *Pipe) eachLine(process func(string, *strings.Builder)) *Pipe {
+	if p == nil || p.Error() != nil || p.rejectBinary() {
+		return p
+	}
+	scanner, release := newLineScanner(p.Reader)
+	defer release()
+	output := strings.Builder{}
+	for scanner.Scan() {
+		process(scanner.Text(), &output)
+		if p.Error() != nil {
+			return p
+		}
+	}
+	err := scanner.Err()
+	if err != nil {
+		p.SetError(err)
+	}
+	return p.derive(Echo(output.String()).WithError(p.Error()))
+}
+
+// eachJSONValue reads a sequence of JSON values from the pipe, and returns a
+// pipe containing the result of calling format on each one, followed by a
+// newline.
+func (p *Pipe) eachJSONValue(format func(dst *bytes.Buffer, src []byte) error) *Pipe {
+	if p == nil || p.Error() != nil {
+		return p
+	}
+	buf := &bytes.Buffer{}
+	dec := json.NewDecoder(p.Reader)
+	for {
+		var v json.RawMessage
+		err := dec.Decode(&v)
+		if err == io.EOF {
+			break
+		}
+		if err == nil {
+			err = format(buf, v)
+		}
+		if err != nil {
+			// Return the documents formatted so far, rather than the
+			// unread remainder of the input.
+			return p.withReader(buf).WithError(err)
+		}
+		buf.WriteByte('\n')
+	}
+	return p.withReader(buf)
+}
+
+// eachLineConcurrently calls check concurrently for each line of input, and
+// returns a pipe containing the results, one per line, in the same order as
+// the input. If any call returns an error, the pipe's error status is set to
+// the first such error.
+func (p *Pipe) eachLineConcurrently(check func(string) (string, error)) *Pipe {
+	lines, err := p.Slice()
+	if err != nil {
+		return p
+	}
+	results := make([]string, len(lines))
+	errs := make([]error, len(lines))
+	limiter := p.limiter()
+	sem := make(chan struct{}, limiter.workers(maxConcurrentChecks))
+	group := &procGroup{}
+	var wg sync.WaitGroup
+	for i, line := range lines {
+		wg.Add(1)
+		sem <- struct{}{}
+		go func(i int, line string) {
+			release := limiter.acquire(group)
+			defer func() {
+				release()
+				<-sem
+				wg.Done()
+			}()
+			results[i], errs[i] = check(line)
+		}(i, line)
+	}
+	wg.Wait()
+	for _, err := range errs {
+		if err != nil {
+			return p.WithError(err)
+		}
+	}
+	output := strings.Builder{}
+	for _, r := range results {
+		output.WriteString(r)
+		output.WriteRune('\n')
+	}
+	return p.derive(Echo(output.String()))
+}
+
+// splitPipeline splits a shell-style pipeline into its individual commands, at
+// each `|` character that isn't quoted or escaped.
+func splitPipeline(cmdLine string) []string {
+	var stages []string
+	var current strings.Builder
+	var quote byte
+	escaped := false
+	// The separators and quotes are all ASCII, so it's safe to work on bytes,
+	// which also leaves any invalid UTF-8 untouched.
+	for i := 0; i < len(cmdLine); i++ {
+		c := cmdLine[i]
+		switch {
+		case escaped:
+			escaped = false
+		case c == '\\' && quote != '\'':
+			escaped = true
+		case quote != 0:
+			if c == quote {
+				quote = 0
+			}
+		case c == '\'' || c == '"':
+			quote = c
+		case c == '|':
+			stages = append(stages, current.String())
+			current.Reset()
+			continue
+		}
+		current.WriteByte(c)
+	}
+	return append(stages, current.String())
+}
+
+// execLine is the data passed to ExecForEach templates. It prints as the
+// input line, and also has methods for use in templates. It holds the state
+// of a single template execution, but it's a slice, rather than a struct, so
+// that it can be empty when the line is: like a string, it's then false in
+// template conditions such as `{{if .}}`. The state is always at index 0 of
+// its underlying array.
+type execLine []lineState
+
+// lineState is the state of a template execution for execLine.
+type lineState struct {
+	line         string
+	index, total int
+	// file is the path of the temporary file created by File, if any.
+	file string
+}
+
+// newExecLine returns an execLine for the specified line, which is number
+// index of total.
+func newExecLine(line string, index, total int) execLine {
+	l := make(execLine, 1)
+	l[0] = lineState{line: line, index: index, total: total}
+	if line == "" {
+		return l[:0]
+	}
+	return l
+}
+
+// state returns the execution state held by l.
+func (l execLine) state() *lineState {
+	return &l[:1][0]
+}
+
+// File writes the line to a new temporary file, and returns its path. Further
+// calls during the same template execution return the same path.
+func (l execLine) File() (string, error) {
+	st := l.state()
+	if st.file != "" {
+		return st.file, nil
+	}
+	f, err := ioutil.TempFile("", "script-")
+	if err != nil {
+		return "", err
+	}
+	st.file = f.Name()
+	defer f.Close()
+	if _, err := f.WriteString(st.line + "\n"); err != nil {
+		return "", err
+	}
+	return f.Name(), f.Close()
+}
+
+// Index returns the number of the line being processed, counting from 1.
+func (l execLine) Index() int {
+	return l.state().index
+}
+
+// String returns the input line.
+func (l execLine) String() string {
+	return l.state().line
+}
+
+// Total returns the total number of lines to be processed.
+func (l execLine) Total() int {
+	return l.state().total
+}
+
+// exec runs the specified command line, with standard input read from stdin,
+// and returns a pipe containing the output. If stdin is nil, the command reads
+// from the null device.
+func (p *Pipe) exec(cmdLine string, stdin io.Reader) *Pipe {
+	args, ok := shell.Split(cmdLine) // strings.Fields doesn't handle quotes
+	if !ok {
+		return p.WithError(fmt.Errorf("unbalanced quotes or backslashes in [%s]", cmdLine))
+	}
+	return p.execCommand(exec.Command(args[0], args[1:]...), cmdLine, stdin)
+}
+
+// execCached runs cmdLine on stdin, using run, for the first Exec method after
+// Cached, unless the cache has fresh output from the same command line and
+// input, in which case it returns that instead.
+func (p *Pipe) execCached(cmdLine string, stdin io.Reader, run func(stdin io.Reader) *Pipe) *Pipe {
+	entry := p.cache
+	p.cache = nil
+	var input []byte
+	if stdin != nil {
+		var err error
+		if input, err = io.ReadAll(stdin); err != nil {
+			return p.WithError(err)
+		}
+		stdin = bytes.NewReader(input)
+	}
+	dir, err := p.cacheDirectory()
+	if err != nil {
+		return p.WithError(err)
+	}
+	sum := sha256.New()
+	fmt.Fprintf(sum, "%q %q\n", entry.key, cmdLine)
+	sum.Write(input)
+	path := filepath.Join(dir, hex.EncodeToString(sum.Sum(nil)))
+	if info, err := os.Stat(path); err == nil && time.Since(info.ModTime()) < entry.ttl {
+		if data, err := os.ReadFile(path); err == nil {
+			return p.execPipe().withReader(bytes.NewReader(data)).withStageArgs(cmdLine)
+		}
+	}
+	q := run(stdin)
+	if q.Error() != nil {
+		return q
+	}
+	output, err := io.ReadAll(q.Reader)
+	if err != nil {
+		return q.WithError(err)
+	}
+	q.Reader = NewReadAutoCloser(bytes.NewReader(output))
+	tmp, err := os.CreateTemp(dir, ".tmp-")
+	if err != nil {
+		return q.WithError(err)
+	}
+	_, err = tmp.Write(output)
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), path)
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+		return q.WithError(err)
+	}
+	return q
+}
+
+// execCommand runs cmd, which was made from cmdLine, as for exec.
+func (p *Pipe) execCommand(cmd *exec.Cmd, cmdLine string, stdin io.Reader) *Pipe {
+	if p.cache != nil {
+		return p.execCached(cmdLine, stdin, func(stdin io.Reader) *Pipe {
+			return p.execCommand(cmd, cmdLine, stdin)
+		})
+	}
+	if err := p.confine(cmd); err != nil {
+		return p.WithError(err)
+	}
+	// Unless sudo will look up the command itself, report a missing command
+	// the same way whatever the search path.
+	if !p.sudo && errors.Is(cmd.Err, exec.ErrNotFound) {
+		return p.WithError(fmt.Errorf("%w: %w", ErrCommandNotFound, cmd.Err))
+	}
+	if err := p.impersonate(cmd); err != nil {
+		return p.WithError(err)
+	}
+	p.echoCommand(cmdLine)
+	if p.stream {
+		outR, outW, err := os.Pipe()
+		if err != nil {
+			return p.WithError(err)
+		}
+		return p.streamExec([]*exec.Cmd{cmd}, outR, outW, stdin).withStageArgs(cmdLine)
+	}
+	q := p.execPipe()
+	// The output is complete before q is returned, so q no longer depends
+	// on the files p was reading.
+	q.sources = nil
+	cmd.Stdin = stdin
+	output := q.outputBuffer()
+	cmd.Stdout = output
+	cmd.Stderr = p.commandStderr(output)
+	release := p.limiter().acquire(p.group)
+	start := time.Now()
+	err := cmd.Run()
+	release()
+	q.process = newProcessInfo(cmd, start)
+	q.truncated = output.truncated
+	switch {
+	case output.truncated && q.failOnMaxOutput:
+		q.SetError(ErrOutputTooLarge)
+	case err != nil:
+		q.SetError(err)
+	}
+	return q.withReader(bytes.NewReader(output.buf.Bytes())).withStageArgs(cmdLine)
+}
+
+// execParallel runs tpl for each line of input, as for ExecForEachParallel,
+// with up to the specified number of commands at once, writing their output to
+// w. It returns the error from the first command that failed, if any. Once a
+// command fails, the input is closed, and no more is read. So that a slow
+// command doesn't make the output of later lines pile up waiting to be written
+// in order, no more than twice as many lines as there are workers are in
+// progress, or waiting to be written, at once.
+func (p *Pipe) execParallel(tpl *template.Template, total, workers int, input io.Reader, w io.Writer, cp *checkpoint) error {
+	type result struct {
+		index  int
+		line   string
+		output string
+		err    error
+		// skipped is true if the line was processed by an earlier run.
+		skipped bool
+	}
+	type job struct {
+		index   int
+		line    string
+		cmdLine string
+		files   []string
+	}
+	workers = p.limiter().workers(workers)
+	jobs := make(chan job)
+	results := make(chan result)
+	stop := make(chan struct{})
+	// Each line takes a slot until its output is written.
+	slots := make(chan struct{}, 2*workers)
+	var wg sync.WaitGroup
+	group := &procGroup{}
+	for range workers {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := range jobs {
+				q := p.execPipe()
+				q.stream = false
+				q.group = group
+				output, err := q.exec(j.cmdLine, nil).String()
+				removeFiles(j.files)
+				results <- result{index: j.index, line: j.line, output: output, err: err}
+			}
+		}()
+	}
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		defer close(jobs)
+		// take waits for a free slot, and returns false if execution has
+		// stopped in the meantime.
+		take := func() bool {
+			select {
+			case <-stop:
+				return false
+			default:
+			}
+			select {
+			case slots <- struct{}{}:
+				return true
+			case <-stop:
+				return false
+			}
+		}
+		scanner := bufio.NewScanner(input)
+		index := 1
+		for ; take() && scanner.Scan(); index++ {
+			line := scanner.Text()
+			if cp.processed(index, line) {
+				results <- result{index: index, skipped: true}
+				continue
+			}
+			cmdLine := strings.Builder{}
+			files, err := executeLineTemplate(tpl, &cmdLine, line, index, total)
+			if err != nil {
+				removeFiles(files)
+				results <- result{index: index, err: err}
+				return
+			}
+			select {
+			case <-stop:
+				removeFiles(files)
+				return
+			default:
+			}
+			select {
+			case jobs <- job{index, line, cmdLine.String(), files}:
+			case <-stop:
+				removeFiles(files)
+				return
+			}
+		}
+		if err := scanner.Err(); err != nil {
+			select {
+			case <-stop:
+				// The input was closed because execution stopped.
+			default:
+				results <- result{index: index, err: err}
+			}
+		}
+	}()
+	go func() {
+		wg.Wait()
+		close(results)
+	}()
+	var (
+		firstErr error
+		failedAt int // the earliest input line whose command failed
+		writeErr error
+		stopped  bool
+		pending  = map[int]string{}
+		next     = 1
+	)
+	halt := func() {
+		if !stopped {
+			stopped = true
+			close(stop)
+			// Stop reading the input, even if it's waiting for more.
+			if c, ok := input.(io.Closer); ok {
+				c.Close()
+			}
+		}
+	}
+	for r := range results {
+		if r.err == nil && !r.skipped {
+			r.err = cp.record(r.index, r.line)
+		}
+		if r.err != nil {
+			halt()
+			if failedAt == 0 || r.index < failedAt {
+				firstErr, failedAt = r.err, r.index
+			}
+			continue
+		}
+		if writeErr != nil {
+			continue
+		}
+		if p.ordering == Unordered {
+			_, writeErr = io.WriteString(w, r.output)
+			<-slots
+		} else {
+			pending[r.index] = r.output
+		}
+		// Write any results that are now in order, but none from the
+		// failed line onwards.
+		for writeErr == nil && (failedAt == 0 || next < failedAt) {
+			output, ok := pending[next]
+			if !ok {
+				break
+			}
+			delete(pending, next)
+			next++
+			_, writeErr = io.WriteString(w, output)
+			<-slots
+		}
+		if writeErr != nil {
+			// The reader has gone away, so there's no point starting more
+			// commands.
+			halt()
+		}
+	}
+	if firstErr == nil {
+		return writeErr
+	}
+	return firstErr
+}
+
+// execPipe returns a new pipe for the output of an Exec method run on p, with
+// the same settings as p.
+func (p *Pipe) execPipe() *Pipe {
+	q := NewPipe()
+	p.copySettings(q)
+	q.changes = p.changes
+	q.procs = p.procs
+	q.sources = p.sources
+	q.stages = p.stages
+	return q
+}
+
+// execPipeline is ExecPipeline once its stage is recorded.
+func (p *Pipe) execPipeline(cmdLine string) *Pipe {
+	if p.cache != nil {
+		return p.execCached(cmdLine, p.stdinReader(), func(stdin io.Reader) *Pipe {
+			p.stdin = stdin
+			return p.execPipeline(cmdLine)
+		})
+	}
+	var cmds []*exec.Cmd
+	for i, stage := range splitPipeline(cmdLine) {
+		args, ok := shell.Split(stage)
+		if !ok {
+			return p.WithError(fmt.Errorf("unbalanced quotes or backslashes in [%s]", cmdLine))
+		}
+		if len(args) == 0 {
+			return p.WithError(fmt.Errorf("empty command in pipeline [%s]", cmdLine))
+		}
+		cmd := exec.Command(args[0], args[1:]...)
+		err := p.confine(cmd)
+		// Unless sudo will look up the command itself, check that every
+		// stage can run before starting any of them.
+		if err == nil && !p.sudo && errors.Is(cmd.Err, exec.ErrNotFound) {
+			err = fmt.Errorf("%w: %s", ErrCommandNotFound, args[0])
+		}
+		if errors.Is(err, ErrCommandNotFound) {
+			err = fmt.Errorf("%w at stage %d", err, i+1)
+		}
+		if err != nil {
+			return p.WithError(err)
+		}
+		if err := p.impersonate(cmd); err != nil {
+			return p.WithError(err)
+		}
+		cmds = append(cmds, cmd)
+	}
+	outR, outW, err := os.Pipe()
+	if err != nil {
+		return p.WithError(err)
+	}
+	p.echoCommand(cmdLine)
+	if p.stream {
+		return p.streamExec(cmds, outR, outW, p.stdinReader()).withStageArgs(cmdLine)
+	}
+	// The parent's copies of the write ends must be closed once the children
+	// have started, or the readers will never see EOF.
+	parentFiles, err := connectPipeline(cmds, outW, p.commandStderr(outW))
+	parentFiles = append(parentFiles, outW)
+	if err != nil {
+		closeAll(append(parentFiles, outR))
+		return p.WithError(err)
+	}
+	cmds[0].Stdin = p.stdinReader()
+	release := p.limiter().acquireN(p.group, len(cmds))
+	defer release()
+	start := time.Now()
+	var started []*exec.Cmd
+	for _, cmd := range cmds {
+		if err = cmd.Start(); err != nil {
+			break
+		}
+		started = append(started, cmd)
+	}
+	closeAll(parentFiles)
+	output := p.outputBuffer()
+	_, readErr := io.Copy(output, outR)
+	outR.Close()
+	var waitErr error
+	for _, cmd := range started {
+		if err := cmd.Wait(); err != nil {
+			waitErr = err
+		}
+	}
+	q := p.execPipe().withReader(bytes.NewReader(output.buf.Bytes()))
+	q.sources = nil
+	q.truncated = output.truncated
+	q.process = newProcessInfo(cmds[len(cmds)-1], start)
+	switch {
+	case err != nil:
+		q.SetError(err)
+	case readErr != nil:
+		q.SetError(readErr)
+	case waitErr != nil:
+		q.SetError(waitErr)
+	}
+	return q.withStageArgs(cmdLine)
+}
+
+// errReader is an io.Reader that records the first error, other than io.EOF,
+// from reading the underlying reader.
+type errReader struct {
+	io.Reader
+	err error
+}
+
+// Read reads from the underlying reader, recording any error.
+func (r *errReader) Read(buf []byte) (int, error) {
+	n, err := r.Reader.Read(buf)
+	if err != nil && err != io.EOF && r.err == nil {
+		r.err = err
+	}
+	return n, err
+}
+
+// execReader reads the combined output of commands started by an Exec method
+// in streaming mode. When the output ends, it waits for the commands to
+// finish, and returns any error from them instead of io.EOF. Closing it kills
+// any commands still running, and closes their input, so that upstream stages
+// stop too.
+type execReader struct {
+	out       *os.File
+	cmds      []*exec.Cmd
+	input     io.Closer
+	tempFiles []string
+	pipe      *Pipe
+	read      int64
+	exceeded  bool
+	once      sync.Once
+	err       error
+	start     time.Time
+	mu        sync.Mutex
+	inputErr  error
+	// release frees the commands' slots in the pipeline's concurrency
+	// limit, once they've finished.
+	release func()
+	// cleanup closes the reader when CloseAll is called, unless the commands
+	// have finished by then.
+	cleanup *cleanup
+}
+
+// Close kills the commands, if they're still running, and waits for them to
+// exit.
+func (r *execReader) Close() error {
+	r.out.Close()
+	for _, cmd := range r.cmds {
+		cmd.Process.Kill()
+	}
+	r.wait()
+	return nil
+}
+
+// Read reads the commands' output, up to the pipe's WithMaxOutput limit, if
+// any. Once the limit is exceeded, the commands are killed, and Read returns
+// ErrOutputTooLarge, or, if the output is to be truncated, io.EOF.
+func (r *execReader) Read(buf []byte) (int, error) {
+	if r.exceeded {
+		return 0, r.limitError()
+	}
+	limit := r.pipe.maxOutput
+	if limit > 0 && int64(len(buf)) > limit-r.read+1 {
+		buf = buf[:limit-r.read+1]
+	}
+	n, err := r.out.Read(buf)
+	r.read += int64(n)
+	if limit > 0 && r.read > limit {
+		n -= int(r.read - limit)
+		r.read = limit
+		r.exceeded = true
+		r.pipe.truncated = true
+		r.Close()
+		return n, r.limitError()
+	}
+	if err == io.EOF {
+		if err := r.wait(); err != nil {
+			return n, err
+		}
+	}
+	return n, err
+}
+
+// setInputErr records err, if it's not nil, as the error from reading the
+// commands' input.
+func (r *execReader) setInputErr(err error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.inputErr = err
+}
+
+// limitError returns the error Read reports once the output limit has been
+// exceeded.
+func (r *execReader) limitError() error {
+	if r.pipe.failOnMaxOutput {
+		return ErrOutputTooLarge
+	}
+	return io.EOF
+}
+
+// wait waits for all the commands to exit, the first time it's called, and
+// then closes their input, and removes any temporary files they were using.
+// It returns the error from reading the commands' input, if there was one,
+// since that's the original cause of any failure, or otherwise the error from
+// the last (rightmost) command that failed, if any.
+func (r *execReader) wait() error {
+	r.once.Do(func() {
+		for _, cmd := range r.cmds {
+			if err := cmd.Wait(); err != nil {
+				r.err = err
+			}
+		}
+		if len(r.cmds) > 0 {
+			r.pipe.process = newProcessInfo(r.cmds[len(r.cmds)-1], r.start)
+		}
+		r.mu.Lock()
+		if r.inputErr != nil {
+			r.err = r.inputErr
+		}
+		r.mu.Unlock()
+		if r.input != nil {
+			r.input.Close()
+		}
+		removeFiles(r.tempFiles)
+		r.release()
+		r.cleanup.cancel()
+		active.Add(-1)
+	})
+	return r.err
+}
+
+// executeLineTemplate executes tpl for the specified line, which is number
+// index of total, writing the output to w. It returns the paths of any
+// temporary files created by the template, which the caller should remove once
+// they're no longer needed.
+func executeLineTemplate(tpl *template.Template, w io.Writer, line string, index, total int) ([]string, error) {
+	l := newExecLine(line, index, total)
+	err := tpl.Execute(w, l)
+	if file := l.state().file; file != "" {
+		return []string{file}, err
+	}
+	return nil, err
+}
+
+// filterByStat reads a list of file paths from the pipe, one per line, and
+// returns a pipe containing only those for which keep returns true.
+func (p *Pipe) filterByStat(keep func(os.FileInfo) bool) *Pipe {
+	return p.eachLine(func(line string, out *strings.Builder) {
+		info, err := os.Stat(line)
+		if err != nil {
+			p.SetError(err)
+			return
+		}
+		if keep(info) {
+			out.WriteString(line)
+			out.WriteRune('\n')
+		}
+	})
+}
+
+var combinedLogPattern = regexp.MustCompile(`^(\S+) (\S+) (\S+) \[([^\]]+)\] "((?:[^"\\]|\\.)*)" (\d{3}) (\d+|-)(?: "((?:[^"\\]|\\.)*)" "((?:[^"\\]|\\.)*)")?`)
+
+// lockedWriter is an io.Writer that's safe for concurrent use, by allowing
+// only one write at a time to the underlying writer.
+type lockedWriter struct {
+	mu sync.Mutex
+	w  io.Writer
+}
+
+// Write writes buf to the underlying writer.
+func (lw *lockedWriter) Write(buf []byte) (int, error) {
+	lw.mu.Lock()
+	defer lw.mu.Unlock()
+	return lw.w.Write(buf)
+}
+
+// logfmtPair is a single key=value field in a logfmt line.
+type logfmtPair struct {
+	key, value string
+}
+
+// formatLogfmt returns pairs as a logfmt line, quoting values where necessary.
+func formatLogfmt(pairs []logfmtPair) string {
+	fields := make([]string, len(pairs))
+	for i, pair := range pairs {
+		value := pair.value
+		if value == "" || strings.ContainsAny(value, " =\"\\\t") || !strconv.CanBackquote(value) {
+			value = strconv.Quote(value)
+		}
+		fields[i] = pair.key + "=" + value
+	}
+	return strings.Join(fields, " ")
+}
+
+// isASCII reports whether s contains only ASCII characters.
+func isASCII(s string) bool {
+	for i := 0; i < len(s); i++ {
+		if s[i] >= utf8.RuneSelf {
+			return false
+		}
+	}
+	return true
+}
+
+// matchBlockSize is the size of the blocks of input searched by matchBlocks.
+const matchBlockSize = 256 * 1024
+
+// matchBlocks returns a pipe containing the lines of input that contain s,
+// which must not contain line breaks. It searches whole blocks of input at a
+// time, only finding line boundaries around each match, so that lines which
+// don't match cost almost nothing. If fold is true, s must be in lower case,
+// and ASCII letters in the input are matched regardless of case. As with
+// EachLine, a trailing carriage return is removed from each matching line.
+func (p *Pipe) matchBlocks(s []byte, fold bool) *Pipe {
+	if p == nil || p.Error() != nil || p.rejectBinary() {
+		return p
+	}
+	out := &bytes.Buffer{}
+	// emit writes the matching lines in region, searching the equivalent
+	// region of search, which is either the same or its lower-case version.
+	emit := func(region, search []byte) {
+		offset := 0
+		for {
+			i := bytes.Index(search[offset:], s)
+			if i < 0 {
+				return
+			}
+			i += offset
+			start := bytes.LastIndexByte(search[:i], '\n') + 1
+			end := len(search)
+			if j := bytes.IndexByte(search[i:], '\n'); j >= 0 {
+				end = i + j
+			}
+			if bytes.Contains(bytes.TrimSuffix(search[start:end], []byte{'\r'}), s) {
+				out.Write(bytes.TrimSuffix(region[start:end], []byte{'\r'}))
+				out.WriteByte('\n')
+			}
+			if end == len(search) {
+				return
+			}
+			offset = end + 1
+		}
+	}
+	buf := make([]byte, matchBlockSize)
+	var lower []byte
+	// kept is the length of the incomplete line at the end of the previous
+	// block, which is moved to the start of buf to be completed by the next.
+	kept := 0
+	for {
+		if kept == len(buf) {
+			// A single line fills the whole buffer, so make room for more.
+			buf = append(buf, make([]byte, len(buf))...)
+		}
+		n, err := io.ReadFull(p.Reader, buf[kept:])
+		data := buf[:kept+n]
+		done := err == io.EOF || err == io.ErrUnexpectedEOF
+		if err != nil && !done {
+			p.SetError(err)
+			return p.withReader(out)
+		}
+		complete := data
+		if !done {
+			complete = data[:bytes.LastIndexByte(data, '\n')+1]
+		}
+		search := complete
+		if fold {
+			lower = asciiLower(lower[:0], complete)
+			search = lower
+		}
+		emit(complete, search)
+		if done {
+			return p.withReader(out)
+		}
+		kept = copy(buf, data[len(complete):])
+	}
+}
+
+// matchRegexp is MatchRegexp, or MatchFold, once its stage is recorded.
+func (p *Pipe) matchRegexp(re *regexp.Regexp) *Pipe {
+	return p.eachLine(func(line string, out *strings.Builder) {
+		if re.MatchString(line) {
+			out.WriteString(line)
+			out.WriteRune('\n')
+		}
+	})
+}
+
+// multiReader reads from several inputs in sequence, and closes all of them
+// when closed.
+type multiReader struct {
+	io.Reader
+	inputs []io.Closer
+}
+
+// Close closes all the inputs, and returns the first error, if any.
+func (r multiReader) Close() error {
+	var err error
+	for _, input := range r.inputs {
+		if cerr := input.Close(); cerr != nil && err == nil {
+			err = cerr
+		}
+	}
+	return err
+}
+
+// newBloomFilter returns a Bloom filter with the optimal size and number of
+// hashes to hold n items with the given false positive rate.
+func newBloomFilter(n int, fpRate float64) *bloomFilter {
+	m := math.Ceil(-float64(n) * math.Log(fpRate) / (math.Ln2 * math.Ln2))
+	k := math.Max(1, math.Round(m/float64(n)*math.Ln2))
+	return &bloomFilter{
+		bits:   make([]uint64, (uint64(m)+63)/64),
+		hashes: uint64(k),
+	}
+}
+
+// lineBufPool holds the buffers used by line scanners, so that filters
+// processing many small inputs don't each allocate a new one.
+var lineBufPool = sync.Pool{
+	New: func() any {
+		buf := make([]byte, bufio.MaxScanTokenSize)
+		return &buf
+	},
+}
+
+// newLineScanner returns a scanner that reads lines from r using a buffer
+// from lineBufPool, and a function that returns the buffer to the pool, to be
+// called when the scanner is no longer needed.
+func newLineScanner(r io.Reader) (*bufio.Scanner, func()) {
+	buf := lineBufPool.Get().(*[]byte)
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(*buf, bufio.MaxScanTokenSize)
+	return scanner, func() { lineBufPool.Put(buf) }
+}
+
+// outputBuffer returns a cappedBuffer for the output of an Exec method,
+// limited according to the pipe's WithMaxOutput setting.
+func (p *Pipe) outputBuffer() *cappedBuffer {
+	return &cappedBuffer{max: p.maxOutput, fail: p.failOnMaxOutput}
+}
+
+// parseHexdumpLine returns the bytes and offset represented by a line of hex
+// dump output. The hex values end at the first pair of spaces, which separates
+// them from the ASCII column.
+func parseHexdumpLine(line string) ([]byte, int64, error) {
+	offsetText, rest, ok := strings.Cut(line, ":")
+	if !ok {
+		return nil, 0, fmt.Errorf("missing offset in hex dump line %q", line)
+	}
+	offset, err := strconv.ParseInt(strings.TrimSpace(offsetText), 16, 64)
+	if err != nil {
+		return nil, 0, fmt.Errorf("bad offset in hex dump line %q", line)
+	}
+	hexText, _, _ := strings.Cut(strings.TrimPrefix(rest, " "), "  ")
+	data, err := hex.DecodeString(strings.ReplaceAll(hexText, " ", ""))
+	if err != nil {
+		return nil, 0, fmt.Errorf("bad hex data in hex dump line %q: %w", line, err)
+	}
+	return data, offset, nil
+}
+
+var (
+	labelNamePattern  = regexp.MustCompile(`^[a-zA-Z_][a-zA-Z0-9_]*$`)
+	labelValueEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+	metricNamePattern = regexp.MustCompile(`^[a-zA-Z_:][a-zA-Z0-9_:]*$`)
+)
+
+// parseLogfmt parses a logfmt line into its fields. A key with no value (not
+// followed by `=`) has an empty value.
+func parseLogfmt(line string) []logfmtPair {
+	var pairs []logfmtPair
+	rest := line
+	for {
+		rest = strings.TrimLeft(rest, " \t")
+		if rest == "" {
+			return pairs
+		}
+		end := strings.IndexAny(rest, "= \t")
+		if end < 0 {
+			return append(pairs, logfmtPair{key: rest})
+		}
+		key := rest[:end]
+		if rest[end] != '=' {
+			pairs = append(pairs, logfmtPair{key: key})
+			rest = rest[end:]
+			continue
+		}
+		rest = rest[end+1:]
+		var value string
+		if quoted, err := strconv.QuotedPrefix(rest); err == nil && rest[0] == '"' {
+			value, _ = strconv.Unquote(quoted)
+			rest = rest[len(quoted):]
+		} else {
+			end := strings.IndexAny(rest, " \t")
+			if end < 0 {
+				end = len(rest)
+			}
+			value, rest = rest[:end], rest[end:]
+		}
+		if key != "" {
+			pairs = append(pairs, logfmtPair{key, value})
+		}
+	}
+}
+
+// pathStep is one element of a path parsed by parsePath: either a map key, an
+// array index, or every element of an array.
+type pathStep struct {
+	key     string
+	index   int
+	isIndex bool
+	all     bool
+}
+
+// parsePath parses a YQ-style path such as `.items[].metadata.name`.
+func parsePath(path string) ([]pathStep, error) {
+	var steps []pathStep
+	rest := strings.TrimPrefix(path, ".")
+	for rest != "" {
+		switch {
+		case rest[0] == '[':
+			end := strings.IndexByte(rest, ']')
+			if end < 0 {
+				return nil, fmt.Errorf("unclosed bracket in path %q", path)
+			}
+			inside := rest[1:end]
+			rest = rest[end+1:]
+			if inside == "" {
+				steps = append(steps, pathStep{all: true})
+				break
+			}
+			i, err := strconv.Atoi(inside)
+			if err != nil {
+				return nil, fmt.Errorf("invalid array index %q in path %q", inside, path)
+			}
+			steps = append(steps, pathStep{index: i, isIndex: true})
+		case rest[0] == '.':
+			rest = rest[1:]
+		default:
+			end := strings.IndexAny(rest, ".[")
+			if end < 0 {
+				end = len(rest)
+			}
+			steps = append(steps, pathStep{key: rest[:end]})
+			rest = rest[end:]
+		}
+	}
+	return steps, nil
+}
+
+// queryPath returns the values selected by steps within v. Missing keys and
+// out-of-range indexes select nil.
+func queryPath(v any, steps []pathStep) ([]any, error) {
+	if len(steps) == 0 {
+		return []any{v}, nil
+	}
+	if v == nil {
+		return []any{nil}, nil
+	}
+	step := steps[0]
+	switch {
+	case step.all:
+		items, ok := v.([]any)
+		if !ok {
+			return nil, fmt.Errorf("cannot iterate over %T", v)
+		}
+		var results []any
+		for _, item := range items {
+			r, err := queryPath(item, steps[1:])
+			if err != nil {
+				return nil, err
+			}
+			results = append(results, r...)
+		}
+		return results, nil
+	case step.isIndex:
+		items, ok := v.([]any)
+		if !ok {
+			return nil, fmt.Errorf("cannot index %T with [%d]", v, step.index)
+		}
+		i := step.index
+		if i < 0 {
+			i += len(items)
+		}
+		if i < 0 || i >= len(items) {
+			return []any{nil}, nil
+		}
+		return queryPath(items[i], steps[1:])
+	default:
+		m, ok := v.(map[string]any)
+		if !ok {
+			return nil, fmt.Errorf("cannot look up key %q in %T", step.key, v)
+		}
+		return queryPath(m[step.key], steps[1:])
+	}
+}
+
+// removeFiles removes each of the specified files, ignoring any errors.
+func removeFiles(paths []string) {
+	for _, path := range paths {
+		os.Remove(path)
+	}
+}
+
+// runQuietly runs cmdLine, with no input, and discards its output, returning
+// any error. The command is killed if ctx is cancelled before it finishes.
+func (p *Pipe) runQuietly(ctx context.Context, cmdLine string) error {
+	args, ok := shell.Split(cmdLine)
+	if !ok {
+		return fmt.Errorf("unbalanced quotes or backslashes in [%s]", cmdLine)
+	}
+	if len(args) == 0 {
+		return fmt.Errorf("empty command [%s]", cmdLine)
+	}
+	cmd := exec.CommandContext(ctx, args[0], args[1:]...)
+	if err := p.confine(cmd); err != nil {
+		return err
+	}
+	if err := p.impersonate(cmd); err != nil {
+		return err
+	}
+	cmd.Stderr = p.commandStderr(nil)
+	return cmd.Run()
+}
+
+// stageReader reads the output of a filter that processes its input in a
+// separate goroutine. Closing it closes the filter's input as well as its
+// output, so that upstream stages (such as streaming Exec commands) stop as
+// soon as downstream stages stop reading, even if the goroutine is waiting
+// for input.
+type stageReader struct {
+	*io.PipeReader
+	input io.Closer
+}
+
+// Close closes both the filter's output and its input.
+func (r stageReader) Close() error {
+	r.input.Close()
+	return r.PipeReader.Close()
+}
+
+// streamExec starts cmds, a pipeline of one or more commands, with the
+// combined output of all of them written to outW, and returns a pipe that
+// reads it from outR as it's produced. The contents of stdin, if it's not
+// nil, are copied to the first command's standard input in the background, so
+// that waiting for the commands never waits for stdin to end. If stdin is the
+// pipe's own reader, rather than one set with WithStdin, it's closed once the
+// commands have finished. Any temporary files belonging to the pipe, such as
+// one made by AsTempFile, are removed at the same time.
+func (p *Pipe) streamExec(cmds []*exec.Cmd, outR, outW *os.File, stdin io.Reader) *Pipe {
+	parentFiles, err := connectPipeline(cmds, outW, p.commandStderr(outW))
+	parentFiles = append(parentFiles, outW)
+	if err != nil {
+		closeAll(append(parentFiles, outR))
+		return p.WithError(err)
+	}
+	var inW *os.File
+	if stdin != nil {
+		inR, w, err := os.Pipe()
+		if err != nil {
+			closeAll(append(parentFiles, outR))
+			return p.WithError(err)
+		}
+		cmds[0].Stdin = inR
+		inW = w
+		parentFiles = append(parentFiles, inR)
+	}
+	q := p.execPipe()
+	release := p.limiter().acquireN(p.group, len(cmds))
+	r := &execReader{out: outR, pipe: q, tempFiles: p.tempFiles, start: time.Now(), release: release}
+	r.cleanup = registerCleanup(func() { r.Close() })
+	active.Add(1)
+	p.tempFiles = nil
+	if stdin != nil && p.stdin == nil {
+		r.input = p.Reader
+	}
+	for _, cmd := range cmds {
+		if err = cmd.Start(); err != nil {
+			break
+		}
+		r.cmds = append(r.cmds, cmd)
+	}
+	closeAll(parentFiles)
+	if err != nil {
+		if inW != nil {
+			inW.Close()
+		}
+		r.Close()
+		return p.WithError(err)
+	}
+	if inW != nil {
+		goStage(func() {
+			// An error reading the input, such as the exit status of an
+			// upstream command, is the real cause of any failure here, so
+			// it's kept for wait to report.
+			in := &errReader{Reader: stdin}
+			io.Copy(inW, in)
+			r.setInputErr(in.err)
+			inW.Close()
+		})
+	}
+	return q.withReader(r)
+}
+
+// streamLines returns a pipe containing the result of calling process on each
+// line of input, leaving out any lines for which process returns false.
+// Unlike EachLine, lines are passed on as they're read, rather than all at
+// once when the input is exhausted.
+func (p *Pipe) streamLines(process func(string) (string, bool)) *Pipe {
+	if p == nil || p.Error() != nil || p.rejectBinary() {
+		return p
+	}
+	input := p.Reader
+	pr, pw := io.Pipe()
+	goStage(func() {
+		scanner := bufio.NewScanner(input)
+		for scanner.Scan() {
+			line, ok := process(scanner.Text())
+			if !ok {
+				continue
+			}
+			if _, err := fmt.Fprintln(pw, line); err != nil {
+				return // reader has gone away
+			}
+		}
+		pw.CloseWithError(scanner.Err())
+	})
+	return p.withReader(stageReader{pr, input})
+}
+
+// timeColumn parses the timestamp in layout starting at the given column of
+// line, returning the time, its start and end offsets within line, and
+// whether it was found and valid. Columns are delimited as for Column, and
+// if the timestamp spans more than one, they're matched against the layout
+// with a single space between each, however they're separated in line.
+func timeColumn(line, layout string, column int) (t time.Time, start, end int, ok bool) {
+	layoutFields := strings.Fields(layout)
+	width := len(layoutFields)
+	if width == 0 {
+		width = 1
+	}
+	fields := strings.Fields(line)
+	if column < 1 || column+width-1 > len(fields) {
+		return time.Time{}, 0, 0, false
+	}
+	// Each field starts at the first occurrence of its text after the end of
+	// the previous field, since only white space separates them.
+	for i, f := range fields[:column+width-1] {
+		at := end + strings.Index(line[end:], f)
+		if i == column-1 {
+			start = at
+		}
+		end = at + len(f)
+	}
+	value := strings.Join(fields[column-1:column+width-1], " ")
+	t, err := time.ParseInLocation(strings.Join(layoutFields, " "), value, time.Local)
+	if err != nil {
+		return time.Time{}, 0, 0, false
+	}
+	return t, start, end, true
+}
+
+// writeHexdumpLine writes one line of Hexdump output to w, describing up to 16
+// bytes of data starting at offset.
+func writeHexdumpLine(w io.Writer, offset int, data []byte) {
+	var line strings.Builder
+	fmt.Fprintf(&line, "%08x:", offset)
+	for i := 0; i < 16; i++ {
+		if i%2 == 0 {
+			line.WriteByte(' ')
+		}
+		if i < len(data) {
+			fmt.Fprintf(&line, "%02x", data[i])
+		} else {
+			line.WriteString("  ")
+		}
+	}
+	line.WriteString("  ")
+	for _, c := range data {
+		if c < ' ' || c > '~' {
+			c = '.'
+		}
+		line.WriteByte(c)
+	}
+	line.WriteByte('\n')
+	io.WriteString(w, line.String())
+}
+
+// urlParts maps the part names accepted by URLParts to functions that extract
+// them.
+var urlParts = map[string]func(*url.URL) string{
+	"scheme":   func(u *url.URL) string { return u.Scheme },
+	"user":     func(u *url.URL) string { return u.User.Username() },
+	"host":     func(u *url.URL) string { return u.Host },
+	"hostname": (*url.URL).Hostname,
+	"port":     (*url.URL).Port,
+	"path":     func(u *url.URL) string { return u.Path },
+	"query":    func(u *url.URL) string { return u.RawQuery },
+	"fragment": func(u *url.URL) string { return u.Fragment },
+}
+
+// writeQueryValue writes v to w as a line of plain text if it's a scalar, or
+// otherwise using encode.
+func writeQueryValue(w io.Writer, v any, encode func(any) ([]byte, error)) error {
+	switch v := v.(type) {
+	case nil:
+		_, err := fmt.Fprintln(w, "null")
+		return err
+	case map[string]any, []any:
+		data, err := encode(v)
+		if err != nil {
+			return err
+		}
+		_, err = w.Write(data)
+		return err
+	case time.Time:
+		_, err := fmt.Fprintln(w, v.Format(time.RFC3339Nano))
+		return err
+	default:
+		_, err := fmt.Fprintln(w, v)
+		return err
+	}
+}
@@ -1,126 +1,136 @@
 package script_test
 
 import (
+	"bufio"
 	"bytes"
+	"encoding/json"
 	"errors"
+	"fmt"
+	"io"
+	"io/fs"
 	"io/ioutil"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
 	"regexp"
+	"runtime"
+	"strconv"
 	"strings"
 	"testing"
+	"time"
 
+	"bitbucket.org/creachadair/shell"
 	"github.com/bitfield/script"
+	"github.com/bitfield/script/scripttest"
 )
 
-func TestBasename(t *testing.T) {
+func TestAppend(t *testing.T) {
 	t.Parallel()
-	testCases := []struct {
-		testFileName string
-		want         string
+	tcs := []struct {
+		input, s, want string
 	}{
-		{"\n", ".\n"},
-		{"/", "/\n"},
-		{"/root", "root\n"},
-		{"/tmp/example.php", "example.php\n"},
-		{"./src/filters", "filters\n"},
-		{"/var/tmp/example.php", "example.php\n"},
-		{"/tmp/script-21345.txt\n/tmp/script-5371253.txt", "script-21345.txt\nscript-5371253.txt\n"},
-		{"C:/Program Files", "Program Files\n"},
-		{"C:/Program Files/", "Program Files\n"},
+		{"a\nb\n", "footer", "a\nb\nfooter\n"},
+		{"a\nb", "footer\n", "a\nb\nfooter\n"},
+		{"", "footer", "footer\n"},
+		{"a\n", "", "a\n"},
 	}
-	for _, tc := range testCases {
-		got, err := script.Echo(tc.testFileName).Basename().String()
+	for _, tc := range tcs {
+		got, err := script.Echo(tc.input).Append(tc.s).String()
 		if err != nil {
-			t.Error(err)
+			t.Fatal(err)
 		}
 		if got != tc.want {
-			t.Errorf("%q: want %q, got %q", tc.testFileName, tc.want, got)
+			t.Errorf("Append(%q) on %q: want %q, got %q", tc.s, tc.input, tc.want, got)
 		}
 	}
 }
 
-func TestColumn(t *testing.T) {
+func TestAppendPipe(t *testing.T) {
 	t.Parallel()
-	want, err := ioutil.ReadFile("testdata/column.golden.txt")
+	want := "header\nbody\nfooter\n"
+	got, err := script.Echo("header\n").AppendPipe(script.Echo("body\n")).AppendPipe(script.Echo("footer\n")).String()
 	if err != nil {
 		t.Fatal(err)
 	}
-	got, err := script.File("testdata/column.input.txt").Column(3).Bytes()
-	if err != nil {
-		t.Error(err)
-	}
-	if !bytes.Equal(got, want) {
+	if got != want {
 		t.Errorf("want %q, got %q", want, got)
 	}
-	got, err = script.File("testdata/column.input.txt").Column(0).Bytes()
-	if err != nil {
-		t.Error()
+}
+
+func TestAppendPipeCopiesErrorStatus(t *testing.T) {
+	t.Parallel()
+	p := script.Echo("header\n").AppendPipe(script.File("doesntexist.txt"))
+	if p.Error() == nil {
+		t.Error("want error from appended pipe, got nil")
 	}
-	if !bytes.Equal(got, []byte{}) {
-		t.Errorf("want %q, got %q", want, got)
+}
+
+func TestAppendPipeClosesBothInputs(t *testing.T) {
+	t.Parallel()
+	p, q := script.File("testdata/test.txt"), script.File("testdata/hello.txt")
+	input, other := p.Reader, q.Reader
+	if err := p.AppendPipe(q).Close(); err != nil {
+		t.Fatal(err)
 	}
-	got, err = script.File("testdata/column.input.txt").Column(-1).Bytes()
-	if err != nil {
-		t.Error()
+	if _, err := ioutil.ReadAll(input); err == nil {
+		t.Error("pipe input not closed")
 	}
-	if !bytes.Equal(got, []byte{}) {
-		t.Errorf("want %q, got %q", want, got)
+	if _, err := ioutil.ReadAll(other); err == nil {
+		t.Error("appended pipe input not closed")
 	}
-	got, err = script.File("testdata/column.input.txt").Column(10).Bytes()
+}
+
+func TestAsTempFile(t *testing.T) {
+	t.Parallel()
+	path, err := script.Echo("hello\nworld\n").AsTempFile().String()
 	if err != nil {
-		t.Error()
+		t.Fatal(err)
 	}
-	if !bytes.Equal(got, []byte{}) {
-		t.Errorf("want %q, got %q", want, got)
+	path = strings.TrimSuffix(path, "\n")
+	defer os.Remove(path)
+	got, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(got) != "hello\nworld\n" {
+		t.Errorf("want %q, got %q", "hello\nworld\n", got)
 	}
 }
 
-func TestConcat(t *testing.T) {
+func TestAsTempFileIsRemovedAfterExec(t *testing.T) {
 	t.Parallel()
-	want, err := ioutil.ReadFile("testdata/concat.golden.txt")
+	p := script.Echo("hello\n").AsTempFile()
+	got, err := p.ExecForEach("sh -c 'cat {{.}}; echo {{.}}'").Slice()
 	if err != nil {
 		t.Fatal(err)
 	}
-	got, err := script.Echo("testdata/test.txt\ntestdata/doesntexist.txt\ntestdata/hello.txt").Concat().Bytes()
-	if err != nil {
-		t.Fatal(err)
+	if len(got) != 2 || got[0] != "hello" {
+		t.Fatalf("want file contents then path, got %q", got)
 	}
-	if !bytes.Equal(got, want) {
-		t.Errorf("want %q, got %q", want, got)
+	if _, err := os.Stat(got[1]); !os.IsNotExist(err) {
+		t.Errorf("want temp file %s removed, got %v", got[1], err)
 	}
 }
 
-func TestDirname(t *testing.T) {
+func TestBasename(t *testing.T) {
 	t.Parallel()
 	testCases := []struct {
 		testFileName string
 		want         string
 	}{
-		{"/", "/\n"},
 		{"\n", ".\n"},
-		{"/root", "/\n"},
-		{"/tmp/example.php", "/tmp\n"},
-		{"/var/tmp/example.php", "/var/tmp\n"},
-		{"/var/tmp", "/var\n"},
-		{"/var/tmp/", "/var\n"},
-		{"./src/filters", "./src\n"},
-		{"./src/filters/", "./src\n"},
-		{"/tmp/script-21345.txt\n/tmp/script-5371253.txt", "/tmp\n/tmp\n"},
-		{"C:/Program Files/PHP", "C:/Program Files\n"},
-		{"C:/Program Files/PHP/", "C:/Program Files\n"},
-		{"C:/Program Files", "C:\n"},
-
-		// NOTE:
-		// there are no tests for Windows-style directory separators,
-		// because these are not supported by filepath at this time
-		//
-		// the following test data currently does not work with the
-		// Golang filepath library:
-		//
-		// {"C:\\Program Files\\PHP", "C:\\Program Files\n"},
-		// {"C:\\Program Files\\PHP\\", "C:\\Program Files\n"},
+		{"/", "/\n"},
+		{"/root", "root\n"},
+		{"/tmp/example.php", "example.php\n"},
+		{"./src/filters", "filters\n"},
+		{"/var/tmp/example.php", "example.php\n"},
+		{"/tmp/script-21345.txt\n/tmp/script-5371253.txt", "script-21345.txt\nscript-5371253.txt\n"},
+		{"C:/Program Files", "Program Files\n"},
+		{"C:/Program Files/", "Program Files\n"},
 	}
 	for _, tc := range testCases {
-		got, err := script.Echo(tc.testFileName).Dirname().String()
+		got, err := script.Echo(tc.testFileName).Basename().String()
 		if err != nil {
 			t.Error(err)
 		}
@@ -130,298 +140,2393 @@ func TestDirname(t *testing.T) {
 	}
 }
 
-func TestEachLine(t *testing.T) {
+func TestBetween(t *testing.T) {
 	t.Parallel()
-	p := script.Echo("Hello\nGoodbye")
-	q := p.EachLine(func(line string, out *strings.Builder) {
-		out.WriteString(line + " world\n")
-	})
-	want := "Hello world\nGoodbye world\n"
-	got, err := q.String()
-	if err != nil {
-		t.Error(err)
+	input := "a\nBEGIN\nb\nc\nEND\nd\nBEGIN\ne\n"
+	start, end := regexp.MustCompile(`^BEGIN`), regexp.MustCompile(`^END`)
+	tcs := []struct {
+		name string
+		got  *script.Pipe
+		want string
+	}{
+		{"inclusive", script.Echo(input).Between(start, end), "BEGIN\nb\nc\nEND\nBEGIN\ne\n"},
+		{"exclusive", script.Echo(input).BetweenExclusive(start, end), "b\nc\ne\n"},
+		{"no match", script.Echo(input).Between(regexp.MustCompile("x"), end), ""},
+		{"same line", script.Echo("a\n[b]\nc\n").Between(regexp.MustCompile(`\[`), regexp.MustCompile(`\]`)), "[b]\n"},
 	}
-	if got != want {
-		t.Errorf("want %q, got %q", want, got)
+	for _, tc := range tcs {
+		got, err := tc.got.String()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got != tc.want {
+			t.Errorf("%s: want %q, got %q", tc.name, tc.want, got)
+		}
 	}
 }
 
-func TestExecFilter(t *testing.T) {
+func TestBunzip2(t *testing.T) {
 	t.Parallel()
 	want := "hello world"
-	p := script.File("testdata/hello.txt")
-	q := p.Exec("cat")
-	got, err := q.String()
+	got, err := script.File("testdata/hello.txt.bz2").Bunzip2().String()
 	if err != nil {
-		t.Error(err)
+		t.Fatal(err)
 	}
 	if got != want {
 		t.Errorf("want %q, got %q", want, got)
 	}
-	// This should fail because p is now closed.
-	_, err = p.String()
+	_, err = script.Echo("not bzip2").Bunzip2().String()
 	if err == nil {
-		t.Error("input not closed after reading")
-	}
-	p = script.Echo("hello world")
-	p.SetError(errors.New("oh no"))
-	// This should be a no-op because the pipe has error status.
-	out, _ := p.Exec("cat").String()
-	if out != "" {
-		t.Error("want exec on erroneous pipe to be a no-op, but it wasn't")
+		t.Error("want error decompressing invalid data, got nil")
 	}
 }
 
-func TestExecForEach(t *testing.T) {
+func TestCheckPortEach(t *testing.T) {
 	t.Parallel()
-	tcs := []struct {
-		Input       []string
-		Command     string
-		ErrExpected bool
-		WantOutput  string
-	}{
-		{
-			Command:     "bash -c 'echo {{.}}'",
-			Input:       []string{"a", "b", "c"},
-			ErrExpected: false,
-			WantOutput:  "a\nb\nc\n",
-		},
-		{
-			Command:     "bash -c 'echo {{if not .}}DEFAULT{{else}}{{.}}{{end}}'",
-			Input:       []string{"a", "", "c"},
-			ErrExpected: false,
-			WantOutput:  "a\nDEFAULT\nc\n",
-		},
-		{
-			Command:     "bash -c 'echo {{bogus template syntax}}'",
-			Input:       []string{"a", "", "c"},
-			ErrExpected: true,
-			WantOutput:  "",
-		},
-		{
-			Command:     "bogus {{.}}",
-			Input:       []string{"a", "b", "c"},
-			ErrExpected: true,
-			WantOutput:  "",
-		},
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
 	}
-	for _, tc := range tcs {
-		t.Run(tc.Command, func(t *testing.T) {
-			p := script.Slice(tc.Input).ExecForEach(tc.Command)
-			if tc.ErrExpected != (p.Error() != nil) {
-				t.Fatalf("unexpected error value: %v", p.Error())
-			}
-			p.SetError(nil) // else p.String() would be a no-op
-			output, err := p.String()
-			if err != nil {
-				t.Fatalf("unexpected error %v", err)
-			}
-			if !strings.Contains(output, tc.WantOutput) {
-				t.Fatalf("want output %q to contain %q", output, tc.WantOutput)
-			}
-		})
+	defer l.Close()
+	port := l.Addr().(*net.TCPAddr).Port
+	want := fmt.Sprintf("127.0.0.1:%d open\ndoesntexist.invalid:%d closed\n", port, port)
+	got, err := script.Echo("127.0.0.1\ndoesntexist.invalid\n").CheckPortEach(port, time.Second).String()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got != want {
+		t.Errorf("want %q, got %q", want, got)
 	}
 }
 
-func TestFirst(t *testing.T) {
+func TestChmodEach(t *testing.T) {
 	t.Parallel()
-	want, err := ioutil.ReadFile("testdata/first10.golden.txt")
-	if err != nil {
+	if runtime.GOOS == "windows" {
+		t.Skip("Windows doesn't support Unix permissions")
+	}
+	dir := t.TempDir()
+	path := filepath.Join(dir, "script.sh")
+	if err := ioutil.WriteFile(path, []byte{}, 0644); err != nil {
 		t.Fatal(err)
 	}
-	input := script.File("testdata/first.input.txt")
-	got, err := input.First(10).Bytes()
+	script.Echo(path).DryRun().ChmodEach(0755)
+	info, err := os.Stat(path)
 	if err != nil {
-		t.Error(err)
+		t.Fatal(err)
 	}
-	if !bytes.Equal(got, want) {
-		t.Errorf("want %q, got %q", want, got)
+	if info.Mode().Perm() != 0644 {
+		t.Errorf("want mode unchanged in dry-run mode, got %v", info.Mode())
 	}
-	_, err = ioutil.ReadAll(input.Reader)
-	if err == nil {
-		t.Error("input not closed after reading")
+	p := script.Echo(path + "\n" + filepath.Join(dir, "doesntexist")).ChmodEach(0755)
+	if p.Error() == nil {
+		t.Error("want error for nonexistent file, got nil")
 	}
-	input = script.File("testdata/first.input.txt")
-	gotZero, err := input.First(0).CountLines()
+	info, err = os.Stat(path)
 	if err != nil {
 		t.Fatal(err)
 	}
-	if gotZero != 0 {
-		t.Errorf("want 0 lines, got %d lines", gotZero)
-	}
-	_, err = ioutil.ReadAll(input.Reader)
-	if err == nil {
-		t.Error("input not closed after reading")
+	if info.Mode().Perm() != 0755 {
+		t.Errorf("want mode 0755, got %v", info.Mode())
 	}
-	input = script.File("testdata/first.input.txt")
-	gotZero, err = input.First(-1).CountLines()
+}
+
+func TestClone(t *testing.T) {
+	t.Parallel()
+	want, err := script.File("testdata/bytes.bin").Bytes()
 	if err != nil {
 		t.Fatal(err)
 	}
-	if gotZero != 0 {
-		t.Errorf("want 0 lines, got %d lines", gotZero)
+	pipes := script.File("testdata/bytes.bin").Clone(3)
+	if len(pipes) != 3 {
+		t.Fatalf("want 3 pipes, got %d", len(pipes))
 	}
-	_, err = ioutil.ReadAll(input.Reader)
-	if err == nil {
-		t.Error("input not closed after reading")
+	path := t.TempDir() + "/copy.bin"
+	if _, err := pipes[0].WriteFile(path); err != nil {
+		t.Fatal(err)
 	}
-	want, err = script.File("testdata/first.input.txt").Bytes()
+	got, err := os.ReadFile(path)
 	if err != nil {
 		t.Fatal(err)
 	}
-	got, err = script.File("testdata/first.input.txt").First(100).Bytes()
+	if !bytes.Equal(want, got) {
+		t.Errorf("first clone: want %q, got %q", want, got)
+	}
+	wantSum, err := script.Echo(string(want)).SHA256Sum()
 	if err != nil {
 		t.Fatal(err)
 	}
-	if !bytes.Equal(got, want) {
-		t.Errorf("want %q, got %q", want, got)
-	}
-}
-
-func TestFreq(t *testing.T) {
-	t.Parallel()
-	want, err := ioutil.ReadFile("testdata/freq.golden.txt")
+	gotSum, err := pipes[1].SHA256Sum()
 	if err != nil {
 		t.Fatal(err)
 	}
-	got, err := script.File("testdata/freq.input.txt").Freq().Bytes()
+	if wantSum != gotSum {
+		t.Errorf("second clone: want sum %q, got %q", wantSum, gotSum)
+	}
+	got, err = pipes[2].Bytes()
 	if err != nil {
-		t.Error(err)
+		t.Fatal(err)
 	}
-	if !bytes.Equal(got, want) {
-		t.Errorf("want %q, got %q", want, got)
+	if !bytes.Equal(want, got) {
+		t.Errorf("third clone: want %q, got %q", want, got)
 	}
 }
 
-func TestJoin(t *testing.T) {
+func TestCloneKeepsErrorStatusAndSettings(t *testing.T) {
 	t.Parallel()
-	input := "hello\nfrom\nthe\njoin\ntest\n"
-	want := "hello from the join test\n"
-	got, err := script.Echo(input).Join().String()
-	if err != nil {
-		t.Error(err)
+	for _, p := range script.File("testdata/nonexistent.txt").Clone(2) {
+		if p.Error() == nil {
+			t.Error("want error status copied to clone, got nil")
+		}
 	}
-	if got != want {
-		t.Errorf("want %q, got %q", want, got)
+	p := script.Echo("a\n").Binary().Clone(1)[0]
+	_, err := p.CountLines()
+	if !errors.Is(err, script.ErrBinary) {
+		t.Errorf("want binary mode copied to clone, got error %v", err)
 	}
-	input = "hello\nworld"
-	want = "hello world"
-	got, err = script.Echo(input).Join().String()
-	if err != nil {
-		t.Error(err)
+}
+
+func TestCloneGivesEachCloneItsOwnStdin(t *testing.T) {
+	t.Parallel()
+	pipes := script.NewPipe().WithStdin(strings.NewReader("hello\n")).Clone(2)
+	for i, p := range pipes {
+		got, err := p.Exec("cat").String()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got != "hello\n" {
+			t.Errorf("clone %d: want %q, got %q", i, "hello\n", got)
+		}
 	}
-	if got != want {
-		t.Errorf("want %q, got %q", want, got)
+}
+
+func TestCloneGivesEachCloneItsOwnCacheEntry(t *testing.T) {
+	t.Parallel()
+	dir := t.TempDir()
+	pipes := script.Echo("a\n").WithCacheDir(dir).Cached("key", time.Hour).Clone(2)
+	for i, p := range pipes {
+		got, err := p.Exec("cat").String()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got != "a\n" {
+			t.Errorf("clone %d: want %q, got %q", i, "a\n", got)
+		}
 	}
 }
 
-func TestLast(t *testing.T) {
+func TestColumn(t *testing.T) {
 	t.Parallel()
-	want, err := ioutil.ReadFile("testdata/last10.golden.txt")
+	want, err := ioutil.ReadFile("testdata/column.golden.txt")
 	if err != nil {
 		t.Fatal(err)
 	}
-	input := script.File("testdata/first.input.txt")
-	got, err := input.Last(10).Bytes()
+	got, err := script.File("testdata/column.input.txt").Column(3).Bytes()
 	if err != nil {
 		t.Error(err)
 	}
 	if !bytes.Equal(got, want) {
 		t.Errorf("want %q, got %q", want, got)
 	}
+	got, err = script.File("testdata/column.input.txt").Column(0).Bytes()
+	if err != nil {
+		t.Error()
+	}
+	if !bytes.Equal(got, []byte{}) {
+		t.Errorf("want %q, got %q", want, got)
+	}
+	got, err = script.File("testdata/column.input.txt").Column(-1).Bytes()
+	if err != nil {
+		t.Error()
+	}
+	if !bytes.Equal(got, []byte{}) {
+		t.Errorf("want %q, got %q", want, got)
+	}
+	got, err = script.File("testdata/column.input.txt").Column(10).Bytes()
+	if err != nil {
+		t.Error()
+	}
+	if !bytes.Equal(got, []byte{}) {
+		t.Errorf("want %q, got %q", want, got)
+	}
+}
+
+func TestCombinedLog(t *testing.T) {
+	t.Parallel()
+	input := `203.0.113.7 - frank [10/Oct/2023:13:55:36 -0700] "GET /index.html HTTP/1.1" 200 2326 "https://example.com/" "Mozilla/5.0 (X11)"
+198.51.100.2 - - [10/Oct/2023:13:55:37 -0700] "POST /login HTTP/1.1" 401 -
+garbage line
+`
+	want := `remote_addr=203.0.113.7 ident=- user=frank time="10/Oct/2023:13:55:36 -0700" request="GET /index.html HTTP/1.1" method=GET path=/index.html protocol=HTTP/1.1 status=200 bytes=2326 referer=https://example.com/ user_agent="Mozilla/5.0 (X11)"
+remote_addr=198.51.100.2 ident=- user=- time="10/Oct/2023:13:55:37 -0700" request="POST /login HTTP/1.1" method=POST path=/login protocol=HTTP/1.1 status=401 bytes=-
+`
+	got, err := script.Echo(input).CombinedLog().String()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got != want {
+		t.Errorf("want %q, got %q", want, got)
+	}
+	got, err = script.Echo(input).CombinedLog().Field("user_agent").String()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got != "Mozilla/5.0 (X11)\n" {
+		t.Errorf("want user agent, got %q", got)
+	}
+}
+
+func TestConcat(t *testing.T) {
+	t.Parallel()
+	want, err := ioutil.ReadFile("testdata/concat.golden.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := script.Echo("testdata/test.txt\ntestdata/doesntexist.txt\ntestdata/hello.txt").Concat().Bytes()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, want) {
+		t.Errorf("want %q, got %q", want, got)
+	}
+}
+
+func TestConcatWithNames(t *testing.T) {
+	t.Parallel()
+	dir := t.TempDir()
+	a, b := filepath.Join(dir, "a.txt"), filepath.Join(dir, "b.txt")
+	if err := os.WriteFile(a, []byte("one\ntwo\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(b, []byte("three"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	input := strings.Join([]string{a, filepath.Join(dir, "nonexistent.txt"), dir, b}, "\n")
+	got, err := script.Echo(input).ConcatWithNames().String()
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := a + ":one\n" + a + ":two\n" + b + ":three\n"
+	if got != want {
+		t.Errorf("want %q, got %q", want, got)
+	}
+}
+
+func TestConcatWithNamesSetsErrorForLineTooLong(t *testing.T) {
+	t.Parallel()
+	path := filepath.Join(t.TempDir(), "long.txt")
+	if err := os.WriteFile(path, []byte(strings.Repeat("x", 100000)+"\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	p := script.Echo(path).ConcatWithNames()
+	if !errors.Is(p.Error(), bufio.ErrTooLong) {
+		t.Errorf("want bufio.ErrTooLong, got %v", p.Error())
+	}
+}
+
+func TestConfirm(t *testing.T) {
+	t.Parallel()
+	tcs := []struct {
+		answer  string
+		confirm bool
+	}{
+		{"y\n", true},
+		{"Yes\n", true},
+		{" YES ", true},
+		{"n\n", false},
+		{"\n", false},
+		{"", false},
+		{"yes please\n", false},
+	}
+	for _, tc := range tcs {
+		prompt, stdout := &bytes.Buffer{}, &bytes.Buffer{}
+		p := script.Echo("a\nb\n").WithStdout(stdout).WithStderr(prompt).WithStdin(strings.NewReader(tc.answer)).Confirm("Delete?")
+		if prompt.String() != "Delete? [y/N] " {
+			t.Errorf("want prompt %q, got %q", "Delete? [y/N] ", prompt.String())
+		}
+		if stdout.Len() > 0 {
+			t.Errorf("want nothing written to standard output, got %q", stdout)
+		}
+		if !tc.confirm {
+			if p.Error() != script.ErrNotConfirmed {
+				t.Errorf("answer %q: want ErrNotConfirmed, got %v", tc.answer, p.Error())
+			}
+			continue
+		}
+		got, err := p.String()
+		if err != nil {
+			t.Errorf("answer %q: unexpected error %v", tc.answer, err)
+		}
+		if got != "a\nb\n" {
+			t.Errorf("answer %q: want %q, got %q", tc.answer, "a\nb\n", got)
+		}
+	}
+}
+
+func TestConfirmPreview(t *testing.T) {
+	t.Parallel()
+	prompt := &bytes.Buffer{}
+	p := script.Echo("1\n2\n3\n4\n").WithStderr(prompt).WithStdin(strings.NewReader("y\n")).ConfirmPreview("Remove these files?", 2)
+	want := "1\n2\n... (2 more lines)\nRemove these files? [y/N] "
+	if prompt.String() != want {
+		t.Errorf("want prompt %q, got %q", want, prompt.String())
+	}
+	got, err := p.String()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got != "1\n2\n3\n4\n" {
+		t.Errorf("want %q, got %q", "1\n2\n3\n4\n", got)
+	}
+}
+
+func TestConfirmStopsLaterStages(t *testing.T) {
+	t.Parallel()
+	dir := t.TempDir()
+	path := filepath.Join(dir, "precious")
+	if err := ioutil.WriteFile(path, []byte{}, 0644); err != nil {
+		t.Fatal(err)
+	}
+	script.Echo(path).WithStderr(ioutil.Discard).WithStdin(strings.NewReader("no\n")).Confirm("Really?").ExecForEach("rm {{.}}")
+	if _, err := os.Stat(path); err != nil {
+		t.Errorf("want file to survive unconfirmed pipeline, got %v", err)
+	}
+}
+
+func TestCopyFilesTo(t *testing.T) {
+	t.Parallel()
+	dst := t.TempDir()
+	input := "testdata/hello.txt\ntestdata/doesntexist.txt\ntestdata/multiple_files\ntestdata/test.txt\n"
+	p := script.Echo(input).CopyFilesTo(dst)
+	if p.Error() == nil {
+		t.Error("want error for nonexistent file and directory, got nil")
+	} else {
+		for _, name := range []string{"doesntexist.txt", "multiple_files"} {
+			if !strings.Contains(p.Error().Error(), name) {
+				t.Errorf("want error to mention %s, got %v", name, p.Error())
+			}
+		}
+	}
+	p.SetError(nil)
+	got, err := p.String()
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := filepath.Join(dst, "hello.txt") + "\n" + filepath.Join(dst, "test.txt") + "\n"
+	if got != want {
+		t.Errorf("want %q, got %q", want, got)
+	}
+	for _, name := range []string{"hello.txt", "test.txt"} {
+		orig, err := ioutil.ReadFile(filepath.Join("testdata", name))
+		if err != nil {
+			t.Fatal(err)
+		}
+		copied, err := ioutil.ReadFile(filepath.Join(dst, name))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(orig, copied) {
+			t.Errorf("%s: want copy to match original", name)
+		}
+	}
+}
+
+func TestCopyFilesToDryRun(t *testing.T) {
+	t.Parallel()
+	dst := t.TempDir()
+	got, err := script.Echo("testdata/hello.txt\n").DryRun().CopyFilesTo(dst).String()
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := filepath.Join(dst, "hello.txt") + "\n"
+	if got != want {
+		t.Errorf("want %q, got %q", want, got)
+	}
+	if _, err := os.Stat(filepath.Join(dst, "hello.txt")); !os.IsNotExist(err) {
+		t.Errorf("want no file copied in dry-run mode, got %v", err)
+	}
+}
+
+func TestCopyFilesToDryRunReportsMissingFile(t *testing.T) {
+	t.Parallel()
+	p := script.Echo("testdata/doesntexist.txt\n").DryRun().CopyFilesTo(t.TempDir())
+	if !errors.Is(p.Error(), fs.ErrNotExist) {
+		t.Errorf("want ErrNotExist for missing file in dry-run mode, got %v", p.Error())
+	}
+}
+
+func TestCopyFilesToRefusesToCopyFileOntoItself(t *testing.T) {
+	t.Parallel()
+	dir := t.TempDir()
+	path := filepath.Join(dir, "a.txt")
+	if err := os.WriteFile(path, []byte("hello"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	p := script.Echo(path).CopyFilesTo(dir)
+	if p.Error() == nil {
+		t.Error("want error copying file onto itself, got nil")
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(data) != "hello" {
+		t.Errorf("want file untouched, got %q", data)
+	}
+}
+
+func TestCountBy(t *testing.T) {
+	t.Parallel()
+	input := "ERROR disk full\nINFO started\nERROR timeout\nWARN slow\nINFO stopped\nERROR again\n"
+	want := "ERROR\t3\nINFO\t2\nWARN\t1\n"
+	got, err := script.Echo(input).CountBy(firstWord).String()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got != want {
+		t.Errorf("want %q, got %q", want, got)
+	}
+}
+
+func TestCountByOnBinaryPipeIsError(t *testing.T) {
+	t.Parallel()
+	_, err := script.Echo("a\n").Binary().CountBy(firstWord).String()
+	if !errors.Is(err, script.ErrBinary) {
+		t.Errorf("want ErrBinary, got %v", err)
+	}
+}
+
+func TestDedupe(t *testing.T) {
+	t.Parallel()
+	input := "b\na\nb\nc\na\n\nb\n\n"
+	want := "b\na\nc\n\n"
+	got, err := script.Echo(input).Dedupe().String()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got != want {
+		t.Errorf("want %q, got %q", want, got)
+	}
+}
+
+func TestDedupeApprox(t *testing.T) {
+	t.Parallel()
+	var input strings.Builder
+	for i := 0; i < 3; i++ {
+		for j := 0; j < 1000; j++ {
+			fmt.Fprintf(&input, "line %d\n", j)
+		}
+	}
+	got, err := script.Echo(input.String()).DedupeApprox(1000, 0.001).Slice()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(got) > 1000 {
+		t.Fatalf("want at most 1000 distinct lines, got %d", len(got))
+	}
+	// Allow for a few false positives.
+	if len(got) < 990 {
+		t.Errorf("want about 1000 distinct lines, got %d", len(got))
+	}
+	if got[0] != "line 0" {
+		t.Errorf("want first occurrence kept, got %q", got[0])
+	}
+	p := script.Echo("a\n").DedupeApprox(0, 0.01)
+	if p.Error() == nil {
+		t.Error("want error for invalid parameters, got nil")
+	}
+}
+
+func TestDialUnix(t *testing.T) {
+	t.Parallel()
+	path := filepath.Join(t.TempDir(), "upper.sock")
+	l, err := net.Listen("unix", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	go func() {
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		request, err := ioutil.ReadAll(conn)
+		if err != nil {
+			return
+		}
+		conn.Write(bytes.ToUpper(request))
+	}()
+	got, err := script.Echo("hello\nworld\n").DialUnix(path).String()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got != "HELLO\nWORLD\n" {
+		t.Errorf("want %q, got %q", "HELLO\nWORLD\n", got)
+	}
+}
+
+func TestDialUnixNonexistentSocket(t *testing.T) {
+	t.Parallel()
+	p := script.Echo("hello").DialUnix(filepath.Join(t.TempDir(), "bogus.sock"))
+	if p.Error() == nil {
+		t.Error("want error dialling nonexistent socket, got nil")
+	}
+}
+
+func TestDirname(t *testing.T) {
+	t.Parallel()
+	testCases := []struct {
+		testFileName string
+		want         string
+	}{
+		{"/", "/\n"},
+		{"\n", ".\n"},
+		{"/root", "/\n"},
+		{"/tmp/example.php", "/tmp\n"},
+		{"/var/tmp/example.php", "/var/tmp\n"},
+		{"/var/tmp", "/var\n"},
+		{"/var/tmp/", "/var\n"},
+		{"./src/filters", "./src\n"},
+		{"./src/filters/", "./src\n"},
+		{"/tmp/script-21345.txt\n/tmp/script-5371253.txt", "/tmp\n/tmp\n"},
+		{"C:/Program Files/PHP", "C:/Program Files\n"},
+		{"C:/Program Files/PHP/", "C:/Program Files\n"},
+	}
+	if runtime.GOOS == "windows" {
+		testCases = append(testCases, []struct {
+			testFileName string
+			want         string
+		}{
+			{"C:/Program Files", "C:/\n"},
+			{`C:\Program Files\PHP`, "C:\\Program Files\n"},
+			{`C:\Program Files\PHP\`, "C:\\Program Files\n"},
+			{`.\src\filters`, ".\\src\n"},
+		}...)
+	} else {
+		testCases = append(testCases, struct {
+			testFileName string
+			want         string
+		}{"C:/Program Files", "C:\n"})
+	}
+	for _, tc := range testCases {
+		got, err := script.Echo(tc.testFileName).Dirname().String()
+		if err != nil {
+			t.Error(err)
+		}
+		if got != tc.want {
+			t.Errorf("%q: want %q, got %q", tc.testFileName, tc.want, got)
+		}
+	}
+}
+
+func TestDryRunCarriesThroughFilters(t *testing.T) {
+	t.Parallel()
+	src, dst := t.TempDir(), t.TempDir()
+	path := filepath.Join(src, "a.txt")
+	if err := os.WriteFile(path, []byte("hello"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	filters := map[string]func(*script.Pipe) *script.Pipe{
+		"Column": func(p *script.Pipe) *script.Pipe { return p.Column(1) },
+		"First":  func(p *script.Pipe) *script.Pipe { return p.Reject("zzz").First(5) },
+		"Freq":   func(p *script.Pipe) *script.Pipe { return p.Freq().Column(2) },
+	}
+	for name, filter := range filters {
+		_, err := filter(script.Echo(path + "\n").DryRun()).RemoveFiles().String()
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = filter(script.Echo(path + "\n").DryRun()).MoveFilesTo(dst).String()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := os.Stat(path); err != nil {
+			t.Fatalf("%s: want file untouched in dry-run mode, got %v", name, err)
+		}
+	}
+}
+
+func TestEachLine(t *testing.T) {
+	t.Parallel()
+	p := script.Echo("Hello\nGoodbye")
+	q := p.EachLine(func(line string, out *strings.Builder) {
+		out.WriteString(line + " world\n")
+	})
+	want := "Hello world\nGoodbye world\n"
+	got, err := q.String()
+	if err != nil {
+		t.Error(err)
+	}
+	if got != want {
+		t.Errorf("want %q, got %q", want, got)
+	}
+}
+
+func TestEachLineBytes(t *testing.T) {
+	t.Parallel()
+	p := script.Echo("Hello\nGoodbye\r\nNo newline")
+	q := p.EachLineBytes(func(line, out []byte) []byte {
+		out = append(out, line...)
+		return append(out, " world\n"...)
+	})
+	want := "Hello world\nGoodbye world\nNo newline world\n"
+	got, err := q.String()
+	if err != nil {
+		t.Error(err)
+	}
+	if got != want {
+		t.Errorf("want %q, got %q", want, got)
+	}
+}
+
+func TestEachLineBytesHandlesLongLines(t *testing.T) {
+	t.Parallel()
+	long := strings.Repeat("x", 50000)
+	var lens []int
+	_, err := script.Echo(long + "\n" + long + "y\n").EachLineBytes(func(line, out []byte) []byte {
+		lens = append(lens, len(line))
+		return out
+	}).String()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(lens) != 2 || lens[0] != 50000 || lens[1] != 50001 {
+		t.Errorf("want line lengths [50000 50001], got %v", lens)
+	}
+}
+
+func TestExecFilter(t *testing.T) {
+	t.Parallel()
+	want := "hello world"
+	p := script.File("testdata/hello.txt")
+	q := p.Exec("cat")
+	got, err := q.String()
+	if err != nil {
+		t.Error(err)
+	}
+	if got != want {
+		t.Errorf("want %q, got %q", want, got)
+	}
+	// This should fail because p is now closed.
+	_, err = p.String()
+	if err == nil {
+		t.Error("input not closed after reading")
+	}
+	p = script.Echo("hello world")
+	p.SetError(errors.New("oh no"))
+	// This should be a no-op because the pipe has error status.
+	out, _ := p.Exec("cat").String()
+	if out != "" {
+		t.Error("want exec on erroneous pipe to be a no-op, but it wasn't")
+	}
+}
+
+func TestExecForEach(t *testing.T) {
+	t.Parallel()
+	tcs := []struct {
+		Input       []string
+		Command     string
+		ErrExpected bool
+		WantOutput  string
+	}{
+		{
+			Command:     "bash -c 'echo {{.}}'",
+			Input:       []string{"a", "b", "c"},
+			ErrExpected: false,
+			WantOutput:  "a\nb\nc\n",
+		},
+		{
+			Command:     "bash -c 'echo {{if not .}}DEFAULT{{else}}{{.}}{{end}}'",
+			Input:       []string{"a", "", "c"},
+			ErrExpected: false,
+			WantOutput:  "a\nDEFAULT\nc\n",
+		},
+		{
+			Command:     "bash -c 'echo {{bogus template syntax}}'",
+			Input:       []string{"a", "", "c"},
+			ErrExpected: true,
+			WantOutput:  "",
+		},
+		{
+			Command:     "bogus {{.}}",
+			Input:       []string{"a", "b", "c"},
+			ErrExpected: true,
+			WantOutput:  "",
+		},
+	}
+	for _, tc := range tcs {
+		t.Run(tc.Command, func(t *testing.T) {
+			p := script.Slice(tc.Input).ExecForEach(tc.Command)
+			if tc.ErrExpected != (p.Error() != nil) {
+				t.Fatalf("unexpected error value: %v", p.Error())
+			}
+			p.SetError(nil) // else p.String() would be a no-op
+			output, err := p.String()
+			if err != nil {
+				t.Fatalf("unexpected error %v", err)
+			}
+			if !strings.Contains(output, tc.WantOutput) {
+				t.Fatalf("want output %q to contain %q", output, tc.WantOutput)
+			}
+		})
+	}
+}
+
+func TestExecForEachFile(t *testing.T) {
+	t.Parallel()
+	got, err := script.Echo("a\nbb\n").ExecForEach("sh -c 'wc -c < {{.File}}; test -e {{.File}}'").Slice()
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{"2", "3"}
+	if len(got) != len(want) {
+		t.Fatalf("want %q, got %q", want, got)
+	}
+	for i := range want {
+		if strings.TrimSpace(got[i]) != want[i] {
+			t.Errorf("want %q, got %q", want[i], got[i])
+		}
+	}
+}
+
+func TestExecForEachCommandNotFoundRunsNothing(t *testing.T) {
+	t.Parallel()
+	p := script.Echo("a\nb\n").ExecForEach("doesntexist {{.}}")
+	if !errors.Is(p.Error(), script.ErrCommandNotFound) {
+		t.Errorf("want ErrCommandNotFound, got %v", p.Error())
+	}
+}
+
+func TestExecForEachParallelKeepsInputOrderByDefault(t *testing.T) {
+	t.Parallel()
+	got, err := script.Echo("3\n1\n2\n").ExecForEachParallel("sh -c 'sleep 0.{{.}}; echo {{.}}'", 3).String()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got != "3\n1\n2\n" {
+		t.Errorf("want %q, got %q", "3\n1\n2\n", got)
+	}
+}
+
+func TestExecForEachParallelUnorderedProducesResultsWhenReady(t *testing.T) {
+	t.Parallel()
+	got, err := script.Echo("3\n1\n2\n").WithOrdering(script.Unordered).ExecForEachParallel("sh -c 'sleep 0.{{.}}; echo {{.}}'", 3).String()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got != "1\n2\n3\n" {
+		t.Errorf("want %q, got %q", "1\n2\n3\n", got)
+	}
+}
+
+func TestExecForEachParallelStopsAtFailedCommand(t *testing.T) {
+	t.Parallel()
+	p := script.Echo("1\nbad\n3\n").ExecForEachParallel("sh -c 'test {{.}} != bad && echo {{.}}'", 1)
+	got, err := io.ReadAll(p)
+	if err == nil {
+		t.Error("want error from failed command, got nil")
+	}
+	if string(got) != "1\n" {
+		t.Errorf("want %q, got %q", "1\n", got)
+	}
+}
+
+func TestCachedReusesOutputForSameCommandAndInput(t *testing.T) {
+	t.Parallel()
+	dir := t.TempDir()
+	log := filepath.Join(dir, "log")
+	cmd := fmt.Sprintf("sh -c 'echo run >>%s; wc -l <%s; cat'", log, log)
+	run := func(key, input string, ttl time.Duration) string {
+		t.Helper()
+		got, err := script.Echo(input).WithCacheDir(filepath.Join(dir, "cache")).Cached(key, ttl).Exec(cmd).String()
+		if err != nil {
+			t.Fatal(err)
+		}
+		return strings.TrimSpace(got)
+	}
+	for _, tc := range []struct {
+		key, input string
+		ttl        time.Duration
+		want       string
+	}{
+		{"a", "x", time.Hour, "1\nx"},
+		{"a", "x", time.Hour, "1\nx"},
+		{"a", "y", time.Hour, "2\ny"},
+		{"b", "x", time.Hour, "3\nx"},
+		{"a", "x", 0, "4\nx"},
+	} {
+		if got := run(tc.key, tc.input, tc.ttl); got != tc.want {
+			t.Errorf("Cached(%q, %v) on %q: want %q, got %q", tc.key, tc.ttl, tc.input, tc.want, got)
+		}
+	}
+}
+
+func TestCachedDoesNotSaveFailedCommands(t *testing.T) {
+	t.Parallel()
+	dir := t.TempDir()
+	mark := filepath.Join(dir, "mark")
+	cmd := fmt.Sprintf("sh -c 'test -e %s && echo ok'", mark)
+	p := script.NewPipe().WithCacheDir(dir).Cached("test", time.Hour).ExecPipeline(cmd + " | cat")
+	if p.Error() == nil {
+		t.Fatal("want error from failed command, got nil")
+	}
+	if err := os.WriteFile(mark, nil, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	got, err := script.NewPipe().WithCacheDir(dir).Cached("test", time.Hour).ExecPipeline(cmd + " | cat").String()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got != "ok\n" {
+		t.Errorf("want %q, got %q", "ok\n", got)
+	}
+}
+
+func TestWithCheckpointResumesExecForEach(t *testing.T) {
+	t.Parallel()
+	dir := t.TempDir()
+	checkpoint := filepath.Join(dir, "checkpoint")
+	log := filepath.Join(dir, "log")
+	mark := filepath.Join(dir, "mark")
+	cmd := fmt.Sprintf("sh -c 'echo {{.}} >>%s; test {{.}} != b -o -e %s && echo {{.}}'", log, mark)
+	got, err := script.Echo("a\nb\nc\n").WithCheckpoint(checkpoint).ExecForEach(cmd).String()
+	if err == nil {
+		t.Fatal("want error from failed command, got nil")
+	}
+	if _, err := os.Stat(checkpoint); err != nil {
+		t.Fatalf("want checkpoint kept after failure: %v", err)
+	}
+	if err := os.WriteFile(mark, nil, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	got, err = script.Echo("a\nb\nc\n").WithCheckpoint(checkpoint).ExecForEach(cmd).String()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got != "b\nc\n" {
+		t.Errorf("want output only from unprocessed lines %q, got %q", "b\nc\n", got)
+	}
+	ran, err := script.File(log).String()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ran != "a\nb\nb\nc\n" {
+		t.Errorf("want commands for a, b, b, c, got %q", ran)
+	}
+	if _, err := os.Stat(checkpoint); !os.IsNotExist(err) {
+		t.Errorf("want checkpoint removed after complete run, got %v", err)
+	}
+}
+
+func TestWithCheckpointReprocessesChangedLines(t *testing.T) {
+	t.Parallel()
+	checkpoint := filepath.Join(t.TempDir(), "checkpoint")
+	_, err := script.Echo("a\nb\n").WithCheckpoint(checkpoint).ExecForEach("sh -c 'test {{.}} != b && echo {{.}}'").String()
+	if err == nil {
+		t.Fatal("want error from failed command, got nil")
+	}
+	got, err := script.Echo("A\nB\n").WithCheckpoint(checkpoint).ExecForEach("echo {{.}}").String()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got != "A\nB\n" {
+		t.Errorf("want %q, got %q", "A\nB\n", got)
+	}
+}
+
+func TestWithCheckpointResumesExecForEachParallel(t *testing.T) {
+	t.Parallel()
+	dir := t.TempDir()
+	checkpoint := filepath.Join(dir, "checkpoint")
+	mark := filepath.Join(dir, "mark")
+	cmd := fmt.Sprintf("sh -c 'test {{.}} != 3 -o -e %s && echo {{.}}'", mark)
+	got, err := io.ReadAll(script.Echo("1\n2\n3\n4\n").WithCheckpoint(checkpoint).ExecForEachParallel(cmd, 1))
+	if err == nil {
+		t.Fatal("want error from failed command, got nil")
+	}
+	if string(got) != "1\n2\n" {
+		t.Errorf("want %q, got %q", "1\n2\n", got)
+	}
+	if err := os.WriteFile(mark, nil, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	got, err = io.ReadAll(script.Echo("1\n2\n3\n4\n").WithCheckpoint(checkpoint).ExecForEachParallel(cmd, 2))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Line 4 may already have been processed when line 3 failed.
+	if string(got) != "3\n4\n" && string(got) != "3\n" {
+		t.Errorf("want output only from unprocessed lines, got %q", got)
+	}
+	if _, err := os.Stat(checkpoint); !os.IsNotExist(err) {
+		t.Errorf("want checkpoint removed after complete run, got %v", err)
+	}
+}
+
+func TestExecForEachResult(t *testing.T) {
+	t.Parallel()
+	p := script.Echo("0\n3\n").ExecForEachResult("sh -c 'echo \" out {{.}} \"; exit {{.}}'")
+	results, err := script.Lines(p, func(line string) (r script.ExecResult, err error) {
+		return r, json.Unmarshal([]byte(line), &r)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(results) != 2 {
+		t.Fatalf("want 2 results, got %d", len(results))
+	}
+	for i, want := range []script.ExecResult{
+		{Input: "0", ExitStatus: 0, Output: "out 0"},
+		{Input: "3", ExitStatus: 3, Output: "out 3"},
+	} {
+		got := results[i]
+		if got.Duration <= 0 {
+			t.Errorf("%s: want positive duration, got %v", want.Input, got.Duration)
+		}
+		got.Duration = 0
+		if got != want {
+			t.Errorf("want %+v, got %+v", want, got)
+		}
+	}
+}
+
+func TestExecForEachResultCommandNotFound(t *testing.T) {
+	t.Parallel()
+	line, err := script.Echo("a\n").ExecForEachResult("doesntexist {{.}}").String()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var r script.ExecResult
+	if err := json.Unmarshal([]byte(line), &r); err != nil {
+		t.Fatal(err)
+	}
+	if r.ExitStatus != -1 || r.Error == "" {
+		t.Errorf("want exit status -1 and error, got %+v", r)
+	}
+}
+
+func TestExecForEachIndexAndTotal(t *testing.T) {
+	t.Parallel()
+	want := "1/3 a\n2/3 b\n3/3 c\n"
+	got, err := script.Echo("a\nb\nc\n").ExecForEach("echo {{.Index}}/{{.Total}} {{.}}").String()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got != want {
+		t.Errorf("want %q, got %q", want, got)
+	}
+	want = "1 a\n2 b\n"
+	got, err = script.Echo("a\nb\n").ExecForEach("echo {{.Index}} {{.}}").String()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got != want {
+		t.Errorf("want %q, got %q", want, got)
+	}
+}
+
+func TestExecForEachParallelStopsReadingInputAfterFailure(t *testing.T) {
+	t.Parallel()
+	pr, pw := io.Pipe()
+	go pw.Write([]byte("bad\n"))
+	errc := make(chan error, 1)
+	go func() {
+		_, err := script.NewPipe().WithReader(pr).ExecForEachParallel("sh -c 'test {{.}} != bad'", 2).String()
+		errc <- err
+	}()
+	select {
+	case err := <-errc:
+		if err == nil || err.Error() != "exit status 1" {
+			t.Errorf("want exit status 1, got %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("want failure reported while input still open, but it wasn't")
+	}
+	if _, err := pw.Write([]byte("more\n")); err != io.ErrClosedPipe {
+		t.Errorf("want input closed after failure, got %v", err)
+	}
+}
+
+func TestExecForEachParallelLimitsLinesHeldForOrdering(t *testing.T) {
+	t.Parallel()
+	log := filepath.Join(t.TempDir(), "log")
+	var input strings.Builder
+	for i := range 20 {
+		fmt.Fprintln(&input, i+1)
+	}
+	// While line 1's command is slow, only a limited number of later lines
+	// should be started.
+	tpl := "sh -c 'echo {{.}} >>" + log + "; if [ {{.}} = 1 ]; then sleep 0.5; wc -l <" + log + "; fi'"
+	got, err := script.Echo(input.String()).ExecForEachParallel(tpl, 2).First(1).String()
+	if err != nil {
+		t.Fatal(err)
+	}
+	started, err := strconv.Atoi(strings.TrimSpace(got))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if started > 4 {
+		t.Errorf("want at most 4 lines started while line 1 is running, got %d", started)
+	}
+}
+
+func TestExecForEachParallelKeepsTemplateStatePerLine(t *testing.T) {
+	t.Parallel()
+	var input, want strings.Builder
+	for i := range 20 {
+		fmt.Fprintf(&input, "line%d\n", i+1)
+		fmt.Fprintf(&want, "%d line%d\n", i+1, i+1)
+	}
+	got, err := script.Echo(input.String()).ExecForEachParallel("sh -c 'echo {{.Index}} $(cat {{.File}})'", 8).String()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got != want.String() {
+		t.Errorf("want %q, got %q", want.String(), got)
+	}
+}
+
+func TestExecNoStdin(t *testing.T) {
+	t.Parallel()
+	got, err := script.Echo("this should not be read\n").ExecNoStdin("cat").String()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got != "" {
+		t.Errorf("want empty output, got %q", got)
+	}
+}
+
+func TestExecPipeline(t *testing.T) {
+	t.Parallel()
+	tcs := []struct {
+		input, cmdLine, want string
+		wantStatus           int
+	}{
+		{"b\na\nb\n", "sort | uniq -c | sort -rn | head -n 1", "      2 b\n", 0},
+		{"", "echo 'a|b' | tr '|' -", "a-b\n", 0},
+		{"", `echo a\|b`, "a|b\n", 0},
+		{"hello\n", "cat", "hello\n", 0},
+		{"", "sh -c 'exit 3' | sh -c 'exit 4' | cat", "", 4},
+		{"", "sh -c 'exit 3' | cat", "", 3},
+		{"", "sh -c 'echo oops >&2' | cat", "oops\n", 0},
+	}
+	for _, tc := range tcs {
+		p := script.Echo(tc.input).ExecPipeline(tc.cmdLine)
+		if p.ExitStatus() != tc.wantStatus {
+			t.Errorf("%q: want exit status %d, got %d (%v)", tc.cmdLine, tc.wantStatus, p.ExitStatus(), p.Error())
+		}
+		p.SetError(nil)
+		got, err := p.String()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got != tc.want {
+			t.Errorf("%q: want %q, got %q", tc.cmdLine, tc.want, got)
+		}
+	}
+}
+
+func TestExecPipelineInvalid(t *testing.T) {
+	t.Parallel()
+	for _, cmdLine := range []string{"echo 'oops | cat", "echo hello | | cat", "echo hello | doesntexist"} {
+		p := script.ExecPipeline(cmdLine)
+		if p.Error() == nil {
+			t.Errorf("%q: want error, got nil", cmdLine)
+		}
+	}
+}
+
+func TestExecPipelineCommandNotFoundRunsNothing(t *testing.T) {
+	t.Parallel()
+	if runtime.GOOS == "windows" {
+		t.Skip("touch command not available on Windows")
+	}
+	marker := filepath.Join(t.TempDir(), "marker")
+	err := script.ExecPipeline("touch " + marker + " | doesntexist | cat").Error()
+	if !errors.Is(err, script.ErrCommandNotFound) {
+		t.Fatalf("want ErrCommandNotFound, got %v", err)
+	}
+	want := "command not found: doesntexist at stage 2"
+	if err.Error() != want {
+		t.Errorf("want %q, got %q", want, err.Error())
+	}
+	if _, err := os.Stat(marker); err == nil {
+		t.Error("first stage ran, though a later stage wasn't found")
+	}
+}
+
+func FuzzExecPipelineSplitting(f *testing.F) {
+	for _, seed := range []string{
+		"ls | wc -l",
+		`echo 'a|b' | tr a b`,
+		`echo "x\"|y" | cat`,
+		`echo a\|b`,
+		"||",
+	} {
+		f.Add(seed)
+	}
+	f.Fuzz(func(t *testing.T, cmdLine string) {
+		stages := script.SplitPipeline(cmdLine)
+		if got := strings.Join(stages, "|"); got != cmdLine {
+			t.Fatalf("stages %q don't rejoin to %q", stages, cmdLine)
+		}
+		for _, stage := range stages {
+			shell.Split(stage)
+		}
+	})
+}
+
+func TestExecPowerShell(t *testing.T) {
+	t.Parallel()
+	name := "pwsh"
+	if runtime.GOOS == "windows" {
+		name = "powershell.exe"
+	}
+	if _, err := exec.LookPath(name); err != nil {
+		t.Skipf("%s not installed", name)
+	}
+	got, err := script.Echo("b\na\n").ExecPowerShell("$input | Sort-Object").String()
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := "a b"
+	if strings.Join(strings.Fields(got), " ") != want {
+		t.Errorf("want %q, got %q", want, got)
+	}
+}
+
+func TestExecShell(t *testing.T) {
+	t.Parallel()
+	// `sort` and `&&` work the same way in both sh and cmd.exe.
+	got, err := script.Echo("b\na\n").ExecShell("sort && echo done").String()
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := "a b done"
+	if strings.Join(strings.Fields(got), " ") != want {
+		t.Errorf("want %q, got %q", want, got)
+	}
+}
+
+func TestExecShellReportsExitStatus(t *testing.T) {
+	t.Parallel()
+	p := script.ExecShell("exit 3")
+	if p.Error() == nil {
+		t.Fatal("want error from failing command, got nil")
+	}
+	if p.ExitStatus() != 3 {
+		t.Errorf("want exit status 3, got %d", p.ExitStatus())
+	}
+}
+
+func TestExpandCIDR(t *testing.T) {
+	t.Parallel()
+	want := "192.168.1.0\n192.168.1.1\n192.168.1.2\n192.168.1.3\n2001:db8::\n2001:db8::1\n"
+	got, err := script.Echo("192.168.1.1/30\n2001:db8::/127\n").ExpandCIDR().String()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got != want {
+		t.Errorf("want %q, got %q", want, got)
+	}
+	got, err = script.Echo("10.0.0.0/8\n").ExpandCIDR().First(2).String()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got != "10.0.0.0\n10.0.0.1\n" {
+		t.Errorf("want first two addresses, got %q", got)
+	}
+	_, err = script.Echo("bogus\n").ExpandCIDR().String()
+	if err == nil {
+		t.Error("want error expanding invalid prefix, got nil")
+	}
+}
+
+func TestExpandCIDRPassesOnAddressesBeforeError(t *testing.T) {
+	t.Parallel()
+	got, err := io.ReadAll(script.Echo("10.0.0.0/31\nbogus\n").ExpandCIDR())
+	if err == nil {
+		t.Error("want error expanding invalid prefix, got nil")
+	}
+	if string(got) != "10.0.0.0\n10.0.0.1\n" {
+		t.Errorf("want addresses before invalid prefix, got %q", got)
+	}
+}
+
+func TestExtractBlocks(t *testing.T) {
+	t.Parallel()
+	input := "starting\npanic: oh no\n\tmain.go:10\n\tmain.go:5\nrecovered\npanic: again\n  util.go:3\n"
+	want := "panic: oh no\\n\tmain.go:10\\n\tmain.go:5\npanic: again\\n  util.go:3\n"
+	got, err := script.Echo(input).ExtractBlocks(regexp.MustCompile(`^panic:`), nil).String()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got != want {
+		t.Errorf("want %q, got %q", want, got)
+	}
+}
+
+func TestExtractBlocksWithContinuationFunc(t *testing.T) {
+	t.Parallel()
+	input := "ERROR a\nERROR b\ncaused by: c\nINFO d\ncaused by: e\n"
+	want := "ERROR a\nERROR b\\ncaused by: c\n"
+	isCause := func(line string) bool {
+		return strings.HasPrefix(line, "caused by:")
+	}
+	got, err := script.Echo(input).ExtractBlocks(regexp.MustCompile(`^ERROR`), isCause).String()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got != want {
+		t.Errorf("want %q, got %q", want, got)
+	}
+}
+
+func TestField(t *testing.T) {
+	t.Parallel()
+	input := `level=info msg="server started" port=8080
+level=error msg="it's \"broken\"" err=timeout
+msg=no-level
+`
+	tcs := []struct {
+		name, want string
+	}{
+		{"level", "info\nerror\n"},
+		{"msg", "server started\nit's \"broken\"\nno-level\n"},
+		{"err", "timeout\n"},
+		{"missing", ""},
+	}
+	for _, tc := range tcs {
+		got, err := script.Echo(input).Field(tc.name).String()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got != tc.want {
+			t.Errorf("%s: want %q, got %q", tc.name, tc.want, got)
+		}
+	}
+}
+
+func TestFilterByMTime(t *testing.T) {
+	t.Parallel()
+	dir := t.TempDir()
+	old, recent := filepath.Join(dir, "old"), filepath.Join(dir, "recent")
+	for _, path := range []string{old, recent} {
+		if err := ioutil.WriteFile(path, []byte{}, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	then := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	if err := os.Chtimes(old, then, then); err != nil {
+		t.Fatal(err)
+	}
+	input := old + "\n" + recent + "\n"
+	tcs := []struct {
+		after, before time.Time
+		want          string
+	}{
+		{time.Time{}, time.Time{}, input},
+		{then.Add(time.Hour), time.Time{}, recent + "\n"},
+		{time.Time{}, then, old + "\n"},
+		{then, then, old + "\n"},
+		{then.Add(time.Hour), then.Add(2 * time.Hour), ""},
+	}
+	for _, tc := range tcs {
+		got, err := script.Echo(input).FilterByMTime(tc.after, tc.before).String()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got != tc.want {
+			t.Errorf("after %v, before %v: want %q, got %q", tc.after, tc.before, tc.want, got)
+		}
+	}
+}
+
+func TestFilterBySize(t *testing.T) {
+	t.Parallel()
+	input := "testdata/hello.txt\ntestdata/empty.txt\ntestdata/test.txt\n"
+	tcs := []struct {
+		min, max int64
+		want     string
+	}{
+		{0, -1, input},
+		{1, -1, "testdata/hello.txt\ntestdata/test.txt\n"},
+		{0, 0, "testdata/empty.txt\n"},
+		{11, 11, "testdata/hello.txt\n"},
+		{1000000, -1, ""},
+	}
+	for _, tc := range tcs {
+		got, err := script.Echo(input).FilterBySize(tc.min, tc.max).String()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got != tc.want {
+			t.Errorf("min %d, max %d: want %q, got %q", tc.min, tc.max, tc.want, got)
+		}
+	}
+	p := script.Echo("testdata/doesntexist.txt\n").FilterBySize(0, -1)
+	if p.Error() == nil {
+		t.Error("want error for nonexistent file, got nil")
+	}
+}
+
+func TestFilterCIDR(t *testing.T) {
+	t.Parallel()
+	input := "10.1.2.3\n192.168.0.1\nnot an address\n10.255.255.255\n::ffff:10.0.0.1\n2001:db8::1\n"
+	want := "10.1.2.3\n10.255.255.255\n::ffff:10.0.0.1\n"
+	got, err := script.Echo(input).FilterCIDR("10.0.0.0/8").String()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got != want {
+		t.Errorf("want %q, got %q", want, got)
+	}
+	p := script.Echo(input).FilterCIDR("10.0.0.0/33")
+	if p.Error() == nil {
+		t.Error("want error for invalid prefix, got nil")
+	}
+}
+
+func TestFilterSince(t *testing.T) {
+	t.Parallel()
+	input := "2024-03-01T10:00:00Z first\n2024-03-02T10:00:00Z second\nno timestamp here\n2024-03-03T10:00:00Z third\n"
+	since := time.Date(2024, 3, 2, 10, 0, 0, 0, time.UTC)
+	want := "2024-03-02T10:00:00Z second\n2024-03-03T10:00:00Z third\n"
+	got, err := script.Echo(input).FilterSince(since, time.RFC3339, 1).String()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got != want {
+		t.Errorf("want %q, got %q", want, got)
+	}
+}
+
+func TestFilterSinceDelimitsColumnsAsColumnDoes(t *testing.T) {
+	t.Parallel()
+	input := "web1\u00a02024-03-01T10:00:00Z old\nweb1\u20032024-03-05T10:00:00Z new\n"
+	since := time.Date(2024, 3, 2, 0, 0, 0, 0, time.UTC)
+	want := "web1\u20032024-03-05T10:00:00Z new\n"
+	got, err := script.Echo(input).FilterSince(since, time.RFC3339, 2).String()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got != want {
+		t.Errorf("want %q, got %q", want, got)
+	}
+}
+
+func TestFilterSinceMultiColumnLayout(t *testing.T) {
+	t.Parallel()
+	input := "INFO 2024-03-01 10:00:00 +0000 old\nINFO 2024-03-05 09:30:00 +0000 new\n"
+	since := time.Date(2024, 3, 2, 0, 0, 0, 0, time.UTC)
+	want := "INFO 2024-03-05 09:30:00 +0000 new\n"
+	got, err := script.Echo(input).FilterSince(since, "2006-01-02 15:04:05 -0700", 2).String()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got != want {
+		t.Errorf("want %q, got %q", want, got)
+	}
+}
+
+func TestFirst(t *testing.T) {
+	t.Parallel()
+	want, err := ioutil.ReadFile("testdata/first10.golden.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	input := script.File("testdata/first.input.txt")
+	got, err := input.First(10).Bytes()
+	if err != nil {
+		t.Error(err)
+	}
+	if !bytes.Equal(got, want) {
+		t.Errorf("want %q, got %q", want, got)
+	}
+	_, err = ioutil.ReadAll(input.Reader)
+	if err == nil {
+		t.Error("input not closed after reading")
+	}
+	input = script.File("testdata/first.input.txt")
+	gotZero, err := input.First(0).CountLines()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if gotZero != 0 {
+		t.Errorf("want 0 lines, got %d lines", gotZero)
+	}
+	_, err = ioutil.ReadAll(input.Reader)
+	if err == nil {
+		t.Error("input not closed after reading")
+	}
+	input = script.File("testdata/first.input.txt")
+	gotZero, err = input.First(-1).CountLines()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if gotZero != 0 {
+		t.Errorf("want 0 lines, got %d lines", gotZero)
+	}
+	_, err = ioutil.ReadAll(input.Reader)
+	if err == nil {
+		t.Error("input not closed after reading")
+	}
+	want, err = script.File("testdata/first.input.txt").Bytes()
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err = script.File("testdata/first.input.txt").First(100).Bytes()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, want) {
+		t.Errorf("want %q, got %q", want, got)
+	}
+}
+
+func TestFirstSuccess(t *testing.T) {
+	t.Parallel()
+	log := filepath.Join(t.TempDir(), "log")
+	got, err := script.Echo("a\nb\nc\n").FirstSuccess("sh -c 'echo {{.}} >>" + log + "; test {{.}} = b'").String()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got != "b\n" {
+		t.Errorf("want %q, got %q", "b\n", got)
+	}
+	ran, err := os.ReadFile(log)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(ran) != "a\nb\n" {
+		t.Errorf("want commands run only until success, got %q", ran)
+	}
+}
+
+func TestFirstSuccessNoneSucceed(t *testing.T) {
+	t.Parallel()
+	p := script.Echo("a\nb\n").FirstSuccess("false")
+	if p.Error() == nil {
+		t.Fatal("want error when no command succeeds, got nil")
+	}
+	if p.ExitStatus() != 1 {
+		t.Errorf("want exit status 1, got %d", p.ExitStatus())
+	}
+}
+
+func TestFirstSuccessEmptyInput(t *testing.T) {
+	t.Parallel()
+	p := script.Echo("").FirstSuccess("true")
+	if p.Error() == nil {
+		t.Error("want error for empty input, got nil")
+	}
+}
+
+func TestFirstSuccessParallelKillsOtherCommands(t *testing.T) {
+	t.Parallel()
+	start := time.Now()
+	p := script.Echo("slow\nfast\nslower\n")
+	got, err := p.FirstSuccessParallel("sh -c 'test {{.}} = fast || exec sleep 10'", 3).String()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got != "fast\n" {
+		t.Errorf("want %q, got %q", "fast\n", got)
+	}
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Errorf("want other commands killed, but took %s", elapsed)
+	}
+}
+
+func TestFirstSuccessParallelNoneSucceed(t *testing.T) {
+	t.Parallel()
+	p := script.Echo("a\nb\n").FirstSuccessParallel("false", 2)
+	if p.Error() == nil {
+		t.Fatal("want error when no command succeeds, got nil")
+	}
+}
+
+func TestFirstSuccessParallelEmptyInput(t *testing.T) {
+	t.Parallel()
+	p := script.Echo("").FirstSuccessParallel("true", 2)
+	if p.Error() == nil {
+		t.Error("want error for empty input, got nil")
+	}
+}
+
+func TestFreq(t *testing.T) {
+	t.Parallel()
+	want, err := ioutil.ReadFile("testdata/freq.golden.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := script.File("testdata/freq.input.txt").Freq().Bytes()
+	if err != nil {
+		t.Error(err)
+	}
+	if !bytes.Equal(got, want) {
+		t.Errorf("want %q, got %q", want, got)
+	}
+}
+
+func TestGlob(t *testing.T) {
+	t.Parallel()
+	input := "testdata/multiple_files/*.txt\ntestdata/doesntexist*\ntestdata/hello.txt\n"
+	want := "testdata/multiple_files/1.txt\ntestdata/multiple_files/2.txt\ntestdata/hello.txt\n"
+	got, err := script.Echo(input).Glob().String()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got != want {
+		t.Errorf("want %q, got %q", want, got)
+	}
+}
+
+func TestGlobInvalidPattern(t *testing.T) {
+	t.Parallel()
+	p := script.Echo("testdata/[\n").Glob()
+	if p.Error() == nil {
+		t.Error("want error for malformed pattern, got nil")
+	}
+}
+
+func TestGroupLines(t *testing.T) {
+	t.Parallel()
+	input := "ERROR disk full\nINFO started\nERROR timeout\nWARN slow\nINFO stopped\n"
+	want := "ERROR disk full\nERROR timeout\nINFO started\nINFO stopped\nWARN slow\n"
+	got, err := script.Echo(input).GroupLines(firstWord).String()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got != want {
+		t.Errorf("want %q, got %q", want, got)
+	}
+}
+
+func TestGroupLinesOnBinaryPipeIsError(t *testing.T) {
+	t.Parallel()
+	_, err := script.Echo("a\n").Binary().GroupLines(firstWord).String()
+	if !errors.Is(err, script.ErrBinary) {
+		t.Errorf("want ErrBinary, got %v", err)
+	}
+}
+
+func TestHexdump(t *testing.T) {
+	t.Parallel()
+	input := "hello world\n\x00\x01abcdefghijklmnopq"
+	want := "00000000: 6865 6c6c 6f20 776f 726c 640a 0001 6162  hello world...ab\n" +
+		"00000010: 6364 6566 6768 696a 6b6c 6d6e 6f70 71    cdefghijklmnopq\n"
+	got, err := script.Echo(input).Hexdump().String()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got != want {
+		t.Errorf("want %q, got %q", want, got)
+	}
+	got, err = script.Echo("").Hexdump().String()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got != "" {
+		t.Errorf("want empty output for empty input, got %q", got)
+	}
+}
+
+func TestHistogramChart(t *testing.T) {
+	t.Parallel()
+	input := "1\n5\n10\n50\n20\n3\n"
+	want := "  <= 10 ██████████ 4\n <= 100 █████ 2\n<= 1000 0\n > 1000 0\n"
+	got, err := script.Echo(input).HistogramChart([]float64{10, 100, 1000}, 10).String()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got != want {
+		t.Errorf("want %q, got %q", want, got)
+	}
+	p := script.Echo("bogus\n").HistogramChart([]float64{10}, 10)
+	if p.Error() == nil {
+		t.Error("want error for non-numeric input, got nil")
+	}
+}
+
+func TestIfChangedSkipsUnchangedInput(t *testing.T) {
+	t.Parallel()
+	state := filepath.Join(t.TempDir(), "state")
+	for _, tc := range []struct {
+		input         string
+		wantUnchanged bool
+	}{
+		{"a\n", false},
+		{"a\n", true},
+		{"b\n", false},
+		{"a\n", false},
+	} {
+		p := script.Echo(tc.input).IfChanged(state)
+		got, err := p.String()
+		if tc.wantUnchanged {
+			if !errors.Is(err, script.ErrUnchanged) {
+				t.Errorf("%q: want ErrUnchanged, got %v", tc.input, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("%q: %v", tc.input, err)
+		}
+		if got != tc.input {
+			t.Errorf("want %q, got %q", tc.input, got)
+		}
+		if err := p.MarkDone(); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestIfChangedSavesStateOnlyOnMarkDone(t *testing.T) {
+	t.Parallel()
+	state := filepath.Join(t.TempDir(), "state")
+	p := script.Echo("a\n").IfChanged(state).Match("a")
+	if _, err := p.String(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(state); !os.IsNotExist(err) {
+		t.Fatalf("want no state saved before MarkDone, got %v", err)
+	}
+	if err := p.MarkDone(); err != nil {
+		t.Fatal(err)
+	}
+	err := script.Echo("a\n").IfChanged(state).Error()
+	if !errors.Is(err, script.ErrUnchanged) {
+		t.Errorf("want ErrUnchanged after MarkDone, got %v", err)
+	}
+}
+
+func TestIfChangedDoesntSaveStateWhenLaterStageFails(t *testing.T) {
+	t.Parallel()
+	state := filepath.Join(t.TempDir(), "state")
+	p := script.Echo("a\n").IfChanged(state).Exec("sh -c 'cat >/dev/null; exit 3'")
+	if _, err := p.String(); err == nil {
+		t.Fatal("want error from failing command, got nil")
+	}
+	if err := p.MarkDone(); err == nil {
+		t.Error("want MarkDone to return pipe's error, got nil")
+	}
+	if _, err := os.Stat(state); !os.IsNotExist(err) {
+		t.Fatalf("want no state saved after failure, got %v", err)
+	}
+	if err := script.Echo("a\n").IfChanged(state).Error(); err != nil {
+		t.Errorf("want input treated as changed, got %v", err)
+	}
+}
+
+func TestIfChangedStopsLaterStages(t *testing.T) {
+	t.Parallel()
+	dir := t.TempDir()
+	state := filepath.Join(dir, "state")
+	out := filepath.Join(dir, "out")
+	p := script.Echo("data\n").IfChanged(state)
+	if _, err := p.WriteFile(out); err != nil {
+		t.Fatal(err)
+	}
+	if err := p.MarkDone(); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Remove(out); err != nil {
+		t.Fatal(err)
+	}
+	_, err := script.Echo("data\n").IfChanged(state).WriteFile(out)
+	if !errors.Is(err, script.ErrUnchanged) {
+		t.Errorf("want ErrUnchanged, got %v", err)
+	}
+	if _, err := os.Stat(out); !os.IsNotExist(err) {
+		t.Errorf("want no file written for unchanged input, got %v", err)
+	}
+}
+
+func TestInsertAfter(t *testing.T) {
+	t.Parallel()
+	want := "[a]\nx = 1\n[b]\nx = 1\nc\n"
+	got, err := script.Echo("[a]\n[b]\nc\n").InsertAfter(regexp.MustCompile(`^\[`), "x = 1").String()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got != want {
+		t.Errorf("want %q, got %q", want, got)
+	}
+}
+
+func TestJoin(t *testing.T) {
+	t.Parallel()
+	input := "hello\nfrom\nthe\njoin\ntest\n"
+	want := "hello from the join test\n"
+	got, err := script.Echo(input).Join().String()
+	if err != nil {
+		t.Error(err)
+	}
+	if got != want {
+		t.Errorf("want %q, got %q", want, got)
+	}
+	input = "hello\nworld"
+	want = "hello world"
+	got, err = script.Echo(input).Join().String()
+	if err != nil {
+		t.Error(err)
+	}
+	if got != want {
+		t.Errorf("want %q, got %q", want, got)
+	}
+}
+
+func TestJSONCompact(t *testing.T) {
+	t.Parallel()
+	input := "{\n  \"name\": \"script\",\n  \"tags\": [ \"go\", \"shell\" ],\n  \"big\": 12345678901234567890\n}\n"
+	want := `{"name":"script","tags":["go","shell"],"big":12345678901234567890}` + "\n"
+	got, err := script.Echo(input).JSONCompact().String()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got != want {
+		t.Errorf("want %q, got %q", want, got)
+	}
+	_, err = script.Echo(`{"unclosed": `).JSONCompact().String()
+	if err == nil {
+		t.Error("want error for invalid JSON, got nil")
+	}
+}
+
+func TestJSONIndent(t *testing.T) {
+	t.Parallel()
+	input := `{"a":1,"b":[true,null]}`
+	want := "{\n  \"a\": 1,\n  \"b\": [\n    true,\n    null\n  ]\n}\n"
+	got, err := script.Echo(input).JSONIndent("", "  ").String()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got != want {
+		t.Errorf("want %q, got %q", want, got)
+	}
+}
+
+func TestJSONIndentNDJSON(t *testing.T) {
+	t.Parallel()
+	input := "{\"level\":\"info\"}\n\n{\"level\":\"error\"}\n"
+	want := "{\n\t\"level\": \"info\"\n}\n{\n\t\"level\": \"error\"\n}\n"
+	got, err := script.Echo(input).JSONIndent("", "\t").String()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got != want {
+		t.Errorf("want %q, got %q", want, got)
+	}
+	got, err = script.Echo(want).JSONCompact().String()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got != "{\"level\":\"info\"}\n{\"level\":\"error\"}\n" {
+		t.Errorf("want NDJSON, got %q", got)
+	}
+}
+
+func FuzzJSONCompact(f *testing.F) {
+	for _, seed := range []string{
+		`{"a": [1, 2, {"b": null}]}`,
+		"{\"a\":1}\n{\"a\":2}\n",
+		`"\u00e9" 3.5e10 true`,
+		`{"a":`,
+	} {
+		f.Add([]byte(seed))
+	}
+	f.Fuzz(func(t *testing.T, data []byte) {
+		out := scripttest.CheckFilter(t, data, (*script.Pipe).JSONCompact)
+		for _, line := range strings.Split(strings.TrimSuffix(string(out), "\n"), "\n") {
+			if line != "" && !json.Valid([]byte(line)) {
+				t.Errorf("input %q: invalid JSON in output line %q", data, line)
+			}
+		}
+	})
+}
+
+func TestLast(t *testing.T) {
+	t.Parallel()
+	want, err := ioutil.ReadFile("testdata/last10.golden.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	input := script.File("testdata/first.input.txt")
+	got, err := input.Last(10).Bytes()
+	if err != nil {
+		t.Error(err)
+	}
+	if !bytes.Equal(got, want) {
+		t.Errorf("want %q, got %q", want, got)
+	}
+	_, err = ioutil.ReadAll(input.Reader)
+	if err == nil {
+		t.Error("input not closed after reading")
+	}
+	input = script.File("testdata/first.input.txt")
+	gotZero, err := input.Last(0).CountLines()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if gotZero != 0 {
+		t.Errorf("want 0 lines, got %d lines", gotZero)
+	}
+	_, err = ioutil.ReadAll(input.Reader)
+	if err == nil {
+		t.Error("input not closed after reading")
+	}
+	input = script.File("testdata/first.input.txt")
+	gotZero, err = input.Last(-1).CountLines()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if gotZero != 0 {
+		t.Errorf("want 0 lines, got %d lines", gotZero)
+	}
 	_, err = ioutil.ReadAll(input.Reader)
 	if err == nil {
 		t.Error("input not closed after reading")
 	}
-	input = script.File("testdata/first.input.txt")
-	gotZero, err := input.Last(0).CountLines()
+	want, err = script.File("testdata/first.input.txt").Bytes()
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err = script.File("testdata/first.input.txt").Last(100).Bytes()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, want) {
+		t.Errorf("want %q, got %q", want, got)
+	}
+}
+
+func TestLogfmt(t *testing.T) {
+	t.Parallel()
+	input := "level=info   msg=\"hello world\" debug\nplain text message\nempty=\"\" path=/tmp\n"
+	want := "level=info msg=\"hello world\" debug=\"\"\nempty=\"\" path=/tmp\n"
+	got, err := script.Echo(input).Logfmt().String()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got != want {
+		t.Errorf("want %q, got %q", want, got)
+	}
+}
+
+func FuzzLogfmt(f *testing.F) {
+	for _, seed := range []string{
+		`level=info msg="hello world" n=1`,
+		"a= b=\"\\\"\" plain text\n",
+		"=x key",
+	} {
+		f.Add([]byte(seed))
+	}
+	f.Fuzz(func(t *testing.T, data []byte) {
+		once := scripttest.CheckFilter(t, data, (*script.Pipe).Logfmt)
+		twice := scripttest.CheckFilter(t, once, (*script.Pipe).Logfmt)
+		if !bytes.Equal(once, twice) {
+			t.Errorf("input %q: normalising twice gives %q, want %q", data, twice, once)
+		}
+	})
+}
+
+func TestMatch(t *testing.T) {
+	t.Parallel()
+	testCases := []struct {
+		testFileName string
+		match        string
+		want         int
+	}{
+		{"testdata/test.txt", "line", 2},
+		{"testdata/test.txt", "another", 1},
+		{"testdata/test.txt", "rhymenocerous", 0},
+		{"testdata/empty.txt", "line", 0},
+	}
+	for _, tc := range testCases {
+		got, err := script.File(tc.testFileName).Match(tc.match).CountLines()
+		if err != nil {
+			t.Error(err)
+		}
+		if got != tc.want {
+			t.Errorf("%q in %q: want %d, got %d", tc.match, tc.testFileName, tc.want, got)
+		}
+	}
+}
+
+func TestMatchAll(t *testing.T) {
+	t.Parallel()
+	input := "GET /api 200\nGET /api 500\nPOST /api 500\nGET /home 500\n"
+	want := "GET /api 500\n"
+	got, err := script.Echo(input).MatchAll("GET", "/api", "500").String()
 	if err != nil {
 		t.Fatal(err)
 	}
-	if gotZero != 0 {
-		t.Errorf("want 0 lines, got %d lines", gotZero)
+	if got != want {
+		t.Errorf("want %q, got %q", want, got)
 	}
-	_, err = ioutil.ReadAll(input.Reader)
-	if err == nil {
-		t.Error("input not closed after reading")
+	got, err = script.Echo(input).MatchAll().String()
+	if err != nil {
+		t.Fatal(err)
 	}
-	input = script.File("testdata/first.input.txt")
-	gotZero, err = input.Last(-1).CountLines()
+	if got != input {
+		t.Errorf("want all lines to match no patterns, got %q", got)
+	}
+}
+
+func TestMatchAllRegexp(t *testing.T) {
+	t.Parallel()
+	input := "GET /api 200\nGET /api 500\nPOST /api 503\n"
+	want := "POST /api 503\n"
+	got, err := script.Echo(input).MatchAllRegexp(regexp.MustCompile(`^(POST|PUT) `), regexp.MustCompile(` 5\d\d$`)).String()
 	if err != nil {
 		t.Fatal(err)
 	}
-	if gotZero != 0 {
-		t.Errorf("want 0 lines, got %d lines", gotZero)
+	if got != want {
+		t.Errorf("want %q, got %q", want, got)
 	}
-	_, err = ioutil.ReadAll(input.Reader)
+	_, err = script.Echo(input).MatchAllRegexp(regexp.MustCompile("."), nil).String()
 	if err == nil {
-		t.Error("input not closed after reading")
+		t.Error("want error for nil regexp, got nil")
 	}
-	want, err = script.File("testdata/first.input.txt").Bytes()
+}
+
+func TestMatchAny(t *testing.T) {
+	t.Parallel()
+	input := "ERROR disk full\nINFO started\nWARN slow\nFATAL crashed\n"
+	want := "ERROR disk full\nFATAL crashed\n"
+	got, err := script.Echo(input).MatchAny("ERROR", "FATAL").String()
 	if err != nil {
 		t.Fatal(err)
 	}
-	got, err = script.File("testdata/first.input.txt").Last(100).Bytes()
+	if got != want {
+		t.Errorf("want %q, got %q", want, got)
+	}
+	got, err = script.Echo(input).MatchAny().String()
 	if err != nil {
 		t.Fatal(err)
 	}
-	if !bytes.Equal(got, want) {
+	if got != "" {
+		t.Errorf("want no lines to match no patterns, got %q", got)
+	}
+}
+
+func TestMatchAnyRegexp(t *testing.T) {
+	t.Parallel()
+	input := "ERROR disk full\nINFO started\nwarn: slow\n"
+	want := "ERROR disk full\nwarn: slow\n"
+	got, err := script.Echo(input).MatchAnyRegexp(regexp.MustCompile(`^ERROR`), regexp.MustCompile(`(?i)^warn`)).String()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got != want {
+		t.Errorf("want %q, got %q", want, got)
+	}
+	_, err = script.Echo(input).MatchAnyRegexp(nil).String()
+	if err == nil {
+		t.Error("want error for nil regexp, got nil")
+	}
+}
+
+func TestMatchFold(t *testing.T) {
+	t.Parallel()
+	input := "ERROR disk full\nInfo: no errors\nwarning\nStraße\n"
+	want := "ERROR disk full\nInfo: no errors\n"
+	got, err := script.Echo(input).MatchFold("error").String()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got != want {
 		t.Errorf("want %q, got %q", want, got)
 	}
+	got, err = script.Echo(input).MatchFold("STRASSE").String()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got != "" {
+		t.Errorf("want no match for multi-rune folding, got %q", got)
+	}
+	got, err = script.Echo(input).MatchFold("a.b").String()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got != "" {
+		t.Errorf("want pattern treated literally, got %q", got)
+	}
 }
 
-func TestMatch(t *testing.T) {
+func TestMatchLargeInput(t *testing.T) {
+	t.Parallel()
+	var input, want strings.Builder
+	for i := 0; i < 100000; i++ {
+		line := fmt.Sprintf("line %d of the input", i)
+		if i%997 == 0 {
+			line += " NEEDLE"
+			want.WriteString(line + "\n")
+		}
+		input.WriteString(line + "\r\n")
+	}
+	huge := "NEEDLE" + strings.Repeat("y", 600000) + "\n"
+	input.WriteString(huge)
+	want.WriteString(huge)
+	long := strings.Repeat("x", 100000) + "NEEDLE"
+	input.WriteString(long)
+	want.WriteString(long + "\n")
+	got, err := script.Echo(input.String()).Match("NEEDLE").String()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got != want.String() {
+		t.Errorf("want %d bytes of matching lines, got %d", want.Len(), len(got))
+	}
+}
+
+func TestMatchRegexp(t *testing.T) {
 	t.Parallel()
+	p := script.File("testdata/hello.txt")
+	_, err := p.MatchRegexp(nil).String()
+	if err == nil {
+		t.Error("nil regex should cause an error")
+	}
+	_, err = ioutil.ReadAll(p.Reader)
+	if err == nil {
+		t.Error("input not closed after reading")
+	}
+
 	testCases := []struct {
 		testFileName string
 		match        string
 		want         int
 	}{
-		{"testdata/test.txt", "line", 2},
-		{"testdata/test.txt", "another", 1},
-		{"testdata/test.txt", "rhymenocerous", 0},
-		{"testdata/empty.txt", "line", 0},
+		{"testdata/test.txt", `Hello|file`, 3},
+		{"testdata/test.txt", `an.ther`, 1},
+		{"testdata/test.txt", `r[a-z]+s`, 0},
+		{"testdata/empty.txt", `bogus$`, 0},
+	}
+	for _, tc := range testCases {
+		got, err := script.File(tc.testFileName).MatchRegexp(regexp.MustCompile(tc.match)).CountLines()
+		if err != nil {
+			t.Error(err)
+		}
+		if got != tc.want {
+			t.Errorf("%q in %q: want %d, got %d", tc.match, tc.testFileName, tc.want, got)
+		}
+	}
+}
+
+func TestMatchSpecialPatterns(t *testing.T) {
+	t.Parallel()
+	input := "a\nb\n"
+	got, err := script.Echo(input).Match("").String()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got != input {
+		t.Errorf("want every line to match empty string, got %q", got)
+	}
+	got, err = script.Echo(input).Match("a\nb").String()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got != "" {
+		t.Errorf("want no match across lines, got %q", got)
+	}
+}
+
+func TestMkdirAllEach(t *testing.T) {
+	t.Parallel()
+	dir := t.TempDir()
+	a, b := filepath.Join(dir, "a", "b", "c"), filepath.Join(dir, "d")
+	input := a + "\n" + b + "\n"
+	got, err := script.Echo(input).DryRun().MkdirAllEach(0755).String()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got != input {
+		t.Errorf("dry run: want %q, got %q", input, got)
+	}
+	if _, err := os.Stat(a); !os.IsNotExist(err) {
+		t.Errorf("want no directory created in dry-run mode, got %v", err)
+	}
+	got, err = script.Echo(input).MkdirAllEach(0755).String()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got != input {
+		t.Errorf("want %q, got %q", input, got)
+	}
+	for _, path := range []string{a, b} {
+		info, err := os.Stat(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !info.IsDir() {
+			t.Errorf("want %s to be a directory", path)
+		}
+	}
+	p := script.Echo(filepath.Join("testdata", "hello.txt", "sub")).MkdirAllEach(0755)
+	if p.Error() == nil {
+		t.Error("want error creating directory under a file, got nil")
+	}
+}
+
+func TestMoveFilesTo(t *testing.T) {
+	t.Parallel()
+	src, dst := t.TempDir(), t.TempDir()
+	path := filepath.Join(src, "a.txt")
+	if err := ioutil.WriteFile(path, []byte("hello"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	got, err := script.Echo(path).DryRun().MoveFilesTo(dst).String()
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := filepath.Join(dst, "a.txt") + "\n"
+	if got != want {
+		t.Errorf("dry run: want %q, got %q", want, got)
+	}
+	if _, err := os.Stat(path); err != nil {
+		t.Fatalf("want file untouched in dry-run mode, got %v", err)
+	}
+	got, err = script.Echo(path).MoveFilesTo(dst).String()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got != want {
+		t.Errorf("want %q, got %q", want, got)
+	}
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		t.Errorf("want original removed, got %v", err)
+	}
+	data, err := ioutil.ReadFile(filepath.Join(dst, "a.txt"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(data) != "hello" {
+		t.Errorf("want moved contents %q, got %q", "hello", data)
+	}
+	p := script.Echo(path).MoveFilesTo(dst)
+	if p.Error() == nil {
+		t.Error("want error moving nonexistent file, got nil")
+	}
+}
+
+func TestMoveFilesToDryRunReportsMissingFile(t *testing.T) {
+	t.Parallel()
+	p := script.Echo("testdata/doesntexist.txt\n").DryRun().MoveFilesTo(t.TempDir())
+	if !errors.Is(p.Error(), fs.ErrNotExist) {
+		t.Errorf("want ErrNotExist for missing file in dry-run mode, got %v", p.Error())
+	}
+}
+
+func TestMoveFilesToReportsRenameErrorWithoutCopying(t *testing.T) {
+	t.Parallel()
+	src := t.TempDir()
+	path := filepath.Join(src, "a.txt")
+	if err := os.WriteFile(path, []byte("hello"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	dst := filepath.Join(t.TempDir(), "doesntexist")
+	p := script.Echo(path).MoveFilesTo(dst)
+	if !errors.Is(p.Error(), fs.ErrNotExist) {
+		t.Errorf("want rename error for missing directory, got %v", p.Error())
+	}
+	if _, err := os.Stat(path); err != nil {
+		t.Errorf("want original left in place, got %v", err)
+	}
+}
+
+func TestPingEach(t *testing.T) {
+	t.Parallel()
+	p := script.Echo("127.0.0.1\ndoesntexist.invalid\n").PingEach(time.Second)
+	if p.Error() != nil && strings.Contains(p.Error().Error(), "ICMP not available") {
+		t.Skip(p.Error())
+	}
+	got, err := p.Slice()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(got) != 2 {
+		t.Fatalf("want 2 result lines, got %q", got)
+	}
+	if !strings.HasPrefix(got[0], "127.0.0.1 up ") {
+		t.Errorf("want localhost up, got %q", got[0])
+	}
+	if got[1] != "doesntexist.invalid down" {
+		t.Errorf("want %q, got %q", "doesntexist.invalid down", got[1])
+	}
+}
+
+func TestPrepend(t *testing.T) {
+	t.Parallel()
+	want := "// Code generated. DO NOT EDIT.\npackage main\n"
+	got, err := script.Echo("package main\n").Prepend("// Code generated. DO NOT EDIT.").String()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got != want {
+		t.Errorf("want %q, got %q", want, got)
+	}
+}
+
+func TestPrependAndAppendCloseInput(t *testing.T) {
+	t.Parallel()
+	for _, p := range []*script.Pipe{
+		script.File("testdata/test.txt").Prepend("header"),
+		script.File("testdata/test.txt").Append("footer"),
+	} {
+		input := p.Reader
+		if err := p.Close(); err != nil {
+			t.Fatal(err)
+		}
+		_, err := ioutil.ReadAll(input)
+		if err == nil {
+			t.Error("input not closed")
+		}
+	}
+}
+
+func TestPrependPipe(t *testing.T) {
+	t.Parallel()
+	want := "header\nbody\n"
+	got, err := script.Echo("body\n").PrependPipe(script.Echo("header\n")).String()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got != want {
+		t.Errorf("want %q, got %q", want, got)
+	}
+}
+
+func TestRange(t *testing.T) {
+	t.Parallel()
+	tcs := []struct {
+		from, to int
+		want     string
+	}{
+		{2, 3, "b\nc\n"},
+		{1, 1, "a\n"},
+		{3, 0, "c\nd\n"},
+		{3, 10, "c\nd\n"},
+		{3, 2, ""},
+		{0, 2, "a\nb\n"},
+	}
+	for _, tc := range tcs {
+		got, err := script.Echo("a\nb\nc\nd\n").Range(tc.from, tc.to).String()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got != tc.want {
+			t.Errorf("Range(%d, %d): want %q, got %q", tc.from, tc.to, tc.want, got)
+		}
+	}
+}
+
+func TestRangeClosesInputAfterLastLine(t *testing.T) {
+	t.Parallel()
+	input := script.File("testdata/first.input.txt")
+	_, err := input.Range(1, 2).String()
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = ioutil.ReadAll(input.Reader)
+	if err == nil {
+		t.Error("input not closed after reading")
+	}
+}
+
+func TestReformatTime(t *testing.T) {
+	t.Parallel()
+	input := `127.0.0.1 - - [10/Oct/2023:13:55:36 -0700] "GET / HTTP/1.1" 200` + "\n" + "not a log line\n"
+	want := `127.0.0.1 - - 2023-10-10T13:55:36-07:00 "GET / HTTP/1.1" 200` + "\n" + "not a log line\n"
+	got, err := script.Echo(input).ReformatTime("[02/Jan/2006:15:04:05 -0700]", time.RFC3339, 4).String()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got != want {
+		t.Errorf("want %q, got %q", want, got)
+	}
+}
+
+func TestReformatTimeDelimitsColumnsAsColumnDoes(t *testing.T) {
+	t.Parallel()
+	input := "web1\u00a02024-03-05 09:30:00\u2003+0000 new\n"
+	want := "web1\u00a02024-03-05T09:30:00Z new\n"
+	got, err := script.Echo(input).ReformatTime("2006-01-02 15:04:05 -0700", time.RFC3339, 2).String()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got != want {
+		t.Errorf("want %q, got %q", want, got)
+	}
+}
+
+func TestRemoveFiles(t *testing.T) {
+	t.Parallel()
+	dir := t.TempDir()
+	a, b := filepath.Join(dir, "a"), filepath.Join(dir, "b")
+	for _, path := range []string{a, b} {
+		if err := ioutil.WriteFile(path, []byte{}, 0600); err != nil {
+			t.Fatal(err)
+		}
 	}
-	for _, tc := range testCases {
-		got, err := script.File(tc.testFileName).Match(tc.match).CountLines()
-		if err != nil {
-			t.Error(err)
+	input := a + "\n" + filepath.Join(dir, "doesntexist") + "\n" + b + "\n"
+	p := script.Echo(input).DryRun().RemoveFiles()
+	if p.Error() == nil {
+		t.Error("dry run: want error for nonexistent file, got nil")
+	}
+	for _, path := range []string{a, b} {
+		if _, err := os.Stat(path); err != nil {
+			t.Errorf("want %s untouched in dry-run mode, got %v", path, err)
 		}
-		if got != tc.want {
-			t.Errorf("%q in %q: want %d, got %d", tc.match, tc.testFileName, tc.want, got)
+	}
+	p = script.Echo(input).RemoveFiles()
+	if p.Error() == nil {
+		t.Error("want error for nonexistent file, got nil")
+	}
+	p.SetError(nil)
+	got, err := p.String()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got != a+"\n"+b+"\n" {
+		t.Errorf("want %q, got %q", a+"\n"+b+"\n", got)
+	}
+	for _, path := range []string{a, b} {
+		if _, err := os.Stat(path); !os.IsNotExist(err) {
+			t.Errorf("want %s removed, got %v", path, err)
 		}
 	}
 }
 
-func TestMatchRegexp(t *testing.T) {
+func TestReverseHexdump(t *testing.T) {
 	t.Parallel()
-	p := script.File("testdata/hello.txt")
-	_, err := p.MatchRegexp(nil).String()
-	if err == nil {
-		t.Error("nil regex should cause an error")
+	want, err := script.File("testdata/bytes.bin").Bytes()
+	if err != nil {
+		t.Fatal(err)
 	}
-	_, err = ioutil.ReadAll(p.Reader)
-	if err == nil {
-		t.Error("input not closed after reading")
+	got, err := script.File("testdata/bytes.bin").Hexdump().ReverseHexdump().Bytes()
+	if err != nil {
+		t.Fatal(err)
 	}
-
-	testCases := []struct {
-		testFileName string
-		match        string
-		want         int
-	}{
-		{"testdata/test.txt", `Hello|file`, 3},
-		{"testdata/test.txt", `an.ther`, 1},
-		{"testdata/test.txt", `r[a-z]+s`, 0},
-		{"testdata/empty.txt", `bogus$`, 0},
+	if !bytes.Equal(want, got) {
+		t.Errorf("want %q, got %q", want, got)
 	}
-	for _, tc := range testCases {
-		got, err := script.File(tc.testFileName).MatchRegexp(regexp.MustCompile(tc.match)).CountLines()
-		if err != nil {
-			t.Error(err)
-		}
-		if got != tc.want {
-			t.Errorf("%q in %q: want %d, got %d", tc.match, tc.testFileName, tc.want, got)
+	got, err = script.Echo("00000002: 6869  hi\n").ReverseHexdump().Bytes()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal([]byte("\x00\x00hi"), got) {
+		t.Errorf("want gap filled with zeros, got %q", got)
+	}
+	for _, input := range []string{
+		"bogus\n",
+		"00000000: 6zz9  hi\n",
+		"00000010: 6869  hi\n00000000: 6869  hi\n",
+	} {
+		p := script.Echo(input).ReverseHexdump()
+		if p.Error() == nil {
+			t.Errorf("input %q: want error, got nil", input)
 		}
 	}
 }
@@ -561,3 +2666,452 @@ func TestSHA256Sums(t *testing.T) {
 		}
 	}
 }
+
+func TestSortIP(t *testing.T) {
+	t.Parallel()
+	input := "10.0.0.10\nbogus\n::1\n10.0.0.9\n9.255.255.255\nalso bogus\n"
+	want := "9.255.255.255\n10.0.0.9\n10.0.0.10\n::1\nbogus\nalso bogus\n"
+	got, err := script.Echo(input).SortIP().String()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got != want {
+		t.Errorf("want %q, got %q", want, got)
+	}
+}
+
+func TestStat(t *testing.T) {
+	t.Parallel()
+	got, err := script.Echo("testdata/hello.txt\ntestdata/multiple_files\n").Stat("{{.Name}} {{.Size}} {{.IsDir}}").String()
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := "hello.txt 11 false\nmultiple_files "
+	if !strings.HasPrefix(got, want) || !strings.HasSuffix(got, " true\n") {
+		t.Errorf("want output like %q, got %q", want+"N true\n", got)
+	}
+}
+
+func TestStatDefaultFormat(t *testing.T) {
+	t.Parallel()
+	got, err := script.Echo("testdata/hello.txt\n").Stat("").String()
+	if err != nil {
+		t.Fatal(err)
+	}
+	fields := strings.Fields(got)
+	if len(fields) < 4 {
+		t.Fatalf("want at least mode, size, time, and path, got %q", got)
+	}
+	if !strings.HasPrefix(fields[0], "-rw") {
+		t.Errorf("want regular file mode, got %q", fields[0])
+	}
+	if !strings.Contains(got, " 11 ") {
+		t.Errorf("want size 11 in %q", got)
+	}
+	if !strings.HasSuffix(got, " testdata/hello.txt\n") {
+		t.Errorf("want path at end of %q", got)
+	}
+}
+
+func TestStatErrors(t *testing.T) {
+	t.Parallel()
+	p := script.Echo("testdata/doesntexist.txt\n").Stat("")
+	if p.Error() == nil {
+		t.Error("want error for nonexistent file, got nil")
+	}
+	p = script.Echo("testdata/hello.txt\n").Stat("{{.Bogus}}")
+	if p.Error() == nil {
+		t.Error("want error for invalid template field, got nil")
+	}
+	p = script.Echo("testdata/hello.txt\n").Stat("{{")
+	if p.Error() == nil {
+		t.Error("want error for invalid template, got nil")
+	}
+}
+
+func TestStreamExecFeedsAndReadsCommandIncrementally(t *testing.T) {
+	t.Parallel()
+	r, w := io.Pipe()
+	p := script.NewPipe().WithReader(r).StreamExec("cat")
+	go w.Write([]byte("hello\n"))
+	lines := make(chan string)
+	output := bufio.NewReader(p)
+	go func() {
+		line, _ := output.ReadString('\n')
+		lines <- line
+	}()
+	select {
+	case line := <-lines:
+		if line != "hello\n" {
+			t.Errorf("want %q, got %q", "hello\n", line)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("no output before input ended")
+	}
+	w.Close()
+	if rest, err := io.ReadAll(output); err != nil || len(rest) > 0 {
+		t.Errorf("want clean end of output, got %q, %v", rest, err)
+	}
+}
+
+func TestStreamExecDoesNotChangePipeMode(t *testing.T) {
+	t.Parallel()
+	p := script.Echo("hello\n").StreamExec("cat").Exec("sh -c 'exit 3'")
+	if p.ExitStatus() != 3 {
+		t.Errorf("want exit status 3 set without reading output, got %d", p.ExitStatus())
+	}
+}
+
+func TestStrings(t *testing.T) {
+	t.Parallel()
+	input := "\x7fELF\x02\x01\x00/lib/ld.so\x00ab\x00\x00usage:\tfoo [-v]\xff\xfeend"
+	tcs := []struct {
+		minLen int
+		want   string
+	}{
+		{0, "/lib/ld.so\nusage:\tfoo [-v]\n"},
+		{3, "ELF\n/lib/ld.so\nusage:\tfoo [-v]\nend\n"},
+		{2, "ELF\n/lib/ld.so\nab\nusage:\tfoo [-v]\nend\n"},
+		{20, ""},
+	}
+	for _, tc := range tcs {
+		got, err := script.Echo(input).Strings(tc.minLen).String()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got != tc.want {
+			t.Errorf("minLen %d: want %q, got %q", tc.minLen, tc.want, got)
+		}
+	}
+}
+
+func TestStripNames(t *testing.T) {
+	t.Parallel()
+	input := "a.txt:one\nb.txt:key: value\nno prefix\n"
+	want := "one\nkey: value\nno prefix\n"
+	got, err := script.Echo(input).StripNames().String()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got != want {
+		t.Errorf("want %q, got %q", want, got)
+	}
+}
+
+func TestTimestamp(t *testing.T) {
+	t.Parallel()
+	before := time.Now().Format("2006-01-02")
+	got, err := script.Echo("a\nb\n").Timestamp("2006-01-02").String()
+	if err != nil {
+		t.Fatal(err)
+	}
+	after := time.Now().Format("2006-01-02")
+	if got != before+" a\n"+before+" b\n" && got != after+" a\n"+after+" b\n" {
+		t.Errorf("want lines prefixed with date %s, got %q", before, got)
+	}
+	got, err = script.Echo("a\n").Timestamp("").String()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := time.Parse("Jan 02 15:04:05 a\n", got); err != nil {
+		t.Errorf("want default ts format, got %q: %v", got, err)
+	}
+}
+
+func TestTimestampShowsWhenEachLineArrived(t *testing.T) {
+	t.Parallel()
+	lines, err := script.NewPipe().Stream().Exec("sh -c 'echo a; sleep 0.3; echo b'").Timestamp(time.RFC3339Nano).Slice()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(lines) != 2 {
+		t.Fatalf("want 2 lines, got %q", lines)
+	}
+	var stamps []time.Time
+	for _, line := range lines {
+		stamp, _, _ := strings.Cut(line, " ")
+		ts, err := time.Parse(time.RFC3339Nano, stamp)
+		if err != nil {
+			t.Fatal(err)
+		}
+		stamps = append(stamps, ts)
+	}
+	if gap := stamps[1].Sub(stamps[0]); gap < 200*time.Millisecond {
+		t.Errorf("want lines stamped at least 200ms apart, got %v", gap)
+	}
+}
+
+func TestToPrometheus(t *testing.T) {
+	t.Parallel()
+	input := "/ 42%\n/home 7\n\n"
+	want := `# TYPE disk_used_percent gauge
+disk_used_percent{host="web1",mount="/"} 42
+disk_used_percent{host="web1",mount="/home"} 7
+`
+	_, err := script.Echo(input).ToPrometheus("disk_used_percent", map[string]string{"host": "web1", "mount": ""}).String()
+	if err == nil {
+		t.Error("want error for non-numeric value, got nil")
+	}
+	got, err := script.Echo(strings.Replace(input, "%", "", 1)).ToPrometheus("disk_used_percent", map[string]string{"host": "web1", "mount": ""}).String()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got != want {
+		t.Errorf("want %q, got %q", want, got)
+	}
+}
+
+func TestToPrometheusDefaultLabel(t *testing.T) {
+	t.Parallel()
+	input := "3\nsay \"hi\" 1.5\n"
+	want := "# TYPE greetings gauge\ngreetings 3\ngreetings{label=\"say \\\"hi\\\"\"} 1.5\n"
+	got, err := script.Echo(input).ToPrometheus("greetings", nil).String()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got != want {
+		t.Errorf("want %q, got %q", want, got)
+	}
+	p := script.Echo(input).ToPrometheus("bad-name", nil)
+	if p.Error() == nil {
+		t.Error("want error for invalid metric name, got nil")
+	}
+}
+
+func TestToPrometheusInvalidLabelName(t *testing.T) {
+	t.Parallel()
+	for _, name := range []string{"mount-point", "0mount", "mount:point", ""} {
+		p := script.Echo("/ 42\n").ToPrometheus("disk_used_percent", map[string]string{name: ""})
+		if p.Error() == nil {
+			t.Errorf("want error for invalid label name %q, got nil", name)
+		}
+	}
+}
+
+func TestTouchEach(t *testing.T) {
+	t.Parallel()
+	dir := t.TempDir()
+	existing, created := filepath.Join(dir, "existing"), filepath.Join(dir, "created")
+	if err := ioutil.WriteFile(existing, []byte("keep me"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	then := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	if err := os.Chtimes(existing, then, then); err != nil {
+		t.Fatal(err)
+	}
+	input := existing + "\n" + created + "\n"
+	script.Echo(input).DryRun().TouchEach()
+	if _, err := os.Stat(created); !os.IsNotExist(err) {
+		t.Errorf("want no file created in dry-run mode, got %v", err)
+	}
+	got, err := script.Echo(input).TouchEach().String()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got != input {
+		t.Errorf("want %q, got %q", input, got)
+	}
+	info, err := os.Stat(existing)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !info.ModTime().After(then) {
+		t.Errorf("want modification time updated, got %v", info.ModTime())
+	}
+	data, err := ioutil.ReadFile(existing)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(data) != "keep me" {
+		t.Errorf("want contents preserved, got %q", data)
+	}
+	info, err = os.Stat(created)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Size() != 0 {
+		t.Errorf("want new empty file, got size %d", info.Size())
+	}
+	p := script.Echo(filepath.Join(dir, "doesntexist", "file")).TouchEach()
+	if p.Error() == nil {
+		t.Error("want error touching file in nonexistent directory, got nil")
+	}
+}
+
+func TestURLEncodeDecode(t *testing.T) {
+	t.Parallel()
+	input := "hello world\na&b=c/d\n"
+	wantEncoded := "hello+world\na%26b%3Dc%2Fd\n"
+	got, err := script.Echo(input).URLEncode().String()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got != wantEncoded {
+		t.Errorf("want %q, got %q", wantEncoded, got)
+	}
+	got, err = script.Echo(wantEncoded).URLDecode().String()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got != input {
+		t.Errorf("want %q, got %q", input, got)
+	}
+	_, err = script.Echo("bad%zzescape\n").URLDecode().String()
+	if err == nil {
+		t.Error("want error decoding invalid escape, got nil")
+	}
+}
+
+func TestURLParts(t *testing.T) {
+	t.Parallel()
+	input := "https://alice@example.com:8443/a/b?id=42&q=x#top\n/relative/path\n"
+	tcs := []struct {
+		part, want string
+	}{
+		{"scheme", "https\n\n"},
+		{"user", "alice\n\n"},
+		{"host", "example.com:8443\n\n"},
+		{"hostname", "example.com\n\n"},
+		{"port", "8443\n\n"},
+		{"path", "/a/b\n/relative/path\n"},
+		{"query", "id=42&q=x\n\n"},
+		{"query.id", "42\n\n"},
+		{"fragment", "top\n\n"},
+	}
+	for _, tc := range tcs {
+		got, err := script.Echo(input).URLParts(tc.part).String()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got != tc.want {
+			t.Errorf("%s: want %q, got %q", tc.part, tc.want, got)
+		}
+	}
+	p := script.Echo(input).URLParts("bogus")
+	if p.Error() == nil {
+		t.Error("want error for unknown part, got nil")
+	}
+	_, err := script.Echo("http://[::1\n").URLParts("host").String()
+	if err == nil {
+		t.Error("want error parsing invalid URL, got nil")
+	}
+}
+
+func TestYQ(t *testing.T) {
+	t.Parallel()
+	input := `apiVersion: apps/v1
+kind: Deployment
+spec:
+  replicas: 3
+  template:
+    spec:
+      containers:
+        - name: web
+          image: nginx:1.25
+        - name: sidecar
+          image: envoy:1.29
+---
+kind: Service
+spec:
+  ports:
+    - port: 80
+`
+	tcs := []struct {
+		path, want string
+	}{
+		{".kind", "Deployment\nService\n"},
+		{".spec.replicas", "3\nnull\n"},
+		{".spec.template.spec.containers[].image", "nginx:1.25\nenvoy:1.29\nnull\n"},
+		{".spec.ports[0]", "null\nport: 80\n"},
+	}
+	for _, tc := range tcs {
+		got, err := script.Echo(input).YQ(tc.path).String()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got != tc.want {
+			t.Errorf("%s: want %q, got %q", tc.path, tc.want, got)
+		}
+	}
+}
+
+func TestYQInvalid(t *testing.T) {
+	t.Parallel()
+	p := script.Echo("a: [").YQ(".a")
+	if p.Error() == nil {
+		t.Error("want error parsing invalid YAML, got nil")
+	}
+	p = script.Echo("a: 1").YQ(".a[")
+	if p.Error() == nil {
+		t.Error("want error for invalid path, got nil")
+	}
+}
+
+// firstWord returns the first space-separated word of line.
+func firstWord(line string) string {
+	word, _, _ := strings.Cut(line, " ")
+	return word
+}
+
+// benchmarkLogSize is the size of the input for the Match benchmarks, which
+// is large enough that they measure throughput, not setup.
+const benchmarkLogSize = 2 << 30
+
+// benchmarkLog returns a reader producing benchmarkLogSize bytes of log-like
+// input, in which few lines contain "NEEDLE", for benchmarking Match. The
+// input is generated as it's read, so that it doesn't have to fit in memory.
+func benchmarkLog() io.Reader {
+	var b strings.Builder
+	for i := range 1000 {
+		fmt.Fprintf(&b, "2024-03-01T10:00:%02d INFO request %d served in %dms\n", i%60, i, i%1000)
+	}
+	b.WriteString("2024-03-01T10:00:00 ERROR NEEDLE found\n")
+	return io.LimitReader(&repeatReader{data: b.String()}, benchmarkLogSize)
+}
+
+// repeatReader is an io.Reader that produces data over and over again.
+type repeatReader struct {
+	data string
+	off  int
+}
+
+func (r *repeatReader) Read(buf []byte) (int, error) {
+	n := copy(buf, r.data[r.off:])
+	r.off = (r.off + n) % len(r.data)
+	return n, nil
+}
+
+func BenchmarkMatch(b *testing.B) {
+	b.SetBytes(benchmarkLogSize)
+	for b.Loop() {
+		_, err := script.NewPipe().WithReader(benchmarkLog()).Match("NEEDLE").String()
+		if err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkMatchEachLine(b *testing.B) {
+	b.SetBytes(benchmarkLogSize)
+	for b.Loop() {
+		_, err := script.NewPipe().WithReader(benchmarkLog()).EachLine(func(line string, out *strings.Builder) {
+			if strings.Contains(line, "NEEDLE") {
+				out.WriteString(line)
+				out.WriteRune('\n')
+			}
+		}).String()
+		if err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkMatchFold(b *testing.B) {
+	b.SetBytes(benchmarkLogSize)
+	for b.Loop() {
+		_, err := script.NewPipe().WithReader(benchmarkLog()).MatchFold("needle").String()
+		if err != nil {
+			b.Fatal(err)
+		}
+	}
+}
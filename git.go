@@ -0,0 +1,123 @@
+package script
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"os/exec"
+	"strings"
+
+	"bitbucket.org/creachadair/shell"
+)
+
+// GitChangedFiles returns a pipe listing the files in the current directory,
+// and its subdirectories, that have been changed since the commit ref in the
+// git repository containing it, one per line, like `git diff --name-only
+// --relative`. Changes in the working tree count, whether or not they've been
+// staged, but untracked files aren't listed, and nor are deleted files, so
+// that every path listed can be read. Paths are relative to the current
+// directory, so they can be passed straight to filters such as BlameEach, or
+// sources such as File. If ref is empty, it lists the changes since the last
+// commit (HEAD). For example, to check the Go files changed on a branch:
+//
+//	script.GitChangedFiles("main").MatchRegexp(regexp.MustCompile(`\.go$`)).ExecForEach("gofmt -l {{.}}").Stdout()
+//
+// If git fails, for example because the current directory isn't in a
+// repository, or ref doesn't exist, the pipe's error status will be set.
+func GitChangedFiles(ref string) *Pipe {
+	if ref == "" {
+		ref = "HEAD"
+	}
+	return newSource("GitChangedFiles").git("-c", "core.quotePath=false", "diff", "--name-only", "--relative", "--diff-filter=d", "--no-color", ref, "--")
+}
+
+// GitLog returns a pipe containing the log of the git repository containing
+// the current directory, with one line for each commit, most recent first,
+// formatted according to format, as for `git log --format`: for example,
+// "%h %an %s" gives the abbreviated hash, the author's name, and the subject
+// of each commit. If format is empty, it's "%h %s", like `git log
+// --oneline`. If git fails, for example because the current directory isn't
+// in a repository, the pipe's error status will be set.
+func GitLog(format string) *Pipe {
+	if format == "" {
+		format = "%h %s"
+	}
+	return newSource("GitLog").git("log", "--no-color", "--format="+format)
+}
+
+// BlameEach reads a list of file paths from the pipe, one per line, and runs
+// `git blame` on each, producing a line for every line of each file, in the
+// form `path:line:commit:author:text`, where line is the line number, commit
+// is the abbreviated hash of the commit that last changed the line, and
+// author is the name of its author. Lines that haven't been committed yet have
+// a commit of all zeros. It's useful for finding out who to ask about
+// something:
+//
+//	script.GitChangedFiles("main").BlameEach().Match("TODO").Stdout()
+//
+// Commands are run as for Exec, using the pipe's settings, such as its search
+// path. Failures don't stop processing: instead, the pipe's error status is
+// set afterwards to an error listing each path that couldn't be blamed.
+func (p *Pipe) BlameEach() *Pipe {
+	if p == nil || p.Error() != nil {
+		return p
+	}
+	p.addStage("BlameEach")
+	var errs []error
+	q := p.eachLine(func(path string, out *strings.Builder) {
+		blame := p.execPipe().git("blame", "--line-porcelain", "--", path)
+		output, err := blame.Bytes()
+		if err == nil {
+			err = blame.Error()
+		}
+		if err == nil {
+			err = blameLines(path, output, out)
+		}
+		if err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", path, err))
+		}
+	})
+	if len(errs) > 0 {
+		q.SetError(errors.Join(errs...))
+	}
+	return q
+}
+
+// blameLines converts the output of `git blame --line-porcelain` for the file
+// at path to the format produced by BlameEach, writing it to out.
+func blameLines(path string, porcelain []byte, out *strings.Builder) error {
+	var commit, line, author string
+	scanner, release := newLineScanner(bytes.NewReader(porcelain))
+	defer release()
+	header := true
+	for scanner.Scan() {
+		text := scanner.Text()
+		switch {
+		case header:
+			// Each line's entry starts with the commit hash, the line's
+			// number in that commit, and its number in the file.
+			fields := strings.Fields(text)
+			if len(fields) < 3 {
+				return fmt.Errorf("unexpected git blame output %q", text)
+			}
+			commit, line = fields[0], fields[2]
+			if len(commit) > 8 {
+				commit = commit[:8]
+			}
+			header = false
+		case strings.HasPrefix(text, "author "):
+			author = strings.TrimPrefix(text, "author ")
+		case strings.HasPrefix(text, "\t"):
+			fmt.Fprintf(out, "%s:%s:%s:%s:%s\n", path, line, commit, author, text[1:])
+			header = true
+		}
+	}
+	return scanner.Err()
+}
+
+// git runs git with the specified arguments, as for Exec, and returns a pipe
+// containing its output.
+func (p *Pipe) git(args ...string) *Pipe {
+	cmdLine := "git " + shell.Join(args)
+	return p.execCommand(exec.Command("git", args...), cmdLine, nil)
+}
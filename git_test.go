@@ -0,0 +1,170 @@
+package script_test
+
+import (
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/bitfield/script"
+)
+
+// gitRepo creates a git repository in a temporary directory, with two commits
+// by different authors, and changes the current directory to it. Tests using
+// it can't be parallel, since the git sources work on the current directory.
+func gitRepo(t *testing.T) string {
+	t.Helper()
+	if _, err := exec.LookPath("git"); err != nil {
+		t.Skip("git not installed")
+	}
+	dir := t.TempDir()
+	t.Chdir(dir)
+	t.Setenv("GIT_CONFIG_GLOBAL", os.DevNull)
+	t.Setenv("GIT_CONFIG_NOSYSTEM", "1")
+	git := func(author string, args ...string) {
+		t.Helper()
+		cmd := exec.Command("git", args...)
+		cmd.Env = append(os.Environ(),
+			"GIT_AUTHOR_NAME="+author, "GIT_AUTHOR_EMAIL="+author+"@example.com",
+			"GIT_COMMITTER_NAME="+author, "GIT_COMMITTER_EMAIL="+author+"@example.com",
+		)
+		if output, err := cmd.CombinedOutput(); err != nil {
+			t.Fatalf("git %s: %v\n%s", strings.Join(args, " "), err, output)
+		}
+	}
+	write := func(name, data string) {
+		t.Helper()
+		if err := os.MkdirAll(filepath.Dir(name), 0o755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(name, []byte(data), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	git("", "init", "-q", "-b", "main")
+	write("a.txt", "one\ntwo\n")
+	write("sub/b.txt", "bee\n")
+	write("gone.txt", "soon gone\n")
+	git("Alice", "add", ".")
+	git("Alice", "commit", "-q", "-m", "First commit")
+	write("a.txt", "one\nthree\n")
+	git("Bob", "commit", "-q", "-am", "Second commit")
+	return dir
+}
+
+func TestGitChangedFilesListsFilesChangedSinceRef(t *testing.T) {
+	// Not parallel, since it changes the current directory.
+	dir := gitRepo(t)
+	if err := os.WriteFile("sub/b.txt", []byte("changed\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Remove("gone.txt"); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile("untracked.txt", []byte("new\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	got, err := script.GitChangedFiles("HEAD~1").String()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got != "a.txt\nsub/b.txt\n" {
+		t.Errorf("want %q, got %q", "a.txt\nsub/b.txt\n", got)
+	}
+	got, err = script.GitChangedFiles("").String()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got != "sub/b.txt\n" {
+		t.Errorf("want changes since HEAD %q, got %q", "sub/b.txt\n", got)
+	}
+	t.Chdir(filepath.Join(dir, "sub"))
+	got, err = script.GitChangedFiles("HEAD~1").String()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got != "b.txt\n" {
+		t.Errorf("want paths relative to current directory %q, got %q", "b.txt\n", got)
+	}
+	p := script.GitChangedFiles("nonexistent")
+	if p.Error() == nil {
+		t.Error("want error for nonexistent ref, got nil")
+	}
+}
+
+func TestGitLogFormatsEachCommit(t *testing.T) {
+	// Not parallel, since it changes the current directory.
+	gitRepo(t)
+	got, err := script.GitLog("%an: %s").String()
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := "Bob: Second commit\nAlice: First commit\n"
+	if got != want {
+		t.Errorf("want %q, got %q", want, got)
+	}
+	got, err = script.GitLog("").Column(2).String()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got != "Second\nFirst\n" {
+		t.Errorf("want default format of hash and subject, got %q", got)
+	}
+}
+
+func TestGitLogOutsideRepositoryIsError(t *testing.T) {
+	// Not parallel, since it changes the current directory.
+	if _, err := exec.LookPath("git"); err != nil {
+		t.Skip("git not installed")
+	}
+	t.Chdir(t.TempDir())
+	t.Setenv("GIT_CEILING_DIRECTORIES", filepath.Dir(t.TempDir()))
+	p := script.GitLog("")
+	if p.Error() == nil {
+		t.Error("want error outside a repository, got nil")
+	}
+}
+
+func TestBlameEachAttributesEachLine(t *testing.T) {
+	// Not parallel, since it changes the current directory.
+	gitRepo(t)
+	if err := os.WriteFile("sub/b.txt", []byte("bee\nuncommitted\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	got, err := script.Echo("a.txt\nsub/b.txt\n").BlameEach().String()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var lines []string
+	for _, line := range strings.Split(strings.TrimSuffix(got, "\n"), "\n") {
+		fields := strings.SplitN(line, ":", 5)
+		if len(fields) != 5 {
+			t.Fatalf("want path:line:commit:author:text, got %q", line)
+		}
+		if len(fields[2]) != 8 {
+			t.Errorf("want abbreviated commit hash, got %q", fields[2])
+		}
+		fields[2] = "-"
+		lines = append(lines, strings.Join(fields, ":"))
+	}
+	want := []string{
+		"a.txt:1:-:Alice:one",
+		"a.txt:2:-:Bob:three",
+		"sub/b.txt:1:-:Alice:bee",
+		"sub/b.txt:2:-:Not Committed Yet:uncommitted",
+	}
+	if strings.Join(lines, "\n") != strings.Join(want, "\n") {
+		t.Errorf("want %q, got %q", want, lines)
+	}
+}
+
+func TestBlameEachReportsFilesThatCantBeBlamed(t *testing.T) {
+	// Not parallel, since it changes the current directory.
+	gitRepo(t)
+	p := script.Echo("doesntexist.txt\na.txt\n").BlameEach()
+	err := p.Error()
+	if err == nil || !strings.Contains(err.Error(), "doesntexist.txt") {
+		t.Errorf("want error mentioning doesntexist.txt, got %v", err)
+	}
+}
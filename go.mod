@@ -1,8 +1,17 @@
 module github.com/bitfield/script
 
-go 1.12
+go 1.24.0
 
 require (
 	bitbucket.org/creachadair/shell v0.0.6
-	github.com/google/go-cmp v0.3.1
+	github.com/google/go-cmp v0.6.0
+	github.com/gorilla/websocket v1.5.3
+	go.uber.org/goleak v1.3.0
+	golang.org/x/net v0.50.0
+	gopkg.in/yaml.v3 v3.0.1
+)
+
+require (
+	github.com/kr/text v0.2.0 // indirect
+	golang.org/x/sys v0.41.0 // indirect
 )
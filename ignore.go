@@ -0,0 +1,213 @@
+package script
+
+import (
+	"bufio"
+	"errors"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+)
+
+// ignorer decides which paths a directory walk should skip, using patterns
+// in the style of .gitignore files, read from files with the given names in
+// each directory walked, or given directly. Paths are slash-separated, and
+// relative to the top of the walk. A nil *ignorer skips nothing.
+type ignorer struct {
+	files []string
+	// rules holds the patterns read from the ignore files in each directory
+	// walked so far, by the directory's path.
+	rules map[string][]ignoreRule
+	// patterns holds the patterns given directly, which take precedence over
+	// those from files.
+	patterns []ignoreRule
+}
+
+// newIgnorer returns an ignorer that reads the named ignore files, and
+// applies the given patterns, or nil if there are neither. It returns an
+// error if any of the patterns is invalid.
+func newIgnorer(files, patterns []string) (*ignorer, error) {
+	if len(files) == 0 && len(patterns) == 0 {
+		return nil, nil
+	}
+	ig := &ignorer{files: files, rules: map[string][]ignoreRule{}}
+	for _, pattern := range patterns {
+		rule, ok, err := parseIgnoreRule(pattern)
+		if err != nil {
+			return nil, err
+		}
+		if ok {
+			ig.patterns = append(ig.patterns, rule)
+		}
+	}
+	return ig, nil
+}
+
+// load reads the patterns from any ignore files in the directory dir, whose
+// path relative to the top of the walk is rel. Ignore files that don't exist
+// are skipped, as are invalid patterns, as git does.
+func (ig *ignorer) load(dir, rel string) error {
+	if ig == nil {
+		return nil
+	}
+	for _, name := range ig.files {
+		f, err := os.Open(filepath.Join(dir, name))
+		if errors.Is(err, fs.ErrNotExist) {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		scanner := bufio.NewScanner(f)
+		for scanner.Scan() {
+			rule, ok, err := parseIgnoreRule(scanner.Text())
+			if ok && err == nil {
+				ig.rules[rel] = append(ig.rules[rel], rule)
+			}
+		}
+		err = scanner.Err()
+		f.Close()
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ignored reports whether the path rel, which is a directory if isDir is
+// true, should be skipped. As in git, the last pattern that matches decides,
+// with patterns from ignore files deeper in the tree taking precedence over
+// those nearer the top, and patterns given directly taking precedence over
+// all of them.
+func (ig *ignorer) ignored(rel string, isDir bool) bool {
+	if ig == nil || rel == "." {
+		return false
+	}
+	ignored := false
+	check := func(rules []ignoreRule, sub string) {
+		for _, r := range rules {
+			if r.dirOnly && !isDir {
+				continue
+			}
+			if r.re.MatchString(sub) {
+				ignored = !r.negate
+			}
+		}
+	}
+	check(ig.rules["."], rel)
+	for i := range len(rel) {
+		if rel[i] == '/' {
+			check(ig.rules[rel[:i]], rel[i+1:])
+		}
+	}
+	check(ig.patterns, rel)
+	return ignored
+}
+
+// ignoreRule is a single pattern from an ignore file.
+type ignoreRule struct {
+	re      *regexp.Regexp
+	negate  bool
+	dirOnly bool
+}
+
+// parseIgnoreRule parses a line of an ignore file, following the rules for
+// .gitignore files. It reports false if the line is blank, or a comment.
+func parseIgnoreRule(line string) (ignoreRule, bool, error) {
+	line = strings.TrimSuffix(line, "\r")
+	// Trailing spaces are ignored, unless they're escaped.
+	for strings.HasSuffix(line, " ") && !strings.HasSuffix(line, `\ `) {
+		line = line[:len(line)-1]
+	}
+	if line == "" || line[0] == '#' {
+		return ignoreRule{}, false, nil
+	}
+	var rule ignoreRule
+	if line[0] == '!' {
+		rule.negate = true
+		line = line[1:]
+	}
+	if strings.HasSuffix(line, "/") {
+		rule.dirOnly = true
+		line = strings.TrimRight(line, "/")
+	}
+	// A pattern containing a slash matches paths relative to the directory
+	// it applies to; otherwise it matches a name at any depth.
+	anchored := strings.Contains(line, "/")
+	line = strings.TrimPrefix(line, "/")
+	if line == "" {
+		return ignoreRule{}, false, nil
+	}
+	var expr strings.Builder
+	expr.WriteString("^")
+	if !anchored {
+		expr.WriteString("(?:.*/)?")
+	}
+	for i := 0; i < len(line); i++ {
+		c := line[i]
+		atStart := i == 0 || line[i-1] == '/'
+		switch {
+		case atStart && strings.HasPrefix(line[i:], "**/"):
+			expr.WriteString("(?:.*/)?")
+			i += 2
+		case atStart && line[i:] == "**":
+			expr.WriteString(".*")
+			i++
+		case c == '*':
+			expr.WriteString("[^/]*")
+		case c == '?':
+			expr.WriteString("[^/]")
+		case c == '[':
+			class, n := ignoreClass(line[i:])
+			if n == 0 {
+				expr.WriteString(`\[`)
+				continue
+			}
+			expr.WriteString(class)
+			i += n - 1
+		case c == '\\' && i+1 < len(line):
+			i++
+			expr.WriteString(regexp.QuoteMeta(line[i : i+1]))
+		default:
+			expr.WriteString(regexp.QuoteMeta(line[i : i+1]))
+		}
+	}
+	expr.WriteString("$")
+	re, err := regexp.Compile(expr.String())
+	if err != nil {
+		return ignoreRule{}, false, err
+	}
+	rule.re = re
+	return rule, true, nil
+}
+
+// ignoreClass converts the bracket expression at the start of s, such as
+// [a-z] or [!0-9], to a regular expression, returning it and the number of
+// bytes of s it took up, or zero if s doesn't start with a complete bracket
+// expression.
+func ignoreClass(s string) (string, int) {
+	var class strings.Builder
+	class.WriteString("[")
+	i := 1
+	if i < len(s) && (s[i] == '!' || s[i] == '^') {
+		class.WriteString("^/")
+		i++
+	}
+	for start := i; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case c == ']' && i > start:
+			class.WriteString("]")
+			return class.String(), i + 1
+		case c == '\\' && i+1 < len(s):
+			i++
+			class.WriteString(regexp.QuoteMeta(s[i : i+1]))
+		case c == '[' || c == ']' || c == '^' || c == '\\':
+			class.WriteString(`\` + string(c))
+		default:
+			class.WriteByte(c)
+		}
+	}
+	return "", 0
+}
@@ -0,0 +1,478 @@
+// Package k8s provides a script source and sink for Kubernetes clusters, so
+// that pipes can stream pod logs, or apply manifests, without needing kubectl.
+// It talks to the cluster's API server directly, using the credentials from a
+// kubeconfig file, or from the service account of the pod it's running in.
+package k8s
+
+import (
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/bitfield/script"
+	"gopkg.in/yaml.v3"
+)
+
+// fieldManager identifies ApplyManifest to the API server, which keeps track
+// of the fields each client has set.
+const fieldManager = "script"
+
+// serviceAccountDir is where Kubernetes mounts the credentials for a pod's
+// service account.
+const serviceAccountDir = "/var/run/secrets/kubernetes.io/serviceaccount"
+
+// ApplyManifest reads Kubernetes objects from the pipe, as YAML (with multiple
+// objects separated by `---` lines) or JSON, and applies each of them to the
+// cluster, like `kubectl apply --server-side`, creating the object if it
+// doesn't exist, and otherwise updating the fields given in the manifest. A
+// List object applies each of its items. Objects whose metadata doesn't
+// give a namespace are applied in the namespace of the current context.
+//
+// ApplyManifest returns the number of objects applied, or an error. It stops
+// at the first object that can't be applied, for example because one of its
+// fields is managed by another client, such as kubectl. If there is an error
+// reading the pipe or applying an object, the pipe's error status is also set.
+func ApplyManifest(p *script.Pipe) (int, error) {
+	if p == nil {
+		return 0, nil
+	}
+	if err := p.Error(); err != nil {
+		return 0, err
+	}
+	data, err := p.Bytes()
+	if err != nil {
+		return 0, err
+	}
+	objects, err := parseManifest(data)
+	if err != nil {
+		p.SetError(err)
+		return 0, err
+	}
+	if len(objects) == 0 {
+		return 0, nil
+	}
+	c, err := newClient()
+	if err != nil {
+		p.SetError(err)
+		return 0, err
+	}
+	for i, obj := range objects {
+		if err := c.apply(obj); err != nil {
+			p.SetError(err)
+			return i, err
+		}
+	}
+	return len(objects), nil
+}
+
+// PodLogs returns a pipe containing the logs of the specified pod, like
+// `kubectl logs`. If namespace is empty, it's the namespace of the current
+// context. For a pod with more than one container, give the container as well,
+// as "pod/container". If follow is true, the pipe keeps streaming new log
+// output, like `kubectl logs -f`, until the container stops, or the pipe is
+// closed:
+//
+//	k8s.PodLogs("prod", "api-7d9f8", true).Match("ERROR").Stdout()
+//
+// If the API server can't be reached, or the pod doesn't exist, the pipe's
+// error status will be set.
+func PodLogs(namespace, pod string, follow bool) *script.Pipe {
+	c, err := newClient()
+	if err != nil {
+		return script.NewPipe().WithError(err)
+	}
+	if namespace == "" {
+		namespace = c.namespace
+	}
+	query := url.Values{}
+	pod, container, ok := strings.Cut(pod, "/")
+	if ok {
+		query.Set("container", container)
+	}
+	if follow {
+		query.Set("follow", "true")
+	}
+	path := "/api/v1/namespaces/" + url.PathEscape(namespace) + "/pods/" + url.PathEscape(pod) + "/log"
+	if len(query) > 0 {
+		path += "?" + query.Encode()
+	}
+	resp, err := c.request(http.MethodGet, path, "", nil)
+	if err != nil {
+		return script.NewPipe().WithError(err)
+	}
+	return script.NewPipe().WithReader(resp.Body)
+}
+
+// apiPath returns the path on the API server of the specified API group
+// version, such as "v1" or "apps/v1".
+func apiPath(apiVersion string) string {
+	if !strings.Contains(apiVersion, "/") {
+		return "/api/" + apiVersion // the core group
+	}
+	return "/apis/" + apiVersion
+}
+
+// apiResource describes a kind of resource provided by the API server.
+type apiResource struct {
+	Name       string
+	Kind       string
+	Namespaced bool
+}
+
+// client makes requests to a Kubernetes API server.
+type client struct {
+	client    *http.Client
+	server    string
+	token     string
+	namespace string
+	// resources caches the resources the server provides in each API group
+	// version, by the version's name.
+	resources map[string][]apiResource
+}
+
+// newClient returns a client for the API server given by the kubeconfig file
+// named by the KUBECONFIG environment variable, if set (only the first file
+// is used, if it lists several), or else by the service account of the pod
+// it's running in, if any, or else by the kubeconfig file ~/.kube/config.
+func newClient() (*client, error) {
+	if path := os.Getenv("KUBECONFIG"); path != "" {
+		path, _, _ = strings.Cut(path, string(os.PathListSeparator))
+		return kubeconfigClient(path)
+	}
+	if os.Getenv("KUBERNETES_SERVICE_HOST") != "" {
+		return inClusterClient()
+	}
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return nil, err
+	}
+	return kubeconfigClient(filepath.Join(home, ".kube", "config"))
+}
+
+// apply applies obj to the cluster, using server-side apply.
+func (c *client) apply(obj object) error {
+	name := strings.ToLower(obj.Kind) + "/" + obj.Metadata.Name
+	res, err := c.resource(obj.APIVersion, obj.Kind)
+	if err != nil {
+		return fmt.Errorf("applying %s: %w", name, err)
+	}
+	path := apiPath(obj.APIVersion)
+	if res.Namespaced {
+		namespace := obj.Metadata.Namespace
+		if namespace == "" {
+			namespace = c.namespace
+		}
+		path += "/namespaces/" + url.PathEscape(namespace)
+	}
+	path += "/" + res.Name + "/" + url.PathEscape(obj.Metadata.Name) + "?fieldManager=" + fieldManager
+	body, err := yaml.Marshal(obj.node)
+	if err != nil {
+		return fmt.Errorf("applying %s: %w", name, err)
+	}
+	resp, err := c.request(http.MethodPatch, path, "application/apply-patch+yaml", bytes.NewReader(body))
+	if err != nil {
+		return fmt.Errorf("applying %s: %w", name, err)
+	}
+	return resp.Body.Close()
+}
+
+// request sends a request to the API server, with body, if not nil, of the
+// specified content type, and returns the response. If the response status
+// isn't a success, it returns the error message from the response instead.
+func (c *client) request(method, path, contentType string, body io.Reader) (*http.Response, error) {
+	req, err := http.NewRequest(method, c.server+path, body)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Accept", "application/json, */*")
+	if contentType != "" {
+		req.Header.Set("Content-Type", contentType)
+	}
+	if c.token != "" {
+		req.Header.Set("Authorization", "Bearer "+c.token)
+	}
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("kubernetes: %w", err)
+	}
+	if resp.StatusCode/100 != 2 {
+		defer resp.Body.Close()
+		var status struct{ Message string }
+		data, _ := io.ReadAll(io.LimitReader(resp.Body, 64*1024))
+		if json.Unmarshal(data, &status) != nil || status.Message == "" {
+			status.Message = strings.TrimSpace(string(data))
+		}
+		return nil, fmt.Errorf("kubernetes: %s (%s)", status.Message, resp.Status)
+	}
+	return resp, nil
+}
+
+// resource returns the resource for objects of the specified kind in the API
+// group version apiVersion, asking the API server which resources it provides
+// if it hasn't already.
+func (c *client) resource(apiVersion, kind string) (apiResource, error) {
+	resources, ok := c.resources[apiVersion]
+	if !ok {
+		resp, err := c.request(http.MethodGet, apiPath(apiVersion), "", nil)
+		if err != nil {
+			return apiResource{}, err
+		}
+		defer resp.Body.Close()
+		var list struct{ Resources []apiResource }
+		if err := json.NewDecoder(resp.Body).Decode(&list); err != nil {
+			return apiResource{}, fmt.Errorf("kubernetes: listing resources in %s: %w", apiVersion, err)
+		}
+		resources = list.Resources
+		c.resources[apiVersion] = resources
+	}
+	for _, res := range resources {
+		// Subresources, such as pods/log, have the kind of their parent.
+		if res.Kind == kind && !strings.Contains(res.Name, "/") {
+			return res, nil
+		}
+	}
+	return apiResource{}, fmt.Errorf("kubernetes: no resource of kind %s in %s", kind, apiVersion)
+}
+
+// inClusterClient returns a client using the credentials of the service
+// account of the pod it's running in.
+func inClusterClient() (*client, error) {
+	token, err := os.ReadFile(filepath.Join(serviceAccountDir, "token"))
+	if err != nil {
+		return nil, err
+	}
+	ca, err := os.ReadFile(filepath.Join(serviceAccountDir, "ca.crt"))
+	if err != nil {
+		return nil, err
+	}
+	namespace := "default"
+	if data, err := os.ReadFile(filepath.Join(serviceAccountDir, "namespace")); err == nil {
+		namespace = strings.TrimSpace(string(data))
+	}
+	httpClient, err := newHTTPClient(ca, nil, nil, false)
+	if err != nil {
+		return nil, err
+	}
+	return &client{
+		client:    httpClient,
+		server:    "https://" + net.JoinHostPort(os.Getenv("KUBERNETES_SERVICE_HOST"), os.Getenv("KUBERNETES_SERVICE_PORT")),
+		token:     strings.TrimSpace(string(token)),
+		namespace: namespace,
+		resources: map[string][]apiResource{},
+	}, nil
+}
+
+// kubeconfig is the part of a kubeconfig file that describes how to connect
+// to a cluster.
+type kubeconfig struct {
+	CurrentContext string `yaml:"current-context"`
+	Contexts       []struct {
+		Name    string
+		Context struct {
+			Cluster   string
+			User      string
+			Namespace string
+		}
+	}
+	Clusters []struct {
+		Name    string
+		Cluster struct {
+			Server                   string
+			CertificateAuthority     string `yaml:"certificate-authority"`
+			CertificateAuthorityData string `yaml:"certificate-authority-data"`
+			InsecureSkipTLSVerify    bool   `yaml:"insecure-skip-tls-verify"`
+		}
+	}
+	Users []struct {
+		Name string
+		User struct {
+			Token                 string
+			TokenFile             string `yaml:"tokenFile"`
+			ClientCertificate     string `yaml:"client-certificate"`
+			ClientCertificateData string `yaml:"client-certificate-data"`
+			ClientKey             string `yaml:"client-key"`
+			ClientKeyData         string `yaml:"client-key-data"`
+			Exec                  any    `yaml:"exec"`
+			AuthProvider          any    `yaml:"auth-provider"`
+		}
+	}
+}
+
+// kubeconfigClient returns a client for the current context of the kubeconfig
+// file at path. Credential plugins (exec and auth-provider users) aren't
+// supported, since they need external commands.
+func kubeconfigClient(path string) (*client, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var cfg kubeconfig
+	if err := yaml.Unmarshal(data, &cfg); err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	c := &client{namespace: "default", resources: map[string][]apiResource{}}
+	var clusterName, userName string
+	for _, ctx := range cfg.Contexts {
+		if ctx.Name == cfg.CurrentContext {
+			clusterName, userName = ctx.Context.Cluster, ctx.Context.User
+			if ctx.Context.Namespace != "" {
+				c.namespace = ctx.Context.Namespace
+			}
+		}
+	}
+	if clusterName == "" {
+		return nil, fmt.Errorf("%s: no current context", path)
+	}
+	// Files named in a kubeconfig file are relative to its directory.
+	load := func(data, file string) ([]byte, error) {
+		if data != "" {
+			return base64.StdEncoding.DecodeString(data)
+		}
+		if file == "" {
+			return nil, nil
+		}
+		if !filepath.IsAbs(file) {
+			file = filepath.Join(filepath.Dir(path), file)
+		}
+		return os.ReadFile(file)
+	}
+	var ca []byte
+	insecure := false
+	for _, cluster := range cfg.Clusters {
+		if cluster.Name == clusterName {
+			c.server = strings.TrimSuffix(cluster.Cluster.Server, "/")
+			insecure = cluster.Cluster.InsecureSkipTLSVerify
+			ca, err = load(cluster.Cluster.CertificateAuthorityData, cluster.Cluster.CertificateAuthority)
+			if err != nil {
+				return nil, fmt.Errorf("%s: cluster %q: %w", path, clusterName, err)
+			}
+		}
+	}
+	if c.server == "" {
+		return nil, fmt.Errorf("%s: no server for cluster %q", path, clusterName)
+	}
+	var cert, key []byte
+	for _, user := range cfg.Users {
+		if user.Name != userName {
+			continue
+		}
+		u := user.User
+		token, err := load("", u.TokenFile)
+		if err != nil {
+			return nil, fmt.Errorf("%s: user %q: %w", path, userName, err)
+		}
+		c.token = strings.TrimSpace(string(token))
+		if u.Token != "" {
+			c.token = u.Token
+		}
+		if cert, err = load(u.ClientCertificateData, u.ClientCertificate); err == nil {
+			key, err = load(u.ClientKeyData, u.ClientKey)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("%s: user %q: %w", path, userName, err)
+		}
+		if c.token == "" && cert == nil && (u.Exec != nil || u.AuthProvider != nil) {
+			return nil, fmt.Errorf("%s: user %q: exec and auth-provider credentials aren't supported", path, userName)
+		}
+	}
+	c.client, err = newHTTPClient(ca, cert, key, insecure)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	return c, nil
+}
+
+// newHTTPClient returns an HTTP client that trusts the certificate authority
+// ca, or the system's roots if ca is nil, and presents the client certificate
+// cert, with the private key key, if cert isn't nil. If insecure is true, it
+// doesn't verify the server's certificate at all.
+func newHTTPClient(ca, cert, key []byte, insecure bool) (*http.Client, error) {
+	config := &tls.Config{InsecureSkipVerify: insecure}
+	if ca != nil {
+		config.RootCAs = x509.NewCertPool()
+		if !config.RootCAs.AppendCertsFromPEM(ca) {
+			return nil, errors.New("no valid certificates in certificate authority data")
+		}
+	}
+	if cert != nil {
+		pair, err := tls.X509KeyPair(cert, key)
+		if err != nil {
+			return nil, err
+		}
+		config.Certificates = []tls.Certificate{pair}
+	}
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.TLSClientConfig = config
+	return &http.Client{Transport: transport}, nil
+}
+
+// object is a Kubernetes object read from a manifest.
+type object struct {
+	APIVersion string `yaml:"apiVersion"`
+	Kind       string `yaml:"kind"`
+	Metadata   struct {
+		Name      string `yaml:"name"`
+		Namespace string `yaml:"namespace"`
+	} `yaml:"metadata"`
+	// node holds the whole object, as read from the manifest.
+	node *yaml.Node
+}
+
+// parseManifest returns the objects in the YAML or JSON manifest data,
+// expanding any List objects into their items.
+func parseManifest(data []byte) ([]object, error) {
+	var objects []object
+	var add func(node *yaml.Node) error
+	add = func(node *yaml.Node) error {
+		obj := object{node: node}
+		if err := node.Decode(&obj); err != nil {
+			return err
+		}
+		if obj.Kind == "List" {
+			var list struct{ Items []yaml.Node }
+			if err := node.Decode(&list); err != nil {
+				return err
+			}
+			for i := range list.Items {
+				if err := add(&list.Items[i]); err != nil {
+					return err
+				}
+			}
+			return nil
+		}
+		if obj.APIVersion == "" || obj.Kind == "" || obj.Metadata.Name == "" {
+			return fmt.Errorf("line %d: object needs apiVersion, kind, and metadata.name", node.Line)
+		}
+		objects = append(objects, obj)
+		return nil
+	}
+	dec := yaml.NewDecoder(bytes.NewReader(data))
+	for {
+		var doc yaml.Node
+		err := dec.Decode(&doc)
+		if err == io.EOF {
+			return objects, nil
+		}
+		if err != nil {
+			return nil, fmt.Errorf("reading manifest: %w", err)
+		}
+		// Empty documents, such as after a trailing `---`, are skipped.
+		if len(doc.Content) == 0 || doc.Content[0].Tag == "!!null" {
+			continue
+		}
+		if err := add(doc.Content[0]); err != nil {
+			return nil, fmt.Errorf("reading manifest: %w", err)
+		}
+	}
+}
@@ -0,0 +1,306 @@
+package k8s_test
+
+import (
+	"bufio"
+	"encoding/base64"
+	"encoding/pem"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/bitfield/script"
+	"github.com/bitfield/script/k8s"
+)
+
+// fakeCluster starts a fake Kubernetes API server, serving the API with
+// handler, which requires the bearer token "secret", and points KUBECONFIG at
+// a kubeconfig file for it, whose current context has the namespace "team".
+// Tests using it can't be parallel, since KUBECONFIG affects every test.
+func fakeCluster(t *testing.T, handler http.Handler) {
+	t.Helper()
+	srv := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer secret" {
+			w.WriteHeader(http.StatusUnauthorized)
+			w.Write([]byte(`{"kind":"Status","message":"Unauthorized"}`))
+			return
+		}
+		handler.ServeHTTP(w, r)
+	}))
+	t.Cleanup(srv.Close)
+	ca := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: srv.Certificate().Raw})
+	writeKubeconfig(t, `apiVersion: v1
+kind: Config
+current-context: test
+contexts:
+- name: other
+  context: {cluster: nowhere, user: nobody}
+- name: test
+  context: {cluster: fake, user: admin, namespace: team}
+clusters:
+- name: fake
+  cluster:
+    server: `+srv.URL+`
+    certificate-authority-data: `+base64.StdEncoding.EncodeToString(ca)+`
+users:
+- name: admin
+  user: {token: secret}
+`)
+}
+
+// writeKubeconfig writes data to a kubeconfig file, and points KUBECONFIG at
+// it.
+func writeKubeconfig(t *testing.T, data string) {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "config")
+	if err := os.WriteFile(path, []byte(data), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("KUBECONFIG", path)
+}
+
+func TestPodLogsStreamsLogsFromPod(t *testing.T) {
+	// Not parallel, since it sets KUBECONFIG.
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /api/v1/namespaces/team/pods/api-1/log", func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.RawQuery != "" {
+			t.Errorf("want no query, got %q", r.URL.RawQuery)
+		}
+		w.Write([]byte("starting\nERROR oh no\nready\n"))
+	})
+	mux.HandleFunc("GET /api/v1/namespaces/prod/pods/api-2/log", func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.RawQuery != "container=sidecar" {
+			t.Errorf("want container query, got %q", r.URL.RawQuery)
+		}
+		w.Write([]byte("proxying\n"))
+	})
+	fakeCluster(t, mux)
+	got, err := k8s.PodLogs("", "api-1", false).Match("ERROR").String()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got != "ERROR oh no\n" {
+		t.Errorf("want %q, got %q", "ERROR oh no\n", got)
+	}
+	got, err = k8s.PodLogs("prod", "api-2/sidecar", false).String()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got != "proxying\n" {
+		t.Errorf("want logs of specified container, got %q", got)
+	}
+}
+
+func TestPodLogsFollowStreamsUntilClosed(t *testing.T) {
+	// Not parallel, since it sets KUBECONFIG.
+	disconnected := make(chan struct{})
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /api/v1/namespaces/team/pods/api-1/log", func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Query().Get("follow") != "true" {
+			t.Errorf("want follow, got %q", r.URL.RawQuery)
+		}
+		w.Write([]byte("first\n"))
+		w.(http.Flusher).Flush()
+		<-r.Context().Done()
+		close(disconnected)
+	})
+	fakeCluster(t, mux)
+	p := k8s.PodLogs("", "api-1", true)
+	line, err := bufio.NewReader(p).ReadString('\n')
+	if err != nil || line != "first\n" {
+		t.Fatalf("want first line streamed, got %q, %v", line, err)
+	}
+	p.Close()
+	<-disconnected
+}
+
+func TestPodLogsWithUnknownPodIsError(t *testing.T) {
+	// Not parallel, since it sets KUBECONFIG.
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /api/v1/namespaces/team/pods/missing/log", func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNotFound)
+		w.Write([]byte(`{"kind":"Status","message":"pods \"missing\" not found"}`))
+	})
+	fakeCluster(t, mux)
+	p := k8s.PodLogs("", "missing", false)
+	if p.Error() == nil || !strings.Contains(p.Error().Error(), `pods "missing" not found`) {
+		t.Errorf("want error from API server, got %v", p.Error())
+	}
+}
+
+// discovery serves the resource lists of the core and apps API groups.
+func discovery(mux *http.ServeMux) {
+	mux.HandleFunc("GET /api/v1", func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"resources":[
+			{"name":"configmaps","kind":"ConfigMap","namespaced":true},
+			{"name":"namespaces","kind":"Namespace","namespaced":false},
+			{"name":"pods/log","kind":"Pod","namespaced":true},
+			{"name":"pods","kind":"Pod","namespaced":true}]}`))
+	})
+	mux.HandleFunc("GET /apis/apps/v1", func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"resources":[{"name":"deployments","kind":"Deployment","namespaced":true}]}`))
+	})
+}
+
+func TestApplyManifestAppliesEachObject(t *testing.T) {
+	// Not parallel, since it sets KUBECONFIG.
+	var mu sync.Mutex
+	var applied []string
+	bodies := map[string]string{}
+	mux := http.NewServeMux()
+	discovery(mux)
+	mux.HandleFunc("PATCH /", func(w http.ResponseWriter, r *http.Request) {
+		if ct := r.Header.Get("Content-Type"); ct != "application/apply-patch+yaml" {
+			t.Errorf("want server-side apply, got content type %q", ct)
+		}
+		if r.URL.Query().Get("fieldManager") != "script" {
+			t.Errorf("want field manager script, got %q", r.URL.RawQuery)
+		}
+		body, _ := io.ReadAll(r.Body)
+		mu.Lock()
+		defer mu.Unlock()
+		applied = append(applied, r.URL.Path)
+		bodies[r.URL.Path] = string(body)
+		w.Write([]byte("{}"))
+	})
+	fakeCluster(t, mux)
+	manifest := `apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: settings
+data:
+  level: info
+---
+apiVersion: apps/v1
+kind: Deployment
+metadata:
+  name: api
+  namespace: prod
+spec:
+  replicas: 3
+---
+{"apiVersion": "v1", "kind": "List", "items": [
+  {"apiVersion": "v1", "kind": "Namespace", "metadata": {"name": "staging"}}
+]}
+---
+`
+	n, err := k8s.ApplyManifest(script.Echo(manifest).Replace("info", "debug"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 3 {
+		t.Errorf("want 3 objects applied, got %d", n)
+	}
+	want := []string{
+		"/api/v1/namespaces/team/configmaps/settings",
+		"/apis/apps/v1/namespaces/prod/deployments/api",
+		"/api/v1/namespaces/staging",
+	}
+	if !slices.Equal(want, applied) {
+		t.Errorf("want objects applied at %q, got %q", want, applied)
+	}
+	if body := bodies[want[0]]; !strings.Contains(body, "level: debug") {
+		t.Errorf("want manifest applied, got %q", body)
+	}
+}
+
+func TestApplyManifestStopsAtFirstFailure(t *testing.T) {
+	// Not parallel, since it sets KUBECONFIG.
+	mux := http.NewServeMux()
+	discovery(mux)
+	mux.HandleFunc("PATCH /", func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("{}"))
+	})
+	fakeCluster(t, mux)
+	manifest := `apiVersion: v1
+kind: ConfigMap
+metadata: {name: settings}
+---
+apiVersion: example.com/v1
+kind: Widget
+metadata: {name: sprocket}
+---
+apiVersion: v1
+kind: ConfigMap
+metadata: {name: never}
+`
+	p := script.Echo(manifest)
+	n, err := k8s.ApplyManifest(p)
+	if err == nil || !strings.Contains(err.Error(), "widget/sprocket") {
+		t.Errorf("want error mentioning widget/sprocket, got %v", err)
+	}
+	if n != 1 {
+		t.Errorf("want 1 object applied, got %d", n)
+	}
+	if p.Error() != err {
+		t.Errorf("want pipe error status %v, got %v", err, p.Error())
+	}
+}
+
+func TestApplyManifestWithInvalidObjectIsError(t *testing.T) {
+	// Not parallel, since it sets KUBECONFIG.
+	writeKubeconfig(t, "current-context: none\n")
+	n, err := k8s.ApplyManifest(script.Echo("apiVersion: v1\nkind: ConfigMap\n"))
+	if err == nil || !strings.Contains(err.Error(), "metadata.name") {
+		t.Errorf("want error for object without name, got %v", err)
+	}
+	if n != 0 {
+		t.Errorf("want no objects applied, got %d", n)
+	}
+	n, err = k8s.ApplyManifest(script.Echo("---\n"))
+	if err != nil {
+		t.Errorf("want no error for empty manifest, got %v", err)
+	}
+	if n != 0 {
+		t.Errorf("want no objects applied, got %d", n)
+	}
+}
+
+func TestApplyManifestOnErrorPipe(t *testing.T) {
+	t.Parallel()
+	want := errors.New("oh no")
+	n, err := k8s.ApplyManifest(script.Echo("hello\n").WithError(want))
+	if err != want {
+		t.Errorf("want error %v, got %v", want, err)
+	}
+	if n != 0 {
+		t.Errorf("want 0 objects applied, got %d", n)
+	}
+}
+
+func TestApplyManifestOnNilPipe(t *testing.T) {
+	t.Parallel()
+	n, err := k8s.ApplyManifest(nil)
+	if err != nil {
+		t.Error(err)
+	}
+	if n != 0 {
+		t.Errorf("want 0 objects applied, got %d", n)
+	}
+}
+
+func TestPodLogsWithUnsupportedCredentialsIsError(t *testing.T) {
+	// Not parallel, since it sets KUBECONFIG.
+	writeKubeconfig(t, `current-context: cloud
+contexts:
+- name: cloud
+  context: {cluster: cloud, user: cloud}
+clusters:
+- name: cloud
+  cluster: {server: "https://127.0.0.1:1"}
+users:
+- name: cloud
+  user:
+    exec: {command: cloud-auth-plugin}
+`)
+	p := k8s.PodLogs("", "api-1", false)
+	if p.Error() == nil || !strings.Contains(p.Error().Error(), "exec") {
+		t.Errorf("want error for exec credentials, got %v", p.Error())
+	}
+}
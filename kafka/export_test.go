@@ -0,0 +1,9 @@
+package kafka
+
+// ConsumeFrom and ProduceTo are versions of Consume and Produce that read
+// from and write to the supplied reader and writer, so that tests can use
+// fakes instead of a broker.
+var (
+	ConsumeFrom = consume
+	ProduceTo   = produce
+)
@@ -0,0 +1,20 @@
+module github.com/bitfield/script/kafka
+
+go 1.26.0
+
+require (
+	github.com/bitfield/script v0.25.1
+	github.com/segmentio/kafka-go v0.4.51
+)
+
+require (
+	github.com/google/go-cmp v0.6.0 // indirect
+	github.com/itchyny/gojq v0.12.13 // indirect
+	github.com/itchyny/timefmt-go v0.1.5 // indirect
+	github.com/klauspost/compress v1.20.1 // indirect
+	github.com/pierrec/lz4/v4 v4.1.15 // indirect
+	github.com/rogpeppe/go-internal v1.16.0 // indirect
+	golang.org/x/net v0.60.0 // indirect
+	golang.org/x/tools v0.49.0 // indirect
+	mvdan.cc/sh/v3 v3.7.0 // indirect
+)
@@ -0,0 +1,140 @@
+// Package kafka provides script sources and sinks for Apache Kafka, so that
+// pipes can consume messages from a topic, or publish to one.
+package kafka
+
+import (
+	"bufio"
+	"context"
+	"io"
+	"strings"
+
+	"github.com/bitfield/script"
+	kafkago "github.com/segmentio/kafka-go"
+)
+
+// batchSize is the maximum number of messages that Produce sends at once.
+const batchSize = 100
+
+// maxMessageSize is the longest line that Produce will publish, which is the
+// default maximum message size of a Kafka broker.
+const maxMessageSize = 1 << 20
+
+// Consume connects to the specified Kafka brokers (for example,
+// "localhost:9092") as a member of the consumer group `group`, and returns a
+// pipe containing the value of each message received on `topic`, one per line,
+// as it arrives. If `group` is empty, Consume reads only the topic's first
+// partition (partition 0), from the beginning, without committing offsets, so
+// a group is needed to consume a topic with more than one partition. The pipe
+// continues until it is closed, or there is an error reading messages, in
+// which case the pipe's error status will be set.
+func Consume(brokers []string, topic, group string) *script.Pipe {
+	return consume(kafkago.NewReader(kafkago.ReaderConfig{
+		Brokers: brokers,
+		Topic:   topic,
+		GroupID: group,
+	}))
+}
+
+// consume returns a pipe containing the value of each message read from r,
+// as for Consume.
+func consume(r messageReader) *script.Pipe {
+	ctx, cancel := context.WithCancel(context.Background())
+	pr, pw := io.Pipe()
+	go func() {
+		for {
+			m, err := r.ReadMessage(ctx)
+			if err != nil {
+				if ctx.Err() != nil {
+					err = nil // pipe was closed
+				}
+				pw.CloseWithError(err)
+				return
+			}
+			line := strings.TrimSuffix(string(m.Value), "\n") + "\n"
+			if _, err := io.WriteString(pw, line); err != nil {
+				return // reader closed
+			}
+		}
+	}()
+	return script.NewPipe().WithReader(consumer{pr, r, cancel})
+}
+
+// Produce reads from the pipe and publishes each line as a separate message to
+// `topic` on the specified Kafka brokers. It returns the number of messages
+// published, or an error. If there is an error reading the pipe or publishing
+// messages, the pipe's error status is also set.
+func Produce(p *script.Pipe, brokers []string, topic string) (int, error) {
+	if p == nil {
+		return 0, nil
+	}
+	if err := p.Error(); err != nil {
+		return 0, err
+	}
+	return produce(p, &kafkago.Writer{
+		Addr:      kafkago.TCP(brokers...),
+		Topic:     topic,
+		Balancer:  &kafkago.LeastBytes{},
+		BatchSize: batchSize,
+	})
+}
+
+// produce reads from the pipe and writes each line as a separate message to
+// w, in batches, as for Produce.
+func produce(p *script.Pipe, w messageWriter) (int, error) {
+	defer w.Close()
+	var published int
+	batch := make([]kafkago.Message, 0, batchSize)
+	flush := func() {
+		if len(batch) == 0 || p.Error() != nil {
+			return
+		}
+		if err := w.WriteMessages(context.Background(), batch...); err != nil {
+			p.SetError(err)
+			return
+		}
+		published += len(batch)
+		batch = batch[:0]
+	}
+	scanner := bufio.NewScanner(p)
+	scanner.Buffer(nil, maxMessageSize)
+	for p.Error() == nil && scanner.Scan() {
+		batch = append(batch, kafkago.Message{Value: []byte(scanner.Text())})
+		if len(batch) == batchSize {
+			flush()
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		p.SetError(err)
+	}
+	flush()
+	return published, p.Error()
+}
+
+// messageReader reads messages from a Kafka topic. It's implemented by
+// *kafkago.Reader.
+type messageReader interface {
+	ReadMessage(context.Context) (kafkago.Message, error)
+	Close() error
+}
+
+// messageWriter publishes messages to a Kafka topic. It's implemented by
+// *kafkago.Writer.
+type messageWriter interface {
+	WriteMessages(context.Context, ...kafkago.Message) error
+	Close() error
+}
+
+// consumer reads messages from a Kafka topic, and stops consuming when it is
+// closed.
+type consumer struct {
+	*io.PipeReader
+	r      messageReader
+	cancel context.CancelFunc
+}
+
+// Close stops consuming messages and closes the connection to the brokers.
+func (c consumer) Close() error {
+	c.cancel()
+	c.PipeReader.Close()
+	return c.r.Close()
+}
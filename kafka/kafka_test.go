@@ -0,0 +1,195 @@
+package kafka_test
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/bitfield/script"
+	"github.com/bitfield/script/kafka"
+	kafkago "github.com/segmentio/kafka-go"
+)
+
+// fakeReader returns the messages with the specified values, followed by err,
+// or waits until its context is cancelled if err is nil.
+type fakeReader struct {
+	values []string
+	err    error
+	closed bool
+}
+
+func (r *fakeReader) ReadMessage(ctx context.Context) (kafkago.Message, error) {
+	if len(r.values) > 0 {
+		m := kafkago.Message{Value: []byte(r.values[0])}
+		r.values = r.values[1:]
+		return m, nil
+	}
+	if r.err != nil {
+		return kafkago.Message{}, r.err
+	}
+	<-ctx.Done()
+	return kafkago.Message{}, ctx.Err()
+}
+
+func (r *fakeReader) Close() error {
+	r.closed = true
+	return nil
+}
+
+// fakeWriter records the batches of messages written to it, and fails with
+// err once it has accepted the specified number of batches.
+type fakeWriter struct {
+	batches [][]string
+	failAt  int
+	err     error
+	closed  bool
+}
+
+func (w *fakeWriter) WriteMessages(ctx context.Context, msgs ...kafkago.Message) error {
+	if w.err != nil && len(w.batches) == w.failAt {
+		return w.err
+	}
+	var batch []string
+	for _, m := range msgs {
+		batch = append(batch, string(m.Value))
+	}
+	w.batches = append(w.batches, batch)
+	return nil
+}
+
+func (w *fakeWriter) Close() error {
+	w.closed = true
+	return nil
+}
+
+func TestConsumeStreamsMessageValuesAsLines(t *testing.T) {
+	t.Parallel()
+	r := &fakeReader{values: []string{"hello", "world\n"}}
+	p := kafka.ConsumeFrom(r)
+	br := bufio.NewReader(p)
+	line, err := br.ReadString('\n')
+	if err != nil {
+		t.Fatal(err)
+	}
+	if line != "hello\n" {
+		t.Errorf("want %q, got %q", "hello\n", line)
+	}
+	line, err = br.ReadString('\n')
+	if err != nil {
+		t.Fatal(err)
+	}
+	if line != "world\n" {
+		t.Errorf("want trailing newline not doubled, got %q", line)
+	}
+	if err := p.Close(); err != nil {
+		t.Error(err)
+	}
+	if !r.closed {
+		t.Error("want reader closed when pipe closed, but it wasn't")
+	}
+}
+
+func TestConsumeSetsErrorFromReader(t *testing.T) {
+	t.Parallel()
+	want := errors.New("oh no")
+	p := kafka.ConsumeFrom(&fakeReader{values: []string{"hello"}, err: want})
+	got, err := p.String()
+	if !errors.Is(err, want) {
+		t.Errorf("want error %v, got %v", want, err)
+	}
+	if got != "hello\n" {
+		t.Errorf("want messages before error, got %q", got)
+	}
+}
+
+func TestProducePublishesLinesInBatches(t *testing.T) {
+	t.Parallel()
+	var input strings.Builder
+	for i := range 150 {
+		fmt.Fprintln(&input, i)
+	}
+	w := &fakeWriter{}
+	n, err := kafka.ProduceTo(script.Echo(input.String()), w)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 150 {
+		t.Errorf("want 150 messages published, got %d", n)
+	}
+	if len(w.batches) != 2 || len(w.batches[0]) != 100 || len(w.batches[1]) != 50 {
+		t.Fatalf("want batches of 100 and 50 messages, got %d batches", len(w.batches))
+	}
+	if w.batches[0][0] != "0" || w.batches[1][49] != "149" {
+		t.Errorf("want lines published in order, got %q ... %q", w.batches[0][0], w.batches[1][49])
+	}
+	if !w.closed {
+		t.Error("want writer closed, but it wasn't")
+	}
+}
+
+func TestProduceSetsPipeErrorWhenPublishingFails(t *testing.T) {
+	t.Parallel()
+	var input strings.Builder
+	for i := range 250 {
+		fmt.Fprintln(&input, i)
+	}
+	want := errors.New("oh no")
+	w := &fakeWriter{failAt: 1, err: want}
+	p := script.Echo(input.String())
+	n, err := kafka.ProduceTo(p, w)
+	if err != want {
+		t.Errorf("want error %v, got %v", want, err)
+	}
+	if p.Error() != want {
+		t.Errorf("want pipe error status %v, got %v", want, p.Error())
+	}
+	if n != 100 {
+		t.Errorf("want 100 messages published before failure, got %d", n)
+	}
+	if len(w.batches) != 1 {
+		t.Errorf("want no batches sent after failure, got %d", len(w.batches))
+	}
+}
+
+func TestConsumeStopsWhenPipeClosed(t *testing.T) {
+	t.Parallel()
+	p := kafka.Consume([]string{"127.0.0.1:1"}, "test", "")
+	if p.Error() != nil {
+		t.Fatal(p.Error())
+	}
+	err := p.Close()
+	if err != nil {
+		t.Error(err)
+	}
+	n, _ := p.Read(make([]byte, 1))
+	if n != 0 {
+		t.Errorf("want no data from closed pipe, got %d bytes", n)
+	}
+}
+
+func TestProduceOnErrorPipe(t *testing.T) {
+	t.Parallel()
+	want := errors.New("oh no")
+	p := script.Echo("hello\n").WithError(want)
+	n, err := kafka.Produce(p, []string{"127.0.0.1:1"}, "test")
+	if err != want {
+		t.Errorf("want error %v, got %v", want, err)
+	}
+	if n != 0 {
+		t.Errorf("want 0 messages published, got %d", n)
+	}
+}
+
+func TestProduceOnNilPipe(t *testing.T) {
+	t.Parallel()
+	n, err := kafka.Produce(nil, []string{"127.0.0.1:1"}, "test")
+	if err != nil {
+		t.Error(err)
+	}
+	if n != 0 {
+		t.Errorf("want 0 messages published, got %d", n)
+	}
+}
@@ -0,0 +1,116 @@
+package script
+
+import (
+	"sync"
+	"sync/atomic"
+)
+
+// defaultLimiter, if set, limits the concurrency of pipes that don't have a
+// limit of their own (see SetMaxProcs).
+var defaultLimiter atomic.Pointer[procLimiter]
+
+// SetMaxProcs sets the default for the maximum number of commands and
+// concurrent tasks that pipelines may run at once, for pipes that don't have
+// their own limit set with [Pipe.WithMaxProcs], and for sources such as
+// Grep. This is useful for scripts running on shared machines, such as CI
+// runners, where starting a command or a goroutine for every CPU would hog
+// them. If n is zero or less, there is no limit, which is the default.
+//
+// Pipes created before SetMaxProcs is called are affected too, from the next
+// command they run.
+func SetMaxProcs(n int) {
+	defaultLimiter.Store(newProcLimiter(n))
+}
+
+// procLimiter limits the number of commands and concurrent tasks running at
+// once in the pipelines that share it. Every stage of a pipeline can always
+// run at least one command or task, even if the limit has been reached, since
+// otherwise a stage waiting for a slot would deadlock with the stages feeding
+// it. So the limit is enforced by making parallel stages, such as
+// ExecForEachParallel, wait for a slot before running any more tasks than
+// that. A nil *procLimiter has no limit.
+type procLimiter struct {
+	mu      sync.Mutex
+	cond    sync.Cond
+	max     int
+	running int
+}
+
+// newProcLimiter returns a limiter allowing max tasks at once, or nil if max
+// is zero or less.
+func newProcLimiter(max int) *procLimiter {
+	if max <= 0 {
+		return nil
+	}
+	l := &procLimiter{max: max}
+	l.cond.L = &l.mu
+	return l
+}
+
+// procGroup is a set of tasks run by one stage of a pipeline, of which one
+// may always run, regardless of the limit.
+type procGroup struct {
+	owned bool
+}
+
+// acquire waits until a task in group g may run, and returns a function to be
+// called when it has finished. If g is nil, the task is a stage in its own
+// right, and may always run straight away.
+func (l *procLimiter) acquire(g *procGroup) func() {
+	return l.acquireN(g, 1)
+}
+
+// acquireN is like acquire, but for a task made up of n commands running
+// together, such as an ExecPipeline.
+func (l *procLimiter) acquireN(g *procGroup, n int) func() {
+	if l == nil {
+		return func() {}
+	}
+	if g == nil {
+		g = &procGroup{}
+	}
+	l.mu.Lock()
+	own := false
+	for {
+		if !g.owned {
+			g.owned, own = true, true
+			break
+		}
+		if l.running == 0 || l.running+n <= l.max {
+			break
+		}
+		l.cond.Wait()
+	}
+	l.running += n
+	l.mu.Unlock()
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			l.mu.Lock()
+			l.running -= n
+			if own {
+				g.owned = false
+			}
+			l.cond.Broadcast()
+			l.mu.Unlock()
+		})
+	}
+}
+
+// workers returns the number of workers a parallel stage should start, which
+// is at most n, or the limit, if smaller.
+func (l *procLimiter) workers(n int) int {
+	if l != nil && l.max < n {
+		return l.max
+	}
+	return n
+}
+
+// limiter returns the limiter for the pipe's commands and tasks: its own, if
+// set with WithMaxProcs, or otherwise the default set with SetMaxProcs.
+func (p *Pipe) limiter() *procLimiter {
+	if p != nil && p.procs != nil {
+		return p.procs
+	}
+	return defaultLimiter.Load()
+}
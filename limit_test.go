@@ -0,0 +1,72 @@
+package script_test
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/bitfield/script"
+)
+
+func TestWithMaxProcsLimitsParallelCommands(t *testing.T) {
+	t.Parallel()
+	start := time.Now()
+	got, err := script.Echo("1\n2\n3\n4\n5\n6\n").WithMaxProcs(2).ExecForEachParallel("sh -c 'sleep 0.2; echo {{.}}'", 6).String()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got != "1\n2\n3\n4\n5\n6\n" {
+		t.Errorf("want all output in order, got %q", got)
+	}
+	// Six commands of 0.2s each, two at a time, take at least 0.6s.
+	if elapsed := time.Since(start); elapsed < 550*time.Millisecond {
+		t.Errorf("want commands limited to two at a time, but all finished in %v", elapsed)
+	}
+}
+
+func TestWithMaxProcsIsInheritedByDerivedPipes(t *testing.T) {
+	t.Parallel()
+	start := time.Now()
+	got, err := script.Echo("a\nb\nc\n").WithMaxProcs(1).Match("").FirstSuccessParallel("sh -c 'sleep 0.2; exit 1'", 3).String()
+	if err == nil {
+		t.Errorf("want error when every command fails, got output %q", got)
+	}
+	if elapsed := time.Since(start); elapsed < 550*time.Millisecond {
+		t.Errorf("want commands run one at a time, but all finished in %v", elapsed)
+	}
+}
+
+func TestWithMaxProcsDoesntDeadlockStreamingStages(t *testing.T) {
+	t.Parallel()
+	// Enough input to fill the OS pipe buffers between the commands.
+	input := strings.Repeat("hello world, this line is forty bytes!\n", 2000)
+	got, err := script.Echo(input).WithMaxProcs(1).Stream().Exec("cat").Exec("cat").ExecForEachParallel("echo {{.}}", 4).CountLines()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got != 2000 {
+		t.Errorf("want 2000 lines, got %d", got)
+	}
+}
+
+func TestSetMaxProcsLimitsPipesWithoutTheirOwnLimit(t *testing.T) {
+	// Not parallel, since the limit applies to every pipe.
+	script.SetMaxProcs(1)
+	defer script.SetMaxProcs(0)
+	start := time.Now()
+	_, err := script.Echo("1\n2\n3\n").ExecForEachParallel("sleep 0.2", 3).String()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if elapsed := time.Since(start); elapsed < 550*time.Millisecond {
+		t.Errorf("want commands run one at a time, but all finished in %v", elapsed)
+	}
+	start = time.Now()
+	_, err = script.Echo("1\n2\n3\n").WithMaxProcs(3).ExecForEachParallel("sleep 0.2", 3).String()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if elapsed := time.Since(start); elapsed > 550*time.Millisecond {
+		t.Errorf("want pipe's own limit to override the default, but commands took %v", elapsed)
+	}
+}
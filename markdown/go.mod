@@ -0,0 +1,14 @@
+module github.com/bitfield/script/markdown
+
+go 1.26.0
+
+require (
+	github.com/bitfield/script v0.25.1
+	github.com/yuin/goldmark v1.8.6
+)
+
+require (
+	github.com/itchyny/gojq v0.12.13 // indirect
+	github.com/itchyny/timefmt-go v0.1.5 // indirect
+	mvdan.cc/sh/v3 v3.7.0 // indirect
+)
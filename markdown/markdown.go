@@ -0,0 +1,95 @@
+// Package markdown provides script filters that render Markdown as HTML, or
+// strip its formatting to leave plain text.
+package markdown
+
+import (
+	"bytes"
+	"io"
+
+	"github.com/bitfield/script"
+	"github.com/yuin/goldmark"
+	"github.com/yuin/goldmark/ast"
+	"github.com/yuin/goldmark/extension"
+	extast "github.com/yuin/goldmark/extension/ast"
+	"github.com/yuin/goldmark/text"
+)
+
+// Render reads the whole contents of the pipe as Markdown (including GitHub
+// extensions such as tables and task lists), and returns a pipe containing the
+// equivalent HTML. Raw HTML in the input is omitted, for safety.
+func Render(p *script.Pipe) *script.Pipe {
+	if p == nil || p.Error() != nil {
+		return p
+	}
+	src, err := io.ReadAll(p.Reader)
+	if err != nil {
+		return p.WithError(err)
+	}
+	buf := &bytes.Buffer{}
+	md := goldmark.New(goldmark.WithExtensions(extension.GFM))
+	if err := md.Convert(src, buf); err != nil {
+		return p.WithError(err)
+	}
+	return p.WithReader(buf)
+}
+
+// Strip reads the whole contents of the pipe as Markdown, and returns a pipe
+// containing just its text, without any formatting: headings, paragraphs, and
+// list items are written as plain lines, table cells are separated by tabs,
+// links are replaced by their text, and code blocks are kept verbatim.
+// Top-level blocks are separated by a blank line.
+func Strip(p *script.Pipe) *script.Pipe {
+	if p == nil || p.Error() != nil {
+		return p
+	}
+	src, err := io.ReadAll(p.Reader)
+	if err != nil {
+		return p.WithError(err)
+	}
+	doc := goldmark.New(goldmark.WithExtensions(extension.GFM)).Parser().Parse(text.NewReader(src))
+	buf := &bytes.Buffer{}
+	err = ast.Walk(doc, func(n ast.Node, entering bool) (ast.WalkStatus, error) {
+		if !entering {
+			switch n.(type) {
+			case *ast.Paragraph, *ast.Heading, *ast.TextBlock, *extast.TableHeader, *extast.TableRow:
+				buf.WriteByte('\n')
+			case *extast.TableCell:
+				if n.NextSibling() != nil {
+					buf.WriteByte('\t')
+				}
+			}
+			return ast.WalkContinue, nil
+		}
+		if n.Type() == ast.TypeBlock && n.PreviousSibling() != nil {
+			switch n.Parent().(type) {
+			case *ast.Document, *ast.Blockquote:
+				buf.WriteByte('\n')
+			}
+		}
+		switch n := n.(type) {
+		case *ast.Text:
+			buf.Write(n.Segment.Value(src))
+			if n.SoftLineBreak() || n.HardLineBreak() {
+				buf.WriteByte('\n')
+			}
+		case *ast.String:
+			buf.Write(n.Value)
+		case *ast.AutoLink:
+			buf.Write(n.Label(src))
+		case *ast.CodeBlock, *ast.FencedCodeBlock:
+			lines := n.Lines()
+			for i := 0; i < lines.Len(); i++ {
+				seg := lines.At(i)
+				buf.Write(seg.Value(src))
+			}
+			return ast.WalkSkipChildren, nil
+		case *ast.HTMLBlock, *ast.RawHTML:
+			return ast.WalkSkipChildren, nil
+		}
+		return ast.WalkContinue, nil
+	})
+	if err != nil {
+		return p.WithError(err)
+	}
+	return p.WithReader(buf)
+}
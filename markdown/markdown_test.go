@@ -0,0 +1,72 @@
+package markdown_test
+
+import (
+	"testing"
+
+	"github.com/bitfield/script"
+	"github.com/bitfield/script/markdown"
+)
+
+func TestFiltersReturnNilForNilPipe(t *testing.T) {
+	t.Parallel()
+	if markdown.Render(nil) != nil {
+		t.Error("Render: want nil for nil pipe")
+	}
+	if markdown.Strip(nil) != nil {
+		t.Error("Strip: want nil for nil pipe")
+	}
+}
+
+func TestRender(t *testing.T) {
+	t.Parallel()
+	input := "# Title\n\nSome *emphasis* and a [link](https://example.com).\n\n<script>alert(1)</script>\n"
+	want := "<h1>Title</h1>\n<p>Some <em>emphasis</em> and a <a href=\"https://example.com\">link</a>.</p>\n<!-- raw HTML omitted -->\n"
+	got, err := markdown.Render(script.Echo(input)).String()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got != want {
+		t.Errorf("want %q, got %q", want, got)
+	}
+}
+
+func TestStrip(t *testing.T) {
+	t.Parallel()
+	input := `# Changelog
+
+Some **bold** text with a [link](https://example.com)
+over two lines.
+
+- First item
+- Second ` + "`code`" + `
+
+> Quoted <b>text</b>
+
+| Name | Value |
+| ---- | ----- |
+| a    | 1     |
+
+` + "```go\nfmt.Println(\"hi\")\n```\n"
+	want := `Changelog
+
+Some bold text with a link
+over two lines.
+
+First item
+Second code
+
+Quoted text
+
+Name	Value
+a	1
+
+fmt.Println("hi")
+`
+	got, err := markdown.Strip(script.Echo(input)).String()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got != want {
+		t.Errorf("want %q, got %q", want, got)
+	}
+}
@@ -0,0 +1,19 @@
+module github.com/bitfield/script/markup
+
+go 1.26.0
+
+require (
+	github.com/andybalholm/cascadia v1.3.5
+	github.com/antchfx/xmlquery v1.5.1
+	github.com/bitfield/script v0.25.1
+	golang.org/x/net v0.60.0
+)
+
+require (
+	github.com/antchfx/xpath v1.3.6 // indirect
+	github.com/golang/groupcache v0.0.0-20210331224755-41bb18bfe9da // indirect
+	github.com/itchyny/gojq v0.12.13 // indirect
+	github.com/itchyny/timefmt-go v0.1.5 // indirect
+	golang.org/x/text v0.42.0 // indirect
+	mvdan.cc/sh/v3 v3.7.0 // indirect
+)
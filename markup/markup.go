@@ -0,0 +1,118 @@
+// Package markup provides script filters that extract data from HTML and XML
+// documents, using CSS selectors or XPath expressions.
+package markup
+
+import (
+	"bytes"
+	"fmt"
+	"regexp"
+	"strings"
+
+	"github.com/andybalholm/cascadia"
+	"github.com/antchfx/xmlquery"
+	"github.com/bitfield/script"
+	"golang.org/x/net/html"
+)
+
+// HTMLSelect parses the contents of the pipe as HTML, and returns a pipe
+// containing one line for each element matching the given CSS selector (or
+// comma-separated group of selectors). The line contains the element's text,
+// with runs of whitespace collapsed to a single space. If the selector tests
+// for any attributes, such as `a[href]`, the values of those attributes come
+// first, separated by spaces, so that they can be extracted with Column:
+//
+//	markup.HTMLSelect(script.File("index.html"), "a[href]").Column(1)
+//
+// If the selector is invalid, the pipe's error status will be set.
+func HTMLSelect(p *script.Pipe, selector string) *script.Pipe {
+	if p == nil || p.Error() != nil {
+		return p
+	}
+	sel, err := cascadia.ParseGroup(selector)
+	if err != nil {
+		return p.WithError(err)
+	}
+	doc, err := html.Parse(p.Reader)
+	if err != nil {
+		return p.WithError(err)
+	}
+	attrs := selectorAttrs(selector)
+	buf := &bytes.Buffer{}
+	for _, n := range cascadia.QueryAll(doc, sel) {
+		var fields []string
+		for _, name := range attrs {
+			for _, a := range n.Attr {
+				if a.Key == name {
+					fields = append(fields, a.Val)
+				}
+			}
+		}
+		if text := collapseSpace(htmlText(n)); text != "" {
+			fields = append(fields, text)
+		}
+		fmt.Fprintln(buf, strings.Join(fields, " "))
+	}
+	return p.WithReader(buf)
+}
+
+// XPath parses the contents of the pipe as XML, and returns a pipe containing
+// the text of each node matching the given XPath expression, one per line,
+// with runs of whitespace collapsed to a single space. Attribute values can be
+// selected with `@`:
+//
+//	markup.XPath(script.File("feed.xml"), "//item/link/@href")
+//
+// If the input can't be parsed, or the expression is invalid, the pipe's error
+// status will be set.
+func XPath(p *script.Pipe, expr string) *script.Pipe {
+	if p == nil || p.Error() != nil {
+		return p
+	}
+	doc, err := xmlquery.Parse(p.Reader)
+	if err != nil {
+		return p.WithError(err)
+	}
+	nodes, err := xmlquery.QueryAll(doc, expr)
+	if err != nil {
+		return p.WithError(err)
+	}
+	buf := &bytes.Buffer{}
+	for _, n := range nodes {
+		fmt.Fprintln(buf, collapseSpace(n.InnerText()))
+	}
+	return p.WithReader(buf)
+}
+
+// collapseSpace trims s and replaces each run of whitespace within it with a
+// single space.
+func collapseSpace(s string) string {
+	return strings.Join(strings.Fields(s), " ")
+}
+
+// htmlText returns the concatenated text of n and all its descendants.
+func htmlText(n *html.Node) string {
+	if n.Type == html.TextNode {
+		return n.Data
+	}
+	var b strings.Builder
+	for c := n.FirstChild; c != nil; c = c.NextSibling {
+		b.WriteString(htmlText(c))
+	}
+	return b.String()
+}
+
+var selectorAttrPattern = regexp.MustCompile(`\[\s*([^\s\]~|^$*=]+)`)
+
+// selectorAttrs returns the names of the attributes tested by a CSS selector,
+// in order, without duplicates.
+func selectorAttrs(selector string) []string {
+	var names []string
+	seen := map[string]bool{}
+	for _, m := range selectorAttrPattern.FindAllStringSubmatch(selector, -1) {
+		if !seen[m[1]] {
+			seen[m[1]] = true
+			names = append(names, m[1])
+		}
+	}
+	return names
+}
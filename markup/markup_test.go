@@ -0,0 +1,85 @@
+package markup_test
+
+import (
+	"testing"
+
+	"github.com/bitfield/script"
+	"github.com/bitfield/script/markup"
+)
+
+func TestFiltersReturnNilForNilPipe(t *testing.T) {
+	t.Parallel()
+	if markup.HTMLSelect(nil, "a") != nil {
+		t.Error("HTMLSelect: want nil for nil pipe")
+	}
+	if markup.XPath(nil, "//a") != nil {
+		t.Error("XPath: want nil for nil pipe")
+	}
+}
+
+func TestHTMLSelect(t *testing.T) {
+	t.Parallel()
+	input := `<html><body>
+<h1 class="title">Hello,
+  <em>world</em></h1>
+<a href="https://example.com/">Example</a>
+<a name="anchor">No link</a>
+<a href="/about" title="About">About   us</a>
+</body></html>`
+	tcs := []struct {
+		selector, want string
+	}{
+		{"h1.title", "Hello, world\n"},
+		{"a[href]", "https://example.com/ Example\n/about About us\n"},
+		{"a[href][title]", "/about About About us\n"},
+		{"h1, a[name]", "Hello, world\nanchor No link\n"},
+		{"p", ""},
+	}
+	for _, tc := range tcs {
+		got, err := markup.HTMLSelect(script.Echo(input), tc.selector).String()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got != tc.want {
+			t.Errorf("%s: want %q, got %q", tc.selector, tc.want, got)
+		}
+	}
+	p := markup.HTMLSelect(script.Echo(input), "a[")
+	if p.Error() == nil {
+		t.Error("want error for invalid selector, got nil")
+	}
+}
+
+func TestXPath(t *testing.T) {
+	t.Parallel()
+	input := `<?xml version="1.0"?>
+<feed>
+  <entry id="1"><title>First   post</title></entry>
+  <entry id="2"><title>Second post</title></entry>
+</feed>`
+	tcs := []struct {
+		expr, want string
+	}{
+		{"//entry/title", "First post\nSecond post\n"},
+		{"//entry/@id", "1\n2\n"},
+		{"//entry[@id='2']/title", "Second post\n"},
+		{"//missing", ""},
+	}
+	for _, tc := range tcs {
+		got, err := markup.XPath(script.Echo(input), tc.expr).String()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got != tc.want {
+			t.Errorf("%s: want %q, got %q", tc.expr, tc.want, got)
+		}
+	}
+	p := markup.XPath(script.Echo(input), "//[")
+	if p.Error() == nil {
+		t.Error("want error for invalid expression, got nil")
+	}
+	p = markup.XPath(script.Echo("<unclosed>"), "//unclosed")
+	if p.Error() == nil {
+		t.Error("want error for invalid XML, got nil")
+	}
+}
@@ -0,0 +1,17 @@
+//go:build !unix
+
+package script
+
+import "os"
+
+// fileOwner returns empty strings, because file ownership isn't available on
+// this platform.
+func fileOwner(info os.FileInfo) (owner, group string) {
+	return "", ""
+}
+
+// copyOwner does nothing, because file ownership isn't available on this
+// platform.
+func copyOwner(f *os.File, info os.FileInfo) error {
+	return nil
+}
@@ -0,0 +1,49 @@
+//go:build unix
+
+package script
+
+import (
+	"errors"
+	"io/fs"
+	"os"
+	"os/user"
+	"strconv"
+	"syscall"
+)
+
+// fileOwner returns the names of the user and group that own the file
+// described by info, or their numeric IDs if the names can't be found.
+func fileOwner(info os.FileInfo) (owner, group string) {
+	st, ok := info.Sys().(*syscall.Stat_t)
+	if !ok {
+		return "", ""
+	}
+	owner = strconv.FormatUint(uint64(st.Uid), 10)
+	if u, err := user.LookupId(owner); err == nil {
+		owner = u.Username
+	}
+	group = strconv.FormatUint(uint64(st.Gid), 10)
+	if g, err := user.LookupGroupId(group); err == nil {
+		group = g.Name
+	}
+	return owner, group
+}
+
+// copyOwner makes the file f belong to the same user and group as the file
+// described by info. If the user isn't allowed to give the file away, as is
+// usual for anyone but root, it keeps the group if possible, and otherwise
+// leaves f owned by the user.
+func copyOwner(f *os.File, info os.FileInfo) error {
+	st, ok := info.Sys().(*syscall.Stat_t)
+	if !ok {
+		return nil
+	}
+	err := f.Chown(int(st.Uid), int(st.Gid))
+	if errors.Is(err, fs.ErrPermission) {
+		err = f.Chown(-1, int(st.Gid))
+	}
+	if errors.Is(err, fs.ErrPermission) {
+		return nil
+	}
+	return err
+}
@@ -0,0 +1,17 @@
+module github.com/bitfield/script/pgp
+
+go 1.26.0
+
+require (
+	github.com/ProtonMail/go-crypto v1.5.2
+	github.com/bitfield/script v0.25.1
+)
+
+require (
+	github.com/cloudflare/circl v1.6.3 // indirect
+	github.com/itchyny/gojq v0.12.13 // indirect
+	github.com/itchyny/timefmt-go v0.1.5 // indirect
+	golang.org/x/crypto v0.41.0 // indirect
+	golang.org/x/sys v0.35.0 // indirect
+	mvdan.cc/sh/v3 v3.7.0 // indirect
+)
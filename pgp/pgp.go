@@ -0,0 +1,122 @@
+// Package pgp provides script filters that sign data, and verify signatures,
+// using OpenPGP, like gpg.
+package pgp
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/ProtonMail/go-crypto/openpgp"
+	"github.com/ProtonMail/go-crypto/openpgp/clearsign"
+	"github.com/ProtonMail/go-crypto/openpgp/packet"
+	"github.com/bitfield/script"
+)
+
+// ErrBadSignature is the error status set by Verify and VerifyDetached when
+// the data isn't validly signed by any of the given keys.
+var ErrBadSignature = errors.New("bad signature")
+
+// Sign reads the whole contents of the pipe and returns a pipe containing an
+// OpenPGP clearsigned message: the original text, followed by a signature made
+// with the given armored private key, like `gpg --clearsign`. The key must not
+// be protected by a passphrase. If the key can't be used, the pipe's error
+// status will be set.
+func Sign(p *script.Pipe, key string) *script.Pipe {
+	if p == nil || p.Error() != nil {
+		return p
+	}
+	signer, err := signingKey(key)
+	if err != nil {
+		return p.WithError(err)
+	}
+	data, err := io.ReadAll(p.Reader)
+	if err != nil {
+		return p.WithError(err)
+	}
+	buf := &bytes.Buffer{}
+	w, err := clearsign.Encode(buf, signer, nil)
+	if err != nil {
+		return p.WithError(err)
+	}
+	if _, err := w.Write(data); err != nil {
+		return p.WithError(err)
+	}
+	if err := w.Close(); err != nil {
+		return p.WithError(err)
+	}
+	return p.WithReader(buf)
+}
+
+// Verify reads an OpenPGP clearsigned message from the pipe, such as one
+// produced by Sign, and checks its signature against the given armored public
+// key (or keyring). If the signature is valid, it returns a pipe containing
+// the signed text. Otherwise, the pipe's error status will be set to an error
+// wrapping ErrBadSignature.
+func Verify(p *script.Pipe, pubkey string) *script.Pipe {
+	if p == nil || p.Error() != nil {
+		return p
+	}
+	keyring, err := openpgp.ReadArmoredKeyRing(strings.NewReader(pubkey))
+	if err != nil {
+		return p.WithError(err)
+	}
+	data, err := io.ReadAll(p.Reader)
+	if err != nil {
+		return p.WithError(err)
+	}
+	block, _ := clearsign.Decode(data)
+	if block == nil {
+		return p.WithError(fmt.Errorf("%w: no clearsigned message found", ErrBadSignature))
+	}
+	if _, err := block.VerifySignature(keyring, nil); err != nil {
+		return p.WithError(fmt.Errorf("%w: %v", ErrBadSignature, err))
+	}
+	return p.WithReader(bytes.NewReader(block.Plaintext))
+}
+
+// VerifyDetached reads the whole contents of the pipe and checks it against
+// the given armored detached signature (such as the contents of a downloaded
+// `.asc` file), using the given armored public key (or keyring). If the
+// signature is valid, it returns a pipe containing the original data.
+// Otherwise, the pipe's error status will be set to an error wrapping
+// ErrBadSignature.
+func VerifyDetached(p *script.Pipe, pubkey, signature string) *script.Pipe {
+	if p == nil || p.Error() != nil {
+		return p
+	}
+	keyring, err := openpgp.ReadArmoredKeyRing(strings.NewReader(pubkey))
+	if err != nil {
+		return p.WithError(err)
+	}
+	data, err := io.ReadAll(p.Reader)
+	if err != nil {
+		return p.WithError(err)
+	}
+	_, err = openpgp.CheckArmoredDetachedSignature(keyring, bytes.NewReader(data), strings.NewReader(signature), nil)
+	if err != nil {
+		return p.WithError(fmt.Errorf("%w: %v", ErrBadSignature, err))
+	}
+	return p.WithReader(bytes.NewReader(data))
+}
+
+// signingKey returns the first usable private key in the given armored
+// keyring.
+func signingKey(key string) (*packet.PrivateKey, error) {
+	entities, err := openpgp.ReadArmoredKeyRing(strings.NewReader(key))
+	if err != nil {
+		return nil, err
+	}
+	for _, e := range entities {
+		if e.PrivateKey == nil {
+			continue
+		}
+		if e.PrivateKey.Encrypted {
+			return nil, errors.New("private key is protected by a passphrase")
+		}
+		return e.PrivateKey, nil
+	}
+	return nil, errors.New("no private key found")
+}
@@ -0,0 +1,128 @@
+package pgp_test
+
+import (
+	"bytes"
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/ProtonMail/go-crypto/openpgp"
+	"github.com/ProtonMail/go-crypto/openpgp/armor"
+	"github.com/bitfield/script"
+	"github.com/bitfield/script/pgp"
+)
+
+func TestFiltersReturnNilForNilPipe(t *testing.T) {
+	t.Parallel()
+	if pgp.Sign(nil, "") != nil {
+		t.Error("Sign: want nil for nil pipe")
+	}
+	if pgp.Verify(nil, "") != nil {
+		t.Error("Verify: want nil for nil pipe")
+	}
+	if pgp.VerifyDetached(nil, "", "") != nil {
+		t.Error("VerifyDetached: want nil for nil pipe")
+	}
+}
+
+func TestSignInvalidKey(t *testing.T) {
+	t.Parallel()
+	_, public := newTestKeyPair(t)
+	p := pgp.Sign(script.Echo("hello"), public)
+	if p.Error() == nil {
+		t.Error("want error signing with public key, got nil")
+	}
+	p = pgp.Sign(script.Echo("hello"), "bogus")
+	if p.Error() == nil {
+		t.Error("want error signing with invalid key, got nil")
+	}
+}
+
+func TestSignVerify(t *testing.T) {
+	t.Parallel()
+	private, public := newTestKeyPair(t)
+	want := "abc123  file.tar.gz\n"
+	signed, err := pgp.Sign(script.Echo(want), private).String()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(signed, "-----BEGIN PGP SIGNED MESSAGE-----") {
+		t.Fatalf("want clearsigned message, got %q", signed)
+	}
+	got, err := pgp.Verify(script.Echo(signed), public).String()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got != want {
+		t.Errorf("want %q, got %q", want, got)
+	}
+	tampered := strings.Replace(signed, "abc123", "def456", 1)
+	_, err = pgp.Verify(script.Echo(tampered), public).String()
+	if !errors.Is(err, pgp.ErrBadSignature) {
+		t.Errorf("want ErrBadSignature verifying tampered message, got %v", err)
+	}
+	_, otherPublic := newTestKeyPair(t)
+	_, err = pgp.Verify(script.Echo(signed), otherPublic).String()
+	if !errors.Is(err, pgp.ErrBadSignature) {
+		t.Errorf("want ErrBadSignature verifying with wrong key, got %v", err)
+	}
+	_, err = pgp.Verify(script.Echo(want), public).String()
+	if !errors.Is(err, pgp.ErrBadSignature) {
+		t.Errorf("want ErrBadSignature verifying unsigned data, got %v", err)
+	}
+}
+
+func TestVerifyDetached(t *testing.T) {
+	t.Parallel()
+	private, public := newTestKeyPair(t)
+	keyring, err := openpgp.ReadArmoredKeyRing(strings.NewReader(private))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := "binary\x00data"
+	sig := &bytes.Buffer{}
+	err = openpgp.ArmoredDetachSign(sig, keyring[0], strings.NewReader(want), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := pgp.VerifyDetached(script.Echo(want), public, sig.String()).String()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got != want {
+		t.Errorf("want %q, got %q", want, got)
+	}
+	_, err = pgp.VerifyDetached(script.Echo("other data"), public, sig.String()).String()
+	if !errors.Is(err, pgp.ErrBadSignature) {
+		t.Errorf("want ErrBadSignature, got %v", err)
+	}
+}
+
+// newTestKeyPair returns a fresh armored OpenPGP private key and its
+// corresponding armored public key.
+func newTestKeyPair(t *testing.T) (private, public string) {
+	t.Helper()
+	e, err := openpgp.NewEntity("Test", "", "test@example.com", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	priv := &bytes.Buffer{}
+	w, err := armor.Encode(priv, openpgp.PrivateKeyType, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := e.SerializePrivate(w, nil); err != nil {
+		t.Fatal(err)
+	}
+	w.Close()
+	pub := &bytes.Buffer{}
+	w, err = armor.Encode(pub, openpgp.PublicKeyType, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := e.Serialize(w); err != nil {
+		t.Fatal(err)
+	}
+	w.Close()
+	return priv.String(), pub.String()
+}
@@ -0,0 +1,86 @@
+package script
+
+import (
+	"errors"
+	"net"
+	"sync/atomic"
+	"time"
+
+	"golang.org/x/net/icmp"
+	"golang.org/x/net/ipv4"
+	"golang.org/x/net/ipv6"
+)
+
+// errICMPUnavailable is returned by ping when the program isn't permitted to
+// send ICMP packets.
+var errICMPUnavailable = errors.New("ICMP not available: need root, or membership of a group in net.ipv4.ping_group_range")
+
+// pingSeq is the sequence number of the most recently sent echo request.
+var pingSeq uint32
+
+// ping sends a single ICMP echo request to host and waits at most timeout for
+// the matching reply. It returns the round-trip time, or an error if the host
+// couldn't be resolved or didn't reply in time. Unprivileged ICMP sockets are
+// used where available, falling back to raw sockets.
+func ping(host string, timeout time.Duration) (time.Duration, error) {
+	ip, err := net.ResolveIPAddr("ip", host)
+	if err != nil {
+		return 0, err
+	}
+	dgram, raw, proto := "udp6", "ip6:ipv6-icmp", 58
+	var reqType, replyType icmp.Type = ipv6.ICMPTypeEchoRequest, ipv6.ICMPTypeEchoReply
+	if ip.IP.To4() != nil {
+		dgram, raw, proto = "udp4", "ip4:icmp", 1
+		reqType, replyType = ipv4.ICMPTypeEcho, ipv4.ICMPTypeEchoReply
+	}
+	var dst net.Addr = &net.UDPAddr{IP: ip.IP, Zone: ip.Zone}
+	conn, err := icmp.ListenPacket(dgram, "")
+	if err != nil {
+		conn, err = icmp.ListenPacket(raw, "")
+		if err != nil {
+			return 0, errICMPUnavailable
+		}
+		dst = ip
+	}
+	defer conn.Close()
+	seq := int(atomic.AddUint32(&pingSeq, 1) & 0xffff)
+	// On unprivileged sockets, the kernel replaces the ID with its own and
+	// filters replies for us, so we can only rely on the sequence number.
+	id := 0xb17f
+	msg := icmp.Message{
+		Type: reqType,
+		Body: &icmp.Echo{ID: id, Seq: seq, Data: []byte("github.com/bitfield/script")},
+	}
+	req, err := msg.Marshal(nil)
+	if err != nil {
+		return 0, err
+	}
+	start := time.Now()
+	if err := conn.SetReadDeadline(start.Add(timeout)); err != nil {
+		return 0, err
+	}
+	if _, err := conn.WriteTo(req, dst); err != nil {
+		return 0, err
+	}
+	buf := make([]byte, 1500)
+	for {
+		n, peer, err := conn.ReadFrom(buf)
+		if err != nil {
+			return 0, err
+		}
+		reply, err := icmp.ParseMessage(proto, buf[:n])
+		if err != nil || reply.Type != replyType {
+			continue
+		}
+		echo, ok := reply.Body.(*icmp.Echo)
+		if !ok || echo.Seq != seq {
+			continue
+		}
+		if _, isRaw := dst.(*net.IPAddr); isRaw {
+			if echo.ID != id || peer.String() != ip.String() {
+				continue
+			}
+		}
+		return time.Since(start), nil
+	}
+}
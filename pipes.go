@@ -1,17 +1,252 @@
 package script
 
 import (
+	"errors"
+	"fmt"
 	"io"
 	"os"
+	"os/exec"
+	"path/filepath"
 	"regexp"
+	"runtime"
 	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+	"unicode"
+
+	"bitbucket.org/creachadair/shell"
 )
 
+// DefaultSandboxPath is the search path for commands run in a [Sandbox] that
+// doesn't specify one.
+const DefaultSandboxPath = "/usr/bin:/bin"
+
+// ProcessInfo describes a command run by an Exec method (see
+// [Pipe.LastProcess]).
+type ProcessInfo struct {
+	// PID is the command's process ID.
+	PID int
+	// Args is the command name and its arguments.
+	Args []string
+	// ExitStatus is the command's exit status, or -1 if it was killed by a
+	// signal.
+	ExitStatus int
+	// WallTime is how long the command took to run.
+	WallTime time.Duration
+	// UserTime and SystemTime are the CPU time the command used in user and
+	// kernel mode respectively.
+	UserTime   time.Duration
+	SystemTime time.Duration
+	// MaxRSS is the command's peak memory use (maximum resident set size),
+	// in bytes, or zero if the platform doesn't report it.
+	MaxRSS int64
+}
+
+// newProcessInfo returns information about cmd, which was started at the
+// specified time and has finished, or nil if it never started.
+func newProcessInfo(cmd *exec.Cmd, start time.Time) *ProcessInfo {
+	state := cmd.ProcessState
+	if state == nil {
+		return nil
+	}
+	return &ProcessInfo{
+		PID:        state.Pid(),
+		Args:       cmd.Args,
+		ExitStatus: state.ExitCode(),
+		WallTime:   time.Since(start),
+		UserTime:   state.UserTime(),
+		SystemTime: state.SystemTime(),
+		MaxRSS:     maxRSS(state),
+	}
+}
+
+// Sandbox describes a restricted environment for the commands started by Exec
+// methods (see [Pipe.WithSandbox]). Commands in a sandbox never inherit the
+// program's environment: they see only the variables in Env, plus PATH, and
+// are looked up only in the directories on that PATH (a command given by its
+// path must be in one of those directories). The remaining fields
+// add stronger isolation, where the platform supports it.
+type Sandbox struct {
+	// Env is the complete environment for commands, in the form
+	// "key=value". If it's nil, commands see only PATH.
+	Env []string
+	// Path is the search path for commands, which is also set as their PATH
+	// variable. If it's empty, DefaultSandboxPath is used.
+	Path string
+	// Dir, if set, is the working directory for commands.
+	Dir string
+	// Chroot, if set, is a directory that commands see as their root
+	// directory. Path is searched inside it, and Dir is relative to it. This
+	// is supported only on Unix-like systems, requires the program to be
+	// running as root, and can't be combined with sudo mode.
+	Chroot string
+	// IsolateMounts runs commands in a new mount namespace, so that any
+	// filesystems they mount or unmount don't affect the rest of the system.
+	// IsolateNetwork runs commands in a new network namespace, with no
+	// network access. These are supported only on Linux, and require the
+	// program to be running as root (or to have CAP_SYS_ADMIN).
+	IsolateMounts  bool
+	IsolateNetwork bool
+}
+
 // Pipe represents a pipe object with an associated ReadAutoCloser.
 type Pipe struct {
 	Reader ReadAutoCloser
 	err    error
 	stdout io.Writer
+	// binary is true if the pipe's contents should be treated as opaque bytes,
+	// so that line-oriented operations fail instead of altering the data.
+	binary bool
+	// dryRun is true if file operations should only report what they would
+	// do, without doing it.
+	dryRun bool
+	// maxOutput, if positive, is the maximum number of bytes of output kept
+	// from each Exec method. If failOnMaxOutput is true, exceeding it is an
+	// error, instead of truncating the output.
+	maxOutput       int64
+	failOnMaxOutput bool
+	// truncated is true if the output of an Exec method was cut short because
+	// it exceeded maxOutput.
+	truncated bool
+	// stream is true if Exec methods should return as soon as their commands
+	// have started, producing output as it's written.
+	stream bool
+	// stdin, if set, is the standard input for the next Exec method, instead
+	// of the contents of the pipe.
+	stdin io.Reader
+	// checkpoint, if set, is the path of the file in which the next
+	// ExecForEach or ExecForEachParallel records the lines it has processed.
+	checkpoint string
+	// cache, if set, is the cache key and lifetime for the output of the
+	// next Exec method, and cacheDir is where cached output is kept, if not
+	// in the user's cache directory.
+	cache    *cacheEntry
+	cacheDir string
+	// verbosity controls whether Exec methods print the commands they run,
+	// and where the standard error of those commands goes.
+	verbosity verbosity
+	// stderr is where commands are printed, and their standard error written,
+	// in verbose mode.
+	stderr io.Writer
+	// user, if set, is the name of the user that Exec methods run commands
+	// as, and sudo is true if they should run commands using `sudo`.
+	user string
+	sudo bool
+	// sandbox, if set, restricts the environment that Exec methods run
+	// commands in.
+	sandbox *Sandbox
+	// path, if not nil, lists the only directories that Exec methods look
+	// for commands in.
+	path []string
+	// flushInterval, if positive, is how often Stdout flushes a buffered
+	// standard output while output is pending.
+	flushInterval time.Duration
+	// ordering is the order in which parallel stages produce their results.
+	ordering Ordering
+	// createParents is true if sinks that write files should create any
+	// missing parent directories.
+	createParents bool
+	// procs, if set, limits the commands and tasks the pipeline runs at once,
+	// and group, if set, is the parallel stage whose command the pipe runs.
+	procs *procLimiter
+	group *procGroup
+	// sources lists the files that the pipe's contents are read from, so
+	// that sinks can refuse to write to any that are still being read.
+	sources []*sourceFile
+	// process describes the last command run by the Exec method that
+	// produced the pipe, once it has finished.
+	process *ProcessInfo
+	// changes lists the input hashes found by IfChanged, to be saved by
+	// MarkDone.
+	changes []change
+	// tempFiles lists temporary files to be removed once the next Exec
+	// method on the pipe has run.
+	tempFiles []string
+	// stages describes the sources and filters that produced the pipe, in
+	// order.
+	stages []Stage
+}
+
+// Ordering controls the order in which parallel stages, such as
+// ExecForEachParallel, produce their results (see [Pipe.WithOrdering]).
+type Ordering int
+
+const (
+	// Ordered produces results in the same order as the input lines they
+	// came from, holding back only results that are ready before an earlier
+	// one. This is the default.
+	Ordered Ordering = iota
+	// Unordered produces each result as soon as it's ready, for the lowest
+	// latency.
+	Unordered
+)
+
+// GraphFormat is the language in which Graph describes a pipeline.
+type GraphFormat int
+
+const (
+	// GraphDOT is the DOT language read by Graphviz.
+	GraphDOT GraphFormat = iota
+	// GraphMermaid is a Mermaid flowchart, which GitHub, among others,
+	// renders in Markdown documents.
+	GraphMermaid
+)
+
+// Stage describes one stage of the pipeline that produced a pipe (see
+// [Pipe.Pipeline]).
+type Stage struct {
+	// Name is the name given to the stage with Named, if any.
+	Name string
+	// Op is the source or filter that made the stage, such as "File" or
+	// "Match".
+	Op string
+	// Args is the command line run by the stage, for Exec methods.
+	Args string
+	// Inputs describes the stages of any other pipes that the stage combines
+	// with its input, such as the pipe given to AppendPipe.
+	Inputs [][]Stage
+	// id identifies the stage, which may be shared by several pipes, such as
+	// the clones made by Clone.
+	id uint64
+}
+
+// verbosity is the level of detail reported by Exec methods.
+type verbosity int
+
+const (
+	// verbosityNormal mixes the standard error of commands with their output.
+	verbosityNormal verbosity = iota
+	// verbosityQuiet discards the standard error of commands.
+	verbosityQuiet
+	// verbosityVerbose prints each command before running it, and passes its
+	// standard error through to the pipe's standard error.
+	verbosityVerbose
+)
+
+// active is the number of pipeline stages running in the background.
+var active atomic.Int64
+
+// ActivePipelines returns the number of pipeline stages currently running in
+// the background: goroutines processing data for streaming filters, such as
+// Hexdump or Strings, and commands started by Exec methods in streaming mode.
+// Each stage stops once its output has been read to the end, or the pipe has
+// been closed, or an error has occurred, so, once every pipe has been read or
+// closed, ActivePipelines returns zero. A pipe that's neither read nor closed
+// keeps its stages running, and this is a useful check for such leaks in
+// long-running programs and their tests.
+func ActivePipelines() int {
+	return int(active.Load())
+}
+
+// goStage runs f in a new goroutine, counting it as an active pipeline stage
+// until it returns.
+func goStage(f func()) {
+	active.Add(1)
+	go func() {
+		defer active.Add(-1)
+		f()
+	}()
 }
 
 // NewPipe returns a pointer to a new empty pipe.
@@ -20,9 +255,64 @@ func NewPipe() *Pipe {
 		Reader: ReadAutoCloser{},
 		err:    nil,
 		stdout: os.Stdout,
+		stderr: os.Stderr,
 	}
 }
 
+// ErrOutputTooLarge is the error status set by Exec methods on a pipe
+// configured with WithMaxOutputError, when a command produces more output
+// than the limit.
+var ErrOutputTooLarge = errors.New("command output exceeds size limit")
+
+// ErrCommandNotFound is the error status set by Exec methods when a command
+// can't be found on the search path. The error message includes the name of
+// the command and, for ExecPipeline, which stage of the pipeline it's in.
+var ErrCommandNotFound = errors.New("command not found")
+
+// ErrBinary is the error status set by line-oriented operations, such as
+// EachLine, Match, or First, when they're called on a pipe in binary mode.
+var ErrBinary = errors.New("line-oriented operation on binary pipe")
+
+// Binary sets the pipe to binary mode, in which its contents are treated as
+// opaque bytes. Sources, sinks, and filters that don't care about lines, such
+// as File, Exec, WriteFile, and Bytes, pass the data through unchanged.
+// Line-oriented operations, which would otherwise split the data at newlines
+// and might add or drop line endings, instead set the pipe's error status to
+// ErrBinary. Binary mode is inherited by the pipes returned from Exec and
+// ExecPipeline. It returns the modified pipe.
+func (p *Pipe) Binary() *Pipe {
+	if p == nil {
+		return nil
+	}
+	p.binary = true
+	return p
+}
+
+// Cached sets the next Exec, ExecNoStdin, ExecShell, ExecPowerShell,
+// ExecPipeline, or StreamExec method on the pipe to save the command's output,
+// and, if the same command line is run again with the same key and the same
+// input, within ttl, to return the saved output instead of running the
+// command. This lets scripts that are run repeatedly skip slow downloads and
+// other expensive commands:
+//
+//	script.NewPipe().Cached("releases", time.Hour).Exec("curl -s https://example.com/releases.json")
+//
+// The key distinguishes different uses of the same command, such as different
+// scripts. Only the output of commands that succeed is saved. The output is
+// kept in the directory set with WithCacheDir, or otherwise in the `script`
+// directory under the user's cache directory (see os.UserCacheDir). Since the
+// input and output are compared and saved in full, it's best not to cache
+// commands whose input or output never ends, even in streaming mode. If the
+// cache can't be read or written, the pipe's error status is set. It returns
+// the modified pipe.
+func (p *Pipe) Cached(key string, ttl time.Duration) *Pipe {
+	if p == nil {
+		return nil
+	}
+	p.cache = &cacheEntry{key: key, ttl: ttl}
+	return p
+}
+
 // Close closes the pipe's associated reader. This is always safe to do, because
 // pipes created from a non-closable source will have an `ioutil.NopCloser` to
 // call.
@@ -33,6 +323,45 @@ func (p *Pipe) Close() error {
 	return p.Reader.Close()
 }
 
+// Defer registers f to be called once the pipe is finished with, to release
+// resources such as temporary files, sockets, or child processes that the
+// pipe's contents depend on. f is called when the contents have been read to
+// the end, or reading them fails, or the pipe is closed, or its error status
+// is set, whichever comes first (so if it's already set, f is called
+// straight away). If the pipe is abandoned without any of these happening, f
+// is called when the pipe is garbage collected, or, at the latest, by
+// CloseAll:
+//
+//	dir, _ := os.MkdirTemp("", "build")
+//	script.Exec("make -C " + dir).Defer(func() { os.RemoveAll(dir) }).Stdout()
+//
+// f is called only once, and may be called from another goroutine. Since
+// most filters return a new pipe, Defer should be called on the pipe whose
+// contents need the resources. It returns the modified pipe.
+func (p *Pipe) Defer(f func()) *Pipe {
+	if p == nil {
+		return nil
+	}
+	if p.Error() != nil {
+		f()
+		return p
+	}
+	p.Reader = NewReadAutoCloser(newDeferReader(p.Reader, f))
+	return p
+}
+
+// DryRun sets the pipe to dry-run mode, in which file operations such as
+// CopyFilesTo and RemoveFiles report what they would do, without actually doing
+// it. The setting carries through any filters that follow, so it applies to
+// every file operation later in the pipeline. It returns the modified pipe.
+func (p *Pipe) DryRun() *Pipe {
+	if p == nil {
+		return nil
+	}
+	p.dryRun = true
+	return p
+}
+
 // Error returns the last error returned by any pipe operation, or nil otherwise.
 func (p *Pipe) Error() error {
 	if p == nil {
@@ -62,6 +391,149 @@ func (p *Pipe) ExitStatus() int {
 	return status
 }
 
+// Graph returns a description of the pipeline that produced the pipe, in the
+// specified format, for drawing with Graphviz or Mermaid. Each stage listed by
+// Pipeline is a node, labelled with the source or filter that made it, its
+// command line, if any, and its name, if any. Pipes combined by stages such as
+// AppendPipe are drawn as branches joining the main pipeline. To draw several
+// pipelines together, pass the other pipes as well: stages they share, such as
+// those before a Clone, are drawn once, so the graph shows where the pipelines
+// divide:
+//
+//	pipes := script.File("access.log").Clone(2)
+//	errors := pipes[0].Match("ERROR")
+//	top := pipes[1].Column(1).Freq().First(10)
+//	fmt.Println(errors.Graph(script.GraphMermaid, top))
+func (p *Pipe) Graph(format GraphFormat, others ...*Pipe) string {
+	g := &graph{nodes: map[uint64]string{}, edges: map[[2]string]bool{}}
+	for _, q := range append([]*Pipe{p}, others...) {
+		g.addChain(q.Pipeline())
+	}
+	out := &strings.Builder{}
+	if format == GraphMermaid {
+		out.WriteString("flowchart LR\n")
+		for _, n := range g.order {
+			fmt.Fprintf(out, "\t%s[\"%s\"]\n", n.id, strings.ReplaceAll(n.label, `"`, "#quot;"))
+		}
+		for _, e := range g.edgeOrder {
+			fmt.Fprintf(out, "\t%s --> %s\n", e[0], e[1])
+		}
+		return out.String()
+	}
+	out.WriteString("digraph pipeline {\n\trankdir=LR;\n")
+	dotEscaper := strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+	for _, n := range g.order {
+		fmt.Fprintf(out, "\t%s [label=\"%s\"];\n", n.id, dotEscaper.Replace(n.label))
+	}
+	for _, e := range g.edgeOrder {
+		fmt.Fprintf(out, "\t%s -> %s;\n", e[0], e[1])
+	}
+	out.WriteString("}\n")
+	return out.String()
+}
+
+// LastProcess returns information about the last command run by the Exec
+// method that produced the pipe, such as its process ID and resource usage, or
+// nil if there isn't one. For ExecPipeline, this is the last command in the
+// pipeline, and for ExecForEach, the command run for the last line of input.
+// In streaming mode (see Stream), the information isn't available until the
+// pipe's contents have been read completely.
+func (p *Pipe) LastProcess() *ProcessInfo {
+	if p == nil {
+		return nil
+	}
+	return p.process
+}
+
+// LookPath returns the path of the named command, as Exec methods on the pipe
+// would find it: that is, using the search path set with WithPath or
+// WithSandbox, if any, or otherwise the PATH environment variable. If the
+// command can't be found, it returns an error wrapping ErrCommandNotFound.
+func (p *Pipe) LookPath(name string) (string, error) {
+	path, restricted := p.searchPath()
+	if !restricted {
+		found, err := exec.LookPath(name)
+		if err != nil {
+			return "", fmt.Errorf("%w: %s", ErrCommandNotFound, name)
+		}
+		return found, nil
+	}
+	var root string
+	if p.sandbox != nil {
+		root = p.sandbox.Chroot
+	}
+	found, ok := lookPathIn(name, path, root)
+	if !ok {
+		return "", fmt.Errorf("%w: %s", ErrCommandNotFound, name)
+	}
+	return found, nil
+}
+
+// MarkDone records that the pipeline using the output of IfChanged has
+// succeeded, by saving the hash of IfChanged's input in its state file, so
+// that later runs with the same input are skipped. It can be called on the
+// pipe returned by IfChanged, or on any pipe made from it by later stages. If
+// the pipe's error status is set, MarkDone saves nothing, and returns the
+// error. Otherwise, it returns any error writing the state file.
+func (p *Pipe) MarkDone() error {
+	if p == nil || p.Error() != nil {
+		return p.Error()
+	}
+	for _, c := range p.changes {
+		if err := os.WriteFile(c.statePath, []byte(c.hash+"\n"), 0o644); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Named gives a name to the last stage of the pipeline that produced the pipe,
+// such as "parse" in:
+//
+//	script.File("access.log").Match("GET").Named("parse").Column(7)
+//
+// The name appears in the list of stages returned by Pipeline, and in any
+// error from the named stage: either the pipe's error status, if it's already
+// set, or an error from reading its output, as in `stage 2 "parse": ...`. The
+// errors still match their originals with errors.Is. A pipe with no stages,
+// such as one returned by NewPipe, is unchanged. It returns the modified pipe.
+func (p *Pipe) Named(name string) *Pipe {
+	if p == nil || len(p.stages) == 0 {
+		return p
+	}
+	n := len(p.stages)
+	p.lastStage().Name = name
+	p.err = nameError(p.err, n, name)
+	p.Reader = NewReadAutoCloser(&namedReader{r: p.Reader, stage: n, name: name})
+	return p
+}
+
+// Pipeline returns a description of each stage of the pipeline that produced
+// the pipe, from its source onwards: which source or filter made it, the
+// command line, for Exec methods, and the name given with Named, if any. This
+// is useful for tracing, and for tools that display pipelines. Settings, such
+// as Stream or WithStdout, aren't stages.
+func (p *Pipe) Pipeline() []Stage {
+	if p == nil {
+		return nil
+	}
+	return append([]Stage{}, p.stages...)
+}
+
+// Quiet sets the pipe to quiet mode, in which the standard error of commands
+// run by Exec methods is discarded, instead of being included in their output
+// along with the standard output. This is useful for scripts that run
+// unattended, such as from cron, where only the output matters. Quiet mode is
+// inherited by the pipes returned from Exec methods. It returns the modified
+// pipe.
+func (p *Pipe) Quiet() *Pipe {
+	if p == nil {
+		return nil
+	}
+	p.verbosity = verbosityQuiet
+	return p
+}
+
 // Read reads up to len(b) bytes from the data source into b. It returns the
 // number of bytes read and any error encountered. At end of file, or on a nil
 // pipe, Read returns 0, io.EOF.
@@ -82,17 +554,344 @@ func (p *Pipe) SetError(err error) {
 	}
 }
 
+// rejectBinary reports whether the pipe is in binary mode, in which case it
+// also sets the pipe's error status to ErrBinary. Line-oriented operations
+// call it before reading any input.
+func (p *Pipe) rejectBinary() bool {
+	if !p.binary {
+		return false
+	}
+	p.SetError(ErrBinary)
+	return true
+}
+
+// Stream sets the pipe to streaming mode, in which Exec, ExecNoStdin, and
+// ExecPipeline start their commands and return straight away, without waiting
+// for them to finish, and the returned pipe contains the commands' output as
+// it's produced. ExecForEach still waits for each of its commands in turn. The contents of the pipe are fed to
+// the commands' standard input as they're read, too, so a pipeline of several
+// Exec commands runs concurrently, like a shell pipeline. Neither the input
+// nor the output is ever buffered in full, so a command can process input
+// that never ends, such as Stdin, live. To stream a single command, without
+// changing the pipe's mode, use StreamExec.
+//
+// As in the shell, if a later stage stops reading early (for example, because
+// First has read all the lines it needs, or the pipe has been closed), the
+// commands are killed, and their own input is closed, so that any earlier
+// commands are stopped too. Because a command's exit status isn't known until
+// it has finished, a non-zero exit status is reported as the error from
+// reading the end of its output, rather than being set on the pipe returned by
+// the Exec method.
+//
+// Errors follow a strict contract. An error in one stage, such as a command's
+// non-zero exit status, takes the place of the end of its output. Each later
+// stage that reads to the end of its input stops there, and passes on that
+// original error, in preference to any error of its own that it caused, such
+// as a downstream command failing because its input was cut short. So the
+// sink at the end of the pipeline returns the error from the stage that
+// failed first, whichever order the stages happen to finish in. Stopping
+// early, on the other hand, as First does, isn't an error. Streaming mode is
+// inherited by the pipes returned from Exec methods. It returns the modified
+// pipe.
+func (p *Pipe) Stream() *Pipe {
+	if p == nil {
+		return nil
+	}
+	p.stream = true
+	return p
+}
+
+// Truncated reports whether the output of the Exec method that created the
+// pipe was cut short, because it exceeded the limit set by WithMaxOutput.
+func (p *Pipe) Truncated() bool {
+	if p == nil {
+		return false
+	}
+	return p.truncated
+}
+
+// Verbose sets the pipe to verbose mode, in which Exec methods print each
+// command line to standard error before running it, prefixed with `+ `, like
+// the shell's `set -x` option, and the standard error of the commands is
+// passed through to standard error, instead of being included in their output.
+// This makes it easy to see what an interactive script is doing, without
+// polluting its output. Verbose mode is inherited by the pipes returned from
+// Exec methods. It returns the modified pipe.
+func (p *Pipe) Verbose() *Pipe {
+	if p == nil {
+		return nil
+	}
+	p.verbosity = verbosityVerbose
+	return p
+}
+
+// WithCacheDir sets the directory in which Cached keeps the output of
+// commands, instead of the default, which is the `script` directory under the
+// user's cache directory. The directory is created if necessary. The cache
+// directory is inherited by the pipes returned from Exec methods. It returns
+// the modified pipe.
+func (p *Pipe) WithCacheDir(dir string) *Pipe {
+	if p == nil {
+		return nil
+	}
+	p.cacheDir = dir
+	return p
+}
+
+// WithCheckpoint sets the next ExecForEach or ExecForEachParallel on the pipe
+// to record each input line it processes successfully in the file at path, so
+// that, if the run is interrupted, or a command fails, running the same
+// pipeline again resumes where it left off, instead of redoing the work:
+//
+//	script.File("urls.txt").WithCheckpoint("fetch.checkpoint").ExecForEach("curl -sO {{.}}").Stdout()
+//
+// A line is skipped only if the same line, at the same position in the input,
+// was processed by an earlier run, so a changed line is processed again. The
+// skipped lines produce no output. Once every line has been processed, the
+// checkpoint file is removed, so the next run starts afresh. If the file
+// can't be read or written, the pipe's error status is set. It returns the
+// modified pipe.
+func (p *Pipe) WithCheckpoint(path string) *Pipe {
+	if p == nil {
+		return nil
+	}
+	p.checkpoint = path
+	return p
+}
+
+// WithCreateParents sets the pipe's file sinks, such as WriteFile, AppendFile,
+// and WriteFileExclusive, to create any missing parent directories of the
+// file before writing it, like `mkdir -p`, with permissions 0755 (before the
+// umask). The setting is inherited by the pipes returned from filters and
+// Exec methods. It returns the modified pipe.
+func (p *Pipe) WithCreateParents() *Pipe {
+	if p == nil {
+		return nil
+	}
+	p.createParents = true
+	return p
+}
+
+// WithFlushInterval sets the pipe to flush its standard output, if it's
+// buffered (see Stdout), at least every d while output is waiting to be
+// flushed, even in the middle of a line. This keeps live pipelines from
+// appearing to stall when they produce partial lines, such as progress
+// indicators, or produce output slowly. Files written by sinks such as
+// WriteFile aren't buffered, so they don't need flushing. The interval is
+// inherited by the pipes returned from Exec methods. It returns the modified
+// pipe.
+func (p *Pipe) WithFlushInterval(d time.Duration) *Pipe {
+	if p == nil {
+		return nil
+	}
+	p.flushInterval = d
+	return p
+}
+
+// WithMaxOutput limits the output kept from each Exec, ExecForEach, or
+// ExecPipeline command run on the pipe to n bytes, protecting the program from
+// a command that unexpectedly produces a huge amount of output. Anything beyond
+// the first n bytes is discarded, and the returned pipe's Truncated method
+// reports true. Normally the command still runs to completion, but in
+// streaming mode (see Stream), it's killed as soon as the limit is exceeded,
+// as if the output had been closed early. The limit also applies to the pipes
+// returned by these methods. If n is zero or negative, output is not limited.
+// It returns the modified pipe.
+func (p *Pipe) WithMaxOutput(n int64) *Pipe {
+	if p == nil {
+		return nil
+	}
+	p.maxOutput = n
+	p.failOnMaxOutput = false
+	return p
+}
+
+// WithMaxOutputError is like WithMaxOutput, but instead of truncating the
+// output of a command that exceeds the limit, it stops reading from the
+// command, and sets the returned pipe's error status to ErrOutputTooLarge. It
+// returns the modified pipe.
+func (p *Pipe) WithMaxOutputError(n int64) *Pipe {
+	if p == nil {
+		return nil
+	}
+	p.maxOutput = n
+	p.failOnMaxOutput = true
+	return p
+}
+
+// WithMaxProcs limits the number of commands and concurrent tasks the
+// pipeline may run at once to n, across all its stages: parallel stages such
+// as ExecForEachParallel and FirstSuccessParallel start no more than n
+// workers, and wait for a slot before running each command, while commands
+// in other stages, including streaming ones, take up slots while they run.
+// Since a stage can't wait for a slot without risking deadlock with the
+// stages feeding it, each stage may always run one command, even if others
+// hold all the slots. An ExecPipeline counts as one command for each of its
+// stages. The limit is shared by all the pipes derived from this one; to
+// share a limit between separate pipelines, use SetMaxProcs. If n is zero or
+// negative, the pipe uses the limit set with SetMaxProcs, if any. It returns
+// the modified pipe.
+func (p *Pipe) WithMaxProcs(n int) *Pipe {
+	if p == nil {
+		return nil
+	}
+	p.procs = newProcLimiter(n)
+	return p
+}
+
+// WithOrdering sets the order in which parallel stages, such as
+// ExecForEachParallel, produce their results: Ordered (the default), to keep
+// the same order as the input, or Unordered, to produce each result as soon as
+// it's ready. The ordering is inherited by the pipes returned from Exec
+// methods. It returns the modified pipe.
+func (p *Pipe) WithOrdering(o Ordering) *Pipe {
+	if p == nil {
+		return nil
+	}
+	p.ordering = o
+	return p
+}
+
+// WithPath sets the pipe's search path for commands started by Exec methods to
+// the specified directories, in order, instead of the program's PATH
+// environment variable, which makes scripts hermetic: they run the same tools
+// wherever they're run. The commands' own PATH is set to match. Relative
+// directories are ignored, and a command given by its path must be in one of
+// the directories. The search path is inherited by the pipes returned from
+// Exec methods. It returns the modified pipe.
+//
+//	script.NewPipe().WithPath("/opt/tools/bin", "/usr/bin").Exec("sort")
+//
+// A [Sandbox] with its own Path takes precedence over this search path.
+func (p *Pipe) WithPath(dirs ...string) *Pipe {
+	if p == nil {
+		return nil
+	}
+	p.path = append([]string{}, dirs...)
+	return p
+}
+
 // WithReader takes an io.Reader, and associates the pipe with that reader. If
 // necessary, the reader will be automatically closed once it has been
-// completely read.
+// completely read. So that filters written in other packages, such as
+// compress.Zstd, appear by name in Pipeline, the stage is named after the
+// exported function that called WithReader, if any, or otherwise "WithReader".
 func (p *Pipe) WithReader(r io.Reader) *Pipe {
 	if p == nil {
 		return nil
 	}
+	return p.withReader(r).addStage(readerOp())
+}
+
+// readerOp returns the op for the stage recorded by WithReader: the name of
+// its caller, qualified by the last element of its package path, such as
+// "compress.Zstd", if it's an exported function outside this package, or
+// otherwise "WithReader".
+func readerOp() string {
+	pcs := make([]uintptr, 8)
+	frames := runtime.CallersFrames(pcs[:runtime.Callers(2, pcs)])
+	for {
+		frame, more := frames.Next()
+		if !strings.HasSuffix(frame.Function, ".(*Pipe).WithReader") {
+			if !more {
+				return "WithReader"
+			}
+			continue
+		}
+		caller, _ := frames.Next()
+		name := caller.Function[strings.LastIndex(caller.Function, "/")+1:]
+		pkg, fn, _ := strings.Cut(name, ".")
+		if pkg == "script" || fn == "" || strings.Contains(fn, ".") || !unicode.IsUpper([]rune(fn)[0]) {
+			return "WithReader"
+		}
+		return name
+	}
+}
+
+// withReader is WithReader for sources and filters, which record their own
+// stages.
+func (p *Pipe) withReader(r io.Reader) *Pipe {
 	p.Reader = NewReadAutoCloser(r)
 	return p
 }
 
+// withLines is withReader for a pipe containing each element of s, one per
+// line, as for Slice.
+func (p *Pipe) withLines(s []string) *Pipe {
+	return p.withReader(strings.NewReader(strings.Join(s, "\n") + "\n"))
+}
+
+// WithStdin takes an io.Reader, and uses it as the standard input for the next
+// Exec or ExecPipeline command run on the pipe, instead of the contents of the
+// pipe. This is useful when a command in the middle of a pipeline needs
+// different input, such as a prepared answers file. Confirm also reads its
+// answer from this reader, if set.
+func (p *Pipe) WithStdin(r io.Reader) *Pipe {
+	if p == nil {
+		return nil
+	}
+	p.stdin = r
+	return p
+}
+
+// WithSudo sets the pipe to run the commands started by Exec methods using
+// `sudo -n` (so that sudo fails, rather than waiting for a password, if one is
+// needed). Combined with WithUser, commands are run as that user, using
+// `sudo -u`; otherwise, they're run as root. Commands are looked up on sudo's
+// own search path, unless the pipe has one set with WithPath or WithSandbox.
+// Sudo mode is inherited by the pipes returned from Exec methods. It returns
+// the modified pipe.
+func (p *Pipe) WithSudo() *Pipe {
+	if p == nil {
+		return nil
+	}
+	p.sudo = true
+	return p
+}
+
+// WithSandbox sets the pipe to run the commands started by Exec methods in the
+// restricted environment described by sb (see [Sandbox]). This is useful when
+// pipelines process untrusted input through external tools. If the sandbox
+// can't be set up (for example, because the platform doesn't support it, or
+// the program lacks the privileges it needs), the Exec method sets the pipe's
+// error status, and the command isn't run. The sandbox is inherited by the
+// pipes returned from Exec methods. It returns the modified pipe.
+func (p *Pipe) WithSandbox(sb Sandbox) *Pipe {
+	if p == nil {
+		return nil
+	}
+	p.sandbox = &sb
+	return p
+}
+
+// WithStderr takes an io.Writer, and associates the pipe's standard error with
+// that writer, instead of the default os.Stderr. This is where commands are
+// printed, and their standard error written, in verbose mode, and where
+// Confirm and ConfirmPreview write their prompts.
+func (p *Pipe) WithStderr(w io.Writer) *Pipe {
+	if p == nil {
+		return nil
+	}
+	p.stderr = w
+	return p
+}
+
+// WithUser sets the pipe to run the commands started by Exec methods as the
+// specified user. Unless the pipe is also in sudo mode (see WithSudo), this
+// works by setting the commands' user and group IDs directly, which requires
+// the program to be running with sufficient privileges (usually as root), and
+// is only supported on Unix-like systems. If the user doesn't exist, or can't
+// be switched to, the Exec method sets the pipe's error status. The user is
+// inherited by the pipes returned from Exec methods. It returns the modified
+// pipe.
+func (p *Pipe) WithUser(username string) *Pipe {
+	if p == nil {
+		return nil
+	}
+	p.user = username
+	return p
+}
+
 // WithStdout takes an io.Writer, and associates the pipe's standard output with
 // that reader, instead of the default os.Stdout. This is primarily useful for
 // testing.
@@ -110,3 +909,416 @@ func (p *Pipe) WithError(err error) *Pipe {
 	p.SetError(err)
 	return p
 }
+
+// stageIDs is the number of stages made so far.
+var stageIDs atomic.Uint64
+
+// newStage returns a new stage for the source or filter op.
+func newStage(op string) Stage {
+	return Stage{Op: op, id: stageIDs.Add(1)}
+}
+
+// addStage records a new stage of the pipe, for the source or filter op, and
+// returns the pipe. Each source and filter calls it once, as it starts work,
+// and uses unexported versions of any other sources or filters it runs, so
+// that they don't record stages of their own. A nil pipe, or one whose error
+// status is set, is unchanged, since the filter won't run.
+func (p *Pipe) addStage(op string) *Pipe {
+	if p == nil || p.Error() != nil {
+		return p
+	}
+	p.stages = append(p.stages[:len(p.stages):len(p.stages)], newStage(op))
+	return p
+}
+
+// newSource returns a new pipe, recording the source op as its first stage.
+func newSource(op string) *Pipe {
+	return NewPipe().addStage(op)
+}
+
+// derive returns q, a pipe made by a filter on p, with p's settings, and with
+// p's stages, including the one the filter recorded, in place of any of its
+// own.
+func (p *Pipe) derive(q *Pipe) *Pipe {
+	if p == nil {
+		return q
+	}
+	p.copySettings(q)
+	q.stages = p.stages[:len(p.stages):len(p.stages)]
+	if q.procs == nil {
+		q.procs = p.procs
+	}
+	q.changes = append(p.changes[:len(p.changes):len(p.changes)], q.changes...)
+	q.sources = append(p.sources[:len(p.sources):len(p.sources)], q.sources...)
+	return q
+}
+
+// copySettings copies p's settings, such as DryRun, WithSandbox, and Stream,
+// to q, so that they apply to the rest of the pipeline.
+func (p *Pipe) copySettings(q *Pipe) {
+	q.dryRun = p.dryRun
+	q.binary = p.binary
+	q.stream = p.stream
+	q.maxOutput = p.maxOutput
+	q.failOnMaxOutput = p.failOnMaxOutput
+	q.verbosity = p.verbosity
+	q.stderr = p.stderr
+	q.user = p.user
+	q.sudo = p.sudo
+	q.sandbox = p.sandbox
+	q.path = p.path
+	q.flushInterval = p.flushInterval
+	q.ordering = p.ordering
+	q.createParents = p.createParents
+	q.cacheDir = p.cacheDir
+}
+
+// lastStage returns the pipe's own copy of its last stage, to be updated, or
+// nil if it has no stages.
+func (p *Pipe) lastStage() *Stage {
+	n := len(p.stages)
+	if n == 0 {
+		return nil
+	}
+	p.stages = append(p.stages[:n-1:n-1], p.stages[n-1])
+	return &p.stages[n-1]
+}
+
+// withStageArgs records the command line run by the pipe's last stage, and
+// returns the pipe.
+func (p *Pipe) withStageArgs(args string) *Pipe {
+	if st := p.lastStage(); st != nil {
+		st.Args = args
+	}
+	return p
+}
+
+// withStageInputs records the stages of the pipes that the pipe's last stage
+// combines with its input, and returns the pipe.
+func (p *Pipe) withStageInputs(inputs ...*Pipe) *Pipe {
+	if st := p.lastStage(); st != nil {
+		for _, q := range inputs {
+			st.Inputs = append(st.Inputs, q.Pipeline())
+		}
+	}
+	return p
+}
+
+// graph collects the nodes and edges drawn by Graph, in the order they're
+// found, so that the same pipelines are always drawn the same way.
+type graph struct {
+	nodes     map[uint64]string
+	order     []graphNode
+	edges     map[[2]string]bool
+	edgeOrder [][2]string
+}
+
+type graphNode struct {
+	id, label string
+}
+
+// addChain adds the stages of a pipeline to the graph, with the pipelines
+// they combine, and returns the node for the last stage, or "" if there are
+// no stages.
+func (g *graph) addChain(stages []Stage) string {
+	var prev string
+	for _, st := range stages {
+		id, seen := g.nodes[st.id]
+		if !seen {
+			id = fmt.Sprintf("s%d", len(g.order)+1)
+			g.nodes[st.id] = id
+			g.order = append(g.order, graphNode{id: id, label: st.label()})
+		}
+		for _, input := range st.Inputs {
+			if from := g.addChain(input); from != "" {
+				g.addEdge(from, id)
+			}
+		}
+		if prev != "" {
+			g.addEdge(prev, id)
+		}
+		prev = id
+	}
+	return prev
+}
+
+func (g *graph) addEdge(from, to string) {
+	e := [2]string{from, to}
+	if !g.edges[e] {
+		g.edges[e] = true
+		g.edgeOrder = append(g.edgeOrder, e)
+	}
+}
+
+// label describes the stage for Graph.
+func (s Stage) label() string {
+	label := s.Op
+	if s.Args != "" {
+		label += " " + s.Args
+	}
+	if s.Name != "" {
+		label = s.Name + ": " + label
+	}
+	return label
+}
+
+// stageError is an error from a named stage of a pipeline.
+type stageError struct {
+	stage int
+	name  string
+	err   error
+}
+
+func (e *stageError) Error() string {
+	return fmt.Sprintf("stage %d %q: %v", e.stage, e.name, e.err)
+}
+
+func (e *stageError) Unwrap() error {
+	return e.err
+}
+
+// nameError returns err annotated with the number and name of the stage it
+// came from, unless it's nil, io.EOF, or already annotated.
+func nameError(err error, stage int, name string) error {
+	var se *stageError
+	if err == nil || err == io.EOF || errors.As(err, &se) {
+		return err
+	}
+	return &stageError{stage: stage, name: name, err: err}
+}
+
+// namedReader annotates errors from reading the output of a named stage.
+type namedReader struct {
+	r     io.Reader
+	stage int
+	name  string
+}
+
+func (n *namedReader) Read(b []byte) (int, error) {
+	count, err := n.r.Read(b)
+	return count, nameError(err, n.stage, n.name)
+}
+
+func (n *namedReader) Close() error {
+	if c, ok := n.r.(io.Closer); ok {
+		return c.Close()
+	}
+	return nil
+}
+
+// removeTempFiles removes any temporary files associated with the pipe, such
+// as those created by AsTempFile.
+func (p *Pipe) removeTempFiles() {
+	if p == nil {
+		return
+	}
+	for _, f := range p.tempFiles {
+		os.Remove(f)
+	}
+	p.tempFiles = nil
+}
+
+// stdinReader returns the reader that Exec methods should use as the standard
+// input for commands: the one set by WithStdin, if any, or else the pipe's own
+// reader.
+func (p *Pipe) stdinReader() io.Reader {
+	if p.stdin != nil {
+		return p.stdin
+	}
+	return p.Reader
+}
+
+// cacheEntry is the key and lifetime of a cached command's output (see
+// [Pipe.Cached]).
+type cacheEntry struct {
+	key string
+	ttl time.Duration
+}
+
+// change is the hash of the input to IfChanged, and the file to save it in.
+type change struct {
+	statePath string
+	hash      string
+}
+
+// cacheDirectory returns the directory in which Cached keeps the output of
+// commands, creating it if necessary.
+func (p *Pipe) cacheDirectory() (string, error) {
+	dir := p.cacheDir
+	if dir == "" {
+		userDir, err := os.UserCacheDir()
+		if err != nil {
+			return "", err
+		}
+		dir = filepath.Join(userDir, "script")
+	}
+	return dir, os.MkdirAll(dir, 0o755)
+}
+
+// openCheckpoint opens the checkpoint file set with WithCheckpoint, if any,
+// returning nil if there isn't one.
+func (p *Pipe) openCheckpoint() (*checkpoint, error) {
+	if p.checkpoint == "" {
+		return nil, nil
+	}
+	return openCheckpoint(p.checkpoint)
+}
+
+// commandStderr returns the writer that Exec methods should use as the
+// standard error for commands whose standard output is written to output,
+// according to the pipe's verbosity. A nil writer means the null device.
+func (p *Pipe) commandStderr(output io.Writer) io.Writer {
+	switch p.verbosity {
+	case verbosityQuiet:
+		return nil
+	case verbosityVerbose:
+		return p.stderr
+	}
+	return output
+}
+
+// echoCommand prints cmdLine to the pipe's standard error, if the pipe is in
+// verbose mode.
+func (p *Pipe) echoCommand(cmdLine string) {
+	if p.verbosity == verbosityVerbose && p.stderr != nil {
+		fmt.Fprintf(p.stderr, "+ %s\n", cmdLine)
+	}
+}
+
+// confine changes cmd, before it's started, to use the pipe's search path (see
+// WithPath) and to run in its sandbox (see WithSandbox), if it has either. If
+// the command can't be found on that path, it returns an error wrapping
+// ErrCommandNotFound.
+func (p *Pipe) confine(cmd *exec.Cmd) error {
+	sb := p.sandbox
+	if sb != nil && sb.Chroot != "" && p.sudo {
+		return errors.New("sandbox: can't use Chroot in sudo mode")
+	}
+	path, restricted := p.searchPath()
+	if !restricted {
+		return nil
+	}
+	if sb != nil {
+		cmd.Env = append([]string{"PATH=" + path}, sb.Env...)
+		cmd.Dir = sb.Dir
+	} else {
+		cmd.Env = append(cmd.Environ(), "PATH="+path)
+	}
+	name, err := p.LookPath(cmd.Args[0])
+	if err != nil {
+		return err
+	}
+	cmd.Path = name
+	// The command was looked up using the program's own search path, which
+	// no longer applies.
+	cmd.Err = nil
+	if sb != nil {
+		return isolate(cmd, sb)
+	}
+	return nil
+}
+
+// searchPath returns the search path for commands set with WithPath or
+// WithSandbox, and true, or false if the pipe uses the program's own PATH.
+func (p *Pipe) searchPath() (string, bool) {
+	switch {
+	case p == nil:
+		return "", false
+	case p.sandbox != nil && p.sandbox.Path != "":
+		return p.sandbox.Path, true
+	case p.path != nil:
+		return strings.Join(p.path, string(os.PathListSeparator)), true
+	case p.sandbox != nil:
+		return DefaultSandboxPath, true
+	}
+	return "", false
+}
+
+// checkTemplateCommand returns an error wrapping ErrCommandNotFound if the
+// command at the start of cmdTpl can't be found, so that templated commands
+// fail before any of them have run. If the command name is itself templated,
+// or will be looked up by sudo, it can't be checked in advance.
+func (p *Pipe) checkTemplateCommand(cmdTpl string) error {
+	if _, restricted := p.searchPath(); p.sudo && !restricted {
+		return nil
+	}
+	args, ok := shell.Split(cmdTpl)
+	if !ok || len(args) == 0 || strings.Contains(args[0], "{{") {
+		return nil
+	}
+	_, err := p.LookPath(args[0])
+	return err
+}
+
+// lookPathIn searches for the named command in the directories listed in
+// path, as they appear inside the directory root (or in the real root
+// directory, if root is empty), and returns its path inside root. A name
+// containing a path separator is found only if it's an absolute path to a
+// command in one of those directories, so that it can't escape the search
+// path.
+func lookPathIn(name, path, root string) (string, bool) {
+	var inDir string
+	if strings.ContainsRune(name, filepath.Separator) || strings.ContainsRune(name, '/') {
+		if !filepath.IsAbs(name) {
+			return "", false
+		}
+		inDir, name = filepath.Split(filepath.Clean(name))
+		inDir = filepath.Clean(inDir)
+	}
+	names := []string{name}
+	if runtime.GOOS == "windows" && filepath.Ext(name) == "" {
+		names = []string{name + ".exe", name + ".bat", name + ".cmd"}
+	}
+	for _, dir := range filepath.SplitList(path) {
+		if !filepath.IsAbs(dir) {
+			// Relative entries would depend on the working directory,
+			// which defeats the point of restricting the path.
+			continue
+		}
+		if inDir != "" && filepath.Clean(dir) != inDir {
+			continue
+		}
+		for _, n := range names {
+			candidate := filepath.Join(dir, n)
+			info, err := os.Stat(filepath.Join(root, candidate))
+			if err != nil || !info.Mode().IsRegular() {
+				continue
+			}
+			if runtime.GOOS == "windows" || info.Mode().Perm()&0o111 != 0 {
+				return candidate, true
+			}
+		}
+	}
+	return "", false
+}
+
+// impersonate changes cmd, before it's started, to run as the user set with
+// WithUser, or using sudo, if the pipe is configured to do either.
+func (p *Pipe) impersonate(cmd *exec.Cmd) error {
+	if p.sudo {
+		sudo, err := exec.LookPath("sudo")
+		if err != nil {
+			return err
+		}
+		args := []string{"sudo", "-n"}
+		if p.user != "" {
+			args = append(args, "-u", p.user)
+		}
+		name := cmd.Args[0]
+		if _, restricted := p.searchPath(); restricted {
+			// Run the command found on the pipe's search path, not
+			// whatever sudo would find on its own.
+			name = cmd.Path
+		}
+		cmd.Args = append(append(args, "--", name), cmd.Args[1:]...)
+		cmd.Path = sudo
+		// Otherwise, sudo looks up the command itself, using its own search
+		// path.
+		cmd.Err = nil
+		return nil
+	}
+	if p.user != "" {
+		return setCredential(cmd, p.user)
+	}
+	return nil
+}
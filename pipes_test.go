@@ -2,17 +2,91 @@ package script_test
 
 import (
 	"bytes"
+	"context"
 	"errors"
-	"fmt"
 	"io"
 	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"os/exec"
+	"path/filepath"
 	"regexp"
+	"runtime"
 	"strings"
 	"testing"
+	"testing/iotest"
+	"time"
 
 	"github.com/bitfield/script"
+	"github.com/google/go-cmp/cmp"
+	"github.com/google/go-cmp/cmp/cmpopts"
+	"go.uber.org/goleak"
 )
 
+func TestWithMaxOutput(t *testing.T) {
+	t.Parallel()
+	p := script.NewPipe().WithMaxOutput(5).Exec("echo hello world")
+	got, err := p.String()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got != "hello" {
+		t.Errorf("want %q, got %q", "hello", got)
+	}
+	if !p.Truncated() {
+		t.Error("want Truncated true for output over limit, got false")
+	}
+	p = script.NewPipe().WithMaxOutput(100).Exec("echo hello world")
+	got, err = p.String()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got != "hello world\n" {
+		t.Errorf("want %q, got %q", "hello world\n", got)
+	}
+	if p.Truncated() {
+		t.Error("want Truncated false for output within limit, got true")
+	}
+}
+
+func TestWithMaxOutputAppliesToExecPipelineAndExecForEach(t *testing.T) {
+	t.Parallel()
+	p := script.NewPipe().WithMaxOutput(3).ExecPipeline("echo hello | tr a-z A-Z")
+	got, err := p.String()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got != "HEL" || !p.Truncated() {
+		t.Errorf("ExecPipeline: want truncated %q, got %q (truncated %t)", "HEL", got, p.Truncated())
+	}
+	p = script.Echo("a\nb\n").WithMaxOutput(4).ExecForEach("echo {{.}}{{.}}{{.}}{{.}}{{.}}")
+	got, err = p.String()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got != "aaaabbbb" || !p.Truncated() {
+		t.Errorf("ExecForEach: want truncated %q, got %q (truncated %t)", "aaaabbbb", got, p.Truncated())
+	}
+}
+
+func TestWithMaxOutputError(t *testing.T) {
+	t.Parallel()
+	for _, p := range []*script.Pipe{
+		script.NewPipe().WithMaxOutputError(1000).Exec("yes"),
+		script.NewPipe().WithMaxOutputError(1000).ExecPipeline("yes | cat"),
+	} {
+		_, err := p.String()
+		if !errors.Is(err, script.ErrOutputTooLarge) {
+			t.Errorf("want ErrOutputTooLarge, got %v", err)
+		}
+	}
+	_, err := script.NewPipe().WithMaxOutputError(1000).Exec("echo hello").String()
+	if err != nil {
+		t.Errorf("want no error for output within limit, got %v", err)
+	}
+}
+
 func TestWithReader(t *testing.T) {
 	t.Parallel()
 	want := "Hello, world."
@@ -45,6 +119,25 @@ func TestWithError(t *testing.T) {
 	}
 }
 
+func TestWithStdin(t *testing.T) {
+	t.Parallel()
+	p := script.Echo("ignored\n").WithStdin(strings.NewReader("instead\n"))
+	got, err := p.Exec("cat").String()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got != "instead\n" {
+		t.Errorf("want %q, got %q", "instead\n", got)
+	}
+	got, err = script.Echo("ignored\n").WithStdin(strings.NewReader("b\na\n")).ExecPipeline("sort | head -n 1").String()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got != "a\n" {
+		t.Errorf("want %q, got %q", "a\n", got)
+	}
+}
+
 func TestWithStdout(t *testing.T) {
 	t.Parallel()
 	buf := &bytes.Buffer{}
@@ -59,6 +152,727 @@ func TestWithStdout(t *testing.T) {
 	}
 }
 
+func TestBinaryPassesBytesThroughUnchanged(t *testing.T) {
+	t.Parallel()
+	want, err := ioutil.ReadFile("testdata/bytes.bin")
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := t.TempDir() + "/bytes.bin"
+	_, err = script.File("testdata/bytes.bin").Binary().Exec("cat").WriteFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := script.File(path).Binary().Bytes()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(want, got) {
+		t.Errorf("want %q, got %q", want, got)
+	}
+}
+
+func TestBinaryRejectsLineOrientedOperations(t *testing.T) {
+	t.Parallel()
+	ops := map[string]func(*script.Pipe) *script.Pipe{
+		"EachLine": func(p *script.Pipe) *script.Pipe {
+			return p.EachLine(func(string, *strings.Builder) {})
+		},
+		"EachLineBytes": func(p *script.Pipe) *script.Pipe {
+			return p.EachLineBytes(func(_, out []byte) []byte { return out })
+		},
+		"First":      func(p *script.Pipe) *script.Pipe { return p.First(1) },
+		"Last":       func(p *script.Pipe) *script.Pipe { return p.Last(1) },
+		"Match":      func(p *script.Pipe) *script.Pipe { return p.Match("a") },
+		"MatchFold":  func(p *script.Pipe) *script.Pipe { return p.MatchFold("a") },
+		"Reject":     func(p *script.Pipe) *script.Pipe { return p.Reject("a") },
+		"Concat":     func(p *script.Pipe) *script.Pipe { return p.Concat() },
+		"ExecOutput": func(p *script.Pipe) *script.Pipe { return p.Exec("cat").First(1) },
+	}
+	for name, op := range ops {
+		_, err := op(script.Echo("a\nb").Binary()).String()
+		if !errors.Is(err, script.ErrBinary) {
+			t.Errorf("%s: want ErrBinary, got %v", name, err)
+		}
+	}
+	_, err := script.Echo("a\nb").Binary().CountLines()
+	if !errors.Is(err, script.ErrBinary) {
+		t.Errorf("CountLines: want ErrBinary, got %v", err)
+	}
+}
+
+func TestStreamExec(t *testing.T) {
+	t.Parallel()
+	got, err := script.Echo("hello\nworld\n").Stream().Exec("tr a-z A-Z").Exec("sort -r").String()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got != "WORLD\nHELLO\n" {
+		t.Errorf("want %q, got %q", "WORLD\nHELLO\n", got)
+	}
+	got, err = script.Echo("b\na\nb\n").Stream().ExecPipeline("sort | uniq -c").String()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got != "      1 a\n      2 b\n" {
+		t.Errorf("want %q, got %q", "      1 a\n      2 b\n", got)
+	}
+}
+
+func TestStreamExecReportsExitStatusAtEndOfOutput(t *testing.T) {
+	t.Parallel()
+	p := script.NewPipe().Stream().Exec("sh -c 'echo hello; exit 3'")
+	if p.Error() != nil {
+		t.Fatalf("want no error before output is read, got %v", p.Error())
+	}
+	_, err := p.String()
+	if err == nil {
+		t.Fatal("want error from non-zero exit status, got nil")
+	}
+	if p.ExitStatus() != 3 {
+		t.Errorf("want exit status 3, got %d", p.ExitStatus())
+	}
+}
+
+func TestStreamExecStopsCommandsWhenDownstreamStopsReading(t *testing.T) {
+	t.Parallel()
+	start := time.Now()
+	got, err := script.NewPipe().Stream().Exec("sh -c 'echo first; sleep 10; echo second'").First(1).String()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got != "first\n" {
+		t.Errorf("want %q, got %q", "first\n", got)
+	}
+	got, err = script.NewPipe().Stream().Exec("yes").Exec("head -n 2").String()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got != "y\ny\n" {
+		t.Errorf("want %q, got %q", "y\ny\n", got)
+	}
+	got, err = script.NewPipe().Stream().ExecPipeline("yes | cat").Dedupe().First(1).String()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got != "y\n" {
+		t.Errorf("want %q, got %q", "y\n", got)
+	}
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Errorf("want commands stopped early, but took %v", elapsed)
+	}
+}
+
+func TestStreamExecWithMaxOutput(t *testing.T) {
+	t.Parallel()
+	p := script.NewPipe().Stream().WithMaxOutput(5).Exec("yes")
+	got, err := p.String()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got != "y\ny\ny" {
+		t.Errorf("want %q, got %q", "y\ny\ny", got)
+	}
+	if !p.Truncated() {
+		t.Error("want Truncated true, got false")
+	}
+	_, err = script.NewPipe().Stream().WithMaxOutputError(5).Exec("yes").String()
+	if !errors.Is(err, script.ErrOutputTooLarge) {
+		t.Errorf("want ErrOutputTooLarge, got %v", err)
+	}
+}
+
+func TestStreamReportsOriginalErrorToSink(t *testing.T) {
+	t.Parallel()
+	fail := "sh -c 'echo a; echo b; exit 3'"
+	tcs := map[string]func() *script.Pipe{
+		"Exec":               func() *script.Pipe { return script.NewPipe().Stream().Exec(fail) },
+		"Exec, Exec":         func() *script.Pipe { return script.NewPipe().Stream().Exec(fail).Exec("cat") },
+		"Exec, Exec, Exec":   func() *script.Pipe { return script.NewPipe().Stream().Exec(fail).Exec("cat").Exec("cat") },
+		"Exec, ExecPipeline": func() *script.Pipe { return script.NewPipe().Stream().Exec(fail).ExecPipeline("cat | cat") },
+		"Exec, Match":        func() *script.Pipe { return script.NewPipe().Stream().Exec(fail).Match("a") },
+		"Exec, CountBy":      func() *script.Pipe { return script.NewPipe().Stream().Exec(fail).CountBy(strings.ToUpper) },
+		"Exec, Freq":         func() *script.Pipe { return script.NewPipe().Stream().Exec(fail).Freq() },
+		"Exec, SortIP":       func() *script.Pipe { return script.NewPipe().Stream().Exec(fail).SortIP() },
+		"Exec, ExpandCIDR": func() *script.Pipe {
+			return script.NewPipe().Stream().Exec("sh -c 'echo 10.0.0.0/31; exit 3'").ExpandCIDR()
+		},
+		"Exec, GroupLines":    func() *script.Pipe { return script.NewPipe().Stream().Exec(fail).GroupLines(strings.ToUpper) },
+		"Exec, First":         func() *script.Pipe { return script.NewPipe().Stream().Exec(fail).First(5) },
+		"Exec, ExecForEach":   func() *script.Pipe { return script.NewPipe().Stream().Exec(fail).ExecForEach("echo {{.}}") },
+		"Exec, Hexdump":       func() *script.Pipe { return script.NewPipe().Stream().Exec(fail).Hexdump() },
+		"Exec, failing Exec":  func() *script.Pipe { return script.NewPipe().Stream().Exec(fail).Exec("sh -c 'cat; exit 4'") },
+		"ExecPipeline failed": func() *script.Pipe { return script.NewPipe().Stream().ExecPipeline(fail + " | cat").Exec("cat") },
+	}
+	for name, pipeline := range tcs {
+		// Repeat each pipeline, to show that the result doesn't depend on
+		// the order in which the stages happen to finish.
+		for range 10 {
+			p := pipeline()
+			_, err := p.String()
+			if err == nil {
+				t.Fatalf("%s: want error, got nil", name)
+			}
+			if p.ExitStatus() != 3 {
+				t.Fatalf("%s: want original exit status 3, got error %v", name, err)
+			}
+		}
+	}
+}
+
+// The leak tests don't call t.Parallel, because goleak checks every goroutine
+// in the program, and ActivePipelines counts every pipe's stages.
+
+// waitForActivePipelines waits for up to five seconds for ActivePipelines to
+// return want.
+func waitForActivePipelines(t *testing.T, want int) {
+	t.Helper()
+	for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); {
+		if script.ActivePipelines() == want {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatalf("want %d active pipelines, got %d", want, script.ActivePipelines())
+}
+
+func TestClosingStreamingPipelineStopsEveryStage(t *testing.T) {
+	defer goleak.VerifyNone(t, goleak.IgnoreCurrent())
+	before := script.ActivePipelines()
+	p := script.NewPipe().Stream().Exec("yes").Exec("cat").Hexdump().Strings(4).Hexdump()
+	if n := script.ActivePipelines() - before; n < 5 {
+		t.Errorf("want at least 5 active stages, got %d", n)
+	}
+	if _, err := io.ReadFull(p, make([]byte, 1024)); err != nil {
+		t.Fatal(err)
+	}
+	p.Close()
+	waitForActivePipelines(t, before)
+}
+
+func TestStreamingPipelineStopsWhenReadToEnd(t *testing.T) {
+	defer goleak.VerifyNone(t, goleak.IgnoreCurrent())
+	before := script.ActivePipelines()
+	_, err := script.Echo("hello\n").Stream().Exec("cat").Hexdump().ExecForEachParallel("echo {{.}}", 2).String()
+	if err != nil {
+		t.Fatal(err)
+	}
+	waitForActivePipelines(t, before)
+}
+
+func TestStringContextStopsPipelineWhenDone(t *testing.T) {
+	defer goleak.VerifyNone(t, goleak.IgnoreCurrent())
+	before := script.ActivePipelines()
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	_, err := script.NewPipe().Stream().Exec("sleep 10").Hexdump().StringContext(ctx)
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("want context.DeadlineExceeded, got %v", err)
+	}
+	waitForActivePipelines(t, before)
+}
+
+func TestLineFiltersReportReadErrors(t *testing.T) {
+	t.Parallel()
+	want := errors.New("oh no")
+	for name, filter := range map[string]func(*script.Pipe) *script.Pipe{
+		"EachLine": func(p *script.Pipe) *script.Pipe {
+			return p.EachLine(func(string, *strings.Builder) {})
+		},
+		"EachLineBytes": func(p *script.Pipe) *script.Pipe {
+			return p.EachLineBytes(func(_, out []byte) []byte { return out })
+		},
+		"First": func(p *script.Pipe) *script.Pipe { return p.First(5) },
+	} {
+		p := filter(script.NewPipe().WithReader(iotest.ErrReader(want)))
+		if !errors.Is(p.Error(), want) {
+			t.Errorf("%s: want %v, got %v", name, want, p.Error())
+		}
+	}
+}
+
+func TestQuietDiscardsCommandStderr(t *testing.T) {
+	t.Parallel()
+	stderr := &bytes.Buffer{}
+	got, err := script.NewPipe().Quiet().WithStderr(stderr).Exec("sh -c 'echo out; echo err >&2'").String()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got != "out\n" {
+		t.Errorf("want %q, got %q", "out\n", got)
+	}
+	if stderr.Len() != 0 {
+		t.Errorf("want nothing written to stderr, got %q", stderr)
+	}
+}
+
+func TestVerbosePrintsCommandsAndPassesStderrThrough(t *testing.T) {
+	t.Parallel()
+	stderr := &bytes.Buffer{}
+	p := script.NewPipe().Verbose().WithStderr(stderr)
+	got, err := p.Exec("sh -c 'echo out; echo err >&2'").ExecPipeline("cat | sh -c 'cat; echo err2 >&2'").String()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got != "out\n" {
+		t.Errorf("want %q, got %q", "out\n", got)
+	}
+	want := "+ sh -c 'echo out; echo err >&2'\nerr\n+ cat | sh -c 'cat; echo err2 >&2'\nerr2\n"
+	if stderr.String() != want {
+		t.Errorf("want %q, got %q", want, stderr)
+	}
+}
+
+func TestWithUserRunsCommandsAsUser(t *testing.T) {
+	t.Parallel()
+	if runtime.GOOS == "windows" || os.Geteuid() != 0 {
+		t.Skip("running commands as another user requires root on a Unix-like system")
+	}
+	got, err := script.NewPipe().WithUser("nobody").Exec("id -un").ExecPipeline("id -un | cat").String()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got != "nobody\n" {
+		t.Errorf("want %q, got %q", "nobody\n", got)
+	}
+}
+
+func TestWithUserCarriesThroughFilters(t *testing.T) {
+	t.Parallel()
+	if runtime.GOOS == "windows" || os.Geteuid() != 0 {
+		t.Skip("running commands as another user requires root on a Unix-like system")
+	}
+	got, err := script.Echo("x\n").WithUser("nobody").Freq().First(1).Exec("id -un").String()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got != "nobody\n" {
+		t.Errorf("want %q, got %q", "nobody\n", got)
+	}
+}
+
+func TestWithUserNonexistent(t *testing.T) {
+	t.Parallel()
+	p := script.NewPipe().WithUser("doesntexist").Exec("true")
+	if p.Error() == nil {
+		t.Error("want error for nonexistent user, got nil")
+	}
+}
+
+func TestLastProcessDescribesCommand(t *testing.T) {
+	t.Parallel()
+	for name, p := range map[string]*script.Pipe{
+		"Exec":         script.Exec("go version"),
+		"ExecPipeline": script.ExecPipeline("cat | go version"),
+		"ExecForEach":  script.Echo("version\n").ExecForEach("go {{.}}"),
+		"Stream":       script.NewPipe().Stream().Exec("go version"),
+	} {
+		if p.LastProcess() != nil && name == "Stream" {
+			t.Errorf("%s: want no process info before output is read", name)
+		}
+		if _, err := p.String(); err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		info := p.LastProcess()
+		if info == nil {
+			t.Fatalf("%s: want process info, got nil", name)
+		}
+		if info.PID <= 0 {
+			t.Errorf("%s: want positive PID, got %d", name, info.PID)
+		}
+		if strings.Join(info.Args, " ") != "go version" {
+			t.Errorf("%s: want args %q, got %q", name, "go version", info.Args)
+		}
+		if info.WallTime <= 0 {
+			t.Errorf("%s: want positive wall time, got %v", name, info.WallTime)
+		}
+		if runtime.GOOS == "linux" && info.MaxRSS <= 0 {
+			t.Errorf("%s: want positive max RSS, got %d", name, info.MaxRSS)
+		}
+	}
+}
+
+func TestLastProcessReportsExitStatus(t *testing.T) {
+	t.Parallel()
+	info := script.Exec("go bogus").LastProcess()
+	if info == nil {
+		t.Fatal("want process info, got nil")
+	}
+	if info.ExitStatus == 0 {
+		t.Error("want non-zero exit status, got 0")
+	}
+}
+
+func TestLastProcessIsNilWithoutCommand(t *testing.T) {
+	t.Parallel()
+	if info := script.Echo("hello").LastProcess(); info != nil {
+		t.Errorf("want nil, got %+v", info)
+	}
+	if info := script.Exec("doesntexist").LastProcess(); info != nil {
+		t.Errorf("want nil for command that didn't start, got %+v", info)
+	}
+}
+
+func TestPipelineDescribesEachStage(t *testing.T) {
+	t.Parallel()
+	p := script.Echo("a\nb\na\n").Match("a").Named("parse").Exec("cat").Freq().First(1)
+	want := []script.Stage{
+		{Op: "Echo"},
+		{Op: "Match", Name: "parse"},
+		{Op: "Exec", Args: "cat"},
+		{Op: "Freq"},
+		{Op: "First"},
+	}
+	got := p.Pipeline()
+	if !cmp.Equal(want, got, cmpopts.IgnoreUnexported(script.Stage{})) {
+		t.Error(cmp.Diff(want, got, cmpopts.IgnoreUnexported(script.Stage{})))
+	}
+}
+
+func TestPipelineIncludesStageThatFailed(t *testing.T) {
+	t.Parallel()
+	p := script.Echo("a\n").Match("a").ExecPipeline("cat | doesntexist")
+	want := []script.Stage{{Op: "Echo"}, {Op: "Match"}, {Op: "ExecPipeline"}}
+	got := p.Pipeline()
+	if !cmp.Equal(want, got, cmpopts.IgnoreUnexported(script.Stage{})) {
+		t.Error(cmp.Diff(want, got, cmpopts.IgnoreUnexported(script.Stage{})))
+	}
+}
+
+func TestPipelineIncludesInputsOfCombiningStages(t *testing.T) {
+	t.Parallel()
+	p := script.Echo("a\n").AppendPipe(script.Echo("b\n").Match("b"))
+	want := []script.Stage{
+		{Op: "Echo"},
+		{Op: "AppendPipe", Inputs: [][]script.Stage{{{Op: "Echo"}, {Op: "Match"}}}},
+	}
+	got := p.Pipeline()
+	if !cmp.Equal(want, got, cmpopts.IgnoreUnexported(script.Stage{})) {
+		t.Error(cmp.Diff(want, got, cmpopts.IgnoreUnexported(script.Stage{})))
+	}
+}
+
+func TestPipelineRecordsOneStagePerFilter(t *testing.T) {
+	t.Parallel()
+	p := script.Echo("É\n").MatchFold("é").WithCacheDir(t.TempDir()).Cached("key", time.Hour).ExecPipeline("cat | cat")
+	if _, err := p.String(); err != nil {
+		t.Fatal(err)
+	}
+	want := []script.Stage{{Op: "Echo"}, {Op: "MatchFold"}, {Op: "ExecPipeline", Args: "cat | cat"}}
+	got := p.Pipeline()
+	if !cmp.Equal(want, got, cmpopts.IgnoreUnexported(script.Stage{})) {
+		t.Error(cmp.Diff(want, got, cmpopts.IgnoreUnexported(script.Stage{})))
+	}
+}
+
+func TestPipelineNamesFilterFromAnotherPackageAfterItsFunction(t *testing.T) {
+	t.Parallel()
+	p := Upcase(script.Echo("hello\n")).Match("HELLO")
+	got, err := p.String()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got != "HELLO\n" {
+		t.Errorf("want %q, got %q", "HELLO\n", got)
+	}
+	want := []script.Stage{{Op: "Echo"}, {Op: "script_test.Upcase"}, {Op: "Match"}}
+	if !cmp.Equal(want, p.Pipeline(), cmpopts.IgnoreUnexported(script.Stage{})) {
+		t.Error(cmp.Diff(want, p.Pipeline(), cmpopts.IgnoreUnexported(script.Stage{})))
+	}
+	p = func() *script.Pipe {
+		return script.NewPipe().WithReader(strings.NewReader("hello\n"))
+	}()
+	want = []script.Stage{{Op: "WithReader"}}
+	if !cmp.Equal(want, p.Pipeline(), cmpopts.IgnoreUnexported(script.Stage{})) {
+		t.Error(cmp.Diff(want, p.Pipeline(), cmpopts.IgnoreUnexported(script.Stage{})))
+	}
+}
+
+// Upcase is a filter written outside package script, as in the compress
+// module, which converts the contents of the pipe to upper case.
+func Upcase(p *script.Pipe) *script.Pipe {
+	data, err := p.Bytes()
+	if err != nil {
+		return p.WithError(err)
+	}
+	return p.WithReader(bytes.NewReader(bytes.ToUpper(data)))
+}
+
+func TestPipelineIsEmptyForNewPipe(t *testing.T) {
+	t.Parallel()
+	if got := script.NewPipe().Named("source").Pipeline(); len(got) != 0 {
+		t.Errorf("want no stages, got %+v", got)
+	}
+}
+
+func TestGraphDOT(t *testing.T) {
+	t.Parallel()
+	p := script.Echo("a\n").Match("a").Named("parse").Exec(`tr "a" "b"`)
+	want := `digraph pipeline {
+	rankdir=LR;
+	s1 [label="Echo"];
+	s2 [label="parse: Match"];
+	s3 [label="Exec tr \"a\" \"b\""];
+	s1 -> s2;
+	s2 -> s3;
+}
+`
+	got := p.Graph(script.GraphDOT)
+	if want != got {
+		t.Error(cmp.Diff(want, got))
+	}
+}
+
+func TestGraphMermaidShowsFanOutAndFanIn(t *testing.T) {
+	t.Parallel()
+	pipes := script.Echo("a\nb\n").Clone(2)
+	left := pipes[0].Match("a").AppendPipe(script.Echo("c\n"))
+	right := pipes[1].Freq()
+	want := `flowchart LR
+	s1["Echo"]
+	s2["Clone"]
+	s3["Match"]
+	s4["AppendPipe"]
+	s5["Echo"]
+	s6["Freq"]
+	s1 --> s2
+	s2 --> s3
+	s5 --> s4
+	s3 --> s4
+	s2 --> s6
+`
+	got := left.Graph(script.GraphMermaid, right)
+	if want != got {
+		t.Error(cmp.Diff(want, got))
+	}
+}
+
+func TestNamedAnnotatesErrorFromStage(t *testing.T) {
+	t.Parallel()
+	p := script.Echo("a\n").Match("a").Exec("sh -c 'exit 3'").Named("check")
+	want := `stage 3 "check": exit status 3`
+	if p.Error() == nil || p.Error().Error() != want {
+		t.Errorf("want error %q, got %v", want, p.Error())
+	}
+	if p.ExitStatus() != 3 {
+		t.Errorf("want exit status 3, got %d", p.ExitStatus())
+	}
+	var exitErr *exec.ExitError
+	if !errors.As(p.Error(), &exitErr) {
+		t.Errorf("want error wrapping *exec.ExitError, got %T", p.Error())
+	}
+}
+
+func TestNamedAnnotatesStreamingErrorFromStage(t *testing.T) {
+	t.Parallel()
+	p := script.Echo("a\n").Stream().Exec("sh -c 'exit 4'").Named("check").Match("a")
+	_, err := p.String()
+	want := `stage 2 "check": exit status 4`
+	if err == nil || err.Error() != want {
+		t.Errorf("want error %q, got %v", want, err)
+	}
+}
+
+func TestWithPathFindsCommandsOnlyInGivenDirectories(t *testing.T) {
+	t.Parallel()
+	if runtime.GOOS == "windows" {
+		t.Skip("shell scripts not executable on Windows")
+	}
+	dir := t.TempDir()
+	err := os.WriteFile(filepath.Join(dir, "hello"), []byte("#!/bin/sh\necho \"$PATH\"\n"), 0o755)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p := script.NewPipe().WithPath(dir)
+	path, err := p.LookPath("hello")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if path != filepath.Join(dir, "hello") {
+		t.Errorf("want %q, got %q", filepath.Join(dir, "hello"), path)
+	}
+	got, err := p.Exec("hello").String()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got != dir+"\n" {
+		t.Errorf("want PATH %q, got %q", dir+"\n", got)
+	}
+	err = p.Exec("go version").Error()
+	if !errors.Is(err, script.ErrCommandNotFound) {
+		t.Errorf("want ErrCommandNotFound for command not on path, got %v", err)
+	}
+}
+
+func TestWithPathCarriesThroughFilters(t *testing.T) {
+	t.Parallel()
+	err := script.Echo("x\n").WithPath(t.TempDir()).Freq().Column(2).Exec("go version").Error()
+	if !errors.Is(err, script.ErrCommandNotFound) {
+		t.Errorf("want ErrCommandNotFound for command not on path, got %v", err)
+	}
+}
+
+func TestWithPathRejectsCommandPathsOutsideGivenDirectories(t *testing.T) {
+	t.Parallel()
+	if runtime.GOOS == "windows" {
+		t.Skip("shell scripts not executable on Windows")
+	}
+	dir := t.TempDir()
+	hello := filepath.Join(dir, "hello")
+	err := os.WriteFile(hello, []byte("#!/bin/sh\necho hello\n"), 0o755)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p := script.NewPipe().WithPath(dir)
+	got, err := p.Exec(hello).String()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got != "hello\n" {
+		t.Errorf("want %q, got %q", "hello\n", got)
+	}
+	other := filepath.Join(t.TempDir(), "hello")
+	err = os.WriteFile(other, []byte("#!/bin/sh\necho hello\n"), 0o755)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, cmd := range []string{"/bin/sh -c true", "./hello", other} {
+		err = p.Exec(cmd).Error()
+		if !errors.Is(err, script.ErrCommandNotFound) {
+			t.Errorf("%q: want ErrCommandNotFound for command outside path, got %v", cmd, err)
+		}
+	}
+}
+
+func TestWithSandboxClearsEnvironment(t *testing.T) {
+	t.Parallel()
+	if runtime.GOOS == "windows" {
+		t.Skip("env command not available on Windows")
+	}
+	got, err := script.NewPipe().WithSandbox(script.Sandbox{
+		Env: []string{"LANG=C"},
+	}).Exec("env").String()
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := "PATH=" + script.DefaultSandboxPath + "\nLANG=C\n"
+	if got != want {
+		t.Errorf("want %q, got %q", want, got)
+	}
+}
+
+func TestWithSandboxCarriesThroughFilters(t *testing.T) {
+	t.Parallel()
+	if runtime.GOOS == "windows" {
+		t.Skip("sh not available on Windows")
+	}
+	got, err := script.Echo("x\n").WithSandbox(script.Sandbox{
+		Env: []string{"FOO=sandboxed"},
+	}).Freq().Reject("zzz").Exec("sh -c 'echo $FOO; echo $HOME'").String()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got != "sandboxed\n\n" {
+		t.Errorf("want %q, got %q", "sandboxed\n\n", got)
+	}
+}
+
+func TestWithSandboxRestrictsPath(t *testing.T) {
+	t.Parallel()
+	p := script.NewPipe().WithSandbox(script.Sandbox{Path: t.TempDir()}).Exec("go version")
+	if p.Error() == nil {
+		t.Fatal("want error running command not on sandbox path, got nil")
+	}
+	if !strings.Contains(p.Error().Error(), "not found") {
+		t.Errorf("want error about command not found, got %v", p.Error())
+	}
+}
+
+func TestWithSandboxSetsWorkingDirectory(t *testing.T) {
+	t.Parallel()
+	if runtime.GOOS == "windows" {
+		t.Skip("pwd command not available on Windows")
+	}
+	dir := t.TempDir()
+	got, err := script.NewPipe().WithSandbox(script.Sandbox{Dir: dir}).Exec("pwd").ExecPipeline("pwd | cat").String()
+	if err != nil {
+		t.Fatal(err)
+	}
+	want, err := filepath.EvalSymlinks(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err = filepath.EvalSymlinks(strings.TrimSpace(got))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got != want {
+		t.Errorf("want %q, got %q", want, got)
+	}
+}
+
+func TestWithSandboxIsolateNetwork(t *testing.T) {
+	t.Parallel()
+	if runtime.GOOS != "linux" || os.Geteuid() != 0 {
+		t.Skip("network namespaces require root on Linux")
+	}
+	got, err := script.NewPipe().WithSandbox(script.Sandbox{IsolateNetwork: true}).Exec("cat /proc/net/dev").Match(":").Column(1).String()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got != "lo:\n" {
+		t.Errorf("want only loopback interface, got %q", got)
+	}
+}
+
+func TestWithSudo(t *testing.T) {
+	t.Parallel()
+	if _, err := exec.LookPath("sudo"); err != nil {
+		// Without sudo, every command fails, which shows that sudo was used.
+		err := script.NewPipe().WithSudo().Exec("true").Error()
+		if err == nil || !strings.Contains(err.Error(), "sudo") {
+			t.Errorf("want error about missing sudo, got %v", err)
+		}
+		return
+	}
+	if err := exec.Command("sudo", "-n", "true").Run(); err != nil {
+		t.Skip("sudo requires a password")
+	}
+	got, err := script.NewPipe().WithSudo().Exec("id -u").String()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got != "0\n" {
+		t.Errorf("want %q, got %q", "0\n", got)
+	}
+}
+
+func TestWithSudoRunsCommandFoundOnPipeSearchPath(t *testing.T) {
+	// Not parallel, since it sets PATH.
+	if runtime.GOOS == "windows" {
+		t.Skip("shell scripts not executable on Windows")
+	}
+	bin := t.TempDir()
+	err := os.WriteFile(filepath.Join(bin, "sudo"), []byte("#!/bin/sh\nprintf '%s\\n' \"$*\"\n"), 0o755)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("PATH", bin)
+	dir := t.TempDir()
+	err = os.WriteFile(filepath.Join(dir, "hello"), []byte("#!/bin/sh\n"), 0o755)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := script.NewPipe().WithPath(dir).WithSudo().Exec("hello world").String()
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := "-n -- " + filepath.Join(dir, "hello") + " world\n"
+	if got != want {
+		t.Errorf("want sudo args %q, got %q", want, got)
+	}
+}
+
 func TestError(t *testing.T) {
 	t.Parallel()
 	p := script.File("testdata/nonexistent.txt")
@@ -102,7 +916,7 @@ func TestExitStatus(t *testing.T) {
 	}
 	for _, tc := range tcs {
 		p := script.NewPipe()
-		p.SetError(fmt.Errorf(tc.input))
+		p.SetError(errors.New(tc.input))
 		got := p.ExitStatus()
 		if got != tc.want {
 			t.Errorf("input %q: want %d, got %d", tc.input, tc.want, got)
@@ -123,54 +937,230 @@ func doMethodsOnPipe(t *testing.T, p *script.Pipe, kind string) {
 			t.Errorf("panic: %s on %s pipe", action, kind)
 		}
 	}()
+	action = "Append()"
+	p.Append("a")
+	action = "AppendBytes()"
+	p.AppendBytes(nil)
 	action = "AppendFile()"
 	p.AppendFile(t.TempDir() + "/AppendFile")
+	action = "AppendPipe()"
+	p.AppendPipe(script.Echo("a"))
+	action = "AppendTo()"
+	p.AppendTo(&strings.Builder{})
+	action = "AppendToBuffer()"
+	p.AppendToBuffer(&bytes.Buffer{})
+	action = "AsTempFile()"
+	p.AsTempFile().Exec("true")
 	action = "Basename()"
 	p.Basename()
+	action = "Between()"
+	p.Between(regexp.MustCompile("a"), regexp.MustCompile("b"))
+	action = "BetweenExclusive()"
+	p.BetweenExclusive(regexp.MustCompile("a"), regexp.MustCompile("b"))
+	action = "Binary()"
+	p.Binary()
+	action = "BlameEach()"
+	p.BlameEach()
+	action = "Bunzip2()"
+	p.Bunzip2()
 	action = "Bytes()"
 	p.Bytes()
+	action = "Cached()"
+	p.Cached("key", time.Hour)
+	action = "Clone()"
+	p.Clone(2)
 	action = "Close()"
 	p.Close()
+	action = "CheckPortEach()"
+	p.CheckPortEach(80, time.Millisecond)
+	action = "ChmodEach()"
+	p.DryRun().ChmodEach(0644)
 	action = "Column()"
 	p.Column(2)
+	action = "CombinedLog()"
+	p.CombinedLog()
 	action = "Concat()"
 	p.Concat()
+	action = "ConcatWithNames()"
+	p.ConcatWithNames()
+	action = "Confirm()"
+	p.WithStdin(strings.NewReader("y\n")).WithStderr(ioutil.Discard).Confirm("OK?")
+	action = "ConfirmPreview()"
+	p.WithStdin(strings.NewReader("y\n")).WithStderr(ioutil.Discard).ConfirmPreview("OK?", 1)
+	action = "ContainsMatch()"
+	p.ContainsMatch("foo")
+	action = "CopyFilesTo()"
+	p.DryRun().CopyFilesTo(t.TempDir())
+	action = "CountBy()"
+	p.CountBy(strings.ToLower)
 	action = "CountLines()"
 	p.CountLines()
+	action = "DecodeJSON()"
+	p.DecodeJSON(&struct{}{})
+	action = "DecodeYAML()"
+	p.DecodeYAML(&struct{}{})
+	action = "Dedupe()"
+	p.Dedupe()
+	action = "DedupeApprox()"
+	p.DedupeApprox(10, 0.01)
+	action = "Defer()"
+	p.Defer(func() {})
+	action = "Describe()"
+	p.Describe(1)
+	action = "DialUnix()"
+	p.DialUnix(t.TempDir() + "/bogus.sock")
 	action = "Dirname()"
 	p.Dirname()
+	action = "DiffFile()"
+	p.DiffFile("testdata/hello.txt")
+	action = "Discard()"
+	p.Discard()
+	action = "DryRun()"
+	p.DryRun()
+	action = "EachFile()"
+	p.EachFile(func(string, *script.Pipe) error { return nil })
 	action = "EachLine()"
 	p.EachLine(func(string, *strings.Builder) {})
+	action = "EachLineBytes()"
+	p.EachLineBytes(func(_, out []byte) []byte { return out })
+	action = "EqualsFile()"
+	p.EqualsFile("testdata/hello.txt")
 	action = "Error()"
 	p.Error()
 	action = "Exec()"
 	p.Exec("bogus")
 	action = "ExecForEach()"
 	p.ExecForEach("bogus")
+	action = "ExecForEachParallel()"
+	p.ExecForEachParallel("true", 2)
+	action = "ExecForEachResult()"
+	p.ExecForEachResult("true")
+	action = "ExecNoStdin()"
+	p.ExecNoStdin("bogus")
+	action = "ExecPipeline()"
+	p.ExecPipeline("bogus | bogus")
+	action = "ExecPowerShell()"
+	p.ExecPowerShell("Write-Output hello")
+	action = "ExecShell()"
+	p.ExecShell("echo hello")
 	action = "ExitStatus()"
 	p.ExitStatus()
+	action = "ExpandCIDR()"
+	p.ExpandCIDR()
+	action = "ExtractBlocks()"
+	p.ExtractBlocks(regexp.MustCompile("a"), nil)
+	action = "Field()"
+	p.Field("level")
+	action = "FilterByMTime()"
+	p.FilterByMTime(time.Time{}, time.Time{})
+	action = "FilterBySize()"
+	p.FilterBySize(0, -1)
+	action = "FilterCIDR()"
+	p.FilterCIDR("10.0.0.0/8")
+	action = "FilterSince()"
+	p.FilterSince(time.Time{}, time.RFC3339, 1)
 	action = "First()"
 	p.First(1)
+	action = "FirstMatch()"
+	p.FirstMatch("foo")
+	action = "FirstSuccess()"
+	p.FirstSuccess("true")
+	action = "FirstSuccessParallel()"
+	p.FirstSuccessParallel("true", 2)
 	action = "Freq()"
 	p.Freq()
+	action = "Glob()"
+	p.Glob()
+	action = "Graph()"
+	p.Graph(script.GraphDOT)
+	action = "GroupBy()"
+	p.GroupBy(strings.ToLower)
+	action = "GroupLines()"
+	p.GroupLines(strings.ToLower)
+	action = "Histogram()"
+	p.Histogram([]float64{1})
+	action = "Hexdump()"
+	p.Hexdump()
+	action = "HistogramChart()"
+	p.HistogramChart([]float64{1}, 10)
+	action = "IfChanged()"
+	p.IfChanged(filepath.Join(t.TempDir(), "state"))
+	action = "InsertAfter()"
+	p.InsertAfter(regexp.MustCompile("a"), "b")
 	action = "Join()"
 	p.Join()
+	action = "JSONCompact()"
+	p.JSONCompact()
+	action = "JSONIndent()"
+	p.JSONIndent("", "  ")
 	action = "Last()"
 	p.Last(1)
+	action = "LastProcess()"
+	p.LastProcess()
+	action = "Logfmt()"
+	p.Logfmt()
+	action = "LookPath()"
+	p.LookPath("go")
+	action = "MarkDone()"
+	p.MarkDone()
 	action = "Match()"
 	p.Match("foo")
+	action = "MatchAll()"
+	p.MatchAll("foo")
+	action = "MatchAllRegexp()"
+	p.MatchAllRegexp(regexp.MustCompile(".*"))
+	action = "MatchAny()"
+	p.MatchAny("foo")
+	action = "MatchAnyRegexp()"
+	p.MatchAnyRegexp(regexp.MustCompile(".*"))
+	action = "MatchFold()"
+	p.MatchFold("foo")
 	action = "MatchRegexp()"
 	p.MatchRegexp(regexp.MustCompile(".*"))
+	action = "MkdirAllEach()"
+	p.DryRun().MkdirAllEach(0755)
+	action = "MoveFilesTo()"
+	p.DryRun().MoveFilesTo(t.TempDir())
+	action = "Named()"
+	p.Named("foo")
+	action = "PingEach()"
+	p.PingEach(time.Millisecond)
+	action = "Pipeline()"
+	p.Pipeline()
+	action = "Prepend()"
+	p.Prepend("a")
+	action = "PrependPipe()"
+	p.PrependPipe(script.Echo("a"))
+	action = "Pushgateway()"
+	p.Pushgateway("http://localhost:0", "job")
+	action = "Range()"
+	p.Range(1, 2)
+	action = "Quiet()"
+	p.Quiet()
 	action = "Read()"
 	p.Read([]byte{})
+	action = "ReformatTime()"
+	p.ReformatTime(time.RFC3339, time.RFC3339, 1)
 	action = "Reject()"
 	p.Reject("")
 	action = "RejectRegexp"
 	p.RejectRegexp(regexp.MustCompile(".*"))
+	action = "RemoveFiles()"
+	p.DryRun().RemoveFiles()
 	action = "Replace()"
 	p.Replace("old", "new")
 	action = "ReplaceRegexp()"
 	p.ReplaceRegexp(regexp.MustCompile(".*"), "")
+	action = "ReverseHexdump()"
+	p.ReverseHexdump()
+	action = "RewriteFiles()"
+	p.RewriteFiles(func(p *script.Pipe) *script.Pipe { return p })
+	action = "RewriteFilesWithBackup()"
+	p.RewriteFilesWithBackup(func(p *script.Pipe) *script.Pipe { return p }, ".bak")
+	action = "Send()"
+	p.Send("tcp", "bogus address")
+	action = "ServeHTTP()"
+	p.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/", nil))
 	action = "SetError()"
 	p.SetError(nil)
 	action = "SHA256Sums()"
@@ -179,16 +1169,92 @@ func doMethodsOnPipe(t *testing.T, p *script.Pipe, kind string) {
 	p.SHA256Sum()
 	action = "Slice()"
 	p.Slice()
+	action = "SliceContext()"
+	p.SliceContext(context.Background())
+	action = "SortIP()"
+	p.SortIP()
+	action = "SplitFiles()"
+	p.SplitFiles(t.TempDir()+"/SplitFiles", 1)
+	action = "SplitFilesBySize()"
+	p.SplitFilesBySize(t.TempDir()+"/SplitFilesBySize", 1)
+	action = "Stat()"
+	p.Stat("")
 	action = "Stdout()"
 	p.Stdout()
+	action = "Stream()"
+	p.Stream()
+	action = "StreamExec()"
+	p.StreamExec("bogus")
 	action = "String()"
 	p.String()
+	action = "StringContext()"
+	p.StringContext(context.Background())
+	action = "Strings()"
+	p.Strings(4)
+	action = "StripNames()"
+	p.StripNames()
+	action = "Timestamp()"
+	p.Timestamp("")
+	action = "ToPrometheus()"
+	p.ToPrometheus("metric", nil)
+	action = "TouchEach()"
+	p.DryRun().TouchEach()
+	action = "Truncated()"
+	p.Truncated()
+	action = "URLDecode()"
+	p.URLDecode()
+	action = "URLEncode()"
+	p.URLEncode()
+	action = "URLParts()"
+	p.URLParts("host")
+	action = "Verbose()"
+	p.Verbose()
+	action = "WithCacheDir()"
+	p.WithCacheDir(t.TempDir())
+	action = "WithCheckpoint()"
+	p.WithCheckpoint("checkpoint")
 	action = "WithError()"
 	p.WithError(nil)
+	action = "WithCreateParents()"
+	p.WithCreateParents()
+	action = "WithFlushInterval()"
+	p.WithFlushInterval(time.Second)
+	action = "WithMaxOutput()"
+	p.WithMaxOutput(1)
+	action = "WithMaxOutputError()"
+	p.WithMaxOutputError(1)
+	action = "WithMaxProcs()"
+	p.WithMaxProcs(2)
+	action = "WithOrdering()"
+	p.WithOrdering(script.Unordered)
+	action = "WithPath()"
+	p.WithPath("/bin")
 	action = "WithReader()"
 	p.WithReader(strings.NewReader(""))
+	action = "WithSandbox()"
+	p.WithSandbox(script.Sandbox{})
+	action = "WithStderr()"
+	p.WithStderr(nil)
+	action = "WithStdin()"
+	p.WithStdin(strings.NewReader(""))
+	action = "WithSudo()"
+	p.WithSudo()
+	action = "WithUser()"
+	p.WithUser("nobody")
 	action = "WriteFile()"
 	p.WriteFile(t.TempDir() + "bogus.txt")
+	action = "WriteFileExclusive()"
+	p.WriteFileExclusive(t.TempDir() + "/WriteFileExclusive")
+	action = "WriteFileRotating()"
+	p.WriteFileRotating(t.TempDir()+"/WriteFileRotating", 1, 1)
+	action = "WriteTempFile()"
+	if path, err := p.WriteTempFile("script-"); err == nil {
+		os.Remove(path)
+	}
+	action = "YQ()"
+	p.YQ(".")
+	action = "Zip()"
+	p.Zip(t.TempDir() + "/bogus.zip")
 }
 
 func TestNilPipes(t *testing.T) {
@@ -0,0 +1,11 @@
+//go:build !unix
+
+package script
+
+import "os"
+
+// maxRSS returns zero, because the peak memory use of processes isn't
+// reported on this platform.
+func maxRSS(state *os.ProcessState) int64 {
+	return 0
+}
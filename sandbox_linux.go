@@ -0,0 +1,27 @@
+package script
+
+import (
+	"os/exec"
+	"syscall"
+)
+
+// isolate applies the chroot and namespace settings of sb to cmd.
+func isolate(cmd *exec.Cmd, sb *Sandbox) error {
+	if sb.Chroot == "" && !sb.IsolateMounts && !sb.IsolateNetwork {
+		return nil
+	}
+	if cmd.SysProcAttr == nil {
+		cmd.SysProcAttr = &syscall.SysProcAttr{}
+	}
+	cmd.SysProcAttr.Chroot = sb.Chroot
+	if sb.IsolateMounts {
+		// Unsharing the mount namespace, rather than cloning it, makes Go
+		// remount the root as private, so that mounts don't propagate back
+		// to the rest of the system.
+		cmd.SysProcAttr.Unshareflags |= syscall.CLONE_NEWNS
+	}
+	if sb.IsolateNetwork {
+		cmd.SysProcAttr.Cloneflags |= syscall.CLONE_NEWNET
+	}
+	return nil
+}
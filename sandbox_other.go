@@ -0,0 +1,21 @@
+//go:build !unix
+
+package script
+
+import (
+	"fmt"
+	"os/exec"
+	"runtime"
+)
+
+// isolate returns an error if sb asks for a chroot or namespaces, neither of
+// which is supported on this platform.
+func isolate(cmd *exec.Cmd, sb *Sandbox) error {
+	if sb.Chroot != "" {
+		return fmt.Errorf("sandbox: chroot not supported on %s", runtime.GOOS)
+	}
+	if sb.IsolateMounts || sb.IsolateNetwork {
+		return fmt.Errorf("sandbox: namespaces not supported on %s", runtime.GOOS)
+	}
+	return nil
+}
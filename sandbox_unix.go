@@ -0,0 +1,26 @@
+//go:build unix && !linux
+
+package script
+
+import (
+	"fmt"
+	"os/exec"
+	"runtime"
+	"syscall"
+)
+
+// isolate applies the chroot setting of sb to cmd. Namespaces aren't supported
+// on this platform.
+func isolate(cmd *exec.Cmd, sb *Sandbox) error {
+	if sb.IsolateMounts || sb.IsolateNetwork {
+		return fmt.Errorf("sandbox: namespaces not supported on %s", runtime.GOOS)
+	}
+	if sb.Chroot == "" {
+		return nil
+	}
+	if cmd.SysProcAttr == nil {
+		cmd.SysProcAttr = &syscall.SysProcAttr{}
+	}
+	cmd.SysProcAttr.Chroot = sb.Chroot
+	return nil
+}
@@ -0,0 +1,400 @@
+package script
+
+import (
+	"fmt"
+	"io"
+	"math/rand"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Job is a pipeline run periodically by Schedule.
+type Job struct {
+	build func() *Pipe
+	sched cronSchedule
+	cfg   scheduleConfig
+
+	mu      sync.Mutex
+	next    time.Time
+	running int
+	pending bool
+	stopped bool
+
+	stop     chan struct{}
+	stopOnce sync.Once
+	runs     sync.WaitGroup
+}
+
+// Overlap is what a scheduled Job does when it's due to run while its previous
+// run is still in progress (see [ScheduleOverlap]).
+type Overlap int
+
+const (
+	// OverlapSkip skips the run, and waits for the next scheduled time. This
+	// is the default.
+	OverlapSkip Overlap = iota
+	// OverlapQueue runs the job again as soon as the previous run finishes.
+	// However many runs fall due in the meantime, only one is queued.
+	OverlapQueue
+	// OverlapAllow starts the run anyway, alongside the previous one.
+	OverlapAllow
+)
+
+// ScheduleOption is an option that changes the behaviour of Schedule.
+type ScheduleOption func(*scheduleConfig)
+
+type scheduleConfig struct {
+	overlap Overlap
+	jitter  time.Duration
+	stdout  io.Writer
+	onError func(error)
+}
+
+// ScheduleJitter delays each run of a scheduled job by a random amount of time
+// up to max, so that many jobs with the same schedule, perhaps on different
+// machines, don't all start at once.
+func ScheduleJitter(max time.Duration) ScheduleOption {
+	return func(cfg *scheduleConfig) {
+		cfg.jitter = max
+	}
+}
+
+// ScheduleOnError makes a scheduled job call fn with the error from each run
+// that fails: that is, the error status of the pipe it returns, once the pipe
+// has been read.
+func ScheduleOnError(fn func(error)) ScheduleOption {
+	return func(cfg *scheduleConfig) {
+		cfg.onError = fn
+	}
+}
+
+// ScheduleOverlap sets what a scheduled job does when it's due to run while
+// its previous run is still in progress (see [Overlap]).
+func ScheduleOverlap(o Overlap) ScheduleOption {
+	return func(cfg *scheduleConfig) {
+		cfg.overlap = o
+	}
+}
+
+// ScheduleStdout makes a scheduled job write the contents of the pipe from
+// each run to w, instead of the default os.Stdout.
+func ScheduleStdout(w io.Writer) ScheduleOption {
+	return func(cfg *scheduleConfig) {
+		cfg.stdout = w
+	}
+}
+
+// Schedule runs the pipeline returned by build periodically, according to the
+// cron-style schedule spec, until the returned Job is stopped. This lets a
+// long-running program do its own monitoring or cleaning up, instead of
+// relying on the system's cron:
+//
+//	job, err := script.Schedule("*/5 * * * *", func() *script.Pipe {
+//		return script.FindFiles("/tmp/uploads").Reject(".keep").RemoveFiles()
+//	})
+//	...
+//	job.Stop()
+//
+// The schedule has the five fields of a crontab entry: minute, hour, day of
+// the month, month, and day of the week. Each field is `*`, meaning any value,
+// or a comma-separated list of numbers, or ranges such as `1-5`, optionally
+// followed by a step, as in `*/15` or `0-30/10`. Months and days of the week
+// can also be given by the first three letters of their English names, such
+// as `jan` or `mon`, and Sunday is either 0 or 7. As in cron, if both the day
+// of the month and the day of the week are restricted, the job runs on days
+// matching either. Times are in the local time zone. The spec can also be one
+// of the shorthands `@yearly` (or `@annually`), `@monthly`, `@weekly`,
+// `@daily` (or `@midnight`), and `@hourly`, or `@every` followed by a
+// duration, such as `@every 30s`, to run the job at that interval.
+//
+// For each run, Schedule calls build, and reads the pipe it returns to the
+// end, writing its contents to standard output (or the writer set with
+// ScheduleStdout). If build returns nil, the run has no output. Other options,
+// such as ScheduleOverlap and ScheduleJitter, control when runs happen, and
+// ScheduleOnError reports the runs that fail. If spec isn't valid, or never
+// matches a real date (such as `0 0 31 2 *`), Schedule returns an error.
+func Schedule(spec string, build func() *Pipe, opts ...ScheduleOption) (*Job, error) {
+	sched, err := parseSchedule(spec)
+	if err != nil {
+		return nil, err
+	}
+	j := &Job{
+		build: build,
+		sched: sched,
+		cfg:   scheduleConfig{stdout: os.Stdout},
+		stop:  make(chan struct{}),
+	}
+	for _, opt := range opts {
+		opt(&j.cfg)
+	}
+	next := sched.next(time.Now())
+	if next.IsZero() {
+		return nil, fmt.Errorf("schedule %q never matches a date", spec)
+	}
+	j.next = next
+	go j.loop()
+	return j, nil
+}
+
+// Next returns the time the job is next due to run, not counting any jitter,
+// or the zero time if the job has been stopped.
+func (j *Job) Next() time.Time {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	if j.stopped {
+		return time.Time{}
+	}
+	return j.next
+}
+
+// Stop stops the job from running again, and waits for any runs in progress
+// to finish, so it mustn't be called from within the job itself. It's safe to
+// call Stop more than once.
+func (j *Job) Stop() {
+	j.stopOnce.Do(func() {
+		j.mu.Lock()
+		j.stopped = true
+		j.pending = false
+		j.mu.Unlock()
+		close(j.stop)
+	})
+	j.runs.Wait()
+}
+
+// loop waits for each time the job is due, and starts it, until the job is
+// stopped.
+func (j *Job) loop() {
+	for {
+		j.mu.Lock()
+		delay := time.Until(j.next)
+		j.mu.Unlock()
+		if j.cfg.jitter > 0 {
+			delay += time.Duration(rand.Int63n(int64(j.cfg.jitter)))
+		}
+		timer := time.NewTimer(delay)
+		select {
+		case <-j.stop:
+			timer.Stop()
+			return
+		case <-timer.C:
+		}
+		j.mu.Lock()
+		j.next = j.sched.next(time.Now())
+		j.mu.Unlock()
+		j.trigger()
+	}
+}
+
+// trigger starts a run of the job, unless one is already in progress, in
+// which case it follows the job's overlap policy.
+func (j *Job) trigger() {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	if j.stopped {
+		return
+	}
+	if j.running > 0 && j.cfg.overlap != OverlapAllow {
+		if j.cfg.overlap == OverlapQueue {
+			j.pending = true
+		}
+		return
+	}
+	j.running++
+	j.runs.Add(1)
+	go j.run()
+}
+
+// run runs the job, and then any run queued while it was in progress.
+func (j *Job) run() {
+	defer j.runs.Done()
+	for {
+		j.runOnce()
+		j.mu.Lock()
+		if j.pending {
+			j.pending = false
+			j.mu.Unlock()
+			continue
+		}
+		j.running--
+		j.mu.Unlock()
+		return
+	}
+}
+
+func (j *Job) runOnce() {
+	p := j.build()
+	if p == nil {
+		return
+	}
+	_, err := p.WithStdout(j.cfg.stdout).Stdout()
+	if err != nil && j.cfg.onError != nil {
+		j.cfg.onError(err)
+	}
+}
+
+// cronSchedule is a parsed schedule spec. Each field is a set of bits, where
+// bit N is set if the value N matches.
+type cronSchedule struct {
+	minute, hour, dom, month, dow uint64
+	// domAny and dowAny are true if the day of the month or week,
+	// respectively, is unrestricted.
+	domAny, dowAny bool
+	// every, if positive, is the interval for an `@every` spec.
+	every time.Duration
+}
+
+var cronShorthands = map[string]string{
+	"@yearly":   "0 0 1 1 *",
+	"@annually": "0 0 1 1 *",
+	"@monthly":  "0 0 1 * *",
+	"@weekly":   "0 0 * * 0",
+	"@daily":    "0 0 * * *",
+	"@midnight": "0 0 * * *",
+	"@hourly":   "0 * * * *",
+}
+
+var (
+	cronMonths = []string{"jan", "feb", "mar", "apr", "may", "jun", "jul", "aug", "sep", "oct", "nov", "dec"}
+	cronDays   = []string{"sun", "mon", "tue", "wed", "thu", "fri", "sat"}
+)
+
+// parseSchedule parses a cron-style schedule spec, as described for Schedule.
+func parseSchedule(spec string) (cronSchedule, error) {
+	spec = strings.TrimSpace(spec)
+	if interval, ok := strings.CutPrefix(spec, "@every "); ok {
+		d, err := time.ParseDuration(strings.TrimSpace(interval))
+		if err != nil || d <= 0 {
+			return cronSchedule{}, fmt.Errorf("invalid schedule %q: interval must be a positive duration", spec)
+		}
+		return cronSchedule{every: d}, nil
+	}
+	if expanded, ok := cronShorthands[strings.ToLower(spec)]; ok {
+		spec = expanded
+	}
+	fields := strings.Fields(spec)
+	if len(fields) != 5 {
+		return cronSchedule{}, fmt.Errorf("invalid schedule %q: want 5 fields, got %d", spec, len(fields))
+	}
+	var s cronSchedule
+	var err error
+	for i, f := range []struct {
+		bits     *uint64
+		min, max int
+		names    []string
+	}{
+		{&s.minute, 0, 59, nil},
+		{&s.hour, 0, 23, nil},
+		{&s.dom, 1, 31, nil},
+		{&s.month, 1, 12, cronMonths},
+		{&s.dow, 0, 7, cronDays},
+	} {
+		*f.bits, err = parseCronField(strings.ToLower(fields[i]), f.min, f.max, f.names)
+		if err != nil {
+			return cronSchedule{}, fmt.Errorf("invalid schedule %q: %w", spec, err)
+		}
+	}
+	if s.dow&(1<<7) != 0 {
+		s.dow |= 1
+	}
+	s.domAny = strings.HasPrefix(fields[2], "*")
+	s.dowAny = strings.HasPrefix(fields[4], "*")
+	return s, nil
+}
+
+// parseCronField parses one field of a schedule spec, whose values range from
+// min to max, and may be given by names, starting from min.
+func parseCronField(field string, min, max int, names []string) (uint64, error) {
+	var bits uint64
+	for _, part := range strings.Split(field, ",") {
+		rng, stepText, hasStep := strings.Cut(part, "/")
+		step := 1
+		if hasStep {
+			var err error
+			step, err = strconv.Atoi(stepText)
+			if err != nil || step <= 0 {
+				return 0, fmt.Errorf("invalid step %q", stepText)
+			}
+		}
+		lo, hi := min, max
+		if rng != "*" {
+			first, last, isRange := strings.Cut(rng, "-")
+			var err error
+			lo, err = cronValue(first, min, max, names)
+			if err != nil {
+				return 0, err
+			}
+			hi = lo
+			switch {
+			case isRange:
+				hi, err = cronValue(last, min, max, names)
+				if err != nil {
+					return 0, err
+				}
+			case hasStep:
+				hi = max
+			}
+			if lo > hi {
+				return 0, fmt.Errorf("invalid range %q", rng)
+			}
+		}
+		for v := lo; v <= hi; v += step {
+			bits |= 1 << uint(v)
+		}
+	}
+	return bits, nil
+}
+
+// cronValue parses a single value in a schedule spec.
+func cronValue(s string, min, max int, names []string) (int, error) {
+	for i, name := range names {
+		if s == name {
+			return min + i, nil
+		}
+	}
+	v, err := strconv.Atoi(s)
+	if err != nil || v < min || v > max {
+		return 0, fmt.Errorf("value %q out of range %d-%d", s, min, max)
+	}
+	return v, nil
+}
+
+// next returns the first time after t that matches the schedule, or the zero
+// time if there's none in the next five years.
+func (s cronSchedule) next(t time.Time) time.Time {
+	if s.every > 0 {
+		return t.Add(s.every)
+	}
+	loc := t.Location()
+	t = time.Date(t.Year(), t.Month(), t.Day(), t.Hour(), t.Minute()+1, 0, 0, loc)
+	limit := t.AddDate(5, 0, 0)
+	for t.Before(limit) {
+		switch {
+		case s.month&(1<<uint(t.Month())) == 0:
+			t = time.Date(t.Year(), t.Month()+1, 1, 0, 0, 0, 0, loc)
+		case !s.dayMatches(t):
+			t = time.Date(t.Year(), t.Month(), t.Day()+1, 0, 0, 0, 0, loc)
+		case s.hour&(1<<uint(t.Hour())) == 0:
+			t = time.Date(t.Year(), t.Month(), t.Day(), t.Hour()+1, 0, 0, 0, loc)
+		case s.minute&(1<<uint(t.Minute())) == 0:
+			t = t.Add(time.Minute)
+		default:
+			return t
+		}
+	}
+	return time.Time{}
+}
+
+// dayMatches reports whether the day of t matches the schedule, which, as in
+// cron, is when either the day of the month or the day of the week matches, if
+// both are restricted.
+func (s cronSchedule) dayMatches(t time.Time) bool {
+	dom := s.dom&(1<<uint(t.Day())) != 0
+	dow := s.dow&(1<<uint(t.Weekday())) != 0
+	if s.domAny || s.dowAny {
+		return dom && dow
+	}
+	return dom || dow
+}
@@ -0,0 +1,170 @@
+package script_test
+
+import (
+	"errors"
+	"io/fs"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/bitfield/script"
+)
+
+func TestScheduleRunsJobRepeatedly(t *testing.T) {
+	t.Parallel()
+	buf := &syncBuffer{}
+	job, err := script.Schedule("@every 10ms", func() *script.Pipe {
+		return script.Echo("tick\n")
+	}, script.ScheduleStdout(buf))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for deadline := time.Now().Add(5 * time.Second); strings.Count(buf.String(), "tick\n") < 3; {
+		if time.Now().After(deadline) {
+			t.Fatalf("want at least 3 runs, got output %q", buf.String())
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	job.Stop()
+	stopped := buf.String()
+	time.Sleep(50 * time.Millisecond)
+	if buf.String() != stopped {
+		t.Error("job ran after Stop")
+	}
+	if !job.Next().IsZero() {
+		t.Errorf("want zero Next after Stop, got %v", job.Next())
+	}
+}
+
+func TestScheduleReportsErrors(t *testing.T) {
+	t.Parallel()
+	errs := make(chan error, 10)
+	job, err := script.Schedule("@every 10ms", func() *script.Pipe {
+		return script.File("doesntexist")
+	}, script.ScheduleOnError(func(err error) {
+		select {
+		case errs <- err:
+		default:
+		}
+	}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer job.Stop()
+	select {
+	case err := <-errs:
+		if !errors.Is(err, fs.ErrNotExist) {
+			t.Errorf("want not-exist error, got %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("no error reported")
+	}
+}
+
+func TestScheduleOverlapPolicies(t *testing.T) {
+	t.Parallel()
+	for _, tc := range []struct {
+		name        string
+		overlap     script.Overlap
+		wantMax     int32
+		wantQueuing bool
+	}{
+		{"Skip", script.OverlapSkip, 1, false},
+		{"Queue", script.OverlapQueue, 1, true},
+		{"Allow", script.OverlapAllow, 2, false},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+			var running, maxRunning, runs atomic.Int32
+			release := make(chan struct{})
+			job, err := script.Schedule("@every 5ms", func() *script.Pipe {
+				n := running.Add(1)
+				defer running.Add(-1)
+				for {
+					m := maxRunning.Load()
+					if n <= m || maxRunning.CompareAndSwap(m, n) {
+						break
+					}
+				}
+				if runs.Add(1) == 1 {
+					<-release
+				}
+				return nil
+			}, script.ScheduleOverlap(tc.overlap))
+			if err != nil {
+				t.Fatal(err)
+			}
+			time.Sleep(100 * time.Millisecond)
+			queued := runs.Load()
+			close(release)
+			time.Sleep(50 * time.Millisecond)
+			job.Stop()
+			if got := maxRunning.Load(); tc.wantMax == 1 && got != 1 || tc.wantMax > 1 && got < 2 {
+				t.Errorf("want max %d concurrent runs, got %d", tc.wantMax, got)
+			}
+			if tc.overlap == script.OverlapSkip && queued != 1 {
+				t.Errorf("want runs skipped while first run in progress, got %d runs", queued)
+			}
+			if tc.wantQueuing && runs.Load() < 2 {
+				t.Errorf("want queued run after first finished, got %d runs", runs.Load())
+			}
+		})
+	}
+}
+
+func TestScheduleNextMatchesSpec(t *testing.T) {
+	t.Parallel()
+	tcs := map[string]func(time.Time) bool{
+		"*/5 * * * *": func(next time.Time) bool {
+			return next.Minute()%5 == 0 && next.Second() == 0 && time.Until(next) <= 5*time.Minute
+		},
+		"30 4 * * *": func(next time.Time) bool {
+			return next.Hour() == 4 && next.Minute() == 30
+		},
+		"0 0 29 feb *": func(next time.Time) bool {
+			return next.Month() == time.February && next.Day() == 29
+		},
+		"0 12 * * sat,7": func(next time.Time) bool {
+			return next.Hour() == 12 && (next.Weekday() == time.Saturday || next.Weekday() == time.Sunday)
+		},
+		"@monthly": func(next time.Time) bool {
+			return next.Day() == 1 && next.Hour() == 0 && next.Minute() == 0
+		},
+	}
+	for spec, ok := range tcs {
+		job, err := script.Schedule(spec, func() *script.Pipe { return nil })
+		if err != nil {
+			t.Fatalf("%s: %v", spec, err)
+		}
+		next := job.Next()
+		job.Stop()
+		if !next.After(time.Now()) || !ok(next) {
+			t.Errorf("%s: unexpected next run %v", spec, next)
+		}
+	}
+}
+
+func TestScheduleRejectsInvalidSpecs(t *testing.T) {
+	t.Parallel()
+	for _, spec := range []string{
+		"",
+		"* * * *",
+		"60 * * * *",
+		"* 24 * * *",
+		"5-1 * * * *",
+		"*/0 * * * *",
+		"* * * foo *",
+		"0 0 31 2 *",
+		"@every -1s",
+		"@every soon",
+	} {
+		job, err := script.Schedule(spec, func() *script.Pipe { return nil })
+		if err == nil {
+			job.Stop()
+			t.Errorf("%q: want error, got nil", spec)
+		} else if !strings.Contains(err.Error(), "schedule") {
+			t.Errorf("%q: want error mentioning schedule, got %v", spec, err)
+		}
+	}
+}
@@ -0,0 +1,110 @@
+package scripttest
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"runtime/debug"
+	"testing"
+
+	"github.com/bitfield/script"
+)
+
+// MaxFuzzOutput is the most output, in bytes, that CheckFilter reads from a
+// filter before giving up on it.
+const MaxFuzzOutput = 1 << 20
+
+// ErrOutputLimit is returned by RunFilter when a filter produces more output
+// than the limit.
+var ErrOutputLimit = errors.New("output limit exceeded")
+
+// PanicError is returned by RunFilter when a filter panics. Value is the value
+// passed to panic, and Stack is the stack trace of the goroutine that
+// panicked.
+type PanicError struct {
+	Value any
+	Stack []byte
+}
+
+func (e *PanicError) Error() string {
+	return fmt.Sprintf("filter panicked: %v\n%s", e.Value, e.Stack)
+}
+
+// RunFilter creates a pipe containing data, passes it to filter, and returns
+// the resulting pipe's output, reading at most maxOutput bytes. If there's
+// more output than that, RunFilter closes the pipe and returns the output so
+// far, along with ErrOutputLimit. If the filter panics, either when it's
+// called or while its output is read, RunFilter recovers, and returns a
+// *PanicError. Otherwise, it returns the pipe's error status, if any.
+//
+// A panic in a goroutine started by the filter can't be recovered, and still
+// crashes the program. Filters that buffer their whole input, such as Freq,
+// aren't bounded by maxOutput either, so keep fuzz inputs reasonably small.
+func RunFilter(data []byte, maxOutput int64, filter func(*script.Pipe) *script.Pipe) (out []byte, err error) {
+	defer func() {
+		if v := recover(); v != nil {
+			out, err = nil, &PanicError{Value: v, Stack: debug.Stack()}
+		}
+	}()
+	p := filter(script.NewPipeFromBytes(data))
+	if p == nil {
+		return nil, nil
+	}
+	defer p.Close()
+	out, err = io.ReadAll(io.LimitReader(p, maxOutput+1))
+	if err != nil {
+		return out, err
+	}
+	if int64(len(out)) > maxOutput {
+		return out[:maxOutput], ErrOutputLimit
+	}
+	return out, p.Error()
+}
+
+// CheckFilter runs filter on data using RunFilter, and fails the test if the
+// filter panics, returning its output otherwise. An error from the pipe, or
+// output beyond MaxFuzzOutput, doesn't fail the test, since invalid input is
+// the point of fuzzing: to check properties of the output, do it in the fuzz
+// target. For example:
+//
+//	func FuzzRedact(f *testing.F) {
+//		scripttest.SeedCorpus(f, "testdata/*.log")
+//		f.Fuzz(func(t *testing.T, data []byte) {
+//			out := scripttest.CheckFilter(t, data, redact)
+//			if bytes.Contains(out, []byte("password=")) {
+//				t.Errorf("password not redacted in %q", out)
+//			}
+//		})
+//	}
+func CheckFilter(t testing.TB, data []byte, filter func(*script.Pipe) *script.Pipe) []byte {
+	t.Helper()
+	out, err := RunFilter(data, MaxFuzzOutput, filter)
+	var perr *PanicError
+	if errors.As(err, &perr) {
+		t.Fatalf("input %q: %v", data, perr)
+	}
+	return out
+}
+
+// SeedCorpus adds the contents of each file matching the glob pattern to the
+// seed corpus of the fuzz test f, so that fuzzing starts from realistic
+// inputs. If no files match, or a file can't be read, the test fails.
+func SeedCorpus(f *testing.F, pattern string) {
+	f.Helper()
+	paths, err := filepath.Glob(pattern)
+	if err != nil {
+		f.Fatal(err)
+	}
+	if len(paths) == 0 {
+		f.Fatalf("no files match %s", pattern)
+	}
+	for _, path := range paths {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			f.Fatal(err)
+		}
+		f.Add(data)
+	}
+}
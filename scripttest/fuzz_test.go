@@ -0,0 +1,86 @@
+package scripttest_test
+
+import (
+	"bytes"
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/bitfield/script"
+	"github.com/bitfield/script/scripttest"
+)
+
+func TestRunFilterReturnsOutputAndPipeError(t *testing.T) {
+	t.Parallel()
+	out, err := scripttest.RunFilter([]byte("a\nb\n"), 100, func(p *script.Pipe) *script.Pipe {
+		return p.Match("b")
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(out) != "b\n" {
+		t.Errorf("want %q, got %q", "b\n", out)
+	}
+	_, err = scripttest.RunFilter([]byte("{"), 100, (*script.Pipe).JSONCompact)
+	if err == nil {
+		t.Error("want error for invalid JSON, got nil")
+	}
+}
+
+func TestRunFilterRecoversPanics(t *testing.T) {
+	t.Parallel()
+	_, err := scripttest.RunFilter([]byte("boom\n"), 100, func(p *script.Pipe) *script.Pipe {
+		return p.EachLine(func(line string, out *strings.Builder) {
+			panic(line)
+		})
+	})
+	var perr *scripttest.PanicError
+	if !errors.As(err, &perr) {
+		t.Fatalf("want PanicError, got %v", err)
+	}
+	if perr.Value != "boom" || !strings.Contains(err.Error(), "fuzz_test.go") {
+		t.Errorf("want panic value and stack in error, got %v", err)
+	}
+}
+
+func TestRunFilterLimitsOutput(t *testing.T) {
+	t.Parallel()
+	out, err := scripttest.RunFilter([]byte("x\n"), 10, func(p *script.Pipe) *script.Pipe {
+		return p.EachLine(func(line string, out *strings.Builder) {
+			out.WriteString(strings.Repeat(line, 1000))
+		})
+	})
+	if !errors.Is(err, scripttest.ErrOutputLimit) {
+		t.Fatalf("want ErrOutputLimit, got %v", err)
+	}
+	if len(out) != 10 {
+		t.Errorf("want 10 bytes of output, got %d", len(out))
+	}
+}
+
+func TestCheckFilterFailsOnlyOnPanic(t *testing.T) {
+	t.Parallel()
+	ft := &fakeT{TB: t}
+	scripttest.CheckFilter(ft, []byte("{"), (*script.Pipe).JSONCompact)
+	if ft.failed {
+		t.Fatalf("want no failure for pipe error, got %q", ft.msg)
+	}
+	scripttest.CheckFilter(ft, []byte("x"), func(p *script.Pipe) *script.Pipe {
+		panic("oops")
+	})
+	if !ft.failed || !strings.Contains(ft.msg, "oops") {
+		t.Errorf("want failure reporting panic, got %q", ft.msg)
+	}
+}
+
+func FuzzSeedCorpus(f *testing.F) {
+	scripttest.SeedCorpus(f, "testdata/*.txt")
+	f.Fuzz(func(t *testing.T, data []byte) {
+		out := scripttest.CheckFilter(t, data, func(p *script.Pipe) *script.Pipe {
+			return p.Freq()
+		})
+		if len(data) > 0 && bytes.Count(out, []byte("\n")) == 0 {
+			t.Errorf("input %q: want at least one line of output, got none", data)
+		}
+	})
+}
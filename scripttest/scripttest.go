@@ -0,0 +1,102 @@
+// Package scripttest helps to test programs whose logic is a script pipeline,
+// by comparing pipes with golden files, and making pipes from fixtures.
+//
+// A golden file holds the output a test expects. When the output changes on
+// purpose, run the tests with the -update-golden flag to rewrite the golden
+// files with the new output, and then review the changes:
+//
+//	go test -run TestReport -args -update-golden
+package scripttest
+
+import (
+	"errors"
+	"flag"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"testing/iotest"
+
+	"github.com/bitfield/script"
+)
+
+// update is true if golden files should be rewritten with the actual output,
+// instead of being compared with it.
+var update = flag.Bool("update-golden", false, "rewrite golden files with the actual output")
+
+// AssertPipe reads the contents of p, and fails the test if they're not the
+// same as the contents of the golden file wantFile, showing the differences as
+// a unified diff. If the tests were run with the -update-golden flag, it
+// writes the contents to wantFile instead, creating any directories needed.
+// If there is an error reading p, the test fails.
+func AssertPipe(t testing.TB, p *script.Pipe, wantFile string) {
+	t.Helper()
+	got, err := p.String()
+	if err != nil {
+		t.Fatalf("reading pipe: %v", err)
+		return
+	}
+	if *update {
+		if err := os.MkdirAll(filepath.Dir(wantFile), 0o755); err != nil {
+			t.Fatal(err)
+			return
+		}
+		if err := os.WriteFile(wantFile, []byte(got), 0o644); err != nil {
+			t.Fatal(err)
+		}
+		return
+	}
+	if _, err := os.Stat(wantFile); errors.Is(err, os.ErrNotExist) {
+		t.Fatalf("golden file %s doesn't exist (run with -update-golden to create it)", wantFile)
+		return
+	}
+	diff, err := script.Echo(got).DiffFile(wantFile)
+	if err != nil {
+		t.Fatal(err)
+		return
+	}
+	if diff != "" {
+		t.Errorf("output differs from golden file (run with -update-golden to update it):\n%s", diff)
+	}
+}
+
+// Fixture returns a pipe containing the contents of the named file, relative
+// to the package's testdata directory. If the file can't be read, the test
+// fails.
+func Fixture(t testing.TB, name string) *script.Pipe {
+	t.Helper()
+	data, err := os.ReadFile(filepath.Join("testdata", name))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return script.Echo(string(data))
+}
+
+// FailingPipe returns a pipe containing the specified data, after which
+// reading fails with err. This is useful for testing how a pipeline handles
+// errors from its source, such as a broken network connection.
+func FailingPipe(data string, err error) *script.Pipe {
+	return script.NewPipe().WithReader(io.MultiReader(strings.NewReader(data), iotest.ErrReader(err)))
+}
+
+// TempFiles creates a temporary directory containing the specified files,
+// which are removed when the test finishes, and returns its path. Each key is
+// the path of a file, relative to the directory, and each value is its
+// contents. Any directories needed are created. This is useful for testing
+// pipelines that start with FindFiles or ListFiles. If a file can't be
+// written, the test fails.
+func TempFiles(t testing.TB, files map[string]string) string {
+	t.Helper()
+	dir := t.TempDir()
+	for name, contents := range files {
+		path := filepath.Join(dir, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, []byte(contents), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return dir
+}
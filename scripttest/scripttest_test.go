@@ -0,0 +1,124 @@
+package scripttest_test
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/bitfield/script"
+	"github.com/bitfield/script/scripttest"
+)
+
+// fakeT records whether a test using it failed, and why, instead of failing
+// the real test.
+type fakeT struct {
+	testing.TB
+	failed bool
+	msg    string
+}
+
+func (f *fakeT) Helper() {}
+
+func (f *fakeT) Errorf(format string, args ...any) {
+	f.failed, f.msg = true, fmt.Sprintf(format, args...)
+}
+
+func (f *fakeT) Fatalf(format string, args ...any) {
+	f.failed, f.msg = true, fmt.Sprintf(format, args...)
+}
+
+func (f *fakeT) Fatal(args ...any) {
+	f.failed, f.msg = true, fmt.Sprint(args...)
+}
+
+func TestAssertPipePassesWhenOutputMatchesGoldenFile(t *testing.T) {
+	t.Parallel()
+	scripttest.AssertPipe(t, scripttest.Fixture(t, "words.txt").Freq(), "testdata/freq.golden.txt")
+}
+
+func TestAssertPipeFailsWithDiffWhenOutputDiffers(t *testing.T) {
+	t.Parallel()
+	ft := &fakeT{TB: t}
+	scripttest.AssertPipe(ft, script.Echo("1 hello\n2 world\n"), "testdata/freq.golden.txt")
+	if !ft.failed {
+		t.Fatal("want test failure, got none")
+	}
+	if !strings.Contains(ft.msg, "-1 world\n+2 world\n") {
+		t.Errorf("want diff in failure message, got %q", ft.msg)
+	}
+}
+
+func TestAssertPipeFailsWhenGoldenFileIsMissing(t *testing.T) {
+	t.Parallel()
+	ft := &fakeT{TB: t}
+	scripttest.AssertPipe(ft, script.Echo("hello\n"), "testdata/doesntexist.golden.txt")
+	if !ft.failed || !strings.Contains(ft.msg, "-update-golden") {
+		t.Errorf("want failure suggesting -update-golden, got %q", ft.msg)
+	}
+}
+
+func TestAssertPipeFailsOnPipeError(t *testing.T) {
+	t.Parallel()
+	ft := &fakeT{TB: t}
+	scripttest.AssertPipe(ft, scripttest.FailingPipe("hello\n", errors.New("oh no")), "testdata/freq.golden.txt")
+	if !ft.failed || !strings.Contains(ft.msg, "oh no") {
+		t.Errorf("want failure reporting pipe error, got %q", ft.msg)
+	}
+}
+
+// This test sets the -update-golden flag, so it can't run in parallel with the
+// others.
+func TestAssertPipeUpdatesGoldenFileWithFlag(t *testing.T) {
+	if err := flag.Set("update-golden", "true"); err != nil {
+		t.Fatal(err)
+	}
+	defer flag.Set("update-golden", "false")
+	path := filepath.Join(t.TempDir(), "new", "output.golden.txt")
+	scripttest.AssertPipe(t, script.Echo("hello\n"), path)
+	got, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(got) != "hello\n" {
+		t.Errorf("want golden file %q, got %q", "hello\n", got)
+	}
+}
+
+func TestFailingPipe(t *testing.T) {
+	t.Parallel()
+	got, err := io.ReadAll(scripttest.FailingPipe("hello\n", io.ErrUnexpectedEOF))
+	if !errors.Is(err, io.ErrUnexpectedEOF) {
+		t.Errorf("want io.ErrUnexpectedEOF, got %v", err)
+	}
+	if string(got) != "hello\n" {
+		t.Errorf("want %q, got %q", "hello\n", got)
+	}
+}
+
+func TestTempFiles(t *testing.T) {
+	t.Parallel()
+	dir := scripttest.TempFiles(t, map[string]string{
+		"a.txt":     "a\n",
+		"sub/b.txt": "b\n",
+	})
+	got, err := script.FindFiles(dir).Replace(dir+string(filepath.Separator), "").String()
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := "a.txt\n" + filepath.Join("sub", "b.txt") + "\n"
+	if want != got {
+		t.Errorf("want %q, got %q", want, got)
+	}
+	contents, err := script.File(filepath.Join(dir, "sub", "b.txt")).String()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if contents != "b\n" {
+		t.Errorf("want %q, got %q", "b\n", contents)
+	}
+}
@@ -0,0 +1,15 @@
+//go:build !windows
+
+package script
+
+import "os/exec"
+
+// shellCommand returns a command that runs cmdLine with `sh -c`.
+func shellCommand(cmdLine string) *exec.Cmd {
+	return exec.Command("sh", "-c", cmdLine)
+}
+
+// powerShellCommand returns a command that runs cmdLine with PowerShell Core.
+func powerShellCommand(cmdLine string) *exec.Cmd {
+	return exec.Command("pwsh", "-NoProfile", "-NonInteractive", "-Command", cmdLine)
+}
@@ -0,0 +1,30 @@
+//go:build windows
+
+package script
+
+import (
+	"os"
+	"os/exec"
+	"syscall"
+)
+
+// shellCommand returns a command that runs cmdLine with the Windows command
+// interpreter, `cmd /C`. The command line is passed to cmd.exe exactly as
+// given, because it doesn't follow the usual rules for quoting arguments.
+func shellCommand(cmdLine string) *exec.Cmd {
+	comspec := os.Getenv("COMSPEC")
+	if comspec == "" {
+		comspec = "cmd.exe"
+	}
+	cmd := exec.Command(comspec)
+	cmd.SysProcAttr = &syscall.SysProcAttr{
+		CmdLine: `cmd.exe /S /C "` + cmdLine + `"`,
+	}
+	return cmd
+}
+
+// powerShellCommand returns a command that runs cmdLine with Windows
+// PowerShell.
+func powerShellCommand(cmdLine string) *exec.Cmd {
+	return exec.Command("powershell.exe", "-NoProfile", "-NonInteractive", "-Command", cmdLine)
+}
@@ -1,23 +1,101 @@
 package script
 
 import (
+	"archive/zip"
+	"bufio"
+	"bytes"
+	"context"
 	"crypto/sha256"
 	"encoding/hex"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
+	"io/fs"
 	"io/ioutil"
+	"math"
+	"net"
+	"net/http"
+	"net/url"
 	"os"
+	"path/filepath"
+	"slices"
+	"sort"
+	"strconv"
 	"strings"
+	"sync"
+	"time"
+
+	"gopkg.in/yaml.v3"
 )
 
+// AppendBytes appends the contents of the pipe to dst, and returns the
+// extended slice, or an error, like strconv.AppendInt. If dst has enough
+// spare capacity, no new memory is allocated, so a loop running many small
+// pipelines can reuse the same buffer:
+//
+//	buf = buf[:0]
+//	buf, err = script.File(path).AppendBytes(buf)
+//
+// If there is an error reading, AppendBytes returns dst extended by the data
+// read so far, and the pipe's error status is also set.
+func (p *Pipe) AppendBytes(dst []byte) ([]byte, error) {
+	if p == nil || p.Error() != nil {
+		return dst, p.Error()
+	}
+	for {
+		if len(dst) == cap(dst) {
+			dst = append(dst, 0)[:len(dst)]
+		}
+		n, err := p.Reader.Read(dst[len(dst):cap(dst)])
+		dst = dst[:len(dst)+n]
+		if err == io.EOF {
+			return dst, nil
+		}
+		if err != nil {
+			p.SetError(err)
+			return dst, err
+		}
+	}
+}
+
 // AppendFile appends the contents of the Pipe to the specified file, and closes
 // the pipe after reading. It returns the number of bytes successfully written,
 // or an error. If there is an error reading or writing, the pipe's error status
-// is also set.
+// is also set. If the pipe is still reading from the file, as in
+// File(x).AppendFile(x), which would never finish, AppendFile writes nothing,
+// and returns an error wrapping ErrSameFile.
 func (p *Pipe) AppendFile(fileName string) (int64, error) {
 	return p.writeOrAppendFile(fileName, os.O_APPEND|os.O_CREATE|os.O_WRONLY)
 }
 
+// AppendTo appends the contents of the pipe to the supplied strings.Builder,
+// without first copying them to an intermediate string. It returns the number
+// of bytes appended, or an error. If there is an error reading, the pipe's
+// error status is also set.
+func (p *Pipe) AppendTo(b *strings.Builder) (int64, error) {
+	if p == nil || p.Error() != nil {
+		return 0, p.Error()
+	}
+	n, err := io.Copy(b, p.Reader)
+	if err != nil {
+		p.SetError(err)
+	}
+	return n, err
+}
+
+// AppendToBuffer is like AppendTo, but appends to the supplied bytes.Buffer.
+func (p *Pipe) AppendToBuffer(buf *bytes.Buffer) (int64, error) {
+	if p == nil || p.Error() != nil {
+		return 0, p.Error()
+	}
+	n, err := buf.ReadFrom(p.Reader)
+	if err != nil {
+		p.SetError(err)
+	}
+	return n, err
+}
+
 // Bytes returns the contents of the Pipe as a slice of byte, or an error. If
 // there is an error reading, the pipe's error status is also set.
 func (p *Pipe) Bytes() ([]byte, error) {
@@ -32,20 +110,492 @@ func (p *Pipe) Bytes() ([]byte, error) {
 	return res, nil
 }
 
+// ContainsMatch reports whether any line of the pipe contains the specified
+// string, or returns an error. Like FirstMatch, it stops reading and closes
+// the pipe as soon as a matching line is found, so it's fast at answering
+// questions such as "does this huge log contain X?" when the answer is yes.
+// If there is an error reading the pipe, the pipe's error status is also set.
+func (p *Pipe) ContainsMatch(s string) (bool, error) {
+	_, found, err := p.firstMatch(s)
+	return found, err
+}
+
 // CountLines counts lines from the pipe's reader, and returns the integer
-// result, or an error. If there is an error reading the pipe, the pipe's error
-// status is also set.
+// result, or an error. Rather than splitting the input into lines, it counts
+// the newlines in large blocks of input at a time, so it's fast even on huge
+// inputs, and lines can be any length. A final line without a trailing
+// newline is counted too. If there is an error reading the pipe, the pipe's
+// error status is also set.
 func (p *Pipe) CountLines() (int, error) {
 	if p == nil || p.Error() != nil {
 		return 0, p.Error()
 	}
+	if p.rejectBinary() {
+		return 0, p.Error()
+	}
+	buf := make([]byte, matchBlockSize)
 	var lines int
-	p.EachLine(func(line string, out *strings.Builder) {
+	last := byte('\n')
+	for {
+		n, err := p.Reader.Read(buf)
+		if n > 0 {
+			lines += bytes.Count(buf[:n], []byte{'\n'})
+			last = buf[n-1]
+		}
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			p.SetError(err)
+			break
+		}
+	}
+	// A final line without a newline still counts.
+	if last != '\n' {
 		lines++
-	})
+	}
 	return lines, p.Error()
 }
 
+// DecodeJSON reads the contents of the pipe as a JSON document, and unmarshals
+// it into the value pointed to by v, as for json.Unmarshal. It returns any
+// error reading or decoding, and the pipe's error status is also set.
+func (p *Pipe) DecodeJSON(v any) error {
+	if p == nil || p.Error() != nil {
+		return p.Error()
+	}
+	data, err := ioutil.ReadAll(p.Reader)
+	if err != nil {
+		p.SetError(err)
+		return err
+	}
+	if err := json.Unmarshal(data, v); err != nil {
+		p.SetError(err)
+		return err
+	}
+	return nil
+}
+
+// DecodeYAML reads the contents of the pipe as a YAML document, and unmarshals
+// it into the value pointed to by v, as for yaml.Unmarshal in
+// gopkg.in/yaml.v3. It returns any error reading or decoding, and the pipe's
+// error status is also set.
+func (p *Pipe) DecodeYAML(v any) error {
+	if p == nil || p.Error() != nil {
+		return p.Error()
+	}
+	data, err := ioutil.ReadAll(p.Reader)
+	if err != nil {
+		p.SetError(err)
+		return err
+	}
+	if err := yaml.Unmarshal(data, v); err != nil {
+		p.SetError(err)
+		return err
+	}
+	return nil
+}
+
+// Stats contains summary statistics about a set of numbers, as returned by
+// Describe. If Count is zero, the other fields are all zero.
+type Stats struct {
+	Count  int
+	Min    float64
+	Max    float64
+	Mean   float64
+	Median float64
+	// P95 is the 95th percentile.
+	P95 float64
+	// StdDev is the sample standard deviation.
+	StdDev float64
+}
+
+// String returns the statistics in s as a table, one per line.
+func (s Stats) String() string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "count  %d\n", s.Count)
+	for _, stat := range []struct {
+		name  string
+		value float64
+	}{
+		{"min", s.Min},
+		{"max", s.Max},
+		{"mean", s.Mean},
+		{"median", s.Median},
+		{"p95", s.P95},
+		{"stddev", s.StdDev},
+	} {
+		fmt.Fprintf(&b, "%-6s %s\n", stat.name, strconv.FormatFloat(stat.value, 'g', -1, 64))
+	}
+	return b.String()
+}
+
+// Describe reads the numbers in the given column of each line of the pipe,
+// where columns are numbered and delimited as for Column, and returns summary
+// statistics about them. Lines where the column is missing or isn't a number
+// are ignored. If there is an error reading the pipe, the pipe's error status
+// is also set.
+//
+//	stats, err := script.File("access.log").Describe(10)
+//	fmt.Print(stats)
+func (p *Pipe) Describe(col int) (Stats, error) {
+	if p == nil || p.Error() != nil {
+		return Stats{}, p.Error()
+	}
+	var values []float64
+	p.eachLine(func(line string, out *strings.Builder) {
+		columns := strings.Fields(line)
+		if col < 1 || col > len(columns) {
+			return
+		}
+		v, err := strconv.ParseFloat(columns[col-1], 64)
+		if err != nil {
+			return
+		}
+		values = append(values, v)
+	})
+	if p.Error() != nil {
+		return Stats{}, p.Error()
+	}
+	return describe(values), nil
+}
+
+// DiffFile reads the contents of the pipe, and compares them with the contents
+// of the specified file, returning the differences as a unified diff, like
+// `diff -u`, which shows the changes that writing the contents to the file
+// would make. If they're the same, it returns the empty string. This is
+// useful for checking configuration drift, or for showing why a test failed:
+//
+//	diff, err := script.Exec("render-config").DiffFile("/etc/app/config.yaml")
+//
+// A file that doesn't exist is treated as empty. If there is an error reading
+// the pipe or the file, the pipe's error status is also set.
+func (p *Pipe) DiffFile(path string) (string, error) {
+	if p == nil || p.Error() != nil {
+		return "", p.Error()
+	}
+	data, err := p.Bytes()
+	if err != nil {
+		return "", err
+	}
+	existing, err := os.ReadFile(path)
+	if err != nil && !os.IsNotExist(err) {
+		p.SetError(err)
+		return "", err
+	}
+	if bytes.Equal(data, existing) {
+		return "", nil
+	}
+	return unifiedDiff(path, splitLinesKeepEnds(string(existing)), splitLinesKeepEnds(string(data))), nil
+}
+
+// Discard reads the pipe to the end, and throws away the contents. This is
+// useful when only the side effects of a pipeline matter, such as the
+// commands run by Exec, or the files written by WriteFile, and the output
+// shouldn't be printed. It returns the pipe's error status, if any, or an
+// error reading the pipe. If there is an error reading, the pipe's error
+// status is also set.
+func (p *Pipe) Discard() error {
+	if p == nil || p.Error() != nil {
+		return p.Error()
+	}
+	_, err := io.Copy(ioutil.Discard, p.Reader)
+	if err != nil {
+		p.SetError(err)
+	}
+	return p.Error()
+}
+
+// EachFile reads a list of file paths from the pipe, one per line, and calls
+// process for each file with its path and a new pipe containing its contents.
+// The contents pipe is closed after process returns. This makes it easy to
+// express per-file operations without a manual loop around File:
+//
+//	err := script.FindFiles("logs").EachFile(func(path string, p *script.Pipe) error {
+//		n, err := p.CountLines()
+//		fmt.Println(path, n)
+//		return err
+//	})
+//
+// If a file can't be opened, or process returns an error, EachFile stops and
+// returns that error, identifying the path, and the pipe's error status is
+// also set.
+func (p *Pipe) EachFile(process func(path string, contents *Pipe) error) error {
+	if p == nil || p.Error() != nil {
+		return p.Error()
+	}
+	p.eachLine(func(path string, out *strings.Builder) {
+		contents := File(path)
+		defer contents.Close()
+		err := contents.Error()
+		if err == nil {
+			err = process(path, contents)
+		}
+		if err != nil {
+			p.SetError(fmt.Errorf("%s: %w", path, err))
+		}
+	})
+	return p.Error()
+}
+
+// EqualsFile reads the contents of the pipe, and reports whether they're
+// exactly the same as the contents of the specified file, which is handy for
+// checking test fixtures, or whether a generated file needs updating:
+//
+//	same, err := script.Exec("render-config").EqualsFile("/etc/app/config.yaml")
+//
+// If the file doesn't exist, EqualsFile returns false. If there is an error
+// reading the pipe or the file, the pipe's error status is also set.
+func (p *Pipe) EqualsFile(path string) (bool, error) {
+	if p == nil || p.Error() != nil {
+		return false, p.Error()
+	}
+	data, err := p.Bytes()
+	if err != nil {
+		return false, err
+	}
+	existing, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return false, nil
+	}
+	if err != nil {
+		p.SetError(err)
+		return false, err
+	}
+	return bytes.Equal(data, existing), nil
+}
+
+// FirstMatch returns the first line of the pipe that contains the specified
+// string, like `grep -m 1`, or an error. It stops reading and closes the pipe
+// as soon as it finds a match, without reading the rest of the input. If no
+// line matches, it returns the empty string (use ContainsMatch to tell this
+// apart from an empty matching line). If there is an error reading the pipe,
+// the pipe's error status is also set.
+func (p *Pipe) FirstMatch(s string) (string, error) {
+	line, _, err := p.firstMatch(s)
+	return line, err
+}
+
+// Fold reads the contents of the pipe line by line, calling fn with the
+// accumulated value so far (starting with init) and the line, and returns the
+// final accumulated value. This makes it easy to finish a pipeline by building
+// a Go value, such as a map or a running total:
+//
+//	counts, err := script.Fold(script.File("access.log").Column(1), map[string]int{},
+//		func(m map[string]int, ip string) (map[string]int, error) {
+//			m[ip]++
+//			return m, nil
+//		})
+//
+// If fn returns an error, Fold stops and returns the value accumulated so far,
+// plus an error giving the line number. If there is an error reading the pipe,
+// or from fn, the pipe's error status is also set.
+func Fold[T any](p *Pipe, init T, fn func(T, string) (T, error)) (T, error) {
+	if p == nil || p.Error() != nil {
+		return init, p.Error()
+	}
+	acc := init
+	n := 0
+	p.eachLine(func(line string, out *strings.Builder) {
+		n++
+		next, err := fn(acc, line)
+		if err != nil {
+			p.SetError(fmt.Errorf("line %d: %w", n, err))
+			return
+		}
+		acc = next
+	})
+	return acc, p.Error()
+}
+
+// GroupBy reads lines from the pipe, calls keyFn to get the key for each
+// line, and returns a map from each distinct key to the lines with that key,
+// in their original order. The input needn't be sorted. If there is an error
+// reading the pipe, the pipe's error status is also set.
+func (p *Pipe) GroupBy(keyFn func(string) string) (map[string][]string, error) {
+	if p == nil || p.Error() != nil {
+		return nil, p.Error()
+	}
+	groups := map[string][]string{}
+	p.eachLine(func(line string, out *strings.Builder) {
+		key := keyFn(line)
+		groups[key] = append(groups[key], line)
+	})
+	return groups, p.Error()
+}
+
+// Handler returns an http.Handler that calls makePipe for each request it
+// receives, and serves the resulting pipe as the response, as with
+// Pipe.ServeHTTP. This makes it easy to turn a pipeline into a simple web
+// endpoint:
+//
+//	http.Handle("/errors", script.Handler(func(r *http.Request) *script.Pipe {
+//		return script.File("/var/log/app.log").Match(r.FormValue("q"))
+//	}))
+func Handler(makePipe func(r *http.Request) *Pipe) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		makePipe(r).ServeHTTP(w, r)
+	})
+}
+
+// Histogram reads numbers from the pipe, one per line, and counts how many
+// fall into each bucket. The buckets are given by their upper bounds, in
+// ascending order: a number belongs to the first bucket whose bound it
+// doesn't exceed. The returned slice has one more element than buckets,
+// counting the numbers greater than the last bound. Blank lines are ignored.
+// If the buckets aren't in ascending order, any line isn't a number, or
+// there is an error reading the pipe, the pipe's error status is also set.
+func (p *Pipe) Histogram(buckets []float64) ([]int, error) {
+	if p == nil || p.Error() != nil {
+		return nil, p.Error()
+	}
+	if !sort.Float64sAreSorted(buckets) {
+		p.SetError(errors.New("histogram buckets must be in ascending order"))
+		return nil, p.Error()
+	}
+	counts := make([]int, len(buckets)+1)
+	p.eachLine(func(line string, out *strings.Builder) {
+		line = strings.TrimSpace(line)
+		if line == "" {
+			return
+		}
+		v, err := strconv.ParseFloat(line, 64)
+		if err != nil {
+			p.SetError(err)
+			return
+		}
+		counts[sort.SearchFloat64s(buckets, v)]++
+	})
+	if p.Error() != nil {
+		return nil, p.Error()
+	}
+	return counts, nil
+}
+
+// Lines reads the contents of the pipe, converts each line to a value of type
+// T by calling parse, and returns the results as a slice, in order. This lifts
+// the text in a pipe into typed Go values:
+//
+//	sizes, err := script.Lines(script.Exec("ls -s").Column(1), strconv.Atoi)
+//
+// If parse returns an error, Lines stops and returns the values converted so
+// far, plus an error giving the line number. If there is an error reading the
+// pipe, or converting a line, the pipe's error status is also set.
+func Lines[T any](p *Pipe, parse func(string) (T, error)) ([]T, error) {
+	if p == nil || p.Error() != nil {
+		return nil, p.Error()
+	}
+	result := []T{}
+	n := 0
+	p.eachLine(func(line string, out *strings.Builder) {
+		n++
+		v, err := parse(line)
+		if err != nil {
+			p.SetError(fmt.Errorf("line %d: %w", n, err))
+			return
+		}
+		result = append(result, v)
+	})
+	return result, p.Error()
+}
+
+// Pushgateway sends the contents of the pipe, which should be metrics in the
+// Prometheus text exposition format (such as that produced by ToPrometheus),
+// to the Prometheus Pushgateway at gatewayURL, under the given job name. Any
+// metrics previously pushed for the job are replaced. It returns the number of
+// bytes sent, or an error. If there is an error reading the pipe or pushing
+// the metrics, or the gateway doesn't accept them, the pipe's error status is
+// also set.
+func (p *Pipe) Pushgateway(gatewayURL, job string) (int64, error) {
+	if p == nil || p.Error() != nil {
+		return 0, p.Error()
+	}
+	data, err := ioutil.ReadAll(p.Reader)
+	if err != nil {
+		p.SetError(err)
+		return 0, err
+	}
+	endpoint := strings.TrimRight(gatewayURL, "/") + "/metrics/job/" + url.PathEscape(job)
+	req, err := http.NewRequest(http.MethodPut, endpoint, bytes.NewReader(data))
+	if err != nil {
+		p.SetError(err)
+		return 0, err
+	}
+	req.Header.Set("Content-Type", "text/plain; version=0.0.4")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		p.SetError(err)
+		return 0, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		msg, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 512))
+		err := fmt.Errorf("pushgateway: %s: %s", resp.Status, strings.TrimSpace(string(msg)))
+		p.SetError(err)
+		return 0, err
+	}
+	return int64(len(data)), nil
+}
+
+// RewriteFiles reads a list of file paths from the pipe, one per line, and
+// edits each file in place, like Unix `sed -i`: it calls transform with a pipe
+// containing the file's contents, and replaces the file with the result. For
+// example, to rename a function throughout a project:
+//
+//	err := script.FindFiles(".").MatchRegexp(regexp.MustCompile(`\.go$`)).
+//		RewriteFiles(func(p *script.Pipe) *script.Pipe {
+//			return p.Replace("oldName(", "newName(")
+//		})
+//
+// Each file is replaced atomically, by writing the new contents to a
+// temporary file in the same directory and renaming it over the original, so
+// a file is never left half-written. The file keeps its original mode, owner,
+// and extended attributes, as far as the user is allowed to set them. If a
+// file can't be read, or the transformed pipe has error status, or writing
+// fails, RewriteFiles leaves that file unchanged, stops, and returns the
+// error, identifying the path. The pipe's error status is also set.
+func (p *Pipe) RewriteFiles(transform func(*Pipe) *Pipe) error {
+	return p.RewriteFilesWithBackup(transform, "")
+}
+
+// RewriteFilesWithBackup is like RewriteFiles, but first saves a copy of each
+// file's original contents to the same path plus suffix, like `sed -i.bak`,
+// replacing any existing backup. If suffix is empty, no backup is made.
+func (p *Pipe) RewriteFilesWithBackup(transform func(*Pipe) *Pipe, suffix string) error {
+	return p.EachFile(func(path string, contents *Pipe) error {
+		return rewriteFile(path, transform(contents), suffix)
+	})
+}
+
+// ServeHTTP writes the contents of the pipe to w as the response to the HTTP
+// request r, flushing each chunk of data to the client as soon as it's read
+// from the pipe, so that slow or long-running pipelines are streamed. Unless
+// the response already has a Content-Type header, it will be sent as plain
+// text. If the pipe has error status, ServeHTTP responds with status 500
+// (Internal Server Error) and the text of the error instead. If there is an
+// error reading the pipe, the pipe's error status is also set, but because the
+// response status has already been sent by then, the response is simply cut
+// short.
+func (p *Pipe) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if p.Error() != nil {
+		http.Error(w, p.Error().Error(), http.StatusInternalServerError)
+		return
+	}
+	if w.Header().Get("Content-Type") == "" {
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	}
+	if p == nil {
+		return
+	}
+	out := io.Writer(w)
+	if f, ok := w.(http.Flusher); ok {
+		out = flushWriter{w, f}
+	}
+	if _, err := io.Copy(out, p.Reader); err != nil {
+		p.SetError(err)
+	}
+}
+
 // SHA256Sum calculates the SHA-256 of the file from the pipe's reader, and returns the
 // string result, or an error. If there is an error reading the pipe, the pipe's
 // error status is also set.
@@ -64,6 +614,44 @@ func (p *Pipe) SHA256Sum() (string, error) {
 	return encodedCheckSum, nil
 }
 
+// Send connects to the address addr on the named network, using the same
+// network names and address formats as net.Dial, and writes the contents of
+// the pipe to the connection, like Unix `nc`. On packet-oriented networks
+// ("udp", "udp4", "udp6", and "unixgram"), each line is sent as a separate
+// datagram, which is what line-based protocols such as statsd and syslog
+// expect. It returns the number of bytes successfully written, or an error. If
+// there is an error reading, connecting, or writing, the pipe's error status
+// is also set.
+func (p *Pipe) Send(network, addr string) (int64, error) {
+	if p == nil || p.Error() != nil {
+		return 0, p.Error()
+	}
+	conn, err := net.Dial(network, addr)
+	if err != nil {
+		p.SetError(err)
+		return 0, err
+	}
+	defer conn.Close()
+	switch network {
+	case "udp", "udp4", "udp6", "unixgram":
+		var wrote int64
+		p.eachLine(func(line string, out *strings.Builder) {
+			n, err := conn.Write([]byte(line + "\n"))
+			wrote += int64(n)
+			if err != nil {
+				p.SetError(err)
+			}
+		})
+		return wrote, p.Error()
+	}
+	wrote, err := io.Copy(conn, p.Reader)
+	if err != nil {
+		p.SetError(err)
+		return wrote, err
+	}
+	return wrote, nil
+}
+
 // Slice returns the contents of the pipe as a slice of strings, one element per line, or an error.
 // If there is an error reading the pipe, the pipe's error status is also set.
 func (p *Pipe) Slice() ([]string, error) {
@@ -71,21 +659,102 @@ func (p *Pipe) Slice() ([]string, error) {
 		return nil, p.Error()
 	}
 	result := []string{}
-	p.EachLine(func(line string, out *strings.Builder) {
+	p.eachLine(func(line string, out *strings.Builder) {
 		result = append(result, line)
 	})
 	return result, p.Error()
 }
 
+// SliceContext is like Slice, but stops reading the pipe once ctx is done,
+// which is useful for pipes fed by sources that may never end, such as
+// WebSocket. In that case, it closes the pipe and returns the lines read so
+// far (including any incomplete last line), along with ctx.Err(), which also
+// becomes the pipe's error status.
+func (p *Pipe) SliceContext(ctx context.Context) ([]string, error) {
+	if p == nil || p.Error() != nil || p.rejectBinary() {
+		return nil, p.Error()
+	}
+	data, err := p.readContext(ctx)
+	result := []string{}
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for scanner.Scan() {
+		result = append(result, scanner.Text())
+	}
+	if err == nil {
+		err = scanner.Err()
+		p.SetError(err)
+	}
+	return result, err
+}
+
+// SplitFiles writes the contents of the pipe to a series of files with at most
+// linesPerFile lines each, like Unix `split -l`, and closes the pipe after
+// reading. The files are named by adding a two-digit number to prefix,
+// counting from zero (`prefix00`, `prefix01`, and so on), and any existing
+// files with those names are replaced. It returns the names of the files
+// written, or an error. If linesPerFile isn't positive, or there is an error
+// reading or writing, the pipe's error status is also set.
+func (p *Pipe) SplitFiles(prefix string, linesPerFile int) ([]string, error) {
+	if p == nil || p.Error() != nil || p.rejectBinary() {
+		return nil, p.Error()
+	}
+	if linesPerFile <= 0 {
+		p.SetError(fmt.Errorf("lines per file must be positive, not %d", linesPerFile))
+		return nil, p.Error()
+	}
+	return p.splitFiles(prefix, func(w io.Writer, r *bufio.Reader) error {
+		for i := 0; i < linesPerFile; i++ {
+			line, err := r.ReadBytes('\n')
+			if _, err := w.Write(line); err != nil {
+				return err
+			}
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// SplitFilesBySize is like SplitFiles, but writes at most bytesPerFile bytes to
+// each file, like Unix `split -b`, regardless of line endings. This is useful
+// for breaking large or binary data into chunks that fit an upload size limit.
+func (p *Pipe) SplitFilesBySize(prefix string, bytesPerFile int64) ([]string, error) {
+	if p == nil || p.Error() != nil {
+		return nil, p.Error()
+	}
+	if bytesPerFile <= 0 {
+		p.SetError(fmt.Errorf("bytes per file must be positive, not %d", bytesPerFile))
+		return nil, p.Error()
+	}
+	return p.splitFiles(prefix, func(w io.Writer, r *bufio.Reader) error {
+		_, err := io.CopyN(w, r, bytesPerFile)
+		return err
+	})
+}
+
 // Stdout writes the contents of the pipe to its configured standard output. It
 // returns the number of bytes successfully written, plus a non-nil error if the
 // write failed or if there was an error reading from the pipe. If the pipe has
 // error status, Stdout returns zero plus the existing error.
+//
+// If the standard output is buffered (that is, it has a Flush method, like a
+// bufio.Writer or an http.ResponseWriter), and the pipe is in streaming mode
+// (see Stream), it's flushed at the end of every line, so that live output
+// appears as it's produced. To flush partial lines, such as progress
+// indicators, too, use WithFlushInterval.
 func (p *Pipe) Stdout() (int, error) {
 	if p == nil || p.Error() != nil || p.stdout == nil {
 		return 0, p.Error()
 	}
-	n64, err := io.Copy(p.stdout, p.Reader)
+	if f, ok := p.stdout.(*os.File); ok {
+		if info, err := f.Stat(); err == nil && p.readingFrom(info) {
+			err := fmt.Errorf("%w: %s", ErrSameFile, f.Name())
+			p.SetError(err)
+			return 0, err
+		}
+	}
+	n64, err := p.copyFlushing(p.stdout, p.Reader)
 	if err != nil {
 		return 0, err
 	}
@@ -108,19 +777,825 @@ func (p *Pipe) String() (string, error) {
 	return string(data), nil
 }
 
+// StringContext is like String, but stops reading the pipe once ctx is done,
+// which is useful for pipes fed by sources that may never end, such as
+// WebSocket:
+//
+//	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+//	defer cancel()
+//	output, err := script.WebSocket(url).StringContext(ctx)
+//
+// In that case, it closes the pipe and returns the data read so far, along
+// with ctx.Err(), which also becomes the pipe's error status.
+func (p *Pipe) StringContext(ctx context.Context) (string, error) {
+	if p == nil || p.Error() != nil {
+		return "", p.Error()
+	}
+	data, err := p.readContext(ctx)
+	return string(data), err
+}
+
+// ErrSameFile is the error status set when a sink would write to a file that
+// the pipe is still reading from, which would lose or corrupt the data.
+var ErrSameFile = errors.New("pipe writes to a file it is still reading")
+
 // WriteFile writes the contents of the Pipe to the specified file, and closes
 // the pipe after reading. If the file already exists, it is truncated and the
 // new data will replace the old. It returns the number of bytes successfully
 // written, or an error. If there is an error reading or writing, the pipe's
-// error status is also set.
+// error status is also set. If the pipe is still reading from the file, as in
+// File(x).Match("TODO").WriteFile(x), WriteFile writes to a temporary file
+// instead, and then renames it over the original, like sponge(1), so that the
+// input isn't truncated before it's been read. If anything goes wrong, the
+// original file is left alone.
 func (p *Pipe) WriteFile(fileName string) (int64, error) {
 	return p.writeOrAppendFile(fileName, os.O_RDWR|os.O_CREATE|os.O_TRUNC)
 }
 
+// WriteFileExclusive is like WriteFile, but creates a new file, failing if
+// the file already exists, so that only one script, or one run of a script,
+// can succeed in writing it. This is useful for lock files, and for steps
+// that must only be done once:
+//
+//	_, err := script.Echo(strconv.Itoa(os.Getpid())).WriteFileExclusive("deploy.lock")
+//	if errors.Is(err, fs.ErrExist) {
+//		log.Fatal("another deploy is already running")
+//	}
+//
+// If the file exists, WriteFileExclusive leaves it alone, and returns an error
+// wrapping fs.ErrExist. The pipe's error status is also set.
+func (p *Pipe) WriteFileExclusive(fileName string) (int64, error) {
+	return p.writeOrAppendFile(fileName, os.O_WRONLY|os.O_CREATE|os.O_EXCL)
+}
+
+// WriteFileRotating appends the contents of the pipe to the specified file,
+// like AppendFile, but rotates the file, in the style of log rotation, once it
+// would grow beyond maxSize bytes, or when the date changes (including when
+// the existing file was last written on an earlier day). Rotating renames the
+// file to `path.1`, the previous `path.1` to `path.2`, and so on, keeping at
+// most keep old files and removing any older ones. If maxSize is zero or
+// negative, the file is rotated only daily. Files are only rotated between
+// lines, and lines are written as soon as they're read, which makes
+// WriteFileRotating suitable for long-running pipelines that should log
+// indefinitely. It returns the number of bytes successfully written, or an
+// error. If there is an error reading, writing, or rotating, the pipe's error
+// status is also set.
+func (p *Pipe) WriteFileRotating(path string, maxSize int64, keep int) (int64, error) {
+	if p == nil || p.Error() != nil || p.rejectBinary() {
+		return 0, p.Error()
+	}
+	defer p.Close()
+	if err := p.checkNotSource(path); err != nil {
+		p.SetError(err)
+		return 0, err
+	}
+	if err := p.makeParents(path); err != nil {
+		p.SetError(err)
+		return 0, err
+	}
+	out := &rotatingFile{path: path, maxSize: maxSize, keep: keep}
+	if err := out.open(); err != nil {
+		p.SetError(err)
+		return 0, err
+	}
+	r := bufio.NewReader(p.Reader)
+	var wrote int64
+	for {
+		line, err := r.ReadBytes('\n')
+		if len(line) > 0 {
+			n, err := out.Write(line)
+			wrote += int64(n)
+			if err != nil {
+				out.Close()
+				p.SetError(err)
+				return wrote, err
+			}
+		}
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			out.Close()
+			p.SetError(err)
+			return wrote, err
+		}
+	}
+	if err := out.Close(); err != nil {
+		p.SetError(err)
+		return wrote, err
+	}
+	return wrote, nil
+}
+
+// WriteTempFile writes the contents of the pipe to a new temporary file, and
+// closes the pipe after reading. The file is created in the default directory
+// for temporary files, with a name made from pattern as for os.CreateTemp (a
+// random string replaces the last `*` in pattern, or is appended to it). This
+// is useful for passing the data to a command that requires a filename,
+// rather than reading standard input. It returns the path of the file, or an
+// error; removing the file afterwards is up to the caller. If there is an
+// error reading the pipe or writing the file, no file is left behind, and the
+// pipe's error status is also set.
+func (p *Pipe) WriteTempFile(pattern string) (string, error) {
+	if p == nil || p.Error() != nil {
+		return "", p.Error()
+	}
+	defer p.Close()
+	f, err := ioutil.TempFile("", pattern)
+	if err != nil {
+		p.SetError(err)
+		return "", err
+	}
+	defer f.Close()
+	if _, err := io.Copy(f, p.Reader); err != nil {
+		os.Remove(f.Name())
+		p.SetError(err)
+		return "", err
+	}
+	if err := f.Close(); err != nil {
+		os.Remove(f.Name())
+		p.SetError(err)
+		return "", err
+	}
+	return f.Name(), nil
+}
+
+// Zip reads a list of file paths from the pipe, one per line, and writes a zip
+// archive containing those files to `archivePath`, like Unix `zip -r`.
+// Directories are added recursively. Each entry is named with the path as read
+// from the pipe (minus any leading slash or volume name), so paths containing
+// ".." aren't allowed. Symbolic links are stored as links, like `zip -y`,
+// rather than followed. If the archive already exists, it is replaced. Zip
+// returns the number of files added, or an error. If there is an error reading
+// the pipe or any of the files, or writing the archive, the pipe's error status
+// is also set.
+func (p *Pipe) Zip(archivePath string) (int, error) {
+	if p == nil || p.Error() != nil {
+		return 0, p.Error()
+	}
+	out, err := os.Create(archivePath)
+	if err != nil {
+		p.SetError(err)
+		return 0, err
+	}
+	defer out.Close()
+	zw := zip.NewWriter(out)
+	var files int
+	p.eachLine(func(line string, _ *strings.Builder) {
+		err := filepath.Walk(line, func(path string, info os.FileInfo, err error) error {
+			if err != nil || info.IsDir() {
+				return err
+			}
+			files++
+			return addZipFile(zw, path, info)
+		})
+		if err != nil {
+			p.SetError(err)
+		}
+	})
+	if err := zw.Close(); err != nil {
+		p.SetError(err)
+	}
+	if err := out.Close(); err != nil && p.Error() == nil {
+		p.SetError(err)
+	}
+	if p.Error() != nil {
+		return 0, p.Error()
+	}
+	return files, nil
+}
+
+// addZipFile adds the file at path, described by info, to the zip archive
+// being written by zw. A symbolic link is stored as an entry containing its
+// target, as is usual for zip archives.
+func addZipFile(zw *zip.Writer, path string, info os.FileInfo) error {
+	hdr, err := zip.FileInfoHeader(info)
+	if err != nil {
+		return err
+	}
+	name := strings.TrimPrefix(path, filepath.VolumeName(path))
+	hdr.Name = strings.TrimLeft(filepath.ToSlash(name), "/")
+	if slices.Contains(strings.Split(hdr.Name, "/"), "..") {
+		return fmt.Errorf("%s: can't add path containing '..' to archive", path)
+	}
+	hdr.Method = zip.Deflate
+	if info.Mode()&os.ModeSymlink != 0 {
+		target, err := os.Readlink(path)
+		if err != nil {
+			return err
+		}
+		w, err := zw.CreateHeader(hdr)
+		if err != nil {
+			return err
+		}
+		_, err = io.WriteString(w, filepath.ToSlash(target))
+		return err
+	}
+	w, err := zw.CreateHeader(hdr)
+	if err != nil {
+		return err
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	_, err = io.Copy(w, f)
+	return err
+}
+
+// describe returns summary statistics for values, sorting values in place.
+func describe(values []float64) Stats {
+	n := len(values)
+	if n == 0 {
+		return Stats{}
+	}
+	sort.Float64s(values)
+	var sum float64
+	for _, v := range values {
+		sum += v
+	}
+	mean := sum / float64(n)
+	var squares float64
+	for _, v := range values {
+		squares += (v - mean) * (v - mean)
+	}
+	var stddev float64
+	if n > 1 {
+		stddev = math.Sqrt(squares / float64(n-1))
+	}
+	return Stats{
+		Count:  n,
+		Min:    values[0],
+		Max:    values[n-1],
+		Mean:   mean,
+		Median: percentile(values, 50),
+		P95:    percentile(values, 95),
+		StdDev: stddev,
+	}
+}
+
+// firstMatch returns the first line of the pipe containing s, and whether
+// there was one, closing the pipe once it's found.
+func (p *Pipe) firstMatch(s string) (string, bool, error) {
+	if p == nil || p.Error() != nil || p.rejectBinary() {
+		return "", false, p.Error()
+	}
+	defer p.Close()
+	scanner := bufio.NewScanner(p.Reader)
+	for scanner.Scan() {
+		if strings.Contains(scanner.Text(), s) {
+			return scanner.Text(), true, nil
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		p.SetError(err)
+		return "", false, err
+	}
+	return "", false, nil
+}
+
+// checkNotSource returns an error wrapping ErrSameFile if the named file is
+// one that the pipe is still reading from.
+func (p *Pipe) checkNotSource(name string) error {
+	if len(p.sources) == 0 {
+		return nil
+	}
+	info, err := os.Stat(name)
+	if err != nil || !p.readingFrom(info) {
+		return nil
+	}
+	return fmt.Errorf("%w: %s", ErrSameFile, name)
+}
+
+// readingFrom reports whether info describes a file that the pipe is still
+// reading from.
+func (p *Pipe) readingFrom(info os.FileInfo) bool {
+	for _, src := range p.sources {
+		if !src.closed.Load() && os.SameFile(info, src.info) {
+			return true
+		}
+	}
+	return false
+}
+
+// copyAttributes gives the file f the mode of the file described by info,
+// including the setuid, setgid, and sticky bits, along with its owner and
+// extended attributes, as far as the user is allowed to set them, so that
+// renaming f over that file doesn't change any of them.
+func copyAttributes(f *os.File, info os.FileInfo, from string) error {
+	// Changing the owner clears the setuid and setgid bits, so do it first.
+	if err := copyOwner(f, info); err != nil {
+		return err
+	}
+	if err := copyXattrs(f.Name(), from); err != nil {
+		return err
+	}
+	return f.Chmod(info.Mode() & (os.ModePerm | os.ModeSetuid | os.ModeSetgid | os.ModeSticky))
+}
+
+// copyFlushing copies r to w, like io.Copy. If w is buffered, and the pipe is
+// in streaming mode, w is flushed after each write containing a newline. If
+// the pipe has a flush interval (see WithFlushInterval), w is also flushed at
+// least that often while unflushed output is pending.
+func (p *Pipe) copyFlushing(w io.Writer, r io.Reader) (int64, error) {
+	flush := flushFunc(w)
+	if flush == nil || (!p.stream && p.flushInterval <= 0) {
+		return io.Copy(w, r)
+	}
+	lw := &lineFlushWriter{w: w, flush: flush, onNewline: p.stream}
+	if p.flushInterval > 0 {
+		done := make(chan struct{})
+		defer close(done)
+		go lw.flushEvery(p.flushInterval, done)
+	}
+	n, err := io.Copy(lw, r)
+	if ferr := lw.Flush(); err == nil {
+		err = ferr
+	}
+	return n, err
+}
+
+// diffOp is one line of an edit script made by diffLines: a line kept from the
+// old text (' '), deleted from it ('-'), or inserted from the new text ('+').
+type diffOp struct {
+	kind byte
+	line string
+}
+
+// diffLines returns the shortest edit script turning the lines of a into the
+// lines of b, using the linear-space version of Myers' algorithm, so that it
+// needs memory only in proportion to the number of lines.
+func diffLines(a, b []string) []diffOp {
+	return appendDiff(make([]diffOp, 0, len(a)+len(b)), a, b)
+}
+
+// appendDiff appends the edit script turning a into b to ops, and returns the
+// result. It finds the middle snake of the shortest edit path, and recurses on
+// the parts of the texts before and after it.
+func appendDiff(ops []diffOp, a, b []string) []diffOp {
+	for len(a) > 0 && len(b) > 0 && a[0] == b[0] {
+		ops = append(ops, diffOp{' ', a[0]})
+		a, b = a[1:], b[1:]
+	}
+	common := 0
+	for common < len(a) && common < len(b) && a[len(a)-1-common] == b[len(b)-1-common] {
+		common++
+	}
+	suffix := a[len(a)-common:]
+	a, b = a[:len(a)-common], b[:len(b)-common]
+	switch {
+	case len(a) == 0:
+		for _, line := range b {
+			ops = append(ops, diffOp{'+', line})
+		}
+	case len(b) == 0:
+		for _, line := range a {
+			ops = append(ops, diffOp{'-', line})
+		}
+	default:
+		// With the common prefix and suffix removed, there are at least two
+		// edits, so both parts are smaller than the whole.
+		x, y, u, v := middleSnake(a, b)
+		ops = appendDiff(ops, a[:x], b[:y])
+		for _, line := range a[x:u] {
+			ops = append(ops, diffOp{' ', line})
+		}
+		ops = appendDiff(ops, a[u:], b[v:])
+	}
+	for _, line := range suffix {
+		ops = append(ops, diffOp{' ', line})
+	}
+	return ops
+}
+
+// flushFunc returns a function that flushes w, if it's buffered, or nil.
+func flushFunc(w io.Writer) func() error {
+	switch f := w.(type) {
+	case interface{ Flush() error }:
+		return f.Flush
+	case http.Flusher:
+		return func() error {
+			f.Flush()
+			return nil
+		}
+	}
+	return nil
+}
+
+// lineFlushWriter is an io.Writer that flushes a buffered writer at the end
+// of each line, if onNewline is true, or on demand. It's safe to flush
+// concurrently with writing.
+type lineFlushWriter struct {
+	mu        sync.Mutex
+	w         io.Writer
+	flush     func() error
+	onNewline bool
+	pending   bool
+}
+
+// Write writes buf to the underlying writer, flushing it if buf contains a
+// newline and onNewline is true.
+func (lw *lineFlushWriter) Write(buf []byte) (int, error) {
+	lw.mu.Lock()
+	defer lw.mu.Unlock()
+	n, err := lw.w.Write(buf)
+	if err != nil {
+		return n, err
+	}
+	lw.pending = true
+	if lw.onNewline && bytes.IndexByte(buf[:n], '\n') >= 0 {
+		lw.pending = false
+		return n, lw.flush()
+	}
+	return n, nil
+}
+
+// Flush flushes the underlying writer, if anything has been written since it
+// was last flushed.
+func (lw *lineFlushWriter) Flush() error {
+	lw.mu.Lock()
+	defer lw.mu.Unlock()
+	if !lw.pending {
+		return nil
+	}
+	lw.pending = false
+	return lw.flush()
+}
+
+// flushEvery calls Flush at the specified interval, until done is closed.
+func (lw *lineFlushWriter) flushEvery(interval time.Duration, done <-chan struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			lw.Flush()
+		case <-done:
+			return
+		}
+	}
+}
+
+// flushWriter is an io.Writer that flushes each write to an HTTP client
+// immediately.
+type flushWriter struct {
+	w io.Writer
+	f http.Flusher
+}
+
+// Write writes buf to the underlying writer, then flushes it.
+func (fw flushWriter) Write(buf []byte) (int, error) {
+	n, err := fw.w.Write(buf)
+	fw.f.Flush()
+	return n, err
+}
+
+// hunkRange formats the start and length of one side of a diff hunk, where
+// start is the number of lines before the hunk.
+func hunkRange(start, count int) string {
+	if count == 0 {
+		return fmt.Sprintf("%d,0", start)
+	}
+	if count == 1 {
+		return strconv.Itoa(start + 1)
+	}
+	return fmt.Sprintf("%d,%d", start+1, count)
+}
+
+// makeParents creates any missing parent directories of the named file, if
+// the pipe is set to (see WithCreateParents).
+func (p *Pipe) makeParents(name string) error {
+	if !p.createParents {
+		return nil
+	}
+	return os.MkdirAll(filepath.Dir(name), 0o755)
+}
+
+// middleSnake returns the start (x, y) and end (u, v) of the middle snake of
+// a shortest path turning a into b: the run of matching lines in the middle of
+// the path, found by searching forwards from the start of both texts, and
+// backwards from the end, at the same time, until the searches overlap.
+func middleSnake(a, b []string) (x, y, u, v int) {
+	n, m := len(a), len(b)
+	delta := n - m
+	odd := delta%2 != 0
+	maxD := (n + m + 1) / 2
+	offset := maxD + 1
+	// forward[offset+k] is the furthest x reached on diagonal k (where
+	// k = x - y) from the start, and backward[offset+k] the furthest
+	// reached from the end, counting from the end of both texts.
+	forward := make([]int, 2*offset+1)
+	backward := make([]int, 2*offset+1)
+	for d := 0; d <= maxD; d++ {
+		for k := -d; k <= d; k += 2 {
+			if k == -d || (k != d && forward[offset+k-1] < forward[offset+k+1]) {
+				x = forward[offset+k+1]
+			} else {
+				x = forward[offset+k-1] + 1
+			}
+			y = x - k
+			u, v = x, y
+			for u < n && v < m && a[u] == b[v] {
+				u++
+				v++
+			}
+			forward[offset+k] = u
+			if c := delta - k; odd && c >= -(d-1) && c <= d-1 && u+backward[offset+c] >= n {
+				return x, y, u, v
+			}
+		}
+		for k := -d; k <= d; k += 2 {
+			if k == -d || (k != d && backward[offset+k-1] < backward[offset+k+1]) {
+				x = backward[offset+k+1]
+			} else {
+				x = backward[offset+k-1] + 1
+			}
+			y = x - k
+			u, v = x, y
+			for u < n && v < m && a[n-1-u] == b[m-1-v] {
+				u++
+				v++
+			}
+			backward[offset+k] = u
+			if c := delta - k; !odd && c >= -d && c <= d && u+forward[offset+c] >= n {
+				return n - u, m - v, n - x, m - y
+			}
+		}
+	}
+	// Unreachable: the searches always meet by the middle.
+	return 0, 0, 0, 0
+}
+
+// percentile returns the pth percentile of the sorted values, interpolating
+// linearly between the closest ranks.
+func percentile(sorted []float64, p float64) float64 {
+	rank := p / 100 * float64(len(sorted)-1)
+	lower := int(math.Floor(rank))
+	upper := int(math.Ceil(rank))
+	frac := rank - float64(lower)
+	return sorted[lower] + frac*(sorted[upper]-sorted[lower])
+}
+
+// readContext reads the pipe to completion, or until ctx is done, and returns
+// the data read, plus any error, which also becomes the pipe's error status.
+// The reading is done in a separate goroutine, so that a Read that blocks
+// indefinitely can't delay the return once ctx is done.
+func (p *Pipe) readContext(ctx context.Context) ([]byte, error) {
+	var (
+		mu   sync.Mutex
+		data []byte
+	)
+	done := make(chan error, 1)
+	goStage(func() {
+		buf := make([]byte, 32*1024)
+		for {
+			n, err := p.Reader.Read(buf)
+			mu.Lock()
+			data = append(data, buf[:n]...)
+			mu.Unlock()
+			if err != nil {
+				if err == io.EOF {
+					err = nil
+				}
+				done <- err
+				return
+			}
+		}
+	})
+	select {
+	case err := <-done:
+		p.SetError(err)
+		return data, err
+	case <-ctx.Done():
+		p.SetError(ctx.Err())
+		// Closing the pipe stops whatever's feeding it, so that the read
+		// in progress returns, and the goroutine doesn't leak.
+		p.Reader.Close()
+		mu.Lock()
+		defer mu.Unlock()
+		return bytes.Clone(data), ctx.Err()
+	}
+}
+
+// rewriteFile atomically replaces the file at path with the contents of p,
+// preserving its mode, owner, and extended attributes (see copyAttributes),
+// and first copies the original to path plus backupSuffix, unless backupSuffix
+// is empty.
+func rewriteFile(path string, p *Pipe, backupSuffix string) error {
+	data, err := p.Bytes()
+	if err != nil {
+		return err
+	}
+	info, err := os.Stat(path)
+	if err != nil {
+		return err
+	}
+	if backupSuffix != "" {
+		if err := copyFile(path, path+backupSuffix); err != nil {
+			return err
+		}
+	}
+	tmp, err := ioutil.TempFile(filepath.Dir(path), "."+filepath.Base(path)+".*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := copyAttributes(tmp, info, path); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+// replaceFile writes the contents of the pipe to a temporary file in the same
+// directory as fileName, and then renames it over fileName, preserving its
+// mode, owner, and extended attributes (see copyAttributes), so that the pipe
+// can carry on reading the original file until it's done, as sponge(1) does.
+// If fileName is a symbolic link, the file it points to is replaced, not the
+// link.
+func (p *Pipe) replaceFile(fileName string) (int64, error) {
+	path, err := filepath.EvalSymlinks(fileName)
+	if err != nil {
+		p.SetError(err)
+		return 0, err
+	}
+	info, err := os.Stat(path)
+	if err != nil {
+		p.SetError(err)
+		return 0, err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(path), "."+filepath.Base(path)+".*")
+	if err != nil {
+		p.SetError(err)
+		return 0, err
+	}
+	defer os.Remove(tmp.Name())
+	wrote, err := io.Copy(tmp, p.Reader)
+	if err == nil {
+		err = copyAttributes(tmp, info, path)
+	}
+	if cerr := tmp.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), path)
+	}
+	if err != nil {
+		p.SetError(err)
+		return 0, err
+	}
+	return wrote, nil
+}
+
+// rotatingFile is a file that WriteFileRotating appends to, keeping track of
+// its size and the day it was last written, so that it knows when to rotate.
+type rotatingFile struct {
+	path    string
+	maxSize int64
+	keep    int
+	file    *os.File
+	size    int64
+	day     string
+}
+
+// Close closes the current file.
+func (f *rotatingFile) Close() error {
+	return f.file.Close()
+}
+
+// Write writes a single line to the file, first rotating it if the line would
+// take it over the maximum size, or if the date has changed.
+func (f *rotatingFile) Write(line []byte) (int, error) {
+	today := time.Now().Format(time.DateOnly)
+	full := f.maxSize > 0 && f.size > 0 && f.size+int64(len(line)) > f.maxSize
+	if full || (f.size > 0 && f.day != today) {
+		if err := f.rotate(); err != nil {
+			return 0, err
+		}
+	}
+	n, err := f.file.Write(line)
+	f.size += int64(n)
+	f.day = today
+	return n, err
+}
+
+// open opens the file for appending, creating it if necessary, and records
+// its size and modification date.
+func (f *rotatingFile) open() error {
+	file, err := os.OpenFile(f.path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0666)
+	if err != nil {
+		return err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return err
+	}
+	f.file = file
+	f.size = info.Size()
+	f.day = info.ModTime().Format(time.DateOnly)
+	return nil
+}
+
+// rotate closes the file, shifts it and the old files along by one, removing
+// the oldest if there are more than f.keep, and opens a new, empty file.
+func (f *rotatingFile) rotate() error {
+	if err := f.file.Close(); err != nil {
+		return err
+	}
+	if f.keep <= 0 {
+		if err := os.Remove(f.path); err != nil {
+			return err
+		}
+		return f.open()
+	}
+	err := os.Remove(fmt.Sprintf("%s.%d", f.path, f.keep))
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return err
+	}
+	for i := f.keep - 1; i >= 0; i-- {
+		old := f.path
+		if i > 0 {
+			old = fmt.Sprintf("%s.%d", f.path, i)
+		}
+		err := os.Rename(old, fmt.Sprintf("%s.%d", f.path, i+1))
+		if err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return err
+		}
+	}
+	return f.open()
+}
+
+// splitFiles writes the contents of the pipe to a series of numbered files
+// starting with prefix, calling chunk to copy each file's share of the data,
+// and returns the names of the files written. Once chunk returns io.EOF, no
+// more files are created, and empty input produces no files at all. Reading
+// stops at the first EOF, because the pipe's reader is closed once it returns
+// EOF.
+func (p *Pipe) splitFiles(prefix string, chunk func(io.Writer, *bufio.Reader) error) ([]string, error) {
+	defer p.Close()
+	r := bufio.NewReader(p.Reader)
+	var names []string
+	for {
+		if _, err := r.Peek(1); err != nil {
+			if err != io.EOF {
+				p.SetError(err)
+			}
+			return names, p.Error()
+		}
+		name := fmt.Sprintf("%s%02d", prefix, len(names))
+		f, err := os.Create(name)
+		if err != nil {
+			p.SetError(err)
+			return names, err
+		}
+		names = append(names, name)
+		w := bufio.NewWriter(f)
+		err = chunk(w, r)
+		eof := err == io.EOF
+		if err == nil || eof {
+			err = w.Flush()
+		}
+		if cerr := f.Close(); err == nil {
+			err = cerr
+		}
+		if err != nil {
+			p.SetError(err)
+			return names, err
+		}
+		if eof {
+			return names, nil
+		}
+	}
+}
+
 func (p *Pipe) writeOrAppendFile(fileName string, mode int) (int64, error) {
 	if p == nil || p.Error() != nil {
 		return 0, p.Error()
 	}
+	// A file opened exclusively can't be one the pipe is reading, since it
+	// doesn't exist yet.
+	if mode&os.O_EXCL == 0 {
+		if err := p.checkNotSource(fileName); err != nil {
+			if mode&os.O_TRUNC != 0 {
+				return p.replaceFile(fileName)
+			}
+			p.SetError(err)
+			return 0, err
+		}
+	}
+	if err := p.makeParents(fileName); err != nil {
+		p.SetError(err)
+		return 0, err
+	}
 	out, err := os.OpenFile(fileName, mode, 0666)
 	if err != nil {
 		p.SetError(err)
@@ -134,3 +1609,72 @@ func (p *Pipe) writeOrAppendFile(fileName string, mode int) (int64, error) {
 	}
 	return wrote, nil
 }
+
+// splitLinesKeepEnds splits s into lines, each ending with its newline, except
+// perhaps the last.
+func splitLinesKeepEnds(s string) []string {
+	var lines []string
+	for s != "" {
+		i := strings.IndexByte(s, '\n') + 1
+		if i == 0 {
+			i = len(s)
+		}
+		lines = append(lines, s[:i])
+		s = s[i:]
+	}
+	return lines
+}
+
+// unifiedDiff returns the differences between the old and new lines of the
+// file at path, in unified diff format, with three lines of context.
+func unifiedDiff(path string, old, new []string) string {
+	const context = 3
+	ops := diffLines(old, new)
+	// Each hunk is a range of ops, containing changes and their context.
+	var hunks [][2]int
+	for i, op := range ops {
+		if op.kind == ' ' {
+			continue
+		}
+		lo, hi := max(i-context, 0), min(i+context+1, len(ops))
+		if n := len(hunks); n > 0 && lo <= hunks[n-1][1] {
+			hunks[n-1][1] = hi
+		} else {
+			hunks = append(hunks, [2]int{lo, hi})
+		}
+	}
+	out := &strings.Builder{}
+	fmt.Fprintf(out, "--- %s\n+++ %s\n", path, path)
+	oldLine, newLine, next := 0, 0, 0
+	for _, h := range hunks {
+		for ; next < h[0]; next++ {
+			oldLine++
+			newLine++
+		}
+		var oldCount, newCount int
+		for _, op := range ops[h[0]:h[1]] {
+			if op.kind != '+' {
+				oldCount++
+			}
+			if op.kind != '-' {
+				newCount++
+			}
+		}
+		fmt.Fprintf(out, "@@ -%s +%s @@\n", hunkRange(oldLine, oldCount), hunkRange(newLine, newCount))
+		for _, op := range ops[h[0]:h[1]] {
+			out.WriteByte(op.kind)
+			out.WriteString(op.line)
+			if !strings.HasSuffix(op.line, "\n") {
+				out.WriteString("\n\\ No newline at end of file\n")
+			}
+			if op.kind != '+' {
+				oldLine++
+			}
+			if op.kind != '-' {
+				newLine++
+			}
+		}
+		next = h[1]
+	}
+	return out.String()
+}
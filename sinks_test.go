@@ -1,16 +1,97 @@
 package script_test
 
 import (
+	"archive/zip"
+	"bufio"
 	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
 	"io/ioutil"
+	"math"
+	"net"
+	"net/http"
+	"net/http/httptest"
 	"os"
+	"path/filepath"
+	"strconv"
 	"strings"
+	"sync"
 	"testing"
+	"testing/iotest"
+	"time"
 
 	"github.com/bitfield/script"
 	"github.com/google/go-cmp/cmp"
+	"github.com/google/go-cmp/cmp/cmpopts"
 )
 
+func TestHandler(t *testing.T) {
+	t.Parallel()
+	h := script.Handler(func(r *http.Request) *script.Pipe {
+		return script.Echo("a\nb\nab\n").Match(r.FormValue("q"))
+	})
+	srv := httptest.NewServer(h)
+	defer srv.Close()
+	resp, err := http.Get(srv.URL + "?q=b")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	got, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := "b\nab\n"
+	if string(got) != want {
+		t.Errorf("want %q, got %q", want, got)
+	}
+}
+
+func TestServeHTTP(t *testing.T) {
+	t.Parallel()
+	w := httptest.NewRecorder()
+	script.Echo("hello\n").ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/", nil))
+	if w.Code != http.StatusOK {
+		t.Errorf("want status %d, got %d", http.StatusOK, w.Code)
+	}
+	wantType := "text/plain; charset=utf-8"
+	if got := w.Header().Get("Content-Type"); got != wantType {
+		t.Errorf("want Content-Type %q, got %q", wantType, got)
+	}
+	if got := w.Body.String(); got != "hello\n" {
+		t.Errorf("want %q, got %q", "hello\n", got)
+	}
+	if !w.Flushed {
+		t.Error("want response flushed, but it wasn't")
+	}
+}
+
+func TestServeHTTPErrorPipe(t *testing.T) {
+	t.Parallel()
+	w := httptest.NewRecorder()
+	p := script.Echo("secret output").WithError(errors.New("oh no"))
+	p.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/", nil))
+	if w.Code != http.StatusInternalServerError {
+		t.Errorf("want status %d, got %d", http.StatusInternalServerError, w.Code)
+	}
+	if got := w.Body.String(); got != "oh no\n" {
+		t.Errorf("want %q, got %q", "oh no\n", got)
+	}
+}
+
+func TestServeHTTPPreservesContentType(t *testing.T) {
+	t.Parallel()
+	w := httptest.NewRecorder()
+	w.Header().Set("Content-Type", "application/json")
+	script.Echo("{}").ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/", nil))
+	if got := w.Header().Get("Content-Type"); got != "application/json" {
+		t.Errorf("want Content-Type %q, got %q", "application/json", got)
+	}
+}
+
 func TestSinksOnNilPipes(t *testing.T) {
 	t.Parallel()
 	doSinksOnPipe(t, nil, "nil")
@@ -62,6 +143,22 @@ func doSinksOnPipe(t *testing.T, p *script.Pipe, kind string) {
 	}
 }
 
+func TestAppendBytesReusesSpareCapacity(t *testing.T) {
+	t.Parallel()
+	buf := make([]byte, 0, 64)
+	buf = append(buf, "prefix:"...)
+	got, err := script.Echo("hello").AppendBytes(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(got) != "prefix:hello" {
+		t.Errorf("want %q, got %q", "prefix:hello", got)
+	}
+	if &got[0] != &buf[0] {
+		t.Error("want existing buffer reused, got new allocation")
+	}
+}
+
 func TestAppendFile(t *testing.T) {
 	t.Parallel()
 	orig := "Hello, world"
@@ -86,6 +183,37 @@ func TestAppendFile(t *testing.T) {
 	}
 }
 
+func TestAppendTo(t *testing.T) {
+	t.Parallel()
+	b := &strings.Builder{}
+	b.WriteString("a\n")
+	n, err := script.Echo("b\n").AppendTo(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 2 {
+		t.Errorf("want 2 bytes appended, got %d", n)
+	}
+	if b.String() != "a\nb\n" {
+		t.Errorf("want %q, got %q", "a\nb\n", b.String())
+	}
+}
+
+func TestAppendToBuffer(t *testing.T) {
+	t.Parallel()
+	buf := bytes.NewBufferString("a\n")
+	n, err := script.Echo("b\n").AppendToBuffer(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 2 {
+		t.Errorf("want 2 bytes appended, got %d", n)
+	}
+	if buf.String() != "a\nb\n" {
+		t.Errorf("want %q, got %q", "a\nb\n", buf.String())
+	}
+}
+
 func TestBytes(t *testing.T) {
 	t.Parallel()
 	inFile := "testdata/bytes.bin"
@@ -102,6 +230,34 @@ func TestBytes(t *testing.T) {
 	}
 }
 
+func TestContainsMatch(t *testing.T) {
+	t.Parallel()
+	tcs := []struct {
+		s    string
+		want bool
+	}{
+		{"error", true},
+		{"bogus", false},
+		{"", true},
+	}
+	for _, tc := range tcs {
+		got, err := script.Echo("info: ok\nerror: failed\n").ContainsMatch(tc.s)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got != tc.want {
+			t.Errorf("%q: want %t, got %t", tc.s, tc.want, got)
+		}
+	}
+	got, err := script.Echo("").ContainsMatch("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got {
+		t.Error("want false for empty input, got true")
+	}
+}
+
 func TestCountLines(t *testing.T) {
 	t.Parallel()
 	want := 3
@@ -142,198 +298,1540 @@ func TestCountLines(t *testing.T) {
 	}
 }
 
-func TestSHA256Sum(t *testing.T) {
+func TestCountLinesCases(t *testing.T) {
 	t.Parallel()
-	testCases := []struct {
-		testFileName string
-		want         string
-	}{
-		{"testdata/empty.txt", "e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855"},
-		{"testdata/test.txt", "a562c9c95e2ff3403e7ffcd8508c6b54d47d5f251387758d3e63dbaaa8296341"},
-		{"testdata/bytes.bin", "b267dc7e66ee428bc8b51b1114bd0e05bde5c8c5d20ce828fbc95b83060c2f17"},
+	long := strings.Repeat("x", 1<<20)
+	tcs := map[string]int{
+		"":                            0,
+		"\n":                          1,
+		"a":                           1,
+		"a\nb":                        2,
+		"a\r\nb\r\n":                  2,
+		"\n\n\n":                      3,
+		long + "\n" + long:            2,
+		strings.Repeat("a\n", 300000): 300000,
 	}
-
-	for _, tc := range testCases {
-		p := script.File(tc.testFileName)
-		got, err := p.SHA256Sum()
+	for input, want := range tcs {
+		got, err := script.Echo(input).CountLines()
 		if err != nil {
-			t.Error(err)
+			t.Fatal(err)
 		}
-		if got != tc.want {
-			t.Errorf("want %q, got %q", tc.want, got)
+		if got != want {
+			t.Errorf("%.20q: want %d lines, got %d", input, want, got)
 		}
 	}
 }
 
-func TestSliceSink(t *testing.T) {
+func TestCountLinesReportsReadErrorsAndBinary(t *testing.T) {
 	t.Parallel()
-	tests := []struct {
-		name    string
-		fields  *script.Pipe
-		want    []string
-		wantErr bool
-	}{
-		{
-			name:   "Multiple lines pipe",
-			fields: script.Echo("testdata/multiple_files/1.txt\ntestdata/multiple_files/2.txt\ntestdata/multiple_files/3.tar.zip\n"),
-			want: []string{
-				"testdata/multiple_files/1.txt",
-				"testdata/multiple_files/2.txt",
-				"testdata/multiple_files/3.tar.zip",
-			},
-			wantErr: false,
-		},
-		{
-			name:    "Empty pipe",
-			fields:  script.Echo(""),
-			want:    []string{},
-			wantErr: false,
-		},
-		{
-			name:    "Single newline",
-			fields:  script.Echo("\n"),
-			want:    []string{""},
-			wantErr: false,
-		},
-		{
-			name:   "Empty line between two existing lines",
-			fields: script.Echo("testdata/multiple_files/1.txt\n\ntestdata/multiple_files/3.tar.zip"),
-			want: []string{
-				"testdata/multiple_files/1.txt",
-				"",
-				"testdata/multiple_files/3.tar.zip",
-			},
-			wantErr: false,
-		},
+	want := errors.New("oh no")
+	_, err := script.NewPipe().WithReader(io.MultiReader(strings.NewReader("a\n"), iotest.ErrReader(want))).CountLines()
+	if !errors.Is(err, want) {
+		t.Errorf("want %v, got %v", want, err)
 	}
-	for _, tt := range tests {
-		t.Run(tt.name, func(t *testing.T) {
-			p := tt.fields
-			got, err := p.Slice()
-			if (err != nil) != tt.wantErr {
-				t.Errorf("Slice() error = %v, wantErr %v", err, tt.wantErr)
-				return
-			}
-			if !cmp.Equal(tt.want, got) {
-				t.Error(cmp.Diff(tt.want, got))
-			}
-		})
+	_, err = script.Echo("a\n").Binary().CountLines()
+	if err == nil {
+		t.Error("want error counting lines of binary pipe, got nil")
 	}
 }
 
-func TestStdout(t *testing.T) {
+func TestDecodeJSON(t *testing.T) {
 	t.Parallel()
-	buf := &bytes.Buffer{}
-	want := "hello world"
-	p := script.File("testdata/hello.txt").WithStdout(buf)
-	wrote, err := p.Stdout()
-	if err != nil {
-		t.Error(err)
+	var got struct {
+		Name string   `json:"name"`
+		Tags []string `json:"tags"`
 	}
-	if wrote != len(want) {
-		t.Errorf("want %d bytes written, got %d", len(want), wrote)
+	err := script.Echo(`{"name":"script","tags":["go","shell"]}`).DecodeJSON(&got)
+	if err != nil {
+		t.Fatal(err)
 	}
-	got := buf.String()
-	if want != got {
-		t.Errorf("want %q, got %q", want, string(got))
+	if got.Name != "script" || !cmp.Equal(got.Tags, []string{"go", "shell"}) {
+		t.Errorf("unexpected result %+v", got)
 	}
-	_, err = p.String()
+	p := script.Echo(`{"name":`)
+	err = p.DecodeJSON(&got)
 	if err == nil {
-		t.Error("input not closed after reading")
+		t.Error("want error decoding invalid JSON, got nil")
+	}
+	if p.Error() != err {
+		t.Errorf("want pipe error status %v, got %v", err, p.Error())
 	}
 }
 
-func TestStdoutNoPanicOnNilOrZero(t *testing.T) {
+func TestDecodeYAML(t *testing.T) {
 	t.Parallel()
-	kind := "nil pipe"
-	defer func() {
-		if r := recover(); r != nil {
-			t.Fatalf("panic: Stdout on %s", kind)
-		}
-	}()
-	var p *script.Pipe
-	_, _ = p.Stdout()
-	kind = "zero pipe"
-	p = &script.Pipe{}
-	_, _ = p.Stdout()
-	kind = "zero pipe with non-empty reader"
-	p.Reader = script.NewReadAutoCloser(strings.NewReader("bogus"))
-	_, _ = p.Stdout()
+	var got struct {
+		Name     string `yaml:"name"`
+		Replicas int    `yaml:"replicas"`
+	}
+	err := script.Echo("name: web\nreplicas: 3\n").DecodeYAML(&got)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.Name != "web" || got.Replicas != 3 {
+		t.Errorf("unexpected result %+v", got)
+	}
+	p := script.Echo("replicas: three\n")
+	err = p.DecodeYAML(&got)
+	if err == nil {
+		t.Error("want error decoding invalid YAML, got nil")
+	}
+	if p.Error() != err {
+		t.Errorf("want pipe error status %v, got %v", err, p.Error())
+	}
 }
 
-func TestString(t *testing.T) {
+func TestDescribe(t *testing.T) {
 	t.Parallel()
-	wantRaw, err := ioutil.ReadFile("testdata/test.txt")
+	input := "a 2\nb 4\nc -\nd 4\ne\nf 4\ng 5\nh 5\ni 7\nj 9\n"
+	want := script.Stats{
+		Count:  8,
+		Min:    2,
+		Max:    9,
+		Mean:   5,
+		Median: 4.5,
+		P95:    8.3,
+		StdDev: math.Sqrt(32.0 / 7),
+	}
+	got, err := script.Echo(input).Describe(2)
 	if err != nil {
 		t.Fatal(err)
 	}
-	want := string(wantRaw)
-	p := script.File("testdata/test.txt")
-	got, err := p.String()
+	if !cmp.Equal(want, got, cmpopts.EquateApprox(0, 1e-9)) {
+		t.Error(cmp.Diff(want, got))
+	}
+}
+
+func TestDescribeEmpty(t *testing.T) {
+	t.Parallel()
+	got, err := script.Echo("no numbers here\n").Describe(1)
 	if err != nil {
-		t.Error(err)
+		t.Fatal(err)
 	}
-	if got != want {
+	if got != (script.Stats{}) {
+		t.Errorf("want zero stats, got %+v", got)
+	}
+}
+
+func TestStatsString(t *testing.T) {
+	t.Parallel()
+	s := script.Stats{Count: 3, Min: 1, Max: 3, Mean: 2, Median: 2, P95: 2.9, StdDev: 1}
+	want := "count  3\nmin    1\nmax    3\nmean   2\nmedian 2\np95    2.9\nstddev 1\n"
+	if got := s.String(); got != want {
 		t.Errorf("want %q, got %q", want, got)
 	}
-	_, err = p.String() // result should be empty
-	if p.Error() == nil {
-		t.Error("want error status after read from closed pipe, got nil")
+}
+
+func TestDiffFile(t *testing.T) {
+	t.Parallel()
+	path := filepath.Join(t.TempDir(), "config")
+	old := "a\nb\nc\nd\ne\nf\ng\nh\ni\nj\n"
+	if err := os.WriteFile(path, []byte(old), 0o644); err != nil {
+		t.Fatal(err)
 	}
-	if err != p.Error() {
-		t.Errorf("got error %v but pipe error status was %v", err, p.Error())
+	tcs := []struct {
+		name, input, want string
+	}{
+		{"Same", old, ""},
+		{"Changed", "a\nB\nc\nd\ne\nf\ng\nh\ni\nj\nk\n",
+			"--- " + path + "\n+++ " + path + "\n" +
+				"@@ -1,5 +1,5 @@\n a\n-b\n+B\n c\n d\n e\n" +
+				"@@ -8,3 +8,4 @@\n h\n i\n j\n+k\n"},
+		{"NoFinalNewline", "a\nb\nc\nd\ne\nf\ng\nh\ni\nj",
+			"--- " + path + "\n+++ " + path + "\n" +
+				"@@ -7,4 +7,4 @@\n g\n h\n i\n-j\n+j\n\\ No newline at end of file\n"},
 	}
-	_, err = p.String()
-	if err == nil {
-		t.Error("input not closed after reading")
+	for _, tc := range tcs {
+		got, err := script.Echo(tc.input).DiffFile(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if tc.want != got {
+			t.Errorf("%s: %s", tc.name, cmp.Diff(tc.want, got))
+		}
 	}
 }
 
-func TestWriteFileNew(t *testing.T) {
+func TestDiffFileHandlesLargeChanges(t *testing.T) {
 	t.Parallel()
-	want := "Hello, world"
-	path := t.TempDir() + "/" + t.Name()
-	wrote, err := script.Echo(want).WriteFile(path)
+	path := filepath.Join(t.TempDir(), "big")
+	var old, input strings.Builder
+	for i := range 5000 {
+		fmt.Fprintf(&old, "old %d\n", i)
+		fmt.Fprintf(&input, "new %d\n", i)
+	}
+	if err := os.WriteFile(path, []byte(old.String()), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	got, err := script.Echo(input.String()).DiffFile(path)
 	if err != nil {
-		t.Error(err)
+		t.Fatal(err)
 	}
-	if int(wrote) != len(want) {
-		t.Errorf("want %d bytes written, got %d", len(want), int(wrote))
+	wantHeader := "--- " + path + "\n+++ " + path + "\n@@ -1,5000 +1,5000 @@\n-old 0\n"
+	if !strings.HasPrefix(got, wantHeader) {
+		t.Errorf("want diff starting %q, got %q", wantHeader, got[:min(len(got), len(wantHeader))])
 	}
-	got, err := script.File(path).String()
+	if lines := strings.Count(got, "\n"); lines != 3+10000 {
+		t.Errorf("want every line replaced, got %d lines of diff", lines)
+	}
+}
+
+func TestDiffFileTreatsMissingFileAsEmpty(t *testing.T) {
+	t.Parallel()
+	path := filepath.Join(t.TempDir(), "doesntexist")
+	got, err := script.Echo("a\nb\n").DiffFile(path)
 	if err != nil {
-		t.Error(err)
+		t.Fatal(err)
 	}
-	if got != want {
-		t.Errorf("want %q, got %q", want, got)
+	want := "--- " + path + "\n+++ " + path + "\n@@ -0,0 +1,2 @@\n+a\n+b\n"
+	if want != got {
+		t.Error(cmp.Diff(want, got))
 	}
 }
 
-func TestWriteFileTruncatesExisting(t *testing.T) {
+func TestDiscard(t *testing.T) {
 	t.Parallel()
-	want := "Hello, world"
-	path := t.TempDir() + "/" + t.Name()
-	// write some data first so we can check for truncation
-	data := make([]byte, 15)
-	err := os.WriteFile(path, data, 0600)
+	path := filepath.Join(t.TempDir(), "out.txt")
+	err := script.Echo("hello\n").Exec("tee " + path).Discard()
 	if err != nil {
 		t.Fatal(err)
 	}
-	wrote, err := script.Echo(want).WriteFile(path)
+	got, err := os.ReadFile(path)
 	if err != nil {
-		t.Error(err)
+		t.Fatal(err)
 	}
-	if int(wrote) != len(want) {
-		t.Errorf("want %d bytes written, got %d", len(want), int(wrote))
+	if string(got) != "hello\n" {
+		t.Errorf("want side effect of command, got %q", got)
 	}
-	got, err := script.File(path).String()
+}
+
+func TestDiscardReturnsPipeError(t *testing.T) {
+	t.Parallel()
+	err := script.Exec("go").Discard()
+	if err == nil {
+		t.Fatal("want error from failed command, got nil")
+	}
+}
+
+func TestEachFile(t *testing.T) {
+	t.Parallel()
+	got := map[string]int{}
+	err := script.Echo("testdata/test.txt\ntestdata/hello.txt\n").EachFile(func(path string, p *script.Pipe) error {
+		n, err := p.CountLines()
+		got[path] = n
+		return err
+	})
 	if err != nil {
-		t.Error(err)
+		t.Fatal(err)
 	}
-	if got == want+"\x00\x00\x00" {
-		t.Fatalf("file not truncated on write")
+	want := map[string]int{"testdata/test.txt": 3, "testdata/hello.txt": 1}
+	if !cmp.Equal(want, got) {
+		t.Error(cmp.Diff(want, got))
 	}
-	if got != want {
-		t.Errorf("want %q, got %q", want, got)
+}
+
+func TestEachFileStopsAtFirstError(t *testing.T) {
+	t.Parallel()
+	var seen []string
+	p := script.Echo("testdata/hello.txt\ndoesntexist.txt\ntestdata/test.txt\n")
+	err := p.EachFile(func(path string, _ *script.Pipe) error {
+		seen = append(seen, path)
+		return nil
+	})
+	if err == nil {
+		t.Fatal("want error for nonexistent file, got nil")
+	}
+	if !strings.HasPrefix(err.Error(), "doesntexist.txt: ") {
+		t.Errorf("want error identifying path, got %q", err)
+	}
+	if !cmp.Equal([]string{"testdata/hello.txt"}, seen) {
+		t.Error(cmp.Diff([]string{"testdata/hello.txt"}, seen))
+	}
+	if p.Error() == nil {
+		t.Error("want pipe error status set, got nil")
+	}
+}
+
+func TestEqualsFile(t *testing.T) {
+	t.Parallel()
+	dir := t.TempDir()
+	path := filepath.Join(dir, "fixture")
+	if err := os.WriteFile(path, []byte("hello\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	for _, tc := range []struct {
+		input, path string
+		want        bool
+	}{
+		{"hello\n", path, true},
+		{"hello", path, false},
+		{"goodbye\n", path, false},
+		{"hello\n", filepath.Join(dir, "doesntexist"), false},
+	} {
+		got, err := script.Echo(tc.input).EqualsFile(tc.path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if tc.want != got {
+			t.Errorf("%q vs %s: want %t, got %t", tc.input, tc.path, tc.want, got)
+		}
+	}
+}
+
+func TestFirstMatch(t *testing.T) {
+	t.Parallel()
+	got, err := script.Echo("a\nfoo bar\nfoo baz\n").FirstMatch("foo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got != "foo bar" {
+		t.Errorf("want %q, got %q", "foo bar", got)
+	}
+	got, err = script.Echo("a\nb\n").FirstMatch("foo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got != "" {
+		t.Errorf("want empty string for no match, got %q", got)
+	}
+}
+
+func TestFirstMatchStopsReadingAtMatch(t *testing.T) {
+	t.Parallel()
+	pr, pw := io.Pipe()
+	writerDone := make(chan struct{})
+	go func() {
+		defer close(writerDone)
+		if _, err := pw.Write([]byte("skip\nneedle\n")); err != nil {
+			return
+		}
+		for {
+			if _, err := pw.Write([]byte("more\n")); err != nil {
+				return
+			}
+		}
+	}()
+	got, err := script.NewPipe().WithReader(pr).FirstMatch("needle")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got != "needle" {
+		t.Errorf("want %q, got %q", "needle", got)
+	}
+	select {
+	case <-writerDone:
+	case <-time.After(time.Second):
+		t.Error("want pipe closed after match, but writer is still blocked")
+	}
+}
+
+func TestFold(t *testing.T) {
+	t.Parallel()
+	want := map[string]int{"a": 2, "b": 1}
+	got, err := script.Fold(script.Echo("a\nb\na\n"), map[string]int{},
+		func(m map[string]int, line string) (map[string]int, error) {
+			m[line]++
+			return m, nil
+		})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !cmp.Equal(want, got) {
+		t.Error(cmp.Diff(want, got))
+	}
+}
+
+func TestFoldError(t *testing.T) {
+	t.Parallel()
+	p := script.Echo("1\n2\nbogus\n4\n")
+	sum, err := script.Fold(p, 0, func(total int, line string) (int, error) {
+		n, err := strconv.Atoi(line)
+		return total + n, err
+	})
+	if err == nil {
+		t.Fatal("want error from fold function, got nil")
+	}
+	if !strings.HasPrefix(err.Error(), "line 3: ") {
+		t.Errorf("want error identifying line 3, got %q", err)
+	}
+	if sum != 3 {
+		t.Errorf("want total accumulated before error (3), got %d", sum)
+	}
+	if p.Error() == nil {
+		t.Error("want pipe error status set, got nil")
+	}
+}
+
+func TestFoldEmptyPipe(t *testing.T) {
+	t.Parallel()
+	got, err := script.Fold(script.NewPipe(), 42, func(n int, line string) (int, error) {
+		return n + 1, nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got != 42 {
+		t.Errorf("want initial value 42, got %d", got)
+	}
+}
+
+func TestGroupBy(t *testing.T) {
+	t.Parallel()
+	want := map[string][]string{
+		"go":  {"main.go", "util.go"},
+		"md":  {"README.md"},
+		"txt": {"notes.txt"},
+	}
+	got, err := script.Echo("main.go\nREADME.md\nutil.go\nnotes.txt\n").GroupBy(func(line string) string {
+		return strings.TrimPrefix(filepath.Ext(line), ".")
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !cmp.Equal(want, got) {
+		t.Error(cmp.Diff(want, got))
+	}
+}
+
+func TestHistogram(t *testing.T) {
+	t.Parallel()
+	want := []int{2, 1, 0, 2}
+	got, err := script.Echo("0.5\n1\n\n1.5\n200\n1e6\n").Histogram([]float64{1, 10, 100})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !cmp.Equal(want, got) {
+		t.Error(cmp.Diff(want, got))
+	}
+}
+
+func TestHistogramErrors(t *testing.T) {
+	t.Parallel()
+	_, err := script.Echo("1\n").Histogram([]float64{10, 1})
+	if err == nil {
+		t.Error("want error for unsorted buckets, got nil")
+	}
+	p := script.Echo("1\ntwo\n")
+	_, err = p.Histogram([]float64{10})
+	if err == nil {
+		t.Error("want error for non-numeric line, got nil")
+	}
+	if p.Error() == nil {
+		t.Error("want pipe error status set, got nil")
+	}
+}
+
+func TestLines(t *testing.T) {
+	t.Parallel()
+	want := []int{1, 22, 333}
+	got, err := script.Lines(script.Echo("1\n22\n333\n"), strconv.Atoi)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !cmp.Equal(want, got) {
+		t.Error(cmp.Diff(want, got))
+	}
+}
+
+func TestLinesParseError(t *testing.T) {
+	t.Parallel()
+	p := script.Echo("1\ntwo\n3\n")
+	got, err := script.Lines(p, strconv.Atoi)
+	if err == nil {
+		t.Fatal("want error parsing invalid line, got nil")
+	}
+	if !strings.HasPrefix(err.Error(), "line 2: ") {
+		t.Errorf("want error identifying line 2, got %q", err)
+	}
+	if !errors.Is(err, strconv.ErrSyntax) {
+		t.Errorf("want error wrapping parse error, got %v", err)
+	}
+	if !cmp.Equal([]int{1}, got) {
+		t.Errorf("want values parsed before error, got %v", got)
+	}
+	if p.Error() == nil {
+		t.Error("want pipe error status set, got nil")
+	}
+}
+
+func TestPushgateway(t *testing.T) {
+	t.Parallel()
+	var gotMethod, gotPath, gotBody string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		gotMethod, gotPath = r.Method, r.URL.Path
+		body, _ := ioutil.ReadAll(r.Body)
+		gotBody = string(body)
+	}))
+	defer srv.Close()
+	metrics := "# TYPE backup_size_bytes gauge\nbackup_size_bytes 1024\n"
+	n, err := script.Echo(metrics).Pushgateway(srv.URL+"/", "nightly backup")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != int64(len(metrics)) {
+		t.Errorf("want %d bytes sent, got %d", len(metrics), n)
+	}
+	if gotMethod != http.MethodPut {
+		t.Errorf("want PUT, got %s", gotMethod)
+	}
+	if gotPath != "/metrics/job/nightly backup" {
+		t.Errorf("want job path, got %q", gotPath)
+	}
+	if gotBody != metrics {
+		t.Errorf("want %q, got %q", metrics, gotBody)
+	}
+}
+
+func TestPushgatewayRejected(t *testing.T) {
+	t.Parallel()
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "text format parsing error", http.StatusBadRequest)
+	}))
+	defer srv.Close()
+	p := script.Echo("bogus metrics\n")
+	_, err := p.Pushgateway(srv.URL, "job")
+	if err == nil {
+		t.Fatal("want error when gateway rejects metrics, got nil")
+	}
+	if !strings.Contains(err.Error(), "text format parsing error") {
+		t.Errorf("want gateway's message in error, got %q", err)
+	}
+	if p.Error() == nil {
+		t.Error("want pipe error status set, got nil")
+	}
+}
+
+func TestRewriteFiles(t *testing.T) {
+	t.Parallel()
+	dir := t.TempDir()
+	path := filepath.Join(dir, "a.txt")
+	if err := os.WriteFile(path, []byte("hello world\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	err := script.Echo(path).RewriteFiles(func(p *script.Pipe) *script.Pipe {
+		return p.Replace("world", "there")
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(got) != "hello there\n" {
+		t.Errorf("want %q, got %q", "hello there\n", got)
+	}
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Mode().Perm() != 0o600 {
+		t.Errorf("want permissions preserved (0600), got %o", info.Mode().Perm())
+	}
+	if _, err := os.Stat(path + ".bak"); !os.IsNotExist(err) {
+		t.Errorf("want no backup file, got %v", err)
+	}
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 1 {
+		t.Errorf("want temporary file removed, got %d files", len(entries))
+	}
+}
+
+func TestRewriteFilesLeavesFileUnchangedOnError(t *testing.T) {
+	t.Parallel()
+	path := filepath.Join(t.TempDir(), "a.txt")
+	if err := os.WriteFile(path, []byte("original\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	p := script.Echo(path)
+	err := p.RewriteFiles(func(p *script.Pipe) *script.Pipe {
+		p.SetError(errors.New("oh no"))
+		return p
+	})
+	if err == nil {
+		t.Fatal("want error from transform, got nil")
+	}
+	got, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(got) != "original\n" {
+		t.Errorf("want file unchanged, got %q", got)
+	}
+	if p.Error() == nil {
+		t.Error("want pipe error status set, got nil")
+	}
+}
+
+func TestRewriteFilesPreservesSetuidBit(t *testing.T) {
+	t.Parallel()
+	path := filepath.Join(t.TempDir(), "tool")
+	if err := os.WriteFile(path, []byte("#!/bin/sh\necho old\n"), 0o700); err != nil {
+		t.Fatal(err)
+	}
+	want := 0o755 | os.ModeSetuid
+	if err := os.Chmod(path, want); err != nil {
+		t.Fatal(err)
+	}
+	for name, rewrite := range map[string]func() error{
+		"RewriteFiles": func() error {
+			return script.Echo(path).RewriteFiles(func(p *script.Pipe) *script.Pipe {
+				return p.Replace("old", "new")
+			})
+		},
+		"WriteFile": func() error {
+			_, err := script.File(path).Replace("new", "newer").WriteFile(path)
+			return err
+		},
+	} {
+		if err := rewrite(); err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		info, err := os.Stat(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := info.Mode() & (os.ModePerm | os.ModeSetuid); got != want {
+			t.Errorf("%s: want mode %v, got %v", name, want, got)
+		}
+	}
+}
+
+func TestRewriteFilesWithBackup(t *testing.T) {
+	t.Parallel()
+	path := filepath.Join(t.TempDir(), "a.txt")
+	if err := os.WriteFile(path, []byte("hello world\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	err := script.Echo(path).RewriteFilesWithBackup(func(p *script.Pipe) *script.Pipe {
+		return p.Replace("world", "there")
+	}, ".bak")
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(got) != "hello there\n" {
+		t.Errorf("want %q, got %q", "hello there\n", got)
+	}
+	backup, err := os.ReadFile(path + ".bak")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(backup) != "hello world\n" {
+		t.Errorf("want original contents in backup, got %q", backup)
+	}
+}
+
+func TestSHA256Sum(t *testing.T) {
+	t.Parallel()
+	testCases := []struct {
+		testFileName string
+		want         string
+	}{
+		{"testdata/empty.txt", "e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855"},
+		{"testdata/test.txt", "a562c9c95e2ff3403e7ffcd8508c6b54d47d5f251387758d3e63dbaaa8296341"},
+		{"testdata/bytes.bin", "b267dc7e66ee428bc8b51b1114bd0e05bde5c8c5d20ce828fbc95b83060c2f17"},
+	}
+
+	for _, tc := range testCases {
+		p := script.File(tc.testFileName)
+		got, err := p.SHA256Sum()
+		if err != nil {
+			t.Error(err)
+		}
+		if got != tc.want {
+			t.Errorf("want %q, got %q", tc.want, got)
+		}
+	}
+}
+
+func TestSendTCP(t *testing.T) {
+	t.Parallel()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	received := make(chan string)
+	go func() {
+		conn, err := l.Accept()
+		if err != nil {
+			close(received)
+			return
+		}
+		defer conn.Close()
+		data, _ := ioutil.ReadAll(conn)
+		received <- string(data)
+	}()
+	want := "metric.one 1 1600000000\nmetric.two 2 1600000000\n"
+	wrote, err := script.Echo(want).Send("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if int(wrote) != len(want) {
+		t.Errorf("want %d bytes written, got %d", len(want), wrote)
+	}
+	got := <-received
+	if got != want {
+		t.Errorf("want %q, got %q", want, got)
+	}
+}
+
+func TestSendUDPSendsOneDatagramPerLine(t *testing.T) {
+	t.Parallel()
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	_, err = script.Echo("a:1|c\nb:2|c\n").Send("udp", conn.LocalAddr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{"a:1|c\n", "b:2|c\n"}
+	buf := make([]byte, 1024)
+	for _, w := range want {
+		n, _, err := conn.ReadFrom(buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(buf[:n]) != w {
+			t.Errorf("want datagram %q, got %q", w, buf[:n])
+		}
+	}
+}
+
+func TestSendInvalidAddress(t *testing.T) {
+	t.Parallel()
+	p := script.Echo("hello")
+	_, err := p.Send("tcp", "bogus address")
+	if err == nil {
+		t.Error("want error sending to invalid address, got nil")
+	}
+	if p.Error() == nil {
+		t.Error("want pipe error status set, got nil")
+	}
+}
+
+func TestSliceSink(t *testing.T) {
+	t.Parallel()
+	tests := []struct {
+		name    string
+		fields  *script.Pipe
+		want    []string
+		wantErr bool
+	}{
+		{
+			name:   "Multiple lines pipe",
+			fields: script.Echo("testdata/multiple_files/1.txt\ntestdata/multiple_files/2.txt\ntestdata/multiple_files/3.tar.zip\n"),
+			want: []string{
+				"testdata/multiple_files/1.txt",
+				"testdata/multiple_files/2.txt",
+				"testdata/multiple_files/3.tar.zip",
+			},
+			wantErr: false,
+		},
+		{
+			name:    "Empty pipe",
+			fields:  script.Echo(""),
+			want:    []string{},
+			wantErr: false,
+		},
+		{
+			name:    "Single newline",
+			fields:  script.Echo("\n"),
+			want:    []string{""},
+			wantErr: false,
+		},
+		{
+			name:   "Empty line between two existing lines",
+			fields: script.Echo("testdata/multiple_files/1.txt\n\ntestdata/multiple_files/3.tar.zip"),
+			want: []string{
+				"testdata/multiple_files/1.txt",
+				"",
+				"testdata/multiple_files/3.tar.zip",
+			},
+			wantErr: false,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p := tt.fields
+			got, err := p.Slice()
+			if (err != nil) != tt.wantErr {
+				t.Errorf("Slice() error = %v, wantErr %v", err, tt.wantErr)
+				return
+			}
+			if !cmp.Equal(tt.want, got) {
+				t.Error(cmp.Diff(tt.want, got))
+			}
+		})
+	}
+}
+
+func TestSliceContext(t *testing.T) {
+	t.Parallel()
+	got, err := script.Echo("a\nb\n").SliceContext(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{"a", "b"}
+	if !cmp.Equal(want, got) {
+		t.Error(cmp.Diff(want, got))
+	}
+}
+
+func TestSliceContextReturnsPartialResultsAtDeadline(t *testing.T) {
+	t.Parallel()
+	pr, pw := io.Pipe()
+	defer pw.Close()
+	go pw.Write([]byte("a\nb\npartial"))
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	p := script.NewPipe().WithReader(pr)
+	got, err := p.SliceContext(ctx)
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("want DeadlineExceeded, got %v", err)
+	}
+	want := []string{"a", "b", "partial"}
+	if !cmp.Equal(want, got) {
+		t.Error(cmp.Diff(want, got))
+	}
+	if !errors.Is(p.Error(), context.DeadlineExceeded) {
+		t.Errorf("want pipe error status DeadlineExceeded, got %v", p.Error())
+	}
+}
+
+func TestSplitFiles(t *testing.T) {
+	t.Parallel()
+	prefix := t.TempDir() + "/chunk-"
+	got, err := script.Echo("a\nb\nc\nd\ne").SplitFiles(prefix, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{prefix + "00", prefix + "01", prefix + "02"}
+	if !cmp.Equal(want, got) {
+		t.Fatal(cmp.Diff(want, got))
+	}
+	for i, wantContents := range []string{"a\nb\n", "c\nd\n", "e"} {
+		contents, err := os.ReadFile(got[i])
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(contents) != wantContents {
+			t.Errorf("%s: want %q, got %q", got[i], wantContents, contents)
+		}
+	}
+}
+
+func TestSplitFilesBySize(t *testing.T) {
+	t.Parallel()
+	want, err := os.ReadFile("testdata/bytes.bin")
+	if err != nil {
+		t.Fatal(err)
+	}
+	files, err := script.File("testdata/bytes.bin").SplitFilesBySize(t.TempDir()+"/part", 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(files) != (len(want)+2)/3 {
+		t.Errorf("want %d files, got %d", (len(want)+2)/3, len(files))
+	}
+	got, err := script.Slice(files).Concat().Bytes()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(want, got) {
+		t.Errorf("want %q, got %q", want, got)
+	}
+}
+
+func TestSplitFilesEmptyInputWritesNoFiles(t *testing.T) {
+	t.Parallel()
+	dir := t.TempDir()
+	files, err := script.Echo("").SplitFiles(dir+"/chunk", 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(files) != 0 {
+		t.Errorf("want no files, got %q", files)
+	}
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 0 {
+		t.Errorf("want empty directory, got %d entries", len(entries))
+	}
+}
+
+func TestSplitFilesInvalidSize(t *testing.T) {
+	t.Parallel()
+	_, err := script.Echo("a\n").SplitFiles(t.TempDir()+"/chunk", 0)
+	if err == nil {
+		t.Error("want error for zero lines per file, got nil")
+	}
+	_, err = script.Echo("a\n").SplitFilesBySize(t.TempDir()+"/chunk", -1)
+	if err == nil {
+		t.Error("want error for negative bytes per file, got nil")
+	}
+}
+
+func TestStdout(t *testing.T) {
+	t.Parallel()
+	buf := &bytes.Buffer{}
+	want := "hello world"
+	p := script.File("testdata/hello.txt").WithStdout(buf)
+	wrote, err := p.Stdout()
+	if err != nil {
+		t.Error(err)
+	}
+	if wrote != len(want) {
+		t.Errorf("want %d bytes written, got %d", len(want), wrote)
+	}
+	got := buf.String()
+	if want != got {
+		t.Errorf("want %q, got %q", want, string(got))
+	}
+	_, err = p.String()
+	if err == nil {
+		t.Error("input not closed after reading")
+	}
+}
+
+// syncBuffer is a bytes.Buffer that's safe for concurrent use.
+type syncBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *syncBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *syncBuffer) String() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.String()
+}
+
+// waitForOutput waits for up to five seconds for b to contain want.
+func waitForOutput(t *testing.T, b *syncBuffer, want string) {
+	t.Helper()
+	for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); {
+		if b.String() == want {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatalf("want output %q, got %q", want, b.String())
+}
+
+func TestStdoutFlushesLinesInStreamingMode(t *testing.T) {
+	t.Parallel()
+	r, w := io.Pipe()
+	out := &syncBuffer{}
+	bw := bufio.NewWriter(out)
+	done := make(chan error)
+	go func() {
+		_, err := script.NewPipe().Stream().WithReader(r).WithStdout(bw).Stdout()
+		done <- err
+	}()
+	w.Write([]byte("hello\n"))
+	waitForOutput(t, out, "hello\n")
+	w.Close()
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestStdoutFlushesPartialLinesWithFlushInterval(t *testing.T) {
+	t.Parallel()
+	r, w := io.Pipe()
+	out := &syncBuffer{}
+	bw := bufio.NewWriter(out)
+	done := make(chan error)
+	go func() {
+		_, err := script.NewPipe().WithFlushInterval(10 * time.Millisecond).WithReader(r).WithStdout(bw).Stdout()
+		done <- err
+	}()
+	w.Write([]byte("50%..."))
+	waitForOutput(t, out, "50%...")
+	w.Write([]byte("100%\n"))
+	w.Close()
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+	if out.String() != "50%...100%\n" {
+		t.Errorf("want %q, got %q", "50%...100%\n", out.String())
+	}
+}
+
+func TestStdoutNoPanicOnNilOrZero(t *testing.T) {
+	t.Parallel()
+	kind := "nil pipe"
+	defer func() {
+		if r := recover(); r != nil {
+			t.Fatalf("panic: Stdout on %s", kind)
+		}
+	}()
+	var p *script.Pipe
+	_, _ = p.Stdout()
+	kind = "zero pipe"
+	p = &script.Pipe{}
+	_, _ = p.Stdout()
+	kind = "zero pipe with non-empty reader"
+	p.Reader = script.NewReadAutoCloser(strings.NewReader("bogus"))
+	_, _ = p.Stdout()
+}
+
+func TestString(t *testing.T) {
+	t.Parallel()
+	wantRaw, err := ioutil.ReadFile("testdata/test.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := string(wantRaw)
+	p := script.File("testdata/test.txt")
+	got, err := p.String()
+	if err != nil {
+		t.Error(err)
+	}
+	if got != want {
+		t.Errorf("want %q, got %q", want, got)
+	}
+	_, err = p.String() // result should be empty
+	if p.Error() == nil {
+		t.Error("want error status after read from closed pipe, got nil")
+	}
+	if err != p.Error() {
+		t.Errorf("got error %v but pipe error status was %v", err, p.Error())
+	}
+	_, err = p.String()
+	if err == nil {
+		t.Error("input not closed after reading")
+	}
+}
+
+func TestStringContext(t *testing.T) {
+	t.Parallel()
+	got, err := script.Echo("hello\n").StringContext(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got != "hello\n" {
+		t.Errorf("want %q, got %q", "hello\n", got)
+	}
+}
+
+func TestStringContextReturnsPartialResultsWhenCancelled(t *testing.T) {
+	t.Parallel()
+	pr, pw := io.Pipe()
+	defer pw.Close()
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() {
+		pw.Write([]byte("hello, "))
+		time.Sleep(10 * time.Millisecond)
+		cancel()
+	}()
+	got, err := script.NewPipe().WithReader(pr).StringContext(ctx)
+	if !errors.Is(err, context.Canceled) {
+		t.Errorf("want Canceled, got %v", err)
+	}
+	if got != "hello, " {
+		t.Errorf("want %q, got %q", "hello, ", got)
+	}
+}
+
+func TestWriteFileNew(t *testing.T) {
+	t.Parallel()
+	want := "Hello, world"
+	path := t.TempDir() + "/" + t.Name()
+	wrote, err := script.Echo(want).WriteFile(path)
+	if err != nil {
+		t.Error(err)
+	}
+	if int(wrote) != len(want) {
+		t.Errorf("want %d bytes written, got %d", len(want), int(wrote))
+	}
+	got, err := script.File(path).String()
+	if err != nil {
+		t.Error(err)
+	}
+	if got != want {
+		t.Errorf("want %q, got %q", want, got)
+	}
+}
+
+func TestWriteFileTruncatesExisting(t *testing.T) {
+	t.Parallel()
+	want := "Hello, world"
+	path := t.TempDir() + "/" + t.Name()
+	// write some data first so we can check for truncation
+	data := make([]byte, 15)
+	err := os.WriteFile(path, data, 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	wrote, err := script.Echo(want).WriteFile(path)
+	if err != nil {
+		t.Error(err)
+	}
+	if int(wrote) != len(want) {
+		t.Errorf("want %d bytes written, got %d", len(want), int(wrote))
+	}
+	got, err := script.File(path).String()
+	if err != nil {
+		t.Error(err)
+	}
+	if got == want+"\x00\x00\x00" {
+		t.Fatalf("file not truncated on write")
+	}
+	if got != want {
+		t.Errorf("want %q, got %q", want, got)
+	}
+}
+
+func TestAppendFileRefusesToWriteFileStillBeingRead(t *testing.T) {
+	t.Parallel()
+	path := filepath.Join(t.TempDir(), "input.txt")
+	want := "a\nb\nc\n"
+	for name, write := range map[string]func() (int64, error){
+		"AppendFile": func() (int64, error) {
+			return script.File(path).AppendFile(path)
+		},
+		"StreamingExec": func() (int64, error) {
+			return script.File(path).Stream().Exec("cat").AppendFile(path)
+		},
+		"Concat": func() (int64, error) {
+			return script.Echo(path + "\n").Concat().AppendFile(path)
+		},
+		"WriteFileRotating": func() (int64, error) {
+			return script.File(path).WriteFileRotating(path, 0, 1)
+		},
+		"Stdout": func() (int64, error) {
+			f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0o644)
+			if err != nil {
+				return 0, err
+			}
+			defer f.Close()
+			n, err := script.File(path).WithStdout(f).Stdout()
+			return int64(n), err
+		},
+	} {
+		if err := os.WriteFile(path, []byte(want), 0o644); err != nil {
+			t.Fatal(err)
+		}
+		_, err := write()
+		if !errors.Is(err, script.ErrSameFile) {
+			t.Errorf("%s: want ErrSameFile, got %v", name, err)
+		}
+		got, err := os.ReadFile(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(got) != want {
+			t.Errorf("%s: want file unchanged, got %q", name, got)
+		}
+	}
+}
+
+func TestWriteFileReplacesFileStillBeingRead(t *testing.T) {
+	t.Parallel()
+	dir := t.TempDir()
+	path := filepath.Join(dir, "input.txt")
+	for name, write := range map[string]func() (int64, error){
+		"WriteFile": func() (int64, error) {
+			return script.File(path).Reject("b").WriteFile(path)
+		},
+		"StreamingExec": func() (int64, error) {
+			return script.File(path).Stream().Exec("grep -v b").WriteFile(path)
+		},
+		"Concat": func() (int64, error) {
+			return script.Echo(path + "\n").Concat().Reject("b").WriteFile(path)
+		},
+	} {
+		if err := os.WriteFile(path, []byte("a\nb\nc\n"), 0o600); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.Chmod(path, 0o751); err != nil {
+			t.Fatal(err)
+		}
+		wrote, err := write()
+		if err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		if wrote != 4 {
+			t.Errorf("%s: want 4 bytes written, got %d", name, wrote)
+		}
+		got, err := os.ReadFile(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(got) != "a\nc\n" {
+			t.Errorf("%s: want %q, got %q", name, "a\nc\n", got)
+		}
+		info, err := os.Stat(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if info.Mode().Perm() != 0o751 {
+			t.Errorf("%s: want permissions preserved as %v, got %v", name, os.FileMode(0o751), info.Mode().Perm())
+		}
+	}
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 1 {
+		t.Errorf("want temporary files removed, but directory contains %d entries", len(entries))
+	}
+}
+
+func TestWriteFileReplacesTargetOfSymlinkStillBeingRead(t *testing.T) {
+	t.Parallel()
+	dir := t.TempDir()
+	target := filepath.Join(dir, "target.txt")
+	link := filepath.Join(dir, "link.txt")
+	if err := os.WriteFile(target, []byte("a\nb\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink(target, link); err != nil {
+		t.Skip(err)
+	}
+	if _, err := script.File(link).Match("a").WriteFile(link); err != nil {
+		t.Fatal(err)
+	}
+	info, err := os.Lstat(link)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Mode()&os.ModeSymlink == 0 {
+		t.Error("want symlink kept, but it was replaced")
+	}
+	got, err := os.ReadFile(target)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(got) != "a\n" {
+		t.Errorf("want %q, got %q", "a\n", got)
+	}
+}
+
+func TestWriteFileAllowsWritingFileAlreadyRead(t *testing.T) {
+	t.Parallel()
+	path := filepath.Join(t.TempDir(), "input.txt")
+	if err := os.WriteFile(path, []byte("a\nb\nc\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := script.File(path).Match("b").WriteFile(path); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := script.File(path).Exec("cat").AppendFile(path); err != nil {
+		t.Fatal(err)
+	}
+	// A separate pipe reading the file doesn't stop it being written.
+	unread := script.File(path)
+	defer unread.Close()
+	if _, err := script.Echo("c\n").AppendFile(path); err != nil {
+		t.Fatal(err)
+	}
+	got, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(got) != "b\nb\nc\n" {
+		t.Errorf("want %q, got %q", "b\nb\nc\n", got)
+	}
+}
+
+func TestWriteFileExclusiveCreatesNewFile(t *testing.T) {
+	t.Parallel()
+	path := filepath.Join(t.TempDir(), "lock")
+	wrote, err := script.Echo("1234\n").WriteFileExclusive(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if wrote != 5 {
+		t.Errorf("want 5 bytes written, got %d", wrote)
+	}
+	got, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(got) != "1234\n" {
+		t.Errorf("want %q, got %q", "1234\n", got)
+	}
+}
+
+func TestWriteFileExclusiveFailsIfFileExists(t *testing.T) {
+	t.Parallel()
+	path := filepath.Join(t.TempDir(), "lock")
+	if err := os.WriteFile(path, []byte("original\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	p := script.Echo("new\n")
+	_, err := p.WriteFileExclusive(path)
+	if !errors.Is(err, fs.ErrExist) {
+		t.Errorf("want fs.ErrExist, got %v", err)
+	}
+	if p.Error() == nil {
+		t.Error("want pipe error status set, got nil")
+	}
+	got, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(got) != "original\n" {
+		t.Errorf("want file unchanged, got %q", got)
+	}
+	// Even when the pipe is reading the file, it's the existing file, not
+	// the pipe, that stops it being written.
+	_, err = script.File(path).WriteFileExclusive(path)
+	if !errors.Is(err, fs.ErrExist) {
+		t.Errorf("want fs.ErrExist writing file being read, got %v", err)
+	}
+}
+
+func TestWithCreateParentsCreatesMissingDirectories(t *testing.T) {
+	t.Parallel()
+	dir := t.TempDir()
+	for name, write := range map[string]func(path string) (int64, error){
+		"WriteFile": func(path string) (int64, error) {
+			return script.Echo("a\nb\n").WithCreateParents().Match("a").WriteFile(path)
+		},
+		"AppendFile": func(path string) (int64, error) {
+			return script.Echo("a\n").WithCreateParents().Exec("cat").AppendFile(path)
+		},
+		"WriteFileExclusive": func(path string) (int64, error) {
+			return script.Echo("a\n").WithCreateParents().WriteFileExclusive(path)
+		},
+		"WriteFileRotating": func(path string) (int64, error) {
+			return script.Echo("a\n").WithCreateParents().WriteFileRotating(path, 0, 1)
+		},
+	} {
+		path := filepath.Join(dir, name, "sub", "file.txt")
+		if _, err := write(path); err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		got, err := os.ReadFile(path)
+		if err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		if string(got) != "a\n" {
+			t.Errorf("%s: want %q, got %q", name, "a\n", got)
+		}
+	}
+}
+
+func TestWriteFileDoesntCreateMissingDirectoriesByDefault(t *testing.T) {
+	t.Parallel()
+	path := filepath.Join(t.TempDir(), "missing", "file.txt")
+	_, err := script.Echo("a\n").WriteFile(path)
+	if !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("want fs.ErrNotExist, got %v", err)
+	}
+}
+
+func TestWriteFileRotating(t *testing.T) {
+	t.Parallel()
+	path := t.TempDir() + "/app.log"
+	wrote, err := script.Echo("one\ntwo\nthree\nfour\nfive\n").WriteFileRotating(path, 8, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if wrote != 24 {
+		t.Errorf("want 24 bytes written, got %d", wrote)
+	}
+	want := map[string]string{
+		path:        "five\n",
+		path + ".1": "four\n",
+		path + ".2": "three\n",
+	}
+	for name, wantContents := range want {
+		got, err := os.ReadFile(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(got) != wantContents {
+			t.Errorf("%s: want %q, got %q", name, wantContents, got)
+		}
+	}
+	if _, err := os.Stat(path + ".3"); err == nil {
+		t.Error("want no more than 2 old files kept")
+	}
+}
+
+func TestWriteFileRotatingAppendsWithinSize(t *testing.T) {
+	t.Parallel()
+	path := t.TempDir() + "/app.log"
+	for _, line := range []string{"a\n", "b\n"} {
+		_, err := script.Echo(line).WriteFileRotating(path, 100, 1)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	got, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(got) != "a\nb\n" {
+		t.Errorf("want %q, got %q", "a\nb\n", got)
+	}
+}
+
+func TestWriteFileRotatingRotatesDaily(t *testing.T) {
+	t.Parallel()
+	path := t.TempDir() + "/app.log"
+	err := os.WriteFile(path, []byte("yesterday\n"), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	yesterday := time.Now().Add(-24 * time.Hour)
+	err = os.Chtimes(path, yesterday, yesterday)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = script.Echo("today\n").WriteFileRotating(path, 0, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(got) != "today\n" {
+		t.Errorf("want %q, got %q", "today\n", got)
+	}
+	got, err = os.ReadFile(path + ".1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(got) != "yesterday\n" {
+		t.Errorf("want %q in rotated file, got %q", "yesterday\n", got)
+	}
+}
+
+func TestWriteTempFile(t *testing.T) {
+	t.Parallel()
+	want := "hello\nworld\n"
+	path, err := script.Echo(want).WriteTempFile("script-test-*.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(path)
+	name := filepath.Base(path)
+	if !strings.HasPrefix(name, "script-test-") || !strings.HasSuffix(name, ".txt") {
+		t.Errorf("want name matching pattern, got %q", name)
+	}
+	got, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(got) != want {
+		t.Errorf("want %q, got %q", want, got)
+	}
+}
+
+func TestWriteTempFileError(t *testing.T) {
+	t.Parallel()
+	_, err := script.Echo("data").WriteTempFile("bogus/*")
+	if err == nil {
+		t.Error("want error for pattern containing a path separator, got nil")
+	}
+}
+
+func TestZip(t *testing.T) {
+	t.Parallel()
+	archive := filepath.Join(t.TempDir(), "test.zip")
+	n, err := script.Echo("testdata/hello.txt\ntestdata/multiple_files\n").Zip(archive)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 4 {
+		t.Errorf("want 4 files added, got %d", n)
+	}
+	want := "testdata/hello.txt\ntestdata/multiple_files/1.txt\ntestdata/multiple_files/2.txt\ntestdata/multiple_files/3.tar.zip\n"
+	got, err := script.ZipEntries(archive).String()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got != want {
+		t.Errorf("want entries %q, got %q", want, got)
+	}
+}
+
+func TestZipStoresSymlinksAsLinks(t *testing.T) {
+	t.Parallel()
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, "target.txt"), []byte("contents"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	link := filepath.Join(dir, "link")
+	if err := os.Symlink("target.txt", link); err != nil {
+		t.Skip(err)
+	}
+	archive := filepath.Join(t.TempDir(), "test.zip")
+	if _, err := script.Echo(link).Zip(archive); err != nil {
+		t.Fatal(err)
+	}
+	r, err := zip.OpenReader(archive)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	if len(r.File) != 1 {
+		t.Fatalf("want 1 entry, got %d", len(r.File))
+	}
+	if r.File[0].Mode()&fs.ModeSymlink == 0 {
+		t.Errorf("want symlink entry, got mode %v", r.File[0].Mode())
+	}
+	f, err := r.File[0].Open()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	data, err := io.ReadAll(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(data) != "target.txt" {
+		t.Errorf("want link target stored, got %q", data)
+	}
+}
+
+func TestZipRejectsPathsContainingParentDirectory(t *testing.T) {
+	t.Parallel()
+	dir := t.TempDir()
+	if err := os.Mkdir(filepath.Join(dir, "sub"), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, "a.txt"), []byte("a"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	path := dir + "/sub/../a.txt"
+	_, err := script.Echo(path).Zip(filepath.Join(t.TempDir(), "test.zip"))
+	if err == nil || !strings.Contains(err.Error(), "..") {
+		t.Errorf("want error for path containing '..', got %v", err)
+	}
+}
+
+func TestZipNonexistentFile(t *testing.T) {
+	t.Parallel()
+	p := script.Echo("testdata/doesntexist.txt\n")
+	_, err := p.Zip(filepath.Join(t.TempDir(), "test.zip"))
+	if err == nil {
+		t.Error("want error zipping nonexistent file, got nil")
+	}
+	if p.Error() == nil {
+		t.Error("want pipe error status set, got nil")
 	}
 }
@@ -1,10 +1,25 @@
 package script
 
 import (
+	"archive/zip"
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
 	"io/ioutil"
+	"net"
 	"os"
 	"path/filepath"
+	"regexp"
+	"runtime"
+	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
+
+	"github.com/gorilla/websocket"
 )
 
 // Args creates a pipe containing the program's command-line arguments, one per
@@ -14,12 +29,81 @@ func Args() *Pipe {
 	for _, a := range os.Args[1:] {
 		s.WriteString(a + "\n")
 	}
-	return Echo(s.String())
+	return newSource("Args").withReader(strings.NewReader(s.String()))
+}
+
+// Dial connects to the address addr on the named network, using the same
+// network names and address formats as net.Dial (for example, "tcp" and
+// "localhost:8080"), and returns a pipe that reads whatever data the remote end
+// sends, until it closes the connection. The connection is closed once the
+// pipe has been fully read. If the connection fails, the pipe's error status
+// will be set.
+func Dial(network, addr string) *Pipe {
+	conn, err := net.Dial(network, addr)
+	if err != nil {
+		return newSource("Dial").WithError(err)
+	}
+	return newSource("Dial").withReader(conn)
+}
+
+// DU returns a pipe containing the total size in bytes of each directory under
+// the specified path, including the path itself, like Unix `du`. Each line
+// contains the size, a space, and the directory path. Subdirectories are
+// listed before their parents, so the last line is always the total for the
+// whole path. Sizes are the sum of the apparent sizes of all the files in the
+// directory tree (like `du -b`), and symbolic links are not followed. The
+// output can be changed with options such as DUMaxDepth and DUHumanReadable.
+// If the path doesn't exist or can't be read, the pipe's error status will be
+// set. Any subdirectories that can't be read, such as those without
+// permission, are left out of the totals, and DU carries on with the rest, but
+// sets the pipe's error status to report them.
+func DU(path string, opts ...DUOption) *Pipe {
+	cfg := duConfig{maxDepth: -1}
+	for _, opt := range opts {
+		opt(&cfg)
+	}
+	output := strings.Builder{}
+	var errs []error
+	_, err := du(path, 0, cfg, &output, &errs)
+	if err != nil {
+		return newSource("DU").WithError(err)
+	}
+	return newSource("DU").withReader(strings.NewReader(output.String())).WithError(errors.Join(errs...))
+}
+
+// DUOption is an option that changes the behaviour of DU.
+type DUOption func(*duConfig)
+
+// DUHumanReadable makes DU print sizes in a human-readable form, using
+// suffixes such as K and M for powers of 1024, like `du -h`. Such sizes can't
+// be sorted numerically, so it's usually best to use this option only when
+// the output is for people to read.
+func DUHumanReadable() DUOption {
+	return func(cfg *duConfig) {
+		cfg.humanReadable = true
+	}
+}
+
+// DUMaxDepth makes DU list only directories at most `depth` levels below the
+// specified path, like `du --max-depth`. Deeper directories still count
+// towards the totals of their parents. A depth of zero lists only the path
+// itself.
+func DUMaxDepth(depth int) DUOption {
+	return func(cfg *duConfig) {
+		cfg.maxDepth = depth
+	}
 }
 
 // Echo returns a pipe containing the supplied string.
 func Echo(s string) *Pipe {
-	return NewPipe().WithReader(strings.NewReader(s))
+	return newSource("Echo").withReader(strings.NewReader(s))
+}
+
+// Empty returns a pipe with no contents. It's the same as NewPipe, but makes
+// it clear, when starting a pipeline that exists only for its side effects,
+// that there's no input.
+func Empty() *Pipe {
+	return NewPipe()
 }
 
 // Exec runs an external command and returns a pipe containing the output. If
@@ -29,6 +113,25 @@ func Exec(s string) *Pipe {
 	return NewPipe().Exec(s)
 }
 
+// ExecPipeline runs a pipeline of external commands, separated by `|`
+// characters, as in the shell, and returns a pipe containing the output. See
+// Pipe.ExecPipeline for details.
+func ExecPipeline(cmdLine string) *Pipe {
+	return NewPipe().ExecPipeline(cmdLine)
+}
+
+// ExecPowerShell runs a command line with PowerShell, and returns a pipe
+// containing the output. See Pipe.ExecPowerShell for details.
+func ExecPowerShell(cmdLine string) *Pipe {
+	return NewPipe().ExecPowerShell(cmdLine)
+}
+
+// ExecShell runs a command line with the platform's command interpreter, and
+// returns a pipe containing the output. See Pipe.ExecShell for details.
+func ExecShell(cmdLine string) *Pipe {
+	return NewPipe().ExecShell(cmdLine)
+}
+
 // IfExists tests whether the specified file exists, and returns a pipe whose
 // error status reflects the result. If the file doesn't exist, the pipe's error
 // status will be set, and if the file does exist, the pipe will have no error
@@ -36,80 +139,867 @@ func Exec(s string) *Pipe {
 func IfExists(filename string) *Pipe {
 	_, err := os.Stat(filename)
 	if err != nil {
-		return NewPipe().WithError(err)
+		return newSource("IfExists").WithError(err)
+	}
+	return newSource("IfExists")
+}
+
+// Ignore makes FindFilesWith leave out the files and directories matching any
+// of the patterns, which are in the style of .gitignore lines, relative to the
+// directory being walked: for example, "*.log" matches any file ending in .log,
+// "/build" matches only the build directory at the top, "docs/**/*.png" matches
+// PNG files anywhere under docs, a trailing slash, as in "node_modules/",
+// matches only directories, and a leading "!" re-includes a path left out by an
+// earlier pattern. Leaving out a directory leaves out everything in it. These
+// patterns take precedence over those in ignore files (see IgnoreFile).
+// FileWith and ListFilesWith ignore this option.
+func Ignore(patterns ...string) FileOption {
+	return func(cfg *fileConfig) {
+		cfg.ignore = append(cfg.ignore, patterns...)
+	}
+}
+
+// IgnoreFile makes FindFilesWith read patterns from any file called name in
+// each directory it walks, such as ".gitignore", and leave out the files and
+// directories matching them, following the same rules as git: patterns apply to
+// the directory containing the ignore file, and everything under it, and
+// patterns in deeper directories take precedence. The option can be given more
+// than once, to read several kinds of ignore file. FileWith and ListFilesWith
+// ignore this option.
+func IgnoreFile(name string) FileOption {
+	return func(cfg *fileConfig) {
+		cfg.ignoreFiles = append(cfg.ignoreFiles, name)
 	}
-	return NewPipe()
 }
 
+// ErrSymlink is the error status set by FileWith, with the ReportSymlinks
+// option, when the file is a symbolic link.
+var ErrSymlink = errors.New("file is a symbolic link")
+
+// ErrSymlinkLoop is the error status set by FindFilesWith, with the
+// FollowSymlinks option, when a symbolic link leads back to a directory that
+// contains it, which would otherwise be walked forever.
+var ErrSymlinkLoop = errors.New("symbolic link loop")
+
 // File returns a *Pipe associated with the specified file. This is useful for
 // starting pipelines. If there is an error opening the file, the pipe's error
-// status will be set.
+// status will be set. If the file is a symbolic link, File reads the file it
+// points to; to change that, use FileWith.
 func File(name string) *Pipe {
-	p := NewPipe()
-	f, err := os.Open(name)
-	if err != nil {
-		return p.WithError(err)
-	}
-	return p.WithReader(f)
+	return fileWith("File", name)
+}
+
+// FileOption is an option that changes the behaviour of FileWith,
+// FindFilesWith, and ListFilesWith, such as how they treat symbolic links.
+type FileOption func(*fileConfig)
+
+// FileWith is like File, but takes options, such as SkipSymlinks or
+// ReportSymlinks, that change how it treats symbolic links.
+func FileWith(name string, opts ...FileOption) *Pipe {
+	return fileWith("FileWith", name, opts...)
 }
 
 // FindFiles takes a directory path and returns a pipe listing all the files in
 // the directory and its subdirectories recursively, one per line, like Unix
-// `find -type f`. If the path doesn't exist or can't be read, the pipe's error
-// status will be set.
+// `find -type f`. Symbolic links are listed, but not followed. If the path
+// doesn't exist or can't be read, the pipe's error status will be set.
 func FindFiles(path string) *Pipe {
-	var fileNames []string
-	walkFn := func(path string, info os.FileInfo, err error) error {
+	return findFilesWith("FindFiles", path)
+}
+
+// FindFilesWith is like FindFiles, but takes options, such as FollowSymlinks
+// or SkipSymlinks, that change how it treats symbolic links. To leave out
+// files and directories, such as .git or node_modules, use the Ignore and
+// IgnoreFile options:
+//
+//	script.FindFilesWith(".", script.IgnoreFile(".gitignore"), script.Ignore(".git/")).Stdout()
+//
+// If an Ignore pattern is invalid, the pipe's error status will be set.
+func FindFilesWith(path string, opts ...FileOption) *Pipe {
+	return findFilesWith("FindFilesWith", path, opts...)
+}
+
+// FollowSymlinks makes FileWith read the file that a symbolic link points to,
+// which is the default, FindFilesWith list the files under a linked directory
+// as though it were a real one, like `find -L`, and ListFilesWith check that
+// each link points to something. A link that leads back to a directory
+// FindFilesWith is already walking isn't followed, so walks always finish.
+// Links that can't be followed, because they're broken or loop, are left out,
+// but afterwards the pipe's error status is set to an error listing them,
+// wrapping ErrSymlinkLoop for loops.
+func FollowSymlinks() FileOption {
+	return func(cfg *fileConfig) {
+		cfg.symlinks = followSymlinks
+	}
+}
+
+// FromValues returns a pipe containing each element of values, converted to
+// text by format, one per line. It's the inverse of Lines, turning typed Go
+// values back into a pipe for further processing:
+//
+//	script.FromValues(sizes, strconv.Itoa).Freq().Stdout()
+func FromValues[T any](values []T, format func(T) string) *Pipe {
+	lines := make([]string, len(values))
+	for i, v := range values {
+		lines[i] = format(v)
+	}
+	return newSource("FromValues").withLines(lines)
+}
+
+// Grep searches every file in the directory tree under dir for lines matching
+// the regular expression pattern, like `grep -rn` or `rg`, and returns a pipe
+// containing each matching line in the form `path:line:text`, where line is
+// the line number. Files are searched concurrently, but the results are in
+// the same order as FindFiles would list the files. Binary files (those
+// containing a zero byte) are skipped, and which files are searched can be
+// changed with options such as GrepInclude, GrepExclude, and GrepIgnoreFile:
+//
+//	script.Grep(".", `TODO\(`, script.GrepInclude("*.go"), script.GrepExclude("vendor")).Stdout()
+//
+// If the pattern, or a GrepIgnore pattern, is invalid, or the directory can't
+// be read, the pipe's error status will be set. Files and subdirectories that
+// can't be read don't stop the search, but afterwards the pipe's error status
+// is set to an error listing them.
+func Grep(dir, pattern string, opts ...GrepOption) *Pipe {
+	re, err := regexp.Compile(pattern)
+	if err != nil {
+		return newSource("Grep").WithError(err)
+	}
+	cfg := grepConfig{workers: runtime.NumCPU()}
+	for _, opt := range opts {
+		opt(&cfg)
+	}
+	for _, glob := range append(cfg.include, cfg.exclude...) {
+		if _, err := filepath.Match(glob, ""); err != nil {
+			return newSource("Grep").WithError(fmt.Errorf("%q: %w", glob, err))
+		}
+	}
+	if cfg.workers < 1 {
+		cfg.workers = 1
+	}
+	ig, err := newIgnorer(cfg.ignoreFiles, cfg.ignore)
+	if err != nil {
+		return newSource("Grep").WithError(err)
+	}
+	var paths []string
+	var walkErrs []error
+	err = filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			if path == dir {
+				return err
+			}
+			// Like unreadable files, unreadable subdirectories don't stop
+			// the search.
+			walkErrs = append(walkErrs, err)
+			return nil
+		}
+		rel, err := filepath.Rel(dir, path)
 		if err != nil {
 			return err
 		}
-		if !info.IsDir() {
-			fileNames = append(fileNames, path)
+		rel = filepath.ToSlash(rel)
+		if path != dir && (cfg.excluded(d.Name()) || ig.ignored(rel, d.IsDir())) {
+			if d.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if d.IsDir() {
+			return ig.load(path, rel)
+		}
+		if d.Type().IsRegular() && cfg.included(d.Name()) {
+			paths = append(paths, path)
 		}
 		return nil
+	})
+	if err != nil {
+		return newSource("Grep").WithError(err)
+	}
+	results := make([]string, len(paths))
+	errs := make([]error, len(paths))
+	limiter := defaultLimiter.Load()
+	sem := make(chan struct{}, limiter.workers(cfg.workers))
+	group := &procGroup{}
+	var wg sync.WaitGroup
+	for i, path := range paths {
+		wg.Add(1)
+		sem <- struct{}{}
+		go func(i int, path string) {
+			release := limiter.acquire(group)
+			defer func() {
+				release()
+				<-sem
+				wg.Done()
+			}()
+			results[i], errs[i] = grepFile(path, re)
+		}(i, path)
 	}
-	if err := filepath.Walk(path, walkFn); err != nil {
-		return NewPipe().WithError(err)
+	wg.Wait()
+	q := newSource("Grep").withReader(strings.NewReader(strings.Join(results, "")))
+	if err := errors.Join(append(walkErrs, errs...)...); err != nil {
+		q.SetError(err)
 	}
-	return Slice(fileNames)
+	return q
+}
+
+// GrepOption is an option that changes the behaviour of Grep.
+type GrepOption func(*grepConfig)
+
+// GrepExclude makes Grep skip files and directories whose names match the
+// glob pattern, as for filepath.Match, like `grep --exclude`. Excluding a
+// directory skips everything in it. The option can be given more than once,
+// to exclude several patterns.
+func GrepExclude(glob string) GrepOption {
+	return func(cfg *grepConfig) {
+		cfg.exclude = append(cfg.exclude, glob)
+	}
+}
+
+// GrepIgnore makes Grep skip files and directories matching any of the
+// patterns, which are in the style of .gitignore lines, as for the Ignore
+// option to FindFiles. Unlike GrepExclude, patterns can match paths, relative
+// to the directory being searched, as well as names.
+func GrepIgnore(patterns ...string) GrepOption {
+	return func(cfg *grepConfig) {
+		cfg.ignore = append(cfg.ignore, patterns...)
+	}
+}
+
+// GrepIgnoreFile makes Grep read patterns from any file called name in each
+// directory it searches, such as ".gitignore", and skip the files and
+// directories matching them, as for the IgnoreFile option to FindFiles.
+func GrepIgnoreFile(name string) GrepOption {
+	return func(cfg *grepConfig) {
+		cfg.ignoreFiles = append(cfg.ignoreFiles, name)
+	}
+}
+
+// GrepInclude makes Grep search only files whose names match the glob
+// pattern, as for filepath.Match, like `grep --include`. The option can be
+// given more than once, to search files matching any of several patterns.
+func GrepInclude(glob string) GrepOption {
+	return func(cfg *grepConfig) {
+		cfg.include = append(cfg.include, glob)
+	}
+}
+
+// GrepWorkers sets the maximum number of files Grep searches at once. The
+// default is the number of CPUs.
+func GrepWorkers(n int) GrepOption {
+	return func(cfg *grepConfig) {
+		cfg.workers = n
+	}
+}
+
+// ListenUnix creates a Unix domain socket at the specified path, and returns a
+// pipe that reads whatever data is sent by the first client to connect, until
+// it closes the connection, like `nc -lU`. The socket is created immediately,
+// so clients can connect as soon as ListenUnix returns, but reading the pipe
+// blocks until a client connects. The connection is closed and the socket
+// file removed once the pipe has been fully read (or closed). If the socket
+// can't be created, for example because the path already exists, the pipe's
+// error status will be set.
+func ListenUnix(path string) *Pipe {
+	l, err := net.ListenUnix("unix", &net.UnixAddr{Name: path, Net: "unix"})
+	if err != nil {
+		return newSource("ListenUnix").WithError(err)
+	}
+	return newSource("ListenUnix").withReader(&unixListenerReader{listener: l})
 }
 
 // ListFiles creates a pipe containing the files and directories matching the
 // supplied path, one per line. The path may be a glob, conforming to
-// filepath.Match syntax.
+// filepath.Match syntax. Symbolic links are listed as they are.
 func ListFiles(path string) *Pipe {
-	if strings.ContainsAny(path, "[]^*?\\{}!") {
+	return listFilesWith("ListFiles", path)
+}
+
+// ListFilesWith is like ListFiles, but takes options, such as FollowSymlinks
+// or SkipSymlinks, that change how it treats symbolic links.
+func ListFilesWith(path string, opts ...FileOption) *Pipe {
+	return listFilesWith("ListFilesWith", path, opts...)
+}
+
+// NewPipeFromBytes creates a pipe containing the supplied data. Unlike Echo, it
+// doesn't copy the data, and it doesn't need it to be valid text, which makes
+// it convenient for fuzz targets:
+//
+//	f.Fuzz(func(t *testing.T, data []byte) {
+//		script.NewPipeFromBytes(data).Logfmt().String()
+//	})
+func NewPipeFromBytes(data []byte) *Pipe {
+	return newSource("NewPipeFromBytes").withReader(bytes.NewReader(data))
+}
+
+// ReportSymlinks makes FileWith refuse to read a symbolic link, setting the
+// pipe's error status to an error wrapping ErrSymlink instead, which protects
+// scripts from being tricked into reading a file they shouldn't, and makes
+// FindFilesWith and ListFilesWith list each link as it is, without following
+// it, which is their default.
+func ReportSymlinks() FileOption {
+	return func(cfg *fileConfig) {
+		cfg.symlinks = reportSymlinks
+	}
+}
+
+// SkipSymlinks makes FileWith, FindFilesWith, and ListFilesWith ignore symbolic
+// links altogether, as though they weren't there: FileWith produces an empty
+// pipe if the file is a link, and FindFilesWith and ListFilesWith leave links
+// out of their listings, and don't walk linked directories.
+func SkipSymlinks() FileOption {
+	return func(cfg *fileConfig) {
+		cfg.symlinks = skipSymlinks
+	}
+}
+
+// Slice returns a pipe containing each element of the supplied slice of strings, one per line.
+func Slice(s []string) *Pipe {
+	return newSource("Slice").withLines(s)
+}
+
+// Stdin returns a pipe that reads from the program's standard input.
+func Stdin() *Pipe {
+	return newSource("Stdin").withReader(os.Stdin)
+}
+
+// Unzip extracts all the files in the specified zip archive into the directory
+// `dest`, creating it and any subdirectories as needed, like Unix `unzip -d`.
+// It returns a pipe containing the path of each extracted file, one per line.
+// Entries that would be extracted outside `dest` (for example, because their
+// names contain `..`) are rejected. If the archive can't be read, or a file
+// can't be extracted, the pipe's error status will be set.
+func Unzip(archive, dest string) *Pipe {
+	r, err := zip.OpenReader(archive)
+	if err != nil {
+		return newSource("Unzip").WithError(err)
+	}
+	defer r.Close()
+	var paths []string
+	for _, f := range r.File {
+		path := filepath.Join(dest, filepath.FromSlash(f.Name))
+		rel, err := filepath.Rel(filepath.Clean(dest), path)
+		if err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(os.PathSeparator)) {
+			return newSource("Unzip").WithError(fmt.Errorf("%s: illegal path in archive: %s", archive, f.Name))
+		}
+		if f.FileInfo().IsDir() {
+			if err := os.MkdirAll(path, 0755); err != nil {
+				return newSource("Unzip").WithError(err)
+			}
+			continue
+		}
+		if err := extractZipFile(f, path); err != nil {
+			return newSource("Unzip").WithError(err)
+		}
+		paths = append(paths, path)
+	}
+	if len(paths) == 0 {
+		return newSource("Unzip")
+	}
+	return newSource("Unzip").withLines(paths)
+}
+
+// WebSocket connects to the WebSocket server at the specified URL (for example,
+// "wss://example.com/feed") and returns a pipe containing each message received
+// from the server, one per line, as it arrives. The pipe ends when the server
+// closes the connection, or when the pipe is closed. If the connection fails,
+// or ends abnormally, the pipe's error status will be set.
+//
+// Since the server may send messages indefinitely, WebSocket is most useful
+// with filters and sinks that process the pipe incrementally, such as Read,
+// First, or Stdout.
+func WebSocket(url string) *Pipe {
+	conn, _, err := websocket.DefaultDialer.Dial(url, nil)
+	if err != nil {
+		return newSource("WebSocket").WithError(err)
+	}
+	pr, pw := io.Pipe()
+	goStage(func() {
+		defer conn.Close()
+		for {
+			_, msg, err := conn.ReadMessage()
+			if err != nil {
+				if websocket.IsCloseError(err, websocket.CloseNormalClosure, websocket.CloseGoingAway) {
+					err = nil
+				}
+				pw.CloseWithError(err)
+				return
+			}
+			if !bytes.HasSuffix(msg, []byte{'\n'}) {
+				msg = append(msg, '\n')
+			}
+			if _, err := pw.Write(msg); err != nil {
+				return // reader closed
+			}
+		}
+	})
+	return newSource("WebSocket").withReader(webSocketReader{pr, conn})
+}
+
+// webSocketReader reads messages from a WebSocket connection, and closes the
+// connection as well as the pipe when it is closed.
+type webSocketReader struct {
+	*io.PipeReader
+	conn *websocket.Conn
+}
+
+// Close closes both the pipe reader and the underlying connection.
+func (r webSocketReader) Close() error {
+	r.PipeReader.Close()
+	return r.conn.Close()
+}
+
+// ZipEntries returns a pipe listing the names of the entries in the specified
+// zip archive, one per line, like `unzip -Z1`. If the archive can't be read,
+// the pipe's error status will be set.
+func ZipEntries(archive string) *Pipe {
+	r, err := zip.OpenReader(archive)
+	if err != nil {
+		return newSource("ZipEntries").WithError(err)
+	}
+	defer r.Close()
+	output := strings.Builder{}
+	for _, f := range r.File {
+		output.WriteString(f.Name)
+		output.WriteRune('\n')
+	}
+	return newSource("ZipEntries").withReader(strings.NewReader(output.String()))
+}
+
+// ZipEntry returns a pipe containing the contents of the entry called `name`
+// in the specified zip archive, like `unzip -p`. If the archive can't be read,
+// or doesn't contain the named entry, the pipe's error status will be set.
+func ZipEntry(archive, name string) *Pipe {
+	r, err := zip.OpenReader(archive)
+	if err != nil {
+		return newSource("ZipEntry").WithError(err)
+	}
+	f, err := r.Open(name)
+	if err != nil {
+		r.Close()
+		return newSource("ZipEntry").WithError(err)
+	}
+	return newSource("ZipEntry").withReader(zipEntryReader{f, r})
+}
+
+// duConfig holds the options for DU.
+type duConfig struct {
+	maxDepth      int
+	humanReadable bool
+}
+
+// du returns the total size of the files under path, which is at the
+// specified depth below the starting path, writing the totals for each listed
+// directory to out. It returns an error if path itself can't be read, but adds
+// any errors reading things under it to errs, and carries on.
+func du(path string, depth int, cfg duConfig, out *strings.Builder, errs *[]error) (int64, error) {
+	info, err := os.Lstat(path)
+	if err != nil {
+		return 0, err
+	}
+	size := info.Size()
+	if info.IsDir() {
+		entries, err := ioutil.ReadDir(path)
+		if err != nil {
+			return 0, err
+		}
+		size = 0
+		for _, e := range entries {
+			s, err := du(filepath.Join(path, e.Name()), depth+1, cfg, out, errs)
+			if err != nil {
+				*errs = append(*errs, err)
+				continue
+			}
+			size += s
+		}
+	}
+	if depth == 0 || info.IsDir() && (cfg.maxDepth < 0 || depth <= cfg.maxDepth) {
+		if cfg.humanReadable {
+			out.WriteString(humanSize(size))
+		} else {
+			out.WriteString(strconv.FormatInt(size, 10))
+		}
+		out.WriteString(" " + path + "\n")
+	}
+	return size, nil
+}
+
+// extractZipFile writes the contents of f to the file at path.
+func extractZipFile(f *zip.File, path string) error {
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+	in, err := f.Open()
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	mode := f.Mode().Perm()
+	if mode == 0 {
+		mode = 0644
+	}
+	out, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, mode)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(out, in); err != nil {
+		out.Close()
+		return err
+	}
+	return out.Close()
+}
+
+// fileWith is FileWith for the source op, which may be File.
+func fileWith(op, name string, opts ...FileOption) *Pipe {
+	cfg := fileConfig{symlinks: followSymlinks}
+	for _, opt := range opts {
+		opt(&cfg)
+	}
+	p := newSource(op)
+	f, err := openSource(name)
+	if err != nil {
+		return p.WithError(err)
+	}
+	if cfg.symlinks != followSymlinks {
+		// Check after opening, so that the link can't be swapped in between.
+		info, err := os.Lstat(name)
+		if err != nil || info.Mode()&fs.ModeSymlink != 0 || !os.SameFile(info, f.info) {
+			f.Close()
+			if cfg.symlinks == skipSymlinks {
+				return p
+			}
+			return p.WithError(&fs.PathError{Op: "open", Path: name, Err: ErrSymlink})
+		}
+	}
+	p.sources = []*sourceFile{f}
+	return p.withReader(f)
+}
+
+// findFilesWith is FindFilesWith for the source op, which may be FindFiles.
+func findFilesWith(op, path string, opts ...FileOption) *Pipe {
+	cfg := fileConfig{symlinks: reportSymlinks}
+	for _, opt := range opts {
+		opt(&cfg)
+	}
+	ig, err := newIgnorer(cfg.ignoreFiles, cfg.ignore)
+	if err != nil {
+		return newSource(op).WithError(err)
+	}
+	info, err := os.Lstat(path)
+	if err != nil {
+		return newSource(op).WithError(err)
+	}
+	w := &fileWalker{cfg: cfg, root: path, ignore: ig}
+	if err := w.walk(path, info); err != nil {
+		return newSource(op).WithError(err)
+	}
+	return newSource(op).withLines(w.paths).WithError(errors.Join(w.errs...))
+}
+
+// symlinkPolicy is how file sources treat symbolic links.
+type symlinkPolicy int
+
+const (
+	reportSymlinks symlinkPolicy = iota
+	followSymlinks
+	skipSymlinks
+)
+
+// fileConfig holds the options for FileWith, FindFilesWith, and ListFilesWith.
+type fileConfig struct {
+	symlinks    symlinkPolicy
+	ignoreFiles []string
+	ignore      []string
+}
+
+// listFiles returns a pipe for the source op listing the paths, one per line,
+// applying the symlink policy.
+func (cfg fileConfig) listFiles(op string, paths []string) *Pipe {
+	if cfg.symlinks == reportSymlinks {
+		return newSource(op).withLines(paths)
+	}
+	var listed []string
+	var errs []error
+	for _, path := range paths {
+		info, err := os.Lstat(path)
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		if info.Mode()&fs.ModeSymlink != 0 {
+			if cfg.symlinks == skipSymlinks {
+				continue
+			}
+			if _, err := os.Stat(path); err != nil {
+				errs = append(errs, err)
+				continue
+			}
+		}
+		listed = append(listed, path)
+	}
+	return newSource(op).withLines(listed).WithError(errors.Join(errs...))
+}
+
+// listFilesWith is ListFilesWith for the source op, which may be ListFiles.
+func listFilesWith(op, path string, opts ...FileOption) *Pipe {
+	cfg := fileConfig{symlinks: reportSymlinks}
+	for _, opt := range opts {
+		opt(&cfg)
+	}
+	if hasGlobMeta(path) {
 		fileNames, err := filepath.Glob(path)
 		if err != nil {
-			return NewPipe().WithError(err)
+			return newSource(op).WithError(err)
 		}
-		return Slice(fileNames)
+		return cfg.listFiles(op, fileNames)
 	}
 	files, err := ioutil.ReadDir(path)
 	if err != nil {
 		// Check for the case where the path matches exactly one file
 		s, err := os.Stat(path)
 		if err != nil {
-			return NewPipe().WithError(err)
+			return newSource(op).WithError(err)
 		}
 		if !s.IsDir() {
-			return Echo(path)
+			if cfg.symlinks == skipSymlinks {
+				if info, err := os.Lstat(path); err == nil && info.Mode()&fs.ModeSymlink != 0 {
+					return newSource(op)
+				}
+			}
+			return newSource(op).withReader(strings.NewReader(path))
 		}
-		return NewPipe().WithError(err)
+		return newSource(op).WithError(err)
 	}
 	fileNames := make([]string, len(files))
 	for i, f := range files {
 		fileNames[i] = filepath.Join(path, f.Name())
 	}
-	return Slice(fileNames)
+	return cfg.listFiles(op, fileNames)
 }
 
-// Slice returns a pipe containing each element of the supplied slice of strings, one per line.
-func Slice(s []string) *Pipe {
-	return Echo(strings.Join(s, "\n") + "\n")
+// fileWalker walks a directory tree for FindFiles, collecting the paths of
+// the files in it.
+type fileWalker struct {
+	cfg    fileConfig
+	root   string
+	ignore *ignorer
+	paths  []string
+	// errs lists the symbolic links that couldn't be followed.
+	errs []error
+	// dirs lists the directories being walked, from the top down, so that
+	// symbolic links leading back to one of them can be detected.
+	dirs []fs.FileInfo
 }
 
-// Stdin returns a pipe that reads from the program's standard input.
-func Stdin() *Pipe {
-	return NewPipe().WithReader(os.Stdin)
+// walk adds path, which info describes, to the list of files, or, if it's a
+// directory, walks everything in it, in lexical order. It returns the first
+// error reading a directory, which stops the walk.
+func (w *fileWalker) walk(path string, info fs.FileInfo) error {
+	if info.Mode()&fs.ModeSymlink != 0 {
+		switch w.cfg.symlinks {
+		case skipSymlinks:
+			return nil
+		case followSymlinks:
+			target, err := os.Stat(path)
+			if err != nil {
+				w.errs = append(w.errs, err)
+				return nil
+			}
+			info = target
+		}
+	}
+	rel, err := filepath.Rel(w.root, path)
+	if err != nil {
+		return err
+	}
+	rel = filepath.ToSlash(rel)
+	if w.ignore.ignored(rel, info.IsDir()) {
+		return nil
+	}
+	if !info.IsDir() {
+		w.paths = append(w.paths, path)
+		return nil
+	}
+	for _, dir := range w.dirs {
+		if os.SameFile(dir, info) {
+			w.errs = append(w.errs, &fs.PathError{Op: "walk", Path: path, Err: ErrSymlinkLoop})
+			return nil
+		}
+	}
+	if err := w.ignore.load(path, rel); err != nil {
+		return err
+	}
+	entries, err := os.ReadDir(path)
+	if err != nil {
+		return err
+	}
+	w.dirs = append(w.dirs, info)
+	defer func() { w.dirs = w.dirs[:len(w.dirs)-1] }()
+	for _, e := range entries {
+		info, err := e.Info()
+		if err != nil {
+			return err
+		}
+		if err := w.walk(filepath.Join(path, e.Name()), info); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// grepConfig holds the options for Grep.
+type grepConfig struct {
+	include, exclude    []string
+	ignore, ignoreFiles []string
+	workers             int
+}
+
+// excluded reports whether name matches any of the exclude patterns.
+func (cfg grepConfig) excluded(name string) bool {
+	for _, glob := range cfg.exclude {
+		if ok, _ := filepath.Match(glob, name); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// included reports whether name matches any of the include patterns, or
+// there are no include patterns.
+func (cfg grepConfig) included(name string) bool {
+	if len(cfg.include) == 0 {
+		return true
+	}
+	for _, glob := range cfg.include {
+		if ok, _ := filepath.Match(glob, name); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// grepFile returns the lines of the file at path that match re, formatted as
+// for Grep, or nothing if the file is binary.
+func grepFile(path string, re *regexp.Regexp) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	output := strings.Builder{}
+	scanner := bufio.NewScanner(f)
+	for n := 1; scanner.Scan(); n++ {
+		line := scanner.Bytes()
+		if bytes.IndexByte(line, 0) >= 0 {
+			return "", nil
+		}
+		if re.Match(line) {
+			fmt.Fprintf(&output, "%s:%d:%s\n", path, n, line)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return "", fmt.Errorf("%s: %w", path, err)
+	}
+	return output.String(), nil
+}
+
+// hasGlobMeta reports whether path contains any of the special characters
+// recognised by filepath.Match. On Windows, where backslash is the path
+// separator rather than an escape character, it isn't counted as special.
+func hasGlobMeta(path string) bool {
+	meta := "[]^*?\\{}!"
+	if filepath.Separator == '\\' {
+		meta = "[]^*?{}!"
+	}
+	return strings.ContainsAny(path, meta)
+}
+
+// humanSize formats a number of bytes using suffixes for powers of 1024, with
+// one decimal place for values less than 10, like `du -h`.
+func humanSize(n int64) string {
+	if n < 1024 {
+		return strconv.FormatInt(n, 10)
+	}
+	value := float64(n)
+	var unit int
+	for value >= 1024 && unit < len(humanUnits)-1 {
+		value /= 1024
+		unit++
+	}
+	if value < 10 {
+		return fmt.Sprintf("%.1f%s", value, humanUnits[unit])
+	}
+	return fmt.Sprintf("%.0f%s", value, humanUnits[unit])
+}
+
+// humanUnits are the suffixes used by humanSize.
+var humanUnits = []string{"", "K", "M", "G", "T", "P", "E"}
+
+// openSource opens the named file for reading as the source of a pipe.
+func openSource(name string) (*sourceFile, error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	return &sourceFile{File: f, info: info}, nil
+}
+
+// sourceFile is a file being read as the source of a pipe.
+type sourceFile struct {
+	*os.File
+	info   os.FileInfo
+	closed atomic.Bool
+}
+
+// Close closes the file, recording that the pipe has finished reading it.
+func (f *sourceFile) Close() error {
+	f.closed.Store(true)
+	return f.File.Close()
+}
+
+// unixListenerReader reads from the first connection accepted by a Unix
+// socket listener, and closes the connection as well as the listener when it
+// is closed.
+type unixListenerReader struct {
+	listener *net.UnixListener
+	conn     net.Conn
+}
+
+// Close closes the connection, if any, and the listener, which removes the
+// socket file.
+func (r *unixListenerReader) Close() error {
+	if r.conn != nil {
+		r.conn.Close()
+	}
+	return r.listener.Close()
+}
+
+// Read accepts a connection, if none has been accepted yet, and reads from
+// it.
+func (r *unixListenerReader) Read(buf []byte) (int, error) {
+	if r.conn == nil {
+		conn, err := r.listener.Accept()
+		if err != nil {
+			return 0, err
+		}
+		r.conn = conn
+	}
+	return r.conn.Read(buf)
+}
+
+// zipEntryReader reads an entry from a zip archive, and closes the archive as
+// well as the entry when it is closed.
+type zipEntryReader struct {
+	fs.File
+	archive io.Closer
+}
+
+// Close closes both the entry and the archive containing it.
+func (r zipEntryReader) Close() error {
+	r.File.Close()
+	return r.archive.Close()
 }
@@ -1,15 +1,27 @@
 package script_test
 
 import (
+	"archive/zip"
+	"bytes"
+	"errors"
 	"fmt"
+	"io"
+	"io/fs"
 	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
 	"os"
 	"os/exec"
+	"path/filepath"
+	"runtime"
+	"strconv"
 	"strings"
 	"testing"
 
 	"github.com/bitfield/script"
 	"github.com/google/go-cmp/cmp"
+	"github.com/gorilla/websocket"
 )
 
 func TestArgs(t *testing.T) {
@@ -29,6 +41,146 @@ func TestArgs(t *testing.T) {
 	}
 }
 
+func TestDial(t *testing.T) {
+	t.Parallel()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	want := "hello from the server\n"
+	go func() {
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		fmt.Fprint(conn, want)
+	}()
+	got, err := script.Dial("tcp", l.Addr().String()).String()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got != want {
+		t.Errorf("want %q, got %q", want, got)
+	}
+}
+
+func TestDialInvalidAddress(t *testing.T) {
+	t.Parallel()
+	p := script.Dial("tcp", "bogus address")
+	if p.Error() == nil {
+		t.Error("want error dialling invalid address, got nil")
+	}
+}
+
+func TestDU(t *testing.T) {
+	t.Parallel()
+	dir := t.TempDir()
+	sub, deep := filepath.Join(dir, "sub"), filepath.Join(dir, "sub", "deep")
+	if err := os.MkdirAll(deep, 0755); err != nil {
+		t.Fatal(err)
+	}
+	files := map[string]int{
+		filepath.Join(dir, "a"):  10,
+		filepath.Join(sub, "b"):  2000,
+		filepath.Join(deep, "c"): 5,
+	}
+	for path, size := range files {
+		if err := ioutil.WriteFile(path, make([]byte, size), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	tcs := []struct {
+		name string
+		path string
+		opts []script.DUOption
+		want string
+	}{
+		{"default", dir, nil, fmt.Sprintf("5 %s\n2005 %s\n2015 %s\n", deep, sub, dir)},
+		{"max depth 1", dir, []script.DUOption{script.DUMaxDepth(1)}, fmt.Sprintf("2005 %s\n2015 %s\n", sub, dir)},
+		{"max depth 0", dir, []script.DUOption{script.DUMaxDepth(0)}, fmt.Sprintf("2015 %s\n", dir)},
+		{"human readable", dir, []script.DUOption{script.DUMaxDepth(0), script.DUHumanReadable()}, fmt.Sprintf("2.0K %s\n", dir)},
+		{"single file", filepath.Join(dir, "a"), nil, fmt.Sprintf("10 %s\n", filepath.Join(dir, "a"))},
+	}
+	for _, tc := range tcs {
+		got, err := script.DU(tc.path, tc.opts...).String()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got != tc.want {
+			t.Errorf("%s: want %q, got %q", tc.name, tc.want, got)
+		}
+	}
+}
+
+func TestDUHumanReadableSizes(t *testing.T) {
+	t.Parallel()
+	dir := t.TempDir()
+	tcs := []struct {
+		size int
+		want string
+	}{
+		{0, "0"},
+		{1023, "1023"},
+		{1024, "1.0K"},
+		{1536, "1.5K"},
+		{20 * 1024, "20K"},
+		{3 << 20, "3.0M"},
+	}
+	for _, tc := range tcs {
+		path := filepath.Join(dir, strconv.Itoa(tc.size))
+		if err := ioutil.WriteFile(path, make([]byte, tc.size), 0644); err != nil {
+			t.Fatal(err)
+		}
+		got, err := script.DU(path, script.DUHumanReadable()).Column(1).String()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got != tc.want+"\n" {
+			t.Errorf("size %d: want %q, got %q", tc.size, tc.want+"\n", got)
+		}
+	}
+}
+
+func TestDUNonexistent(t *testing.T) {
+	t.Parallel()
+	p := script.DU("testdata/doesntexist")
+	if p.Error() == nil {
+		t.Error("want error for nonexistent path, got nil")
+	}
+}
+
+func TestDUReportsUnreadableSubdirectoryAndCarriesOn(t *testing.T) {
+	t.Parallel()
+	if runtime.GOOS == "windows" || os.Geteuid() == 0 {
+		t.Skip("needs a directory the user can't read")
+	}
+	dir := t.TempDir()
+	locked := filepath.Join(dir, "locked")
+	if err := os.Mkdir(locked, 0o755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(locked, "hidden"), make([]byte, 100), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, "a"), make([]byte, 10), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chmod(locked, 0); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.Chmod(locked, 0o755) })
+	p := script.DU(dir)
+	if !errors.Is(p.Error(), fs.ErrPermission) {
+		t.Errorf("want permission error for unreadable directory, got %v", p.Error())
+	}
+	got, _ := io.ReadAll(p)
+	if want := fmt.Sprintf("10 %s\n", dir); string(got) != want {
+		t.Errorf("want total for readable files %q, got %q", want, got)
+	}
+}
+
 func TestEcho(t *testing.T) {
 	t.Parallel()
 	want := "Hello, world."
@@ -42,6 +194,25 @@ func TestEcho(t *testing.T) {
 	}
 }
 
+func TestEmpty(t *testing.T) {
+	t.Parallel()
+	got, err := script.Empty().String()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got != "" {
+		t.Errorf("want empty string, got %q", got)
+	}
+}
+
+func TestExecCommandNotFound(t *testing.T) {
+	t.Parallel()
+	err := script.Exec("doesntexist").Error()
+	if !errors.Is(err, script.ErrCommandNotFound) {
+		t.Errorf("want ErrCommandNotFound, got %v", err)
+	}
+}
+
 func TestExec(t *testing.T) {
 	t.Parallel()
 	tcs := []struct {
@@ -108,6 +279,15 @@ func TestExec(t *testing.T) {
 	}
 }
 
+func TestFileFindFilesAndListFilesCanBeUsedAsFunctionValues(t *testing.T) {
+	t.Parallel()
+	for _, source := range []func(string) *script.Pipe{script.File, script.FindFiles, script.ListFiles} {
+		if err := source("testdata/hello.txt").Error(); err != nil {
+			t.Error(err)
+		}
+	}
+}
+
 func TestFile(t *testing.T) {
 	t.Parallel()
 	wantRaw, _ := ioutil.ReadFile("testdata/test.txt") // ignoring error
@@ -127,6 +307,67 @@ func TestFile(t *testing.T) {
 	}
 }
 
+func TestFileWithSymlinkOptions(t *testing.T) {
+	t.Parallel()
+	dir := t.TempDir()
+	target := filepath.Join(dir, "target.txt")
+	link := filepath.Join(dir, "link.txt")
+	if err := os.WriteFile(target, []byte("secret\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink(target, link); err != nil {
+		t.Skip(err)
+	}
+	got, err := script.File(link).String()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got != "secret\n" {
+		t.Errorf("want link followed by default, got %q", got)
+	}
+	got, err = script.FileWith(link, script.SkipSymlinks()).String()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got != "" {
+		t.Errorf("want empty pipe when skipping link, got %q", got)
+	}
+	_, err = script.FileWith(link, script.ReportSymlinks()).String()
+	if !errors.Is(err, script.ErrSymlink) {
+		t.Errorf("want ErrSymlink reading link, got %v", err)
+	}
+	got, err = script.FileWith(target, script.ReportSymlinks()).String()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got != "secret\n" {
+		t.Errorf("want regular file read as usual, got %q", got)
+	}
+}
+
+// symlinkTree creates a directory containing a file, a subdirectory, and
+// links to each, along with any extra links given as pairs of names and
+// targets, and returns its path.
+func symlinkTree(t *testing.T, extra ...string) string {
+	t.Helper()
+	dir := t.TempDir()
+	if err := os.Mkdir(filepath.Join(dir, "sub"), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"a.txt", "sub/b.txt"} {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(name), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	links := append([]string{"link.txt", "a.txt", "linkdir", "sub"}, extra...)
+	for i := 0; i < len(links); i += 2 {
+		if err := os.Symlink(links[i+1], filepath.Join(dir, links[i])); err != nil {
+			t.Skip(err)
+		}
+	}
+	return dir
+}
+
 func TestFindFiles(t *testing.T) {
 	t.Parallel()
 	tcs := []struct {
@@ -162,13 +403,329 @@ func TestFindFiles(t *testing.T) {
 			if err != nil {
 				t.Fatalf("unexpected error %v", err)
 			}
-			if !cmp.Equal(tc.Want, got) {
-				t.Fatalf("want %q, got %q", tc.Want, got)
+			want := filepath.FromSlash(tc.Want)
+			if !cmp.Equal(want, got) {
+				t.Fatalf("want %q, got %q", want, got)
+			}
+		})
+	}
+}
+
+func TestFindFilesWithSymlinkOptions(t *testing.T) {
+	t.Parallel()
+	dir := symlinkTree(t)
+	tcs := []struct {
+		name string
+		opts []script.FileOption
+		want []string
+	}{
+		{
+			name: "default",
+			want: []string{"a.txt", "link.txt", "linkdir", "sub/b.txt"},
+		},
+		{
+			name: "ReportSymlinks",
+			opts: []script.FileOption{script.ReportSymlinks()},
+			want: []string{"a.txt", "link.txt", "linkdir", "sub/b.txt"},
+		},
+		{
+			name: "FollowSymlinks",
+			opts: []script.FileOption{script.FollowSymlinks()},
+			want: []string{"a.txt", "link.txt", "linkdir/b.txt", "sub/b.txt"},
+		},
+		{
+			name: "SkipSymlinks",
+			opts: []script.FileOption{script.SkipSymlinks()},
+			want: []string{"a.txt", "sub/b.txt"},
+		},
+	}
+	for _, tc := range tcs {
+		t.Run(tc.name, func(t *testing.T) {
+			got, err := script.FindFilesWith(dir, tc.opts...).String()
+			if err != nil {
+				t.Fatal(err)
+			}
+			want := ""
+			for _, name := range tc.want {
+				want += filepath.Join(dir, name) + "\n"
+			}
+			if got != want {
+				t.Errorf("want %q, got %q", want, got)
 			}
 		})
 	}
 }
 
+func TestFindFilesFollowingSymlinksStopsAtLoops(t *testing.T) {
+	t.Parallel()
+	dir := symlinkTree(t, "sub/up", "..", "broken", "missing")
+	p := script.FindFilesWith(dir, script.FollowSymlinks())
+	err := p.Error()
+	if !errors.Is(err, script.ErrSymlinkLoop) {
+		t.Errorf("want ErrSymlinkLoop, got %v", err)
+	}
+	for _, name := range []string{"sub/up", "linkdir/up", "broken"} {
+		if !strings.Contains(fmt.Sprint(err), filepath.Join(dir, name)) {
+			t.Errorf("want error to mention %s, got %v", name, err)
+		}
+	}
+}
+
+// ignoreTree creates a directory tree containing .gitignore files, and
+// returns its path. Every file other than the .gitignore files contains the
+// line "needle".
+func ignoreTree(t *testing.T) string {
+	t.Helper()
+	dir := t.TempDir()
+	files := map[string]string{
+		".gitignore":                "# build output\n*.log\n!keep.log\nbuild/\n/top.txt\ndocs/**/*.png\n\n",
+		"src/.gitignore":            "!x.log\n*.go\n",
+		"a.go":                      "needle\n",
+		"top.txt":                   "needle\n",
+		"debug.log":                 "needle\n",
+		"keep.log":                  "needle\n",
+		"build/out.bin":             "needle\n",
+		"docs/readme.md":            "needle\n",
+		"docs/b.png":                "needle\n",
+		"docs/img/a.png":            "needle\n",
+		"node_modules/pkg/index.js": "needle\n",
+		"src/build":                 "needle\n",
+		"src/main.go":               "needle\n",
+		"src/top.txt":               "needle\n",
+		"src/x.log":                 "needle\n",
+	}
+	for name, data := range files {
+		path := filepath.Join(dir, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, []byte(data), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return dir
+}
+
+func TestFindFilesWithIgnoreOptions(t *testing.T) {
+	t.Parallel()
+	dir := ignoreTree(t)
+	tcs := []struct {
+		name string
+		opts []script.FileOption
+		want []string
+	}{
+		{
+			name: "IgnoreFile",
+			opts: []script.FileOption{script.IgnoreFile(".gitignore")},
+			want: []string{".gitignore", "a.go", "docs/readme.md", "keep.log", "node_modules/pkg/index.js", "src/.gitignore", "src/build", "src/top.txt", "src/x.log"},
+		},
+		{
+			name: "Ignore",
+			opts: []script.FileOption{script.Ignore(".gitignore", "node_modules/", "src/*.go", "*.png")},
+			want: []string{"a.go", "build/out.bin", "debug.log", "docs/readme.md", "keep.log", "src/build", "src/top.txt", "src/x.log", "top.txt"},
+		},
+		{
+			name: "Ignore takes precedence over IgnoreFile",
+			opts: []script.FileOption{script.IgnoreFile(".gitignore"), script.Ignore("keep.log", "**/.gitignore", "/node_modules", "!debug.log")},
+			want: []string{"a.go", "debug.log", "docs/readme.md", "src/build", "src/top.txt", "src/x.log"},
+		},
+		{
+			name: "missing ignore file",
+			opts: []script.FileOption{script.IgnoreFile(".ignore"), script.Ignore("src", "docs", "node_modules", "build", ".*")},
+			want: []string{"a.go", "debug.log", "keep.log", "top.txt"},
+		},
+	}
+	for _, tc := range tcs {
+		t.Run(tc.name, func(t *testing.T) {
+			got, err := script.FindFilesWith(dir, tc.opts...).String()
+			if err != nil {
+				t.Fatal(err)
+			}
+			var want string
+			for _, name := range tc.want {
+				want += filepath.Join(dir, filepath.FromSlash(name)) + "\n"
+			}
+			if got != want {
+				t.Errorf("want %q, got %q", want, got)
+			}
+		})
+	}
+}
+
+func TestFindFilesWithIgnorePatternMatching(t *testing.T) {
+	t.Parallel()
+	dir := t.TempDir()
+	names := []string{
+		"!bang", "#hash", "a b", "a.txt", "abc", "b.txt", "x/a.txt", "x/y/z/a.txt", "x/y/q.md",
+	}
+	for _, name := range names {
+		path := filepath.Join(dir, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, nil, 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	tcs := []struct {
+		pattern string
+		want    []string
+	}{
+		{"a.txt", []string{"!bang", "#hash", "a b", "abc", "b.txt", "x/y/q.md"}},
+		{"/a.txt", []string{"!bang", "#hash", "a b", "abc", "b.txt", "x/a.txt", "x/y/q.md", "x/y/z/a.txt"}},
+		{"x/*.txt", []string{"!bang", "#hash", "a b", "a.txt", "abc", "b.txt", "x/y/q.md", "x/y/z/a.txt"}},
+		{"x/**/a.txt", []string{"!bang", "#hash", "a b", "a.txt", "abc", "b.txt", "x/y/q.md"}},
+		{"x/**", []string{"!bang", "#hash", "a b", "a.txt", "abc", "b.txt"}},
+		{"**/z", []string{"!bang", "#hash", "a b", "a.txt", "abc", "b.txt", "x/a.txt", "x/y/q.md"}},
+		{"[ab].txt", []string{"!bang", "#hash", "a b", "abc", "x/y/q.md"}},
+		{"[!a]*", []string{"a b", "a.txt", "abc"}},
+		{"a?c", []string{"!bang", "#hash", "a b", "a.txt", "b.txt", "x/a.txt", "x/y/q.md", "x/y/z/a.txt"}},
+		{`\#hash`, []string{"!bang", "a b", "a.txt", "abc", "b.txt", "x/a.txt", "x/y/q.md", "x/y/z/a.txt"}},
+		{`\!bang`, []string{"#hash", "a b", "a.txt", "abc", "b.txt", "x/a.txt", "x/y/q.md", "x/y/z/a.txt"}},
+		{"a b   ", []string{"!bang", "#hash", "a.txt", "abc", "b.txt", "x/a.txt", "x/y/q.md", "x/y/z/a.txt"}},
+		{"*.txt/", []string{"!bang", "#hash", "a b", "a.txt", "abc", "b.txt", "x/a.txt", "x/y/q.md", "x/y/z/a.txt"}},
+		{"# comment", []string{"!bang", "#hash", "a b", "a.txt", "abc", "b.txt", "x/a.txt", "x/y/q.md", "x/y/z/a.txt"}},
+	}
+	for _, tc := range tcs {
+		got, err := script.FindFilesWith(dir, script.Ignore(tc.pattern)).String()
+		if err != nil {
+			t.Fatalf("%q: %v", tc.pattern, err)
+		}
+		var want string
+		for _, name := range tc.want {
+			want += filepath.Join(dir, filepath.FromSlash(name)) + "\n"
+		}
+		if got != want {
+			t.Errorf("%q: want %q, got %q", tc.pattern, want, got)
+		}
+	}
+}
+
+func TestFindFilesWithInvalidIgnorePatternIsError(t *testing.T) {
+	t.Parallel()
+	p := script.FindFilesWith("testdata", script.Ignore("[z-a]"))
+	if p.Error() == nil {
+		t.Error("want error for invalid pattern, got nil")
+	}
+}
+
+func TestFromValues(t *testing.T) {
+	t.Parallel()
+	want := "1\n2\n3\n"
+	got, err := script.FromValues([]int{1, 2, 3}, strconv.Itoa).String()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got != want {
+		t.Errorf("want %q, got %q", want, got)
+	}
+}
+
+func TestGrep(t *testing.T) {
+	t.Parallel()
+	dir := t.TempDir()
+	vendor := filepath.Join(dir, "vendor")
+	if err := os.MkdirAll(vendor, 0755); err != nil {
+		t.Fatal(err)
+	}
+	a, b, c := filepath.Join(dir, "a.go"), filepath.Join(dir, "b.txt"), filepath.Join(vendor, "c.go")
+	files := map[string]string{
+		a:                            "package a\n// TODO: fix\nfunc A() {}\n// TODO: test\n",
+		b:                            "nothing to do\nTODO later\n",
+		c:                            "// TODO: vendored\n",
+		filepath.Join(dir, "bin.go"): "TODO\x00binary\n",
+	}
+	for path, data := range files {
+		if err := ioutil.WriteFile(path, []byte(data), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	tcs := []struct {
+		name string
+		opts []script.GrepOption
+		want string
+	}{
+		{"default", nil, fmt.Sprintf("%[1]s:2:// TODO: fix\n%[1]s:4:// TODO: test\n%[2]s:2:TODO later\n%[3]s:1:// TODO: vendored\n", a, b, c)},
+		{"include", []script.GrepOption{script.GrepInclude("*.go")}, fmt.Sprintf("%[1]s:2:// TODO: fix\n%[1]s:4:// TODO: test\n%[2]s:1:// TODO: vendored\n", a, c)},
+		{"include and exclude", []script.GrepOption{script.GrepInclude("*.go"), script.GrepExclude("vendor")}, fmt.Sprintf("%[1]s:2:// TODO: fix\n%[1]s:4:// TODO: test\n", a)},
+		{"one worker", []script.GrepOption{script.GrepExclude("*.go"), script.GrepWorkers(1)}, fmt.Sprintf("%s:2:TODO later\n", b)},
+	}
+	for _, tc := range tcs {
+		got, err := script.Grep(dir, "TODO", tc.opts...).String()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got != tc.want {
+			t.Errorf("%s: want %q, got %q", tc.name, tc.want, got)
+		}
+	}
+}
+
+func TestGrepErrors(t *testing.T) {
+	t.Parallel()
+	tcs := []struct {
+		name    string
+		dir     string
+		pattern string
+		opts    []script.GrepOption
+	}{
+		{"invalid pattern", "testdata", "(", nil},
+		{"invalid glob", "testdata", "x", []script.GrepOption{script.GrepInclude("[")}},
+		{"invalid ignore pattern", "testdata", "x", []script.GrepOption{script.GrepIgnore("[z-a]")}},
+		{"nonexistent directory", "doesntexist", "x", nil},
+	}
+	for _, tc := range tcs {
+		p := script.Grep(tc.dir, tc.pattern, tc.opts...)
+		if p.Error() == nil {
+			t.Errorf("%s: want error, got nil", tc.name)
+		}
+	}
+}
+
+func TestGrepReportsUnreadableSubdirectoryAndCarriesOn(t *testing.T) {
+	t.Parallel()
+	if runtime.GOOS == "windows" || os.Geteuid() == 0 {
+		t.Skip("needs a directory the user can't read")
+	}
+	dir := t.TempDir()
+	locked := filepath.Join(dir, "locked")
+	if err := os.Mkdir(locked, 0o755); err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(dir, "z.txt")
+	if err := os.WriteFile(path, []byte("TODO\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chmod(locked, 0); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.Chmod(locked, 0o755) })
+	p := script.Grep(dir, "TODO")
+	if !errors.Is(p.Error(), fs.ErrPermission) {
+		t.Errorf("want permission error for unreadable directory, got %v", p.Error())
+	}
+	got, _ := io.ReadAll(p)
+	if want := path + ":1:TODO\n"; string(got) != want {
+		t.Errorf("want matches from other files %q, got %q", want, got)
+	}
+}
+
+func TestGrepIgnoreFileSkipsIgnoredFiles(t *testing.T) {
+	t.Parallel()
+	dir := ignoreTree(t)
+	got, err := script.Grep(dir, "needle", script.GrepIgnoreFile(".gitignore"), script.GrepIgnore("node_modules/")).String()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var want string
+	for _, name := range []string{"a.go", "docs/readme.md", "keep.log", "src/build", "src/top.txt", "src/x.log"} {
+		want += filepath.Join(dir, name) + ":1:needle\n"
+	}
+	if got != want {
+		t.Errorf("want %q, got %q", want, got)
+	}
+}
+
 func TestIfExists(t *testing.T) {
 	t.Parallel()
 	p := script.IfExists("testdata/doesntexist")
@@ -181,10 +738,76 @@ func TestIfExists(t *testing.T) {
 	}
 }
 
+func TestListenUnix(t *testing.T) {
+	t.Parallel()
+	path := filepath.Join(t.TempDir(), "listen.sock")
+	p := script.ListenUnix(path)
+	if p.Error() != nil {
+		t.Fatal(p.Error())
+	}
+	want := "hello from the client\n"
+	go func() {
+		conn, err := net.Dial("unix", path)
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		fmt.Fprint(conn, want)
+	}()
+	got, err := p.String()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got != want {
+		t.Errorf("want %q, got %q", want, got)
+	}
+	if _, err := os.Stat(path); err == nil {
+		t.Error("want socket file removed after reading, but it still exists")
+	}
+}
+
+func TestListenUnixExistingPath(t *testing.T) {
+	t.Parallel()
+	p := script.ListenUnix("testdata/hello.txt")
+	if p.Error() == nil {
+		t.Error("want error listening on existing path, got nil")
+	}
+}
+
+func TestListFilesWithSymlinkOptions(t *testing.T) {
+	t.Parallel()
+	dir := symlinkTree(t, "broken", "missing")
+	join := func(names ...string) string {
+		var lines string
+		for _, name := range names {
+			lines += filepath.Join(dir, name) + "\n"
+		}
+		return lines
+	}
+	got, err := script.ListFiles(dir).String()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := join("a.txt", "broken", "link.txt", "linkdir", "sub"); got != want {
+		t.Errorf("default: want %q, got %q", want, got)
+	}
+	got, err = script.ListFilesWith(filepath.Join(dir, "*"), script.SkipSymlinks()).String()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := join("a.txt", "sub"); got != want {
+		t.Errorf("SkipSymlinks: want %q, got %q", want, got)
+	}
+	p := script.ListFilesWith(dir, script.FollowSymlinks())
+	if !strings.Contains(fmt.Sprint(p.Error()), filepath.Join(dir, "broken")) {
+		t.Errorf("FollowSymlinks: want error mentioning broken link, got %v", p.Error())
+	}
+}
+
 func TestListFilesMultipleFiles(t *testing.T) {
 	t.Parallel()
 	dir := "testdata/multiple_files"
-	want := fmt.Sprintf("%s/1.txt\n%s/2.txt\n%s/3.tar.zip\n", dir, dir, dir)
+	want := filepath.FromSlash(fmt.Sprintf("%s/1.txt\n%s/2.txt\n%s/3.tar.zip\n", dir, dir, dir))
 	got, err := script.ListFiles(dir).String()
 	if err != nil {
 		t.Fatal(err)
@@ -202,6 +825,23 @@ func TestListFilesNonexistent(t *testing.T) {
 	}
 }
 
+func TestListFilesWithPlatformSeparators(t *testing.T) {
+	t.Parallel()
+	dir := filepath.Join("testdata", "multiple_files")
+	want := strings.Join([]string{
+		filepath.Join(dir, "1.txt"),
+		filepath.Join(dir, "2.txt"),
+		filepath.Join(dir, "3.tar.zip"),
+	}, "\n") + "\n"
+	got, err := script.ListFiles(dir).String()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got != want {
+		t.Errorf("want %q, got %q", want, got)
+	}
+}
+
 func TestListFilesSingle(t *testing.T) {
 	t.Parallel()
 	got, err := script.ListFiles("testdata/multiple_files/1.txt").String()
@@ -217,7 +857,7 @@ func TestListFilesSingle(t *testing.T) {
 func TestListFilesGlob(t *testing.T) {
 	t.Parallel()
 	dir := "testdata/multiple_files"
-	want := fmt.Sprintf("%s/1.txt\n%s/2.txt\n", dir, dir)
+	want := filepath.FromSlash(fmt.Sprintf("%s/1.txt\n%s/2.txt\n", dir, dir))
 	got, err := script.ListFiles("testdata/multi?le_files/*.txt").String()
 	if err != nil {
 		t.Fatal(err)
@@ -227,6 +867,18 @@ func TestListFilesGlob(t *testing.T) {
 	}
 }
 
+func TestNewPipeFromBytes(t *testing.T) {
+	t.Parallel()
+	want := []byte("hello\x00\xff\n")
+	got, err := script.NewPipeFromBytes(want).Bytes()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !cmp.Equal(want, got) {
+		t.Error(cmp.Diff(want, got))
+	}
+}
+
 func TestSlice(t *testing.T) {
 	t.Parallel()
 	want := "1\n2\n3\n"
@@ -256,3 +908,176 @@ func TestStdin(t *testing.T) {
 		t.Errorf("want %q, got %q", want, string(got))
 	}
 }
+
+func TestUnzip(t *testing.T) {
+	t.Parallel()
+	archive := filepath.Join(t.TempDir(), "test.zip")
+	_, err := script.Echo("testdata/hello.txt\ntestdata/multiple_files\n").Zip(archive)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dest := t.TempDir()
+	got, err := script.Unzip(archive, dest).Slice()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(got) != 4 {
+		t.Fatalf("want 4 files extracted, got %q", got)
+	}
+	want := filepath.Join(dest, "testdata", "hello.txt")
+	if got[0] != want {
+		t.Errorf("want %q, got %q", want, got[0])
+	}
+	orig, err := ioutil.ReadFile("testdata/hello.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	extracted, err := ioutil.ReadFile(want)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(orig, extracted) {
+		t.Errorf("want extracted file to match original, got %q", extracted)
+	}
+}
+
+func TestUnzipNonexistent(t *testing.T) {
+	t.Parallel()
+	p := script.Unzip("testdata/doesntexist.zip", t.TempDir())
+	if p.Error() == nil {
+		t.Error("want error for nonexistent archive, got nil")
+	}
+}
+
+func TestUnzipRejectsPathsOutsideDest(t *testing.T) {
+	t.Parallel()
+	dir := t.TempDir()
+	archive := filepath.Join(dir, "evil.zip")
+	f, err := os.Create(archive)
+	if err != nil {
+		t.Fatal(err)
+	}
+	zw := zip.NewWriter(f)
+	w, err := zw.Create("../evil.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	w.Write([]byte("gotcha"))
+	zw.Close()
+	f.Close()
+	dest := filepath.Join(dir, "dest")
+	p := script.Unzip(archive, dest)
+	if p.Error() == nil {
+		t.Error("want error for path outside destination, got nil")
+	}
+	if _, err := os.Stat(filepath.Join(dir, "evil.txt")); !os.IsNotExist(err) {
+		t.Errorf("want no file written outside destination, got %v", err)
+	}
+}
+
+func TestUnzipIntoCurrentDirectory(t *testing.T) {
+	// Not parallel, since it changes the current directory.
+	archive, err := filepath.Abs(filepath.Join(t.TempDir(), "test.zip"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := script.Echo("testdata/hello.txt\n").Zip(archive); err != nil {
+		t.Fatal(err)
+	}
+	for _, dest := range []string{".", ""} {
+		t.Chdir(t.TempDir())
+		got, err := script.Unzip(archive, dest).String()
+		if err != nil {
+			t.Fatalf("%q: %v", dest, err)
+		}
+		want := filepath.Join("testdata", "hello.txt") + "\n"
+		if got != want {
+			t.Errorf("%q: want %q, got %q", dest, want, got)
+		}
+	}
+}
+
+func TestWebSocket(t *testing.T) {
+	t.Parallel()
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, err := (&websocket.Upgrader{}).Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		for _, msg := range []string{"build started", "step 1 ok\n", "build finished"} {
+			conn.WriteMessage(websocket.TextMessage, []byte(msg))
+		}
+		conn.WriteMessage(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseNormalClosure, ""))
+	}))
+	defer srv.Close()
+	want := "build started\nstep 1 ok\nbuild finished\n"
+	got, err := script.WebSocket("ws" + strings.TrimPrefix(srv.URL, "http")).String()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got != want {
+		t.Errorf("want %q, got %q", want, got)
+	}
+}
+
+func TestWebSocketInvalidURL(t *testing.T) {
+	t.Parallel()
+	p := script.WebSocket("ws://doesntexist.invalid/")
+	if p.Error() == nil {
+		t.Error("want error connecting to invalid URL, got nil")
+	}
+}
+
+func TestWebSocketNeverEnding(t *testing.T) {
+	t.Parallel()
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, err := (&websocket.Upgrader{}).Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		for i := 0; ; i++ {
+			if err := conn.WriteMessage(websocket.TextMessage, []byte(fmt.Sprint(i))); err != nil {
+				return
+			}
+		}
+	}))
+	defer srv.Close()
+	want := "0\n1\n2\n"
+	got, err := script.WebSocket("ws" + strings.TrimPrefix(srv.URL, "http")).First(3).String()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got != want {
+		t.Errorf("want %q, got %q", want, got)
+	}
+}
+
+func TestZipEntry(t *testing.T) {
+	t.Parallel()
+	archive := filepath.Join(t.TempDir(), "test.zip")
+	_, err := script.Echo("testdata/hello.txt\n").Zip(archive)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want, err := ioutil.ReadFile("testdata/hello.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := script.ZipEntry(archive, "testdata/hello.txt").Bytes()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(want, got) {
+		t.Errorf("want %q, got %q", want, got)
+	}
+	p := script.ZipEntry(archive, "doesntexist.txt")
+	if p.Error() == nil {
+		t.Error("want error for nonexistent entry, got nil")
+	}
+	p = script.ZipEntries("testdata/hello.txt")
+	if p.Error() == nil {
+		t.Error("want error listing entries of non-zip file, got nil")
+	}
+}
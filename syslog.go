@@ -0,0 +1,73 @@
+//go:build !windows && !plan9
+// +build !windows,!plan9
+
+package script
+
+import (
+	"fmt"
+	"log/syslog"
+	"net"
+	"strings"
+)
+
+// syslogNetwork and syslogAddr specify the syslog server that Syslog logs to.
+// If both are empty, Syslog uses the local system logger.
+var syslogNetwork, syslogAddr string
+
+// journalSocket is the path of the socket that Journal sends log entries to.
+var journalSocket = "/run/systemd/journal/socket"
+
+// Journal reads from the pipe and sends each line to the systemd journal as a
+// separate log entry, with the specified priority and syslog identifier
+// (`tag`). Only the severity and facility parts of `priority` are used, as in
+// `syslog.LOG_WARNING|syslog.LOG_DAEMON`. It returns the number of entries
+// sent, or an error. If there is an error reading the pipe, or the journal
+// isn't available, the pipe's error status is also set.
+func (p *Pipe) Journal(priority syslog.Priority, tag string) (int, error) {
+	if p == nil || p.Error() != nil {
+		return 0, p.Error()
+	}
+	conn, err := net.Dial("unixgram", journalSocket)
+	if err != nil {
+		p.SetError(err)
+		return 0, err
+	}
+	defer conn.Close()
+	var entries int
+	p.eachLine(func(line string, out *strings.Builder) {
+		entry := fmt.Sprintf("MESSAGE=%s\nPRIORITY=%d\nSYSLOG_FACILITY=%d\nSYSLOG_IDENTIFIER=%s\n",
+			line, priority&0x07, priority>>3, tag)
+		if _, err := conn.Write([]byte(entry)); err != nil {
+			p.SetError(err)
+			return
+		}
+		entries++
+	})
+	return entries, p.Error()
+}
+
+// Syslog reads from the pipe and sends each line to the system logger as a
+// separate message, with the specified priority and tag, as in
+// `syslog.LOG_WARNING|syslog.LOG_DAEMON`. It returns the number of messages
+// sent, or an error. If there is an error reading the pipe, or the system
+// logger isn't available, the pipe's error status is also set.
+func (p *Pipe) Syslog(priority syslog.Priority, tag string) (int, error) {
+	if p == nil || p.Error() != nil {
+		return 0, p.Error()
+	}
+	w, err := syslog.Dial(syslogNetwork, syslogAddr, priority, tag)
+	if err != nil {
+		p.SetError(err)
+		return 0, err
+	}
+	defer w.Close()
+	var messages int
+	p.eachLine(func(line string, out *strings.Builder) {
+		if _, err := w.Write([]byte(line)); err != nil {
+			p.SetError(err)
+			return
+		}
+		messages++
+	})
+	return messages, p.Error()
+}
@@ -0,0 +1,86 @@
+//go:build !windows && !plan9
+// +build !windows,!plan9
+
+package script_test
+
+import (
+	"log/syslog"
+	"net"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/bitfield/script"
+)
+
+// These tests redirect package-level logging destinations, so they can't run
+// in parallel with each other.
+
+func TestJournal(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "journal.sock")
+	conn, err := net.ListenPacket("unixgram", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	script.SetJournalSocket(path)
+	n, err := script.Echo("backup started\nbackup finished\n").Journal(syslog.LOG_WARNING|syslog.LOG_DAEMON, "backup")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 2 {
+		t.Errorf("want 2 entries sent, got %d", n)
+	}
+	buf := make([]byte, 1024)
+	for _, msg := range []string{"backup started", "backup finished"} {
+		n, _, err := conn.ReadFrom(buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		want := "MESSAGE=" + msg + "\nPRIORITY=4\nSYSLOG_FACILITY=3\nSYSLOG_IDENTIFIER=backup\n"
+		if string(buf[:n]) != want {
+			t.Errorf("want %q, got %q", want, buf[:n])
+		}
+	}
+}
+
+func TestJournalUnavailable(t *testing.T) {
+	script.SetJournalSocket(filepath.Join(t.TempDir(), "doesntexist.sock"))
+	p := script.Echo("hello\n")
+	_, err := p.Journal(syslog.LOG_INFO, "test")
+	if err == nil {
+		t.Error("want error when journal is unavailable, got nil")
+	}
+	if p.Error() == nil {
+		t.Error("want pipe error status set, got nil")
+	}
+}
+
+func TestSyslog(t *testing.T) {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	script.SetSyslogServer("udp", conn.LocalAddr().String())
+	defer script.SetSyslogServer("", "")
+	n, err := script.Echo("disk full\n").Syslog(syslog.LOG_ERR|syslog.LOG_USER, "cleanup")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 1 {
+		t.Errorf("want 1 message sent, got %d", n)
+	}
+	buf := make([]byte, 1024)
+	size, _, err := conn.ReadFrom(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := string(buf[:size])
+	if !strings.HasPrefix(got, "<11>") {
+		t.Errorf("want priority <11>, got %q", got)
+	}
+	if !strings.Contains(got, "cleanup[") || !strings.HasSuffix(got, ": disk full\n") {
+		t.Errorf("want tagged message %q, got %q", "disk full", got)
+	}
+}
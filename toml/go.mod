@@ -0,0 +1,14 @@
+module github.com/bitfield/script/toml
+
+go 1.26.0
+
+require (
+	github.com/bitfield/script v0.25.1
+	github.com/pelletier/go-toml/v2 v2.4.3
+)
+
+require (
+	github.com/itchyny/gojq v0.12.13 // indirect
+	github.com/itchyny/timefmt-go v0.1.5 // indirect
+	mvdan.cc/sh/v3 v3.7.0 // indirect
+)
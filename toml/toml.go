@@ -0,0 +1,167 @@
+// Package toml provides a script filter that queries TOML documents.
+package toml
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/bitfield/script"
+	gotoml "github.com/pelletier/go-toml/v2"
+)
+
+// Get reads the whole contents of the pipe as a TOML document, and returns a
+// pipe containing the value at the given path, such as `.servers[0].host`.
+// Paths use the same syntax as script's YQ filter: a series of keys, each
+// preceded by a dot, and array indexes in brackets, where `[]` selects every
+// element. Scalar values are written as plain text, one per line, and tables
+// and arrays are written as indented JSON. A path that doesn't exist in the
+// document produces `null`. If the document can't be parsed, or the path is
+// invalid, the pipe's error status will be set.
+func Get(p *script.Pipe, path string) *script.Pipe {
+	if p == nil || p.Error() != nil {
+		return p
+	}
+	steps, err := parsePath(path)
+	if err != nil {
+		return p.WithError(err)
+	}
+	data, err := io.ReadAll(p.Reader)
+	if err != nil {
+		return p.WithError(err)
+	}
+	var doc any
+	if err := gotoml.Unmarshal(data, &doc); err != nil {
+		return p.WithError(err)
+	}
+	values, err := queryPath(doc, steps)
+	if err != nil {
+		return p.WithError(err)
+	}
+	buf := &bytes.Buffer{}
+	for _, v := range values {
+		if err := writeValue(buf, v); err != nil {
+			return p.WithError(err)
+		}
+	}
+	return p.WithReader(buf)
+}
+
+// pathStep is one element of a path parsed by parsePath: either a table key,
+// an array index, or every element of an array.
+type pathStep struct {
+	key     string
+	index   int
+	isIndex bool
+	all     bool
+}
+
+// parsePath parses a path such as `.servers[].host`.
+func parsePath(path string) ([]pathStep, error) {
+	var steps []pathStep
+	rest := strings.TrimPrefix(path, ".")
+	for rest != "" {
+		switch {
+		case rest[0] == '[':
+			end := strings.IndexByte(rest, ']')
+			if end < 0 {
+				return nil, fmt.Errorf("unclosed bracket in path %q", path)
+			}
+			inside := rest[1:end]
+			rest = rest[end+1:]
+			if inside == "" {
+				steps = append(steps, pathStep{all: true})
+				break
+			}
+			i, err := strconv.Atoi(inside)
+			if err != nil {
+				return nil, fmt.Errorf("invalid array index %q in path %q", inside, path)
+			}
+			steps = append(steps, pathStep{index: i, isIndex: true})
+		case rest[0] == '.':
+			rest = rest[1:]
+		default:
+			end := strings.IndexAny(rest, ".[")
+			if end < 0 {
+				end = len(rest)
+			}
+			steps = append(steps, pathStep{key: rest[:end]})
+			rest = rest[end:]
+		}
+	}
+	return steps, nil
+}
+
+// queryPath returns the values selected by steps within v. Missing keys and
+// out-of-range indexes select nil.
+func queryPath(v any, steps []pathStep) ([]any, error) {
+	if len(steps) == 0 {
+		return []any{v}, nil
+	}
+	if v == nil {
+		return []any{nil}, nil
+	}
+	step := steps[0]
+	switch {
+	case step.all:
+		items, ok := v.([]any)
+		if !ok {
+			return nil, fmt.Errorf("cannot iterate over %T", v)
+		}
+		var results []any
+		for _, item := range items {
+			r, err := queryPath(item, steps[1:])
+			if err != nil {
+				return nil, err
+			}
+			results = append(results, r...)
+		}
+		return results, nil
+	case step.isIndex:
+		items, ok := v.([]any)
+		if !ok {
+			return nil, fmt.Errorf("cannot index %T with [%d]", v, step.index)
+		}
+		i := step.index
+		if i < 0 {
+			i += len(items)
+		}
+		if i < 0 || i >= len(items) {
+			return []any{nil}, nil
+		}
+		return queryPath(items[i], steps[1:])
+	default:
+		m, ok := v.(map[string]any)
+		if !ok {
+			return nil, fmt.Errorf("cannot look up key %q in %T", step.key, v)
+		}
+		return queryPath(m[step.key], steps[1:])
+	}
+}
+
+// writeValue writes v to w as a line of plain text if it's a scalar, or
+// otherwise as indented JSON.
+func writeValue(w io.Writer, v any) error {
+	switch v := v.(type) {
+	case nil:
+		_, err := fmt.Fprintln(w, "null")
+		return err
+	case map[string]any, []any:
+		data, err := json.MarshalIndent(v, "", "  ")
+		if err != nil {
+			return err
+		}
+		_, err = w.Write(append(data, '\n'))
+		return err
+	case time.Time:
+		_, err := fmt.Fprintln(w, v.Format(time.RFC3339Nano))
+		return err
+	default:
+		_, err := fmt.Fprintln(w, v)
+		return err
+	}
+}
@@ -0,0 +1,76 @@
+package toml_test
+
+import (
+	"testing"
+
+	"github.com/bitfield/script"
+	"github.com/bitfield/script/toml"
+)
+
+func TestGet(t *testing.T) {
+	t.Parallel()
+	input := `
+title = "example"
+released = 2024-05-01T12:00:00Z
+
+[owner]
+name = "Tom"
+
+[[servers]]
+host = "alpha"
+port = 8001
+
+[[servers]]
+host = "beta"
+port = 8002
+`
+	tcs := []struct {
+		path, want string
+	}{
+		{".title", "example\n"},
+		{"owner.name", "Tom\n"},
+		{".servers[1].port", "8002\n"},
+		{".servers[].host", "alpha\nbeta\n"},
+		{".servers[-1].host", "beta\n"},
+		{".released", "2024-05-01T12:00:00Z\n"},
+		{".missing", "null\n"},
+		{".missing.deeper[0]", "null\n"},
+		{".owner", "{\n  \"name\": \"Tom\"\n}\n"},
+	}
+	for _, tc := range tcs {
+		got, err := toml.Get(script.Echo(input), tc.path).String()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got != tc.want {
+			t.Errorf("%s: want %q, got %q", tc.path, tc.want, got)
+		}
+	}
+}
+
+func TestGetInvalid(t *testing.T) {
+	t.Parallel()
+	tcs := []struct {
+		input, path string
+	}{
+		{"= bogus", ".title"},
+		{`title = "x"`, ".title[0]"},
+		{`title = "x"`, ".title[]"},
+		{`title = "x"`, ".title.name"},
+		{`title = "x"`, ".servers[0"},
+		{`title = "x"`, ".servers[x]"},
+	}
+	for _, tc := range tcs {
+		p := toml.Get(script.Echo(tc.input), tc.path)
+		if p.Error() == nil {
+			t.Errorf("%q with path %q: want error, got nil", tc.input, tc.path)
+		}
+	}
+}
+
+func TestGetReturnsNilForNilPipe(t *testing.T) {
+	t.Parallel()
+	if toml.Get(nil, ".") != nil {
+		t.Error("want nil for nil pipe")
+	}
+}
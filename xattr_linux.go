@@ -0,0 +1,73 @@
+package script
+
+import (
+	"bytes"
+	"errors"
+	"syscall"
+)
+
+// copyXattrs copies the extended attributes of the file at from to the file
+// at to. Attributes that the user isn't allowed to set, such as those in the
+// trusted namespace for anyone but root, are skipped, as they are if the
+// filesystem doesn't support extended attributes at all.
+func copyXattrs(to, from string) error {
+	list, err := xattrValue(func(buf []byte) (int, error) {
+		return syscall.Listxattr(from, buf)
+	})
+	if err != nil {
+		if skipXattr(err) {
+			return nil
+		}
+		return err
+	}
+	for name := range bytes.SplitSeq(list, []byte{0}) {
+		if len(name) == 0 {
+			continue
+		}
+		value, err := xattrValue(func(buf []byte) (int, error) {
+			return syscall.Getxattr(from, string(name), buf)
+		})
+		if errors.Is(err, syscall.ENODATA) {
+			// Removed since it was listed.
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		err = syscall.Setxattr(to, string(name), value, 0)
+		if err != nil && !skipXattr(err) {
+			return err
+		}
+	}
+	return nil
+}
+
+// xattrValue calls get, which is a system call such as getxattr(2), first to
+// find the size of the value, then to read it into a buffer of that size,
+// trying again if the value grows in between.
+func xattrValue(get func(buf []byte) (int, error)) ([]byte, error) {
+	for {
+		size, err := get(nil)
+		if err != nil {
+			return nil, err
+		}
+		if size == 0 {
+			return nil, nil
+		}
+		buf := make([]byte, size)
+		n, err := get(buf)
+		if errors.Is(err, syscall.ERANGE) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		return buf[:n], nil
+	}
+}
+
+// skipXattr reports whether err, from reading or setting an extended
+// attribute, means it should be skipped, rather than failing the copy.
+func skipXattr(err error) bool {
+	return errors.Is(err, syscall.EPERM) || errors.Is(err, syscall.EACCES) || errors.Is(err, syscall.ENOTSUP)
+}
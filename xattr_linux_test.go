@@ -0,0 +1,65 @@
+package script_test
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+
+	"github.com/bitfield/script"
+)
+
+func TestRewriteFilesPreservesExtendedAttributes(t *testing.T) {
+	t.Parallel()
+	path := filepath.Join(t.TempDir(), "a.txt")
+	if err := os.WriteFile(path, []byte("hello world\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	err := syscall.Setxattr(path, "user.script.test", []byte("value"), 0)
+	if errors.Is(err, syscall.ENOTSUP) {
+		t.Skip("filesystem doesn't support extended attributes")
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = script.Echo(path).RewriteFiles(func(p *script.Pipe) *script.Pipe {
+		return p.Replace("world", "there")
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, 64)
+	n, err := syscall.Getxattr(path, "user.script.test", buf)
+	if err != nil {
+		t.Fatalf("want extended attribute preserved, got %v", err)
+	}
+	if string(buf[:n]) != "value" {
+		t.Errorf("want attribute value %q, got %q", "value", buf[:n])
+	}
+}
+
+func TestWriteFilePreservesOwnerWhenReplacingFileStillBeingRead(t *testing.T) {
+	t.Parallel()
+	if os.Geteuid() != 0 {
+		t.Skip("only root can give files away")
+	}
+	path := filepath.Join(t.TempDir(), "a.txt")
+	if err := os.WriteFile(path, []byte("a\nb\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chown(path, 12345, 23456); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := script.File(path).Match("a").WriteFile(path); err != nil {
+		t.Fatal(err)
+	}
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	st := info.Sys().(*syscall.Stat_t)
+	if st.Uid != 12345 || st.Gid != 23456 {
+		t.Errorf("want owner 12345:23456, got %d:%d", st.Uid, st.Gid)
+	}
+}
@@ -0,0 +1,9 @@
+//go:build !linux
+
+package script
+
+// copyXattrs does nothing, because extended attributes aren't supported on
+// this platform.
+func copyXattrs(to, from string) error {
+	return nil
+}